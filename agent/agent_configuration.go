@@ -18,22 +18,28 @@ type AgentConfiguration struct {
 	GitMirrorsPath        string
 	GitMirrorsLockTimeout int
 	GitMirrorsSkipUpdate  bool
-	PluginsPath           string
-	GitCheckoutFlags      string
-	GitCloneFlags         string
-	GitCloneMirrorFlags   string
-	GitCleanFlags         string
-	GitFetchFlags         string
-	GitSubmodules         bool
-	AllowedRepositories   []*regexp.Regexp
-	AllowedPlugins        []*regexp.Regexp
-	SSHKeyscan            bool
-	CommandEval           bool
-	PluginsEnabled        bool
-	PluginValidation      bool
-	LocalHooksEnabled     bool
-	StrictSingleHooks     bool
-	RunInPty              bool
+	GitMirrorsSeedPath    string
+
+	GitMirrorsMaintenanceInterval time.Duration // How often to prune and garbage collect git mirrors (zero to never)
+	GitMirrorsMaxAge              time.Duration // Remove git mirrors that haven't been used for longer than this
+	GitMirrorsMaxSizeBytes        uint64        // Remove least recently used git mirrors while they use more than this
+
+	PluginsPath         string
+	GitCheckoutFlags    string
+	GitCloneFlags       string
+	GitCloneMirrorFlags string
+	GitCleanFlags       string
+	GitFetchFlags       string
+	GitSubmodules       bool
+	AllowedRepositories []*regexp.Regexp
+	AllowedPlugins      []*regexp.Regexp
+	SSHKeyscan          bool
+	CommandEval         bool
+	PluginsEnabled      bool
+	PluginValidation    bool
+	LocalHooksEnabled   bool
+	StrictSingleHooks   bool
+	RunInPty            bool
 
 	SigningJWKSFile  string // Where to find the key to sign pipeline uploads with (passed through to jobs, they might be uploading pipelines)
 	SigningJWKSKeyID string // The key ID to sign pipeline uploads with
@@ -41,21 +47,29 @@ type AgentConfiguration struct {
 	VerificationJWKS             jwk.Set // The set of keys to verify jobs with
 	VerificationFailureBehaviour string  // What to do if job verification fails (one of `block` or `warn`)
 
-	ANSITimestamps             bool
-	TimestampLines             bool
-	HealthCheckAddr            string
-	DisconnectAfterJob         bool
-	DisconnectAfterIdleTimeout int
-	CancelGracePeriod          int
-	SignalGracePeriod          time.Duration
-	EnableJobLogTmpfile        bool
-	JobLogPath                 string
-	WriteJobLogsToStdout       bool
-	LogFormat                  string
-	Shell                      string
-	Profile                    string
-	RedactedVars               []string
-	AcquireJob                 string
-	TracingBackend             string
-	TracingServiceName         string
+	ANSITimestamps              bool
+	TimestampLines              bool
+	HealthCheckAddr             string
+	DisconnectAfterJob          bool
+	DisconnectAfterIdleTimeout  int
+	CancelGracePeriod           int
+	SignalGracePeriod           time.Duration
+	EnableJobLogTmpfile         bool
+	JobLogPath                  string
+	SpoolJobLogs                bool
+	JobLogLimitPolicy           string
+	JobLogTailSizeBytes         uint64
+	WriteJobLogsToStdout        bool
+	LogFormat                   string
+	Shell                       string
+	Profile                     string
+	RedactedVars                []string
+	RedactedDetectors           []string
+	RedactedPatterns            []string
+	AcquireJob                  string
+	TracingBackend              string
+	TracingServiceName          string
+	MetricsDatadog              bool
+	MetricsDatadogHost          string
+	MetricsDatadogDistributions bool
 }
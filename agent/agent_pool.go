@@ -32,17 +32,38 @@ func (r *AgentPool) Start(ctx context.Context) error {
 	// Co-ordinate idle state across agents
 	idleMonitor := NewIdleMonitor(len(r.workers))
 
+	// Find job logs spooled by previous agent processes. The first worker
+	// uploads them, skipping any still locked by jobs running in other agent
+	// processes that share the build path.
+	var spools []string
+	if len(r.workers) > 0 && r.workers[0].agentConfiguration.SpoolJobLogs {
+		spools = leftoverLogSpools(r.workers[0].agentConfiguration.BuildPath)
+	}
+
+	// Maintain the git mirrors shared by the workers.
+	if len(r.workers) > 0 {
+		conf := r.workers[0].agentConfiguration
+		if conf.GitMirrorsPath != "" && conf.GitMirrorsMaintenanceInterval > 0 {
+			go maintainGitMirrors(ctx, r.workers[0].logger, conf)
+		}
+	}
+
 	// Spawn goroutines for each parallel worker
-	for _, worker := range r.workers {
+	for i, worker := range r.workers {
 		wg.Add(1)
 
-		go func(worker *AgentWorker) {
+		var replay []string
+		if i == 0 {
+			replay = spools
+		}
+
+		go func(worker *AgentWorker, replay []string) {
 			defer wg.Done()
 
-			if err := r.runWorker(ctx, worker, idleMonitor); err != nil {
+			if err := r.runWorker(ctx, worker, idleMonitor, replay); err != nil {
 				errs <- err
 			}
-		}(worker)
+		}(worker, replay)
 	}
 
 	setStat("✅ Workers spawned!")
@@ -55,7 +76,7 @@ func (r *AgentPool) Start(ctx context.Context) error {
 	return <-errs
 }
 
-func (r *AgentPool) runWorker(ctx context.Context, worker *AgentWorker, im *IdleMonitor) error {
+func (r *AgentPool) runWorker(ctx context.Context, worker *AgentWorker, im *IdleMonitor, spools []string) error {
 	// Connect the worker to the API
 	if err := worker.Connect(ctx); err != nil {
 		return err
@@ -63,6 +84,11 @@ func (r *AgentPool) runWorker(ctx context.Context, worker *AgentWorker, im *Idle
 	// Ensure the worker is disconnected at the end of this function.
 	defer worker.Disconnect(ctx)
 
+	// Upload any job logs left behind by a previous agent process.
+	if len(spools) > 0 {
+		go replayLogSpools(ctx, worker.logger, worker.apiClient, spools)
+	}
+
 	// Starts the agent worker and wait for it to finish.
 	return worker.Start(ctx, im)
 }
@@ -0,0 +1,341 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/buildkite/agent/v3/internal/artifact"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// Downloader downloads an artifact.
+type Downloader interface {
+	Start(context.Context) error
+}
+
+// ArtifactBackend is an artifact storage service that artifacts can be
+// uploaded to and downloaded from. Backends are registered by URL scheme with
+// RegisterArtifactBackend.
+type ArtifactBackend struct {
+	// Describes the backend in log messages, e.g. "Amazon S3"
+	Name string
+
+	// Optionally narrows down which destinations the backend handles, for
+	// backends that share a URL scheme with others (e.g. https).
+	Match func(destination string) bool
+
+	// Creates an uploader for an upload destination
+	NewUploader func(logger.Logger, ArtifactBackendUploaderConfig) (Uploader, error)
+
+	// Creates a downloader for an artifact that was uploaded to the backend
+	NewDownloader func(logger.Logger, ArtifactBackendDownloaderConfig) (Downloader, error)
+
+	// Optionally creates a blob store for a destination, for backends that
+	// can store artifacts by content
+	NewBlobStore func(l logger.Logger, destination string) (BlobStore, error)
+}
+
+// ArtifactBackendUploaderConfig configures an uploader created by an
+// ArtifactBackend.
+type ArtifactBackendUploaderConfig struct {
+	// Where artifacts are uploaded to, e.g. s3://my-bucket/some/prefix
+	Destination string
+
+	// Whether to show HTTP debugging
+	DebugHTTP bool
+}
+
+// ArtifactBackendDownloaderConfig configures a downloader created by an
+// ArtifactBackend.
+type ArtifactBackendDownloaderConfig struct {
+	// Where the artifact was uploaded to (its upload destination)
+	Source string
+
+	// The root directory of the download
+	Destination string
+
+	// The relative path that should be preserved in the download folder,
+	// also its location within the source
+	Path string
+
+	// How many times should it retry the download before giving up
+	Retries int
+
+	// Whether to show HTTP debugging
+	DebugHTTP bool
+
+	// The size of the artifact, if known
+	Size int64
+
+	// Whether to give up without retrying if the artifact doesn't exist.
+	// Only the S3, GCS, Artifactory and HTTP backends support this; others
+	// retry as usual.
+	FailFastIfMissing bool
+}
+
+var (
+	artifactBackendsMu sync.RWMutex
+	artifactBackends   = make(map[string][]ArtifactBackend)
+)
+
+// RegisterArtifactBackend registers a backend for destinations with the URL
+// scheme (e.g. "s3" for s3://bucket/path). Several backends may share a
+// scheme, if they have Match funcs to tell their destinations apart. Backends
+// with a Match func are tried before the one without.
+func RegisterArtifactBackend(scheme string, b ArtifactBackend) {
+	artifactBackendsMu.Lock()
+	defer artifactBackendsMu.Unlock()
+
+	scheme = strings.ToLower(scheme)
+	backends := append(artifactBackends[scheme], b)
+	sort.SliceStable(backends, func(i, j int) bool {
+		return backends[i].Match != nil && backends[j].Match == nil
+	})
+	artifactBackends[scheme] = backends
+}
+
+// artifactBackendFor finds the registered backend for a destination.
+func artifactBackendFor(destination string) (ArtifactBackend, bool) {
+	scheme, _, ok := strings.Cut(destination, "://")
+	if !ok {
+		return ArtifactBackend{}, false
+	}
+
+	artifactBackendsMu.RLock()
+	defer artifactBackendsMu.RUnlock()
+
+	for _, b := range artifactBackends[strings.ToLower(scheme)] {
+		if b.Match == nil || b.Match(destination) {
+			return b, true
+		}
+	}
+	return ArtifactBackend{}, false
+}
+
+// DownloadFromArtifactBackend downloads a file from a location that an
+// artifact backend handles (such as s3://my-bucket/some/prefix), for files
+// that aren't artifacts of a build. The file's path within the location is
+// kept under the destination directory. It returns the downloaded file's path.
+// Files that don't exist aren't retried, so callers can cheaply probe for
+// several candidate files.
+func DownloadFromArtifactBackend(ctx context.Context, l logger.Logger, source, path, destination string) (string, error) {
+	backend, ok := artifactBackendFor(source)
+	if !ok {
+		return "", fmt.Errorf("%q isn't a location that can be downloaded from. Supported locations are: %s", source, strings.Join(artifactBackendSchemes(), ", "))
+	}
+
+	dler, err := backend.NewDownloader(l, ArtifactBackendDownloaderConfig{
+		Source:            source,
+		Path:              path,
+		Destination:       destination,
+		Retries:           5,
+		FailFastIfMissing: true,
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := dler.Start(ctx); err != nil {
+		return "", err
+	}
+	return getTargetPath(path, destination), nil
+}
+
+// artifactBackendSchemes lists the schemes that have a backend for any
+// destination (i.e. without a Match func).
+func artifactBackendSchemes() []string {
+	artifactBackendsMu.RLock()
+	defer artifactBackendsMu.RUnlock()
+
+	schemes := make([]string, 0, len(artifactBackends))
+	for scheme, backends := range artifactBackends {
+		if backends[len(backends)-1].Match == nil {
+			schemes = append(schemes, scheme+"://*")
+		}
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// s3Clients holds S3 clients for reuse, because creating them is kind of an
+// expensive operation. Each client only applies to one bucket, so there is one
+// for each bucket.
+var s3Clients = struct {
+	sync.Mutex
+	m map[string]*s3.S3
+}{m: make(map[string]*s3.S3)}
+
+func s3ClientFor(l logger.Logger, bucketName string) (*s3.S3, error) {
+	s3Clients.Lock()
+	defer s3Clients.Unlock()
+
+	if client, ok := s3Clients.m[bucketName]; ok {
+		return client, nil
+	}
+	client, err := NewS3Client(l, bucketName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client for bucket %s: %w", bucketName, err)
+	}
+	s3Clients.m[bucketName] = client
+	return client, nil
+}
+
+func init() {
+	RegisterArtifactBackend("s3", ArtifactBackend{
+		Name: "Amazon S3",
+		NewUploader: func(l logger.Logger, c ArtifactBackendUploaderConfig) (Uploader, error) {
+			return NewS3Uploader(l, S3UploaderConfig{
+				Destination: c.Destination,
+				DebugHTTP:   c.DebugHTTP,
+			})
+		},
+		NewDownloader: func(l logger.Logger, c ArtifactBackendDownloaderConfig) (Downloader, error) {
+			bucketName, _ := ParseS3Destination(c.Source)
+			client, err := s3ClientFor(l, bucketName)
+			if err != nil {
+				return nil, err
+			}
+			return NewS3Downloader(l, S3DownloaderConfig{
+				S3Client:          client,
+				S3Path:            c.Source,
+				Path:              c.Path,
+				Destination:       c.Destination,
+				Retries:           c.Retries,
+				DebugHTTP:         c.DebugHTTP,
+				Size:              c.Size,
+				FailFastIfMissing: c.FailFastIfMissing,
+			}), nil
+		},
+		NewBlobStore: func(l logger.Logger, destination string) (BlobStore, error) {
+			return NewS3BlobStore(l, destination)
+		},
+	})
+
+	RegisterArtifactBackend("gs", ArtifactBackend{
+		Name: "Google Cloud Storage",
+		NewUploader: func(l logger.Logger, c ArtifactBackendUploaderConfig) (Uploader, error) {
+			return NewGSUploader(l, GSUploaderConfig{
+				Destination: c.Destination,
+				DebugHTTP:   c.DebugHTTP,
+			})
+		},
+		NewDownloader: func(l logger.Logger, c ArtifactBackendDownloaderConfig) (Downloader, error) {
+			return NewGSDownloader(l, GSDownloaderConfig{
+				Bucket:            c.Source,
+				Path:              c.Path,
+				Destination:       c.Destination,
+				Retries:           c.Retries,
+				DebugHTTP:         c.DebugHTTP,
+				Size:              c.Size,
+				FailFastIfMissing: c.FailFastIfMissing,
+			}), nil
+		},
+		NewBlobStore: func(l logger.Logger, destination string) (BlobStore, error) {
+			return NewGSBlobStore(l, destination)
+		},
+	})
+
+	RegisterArtifactBackend("rt", ArtifactBackend{
+		Name: "Artifactory",
+		NewUploader: func(l logger.Logger, c ArtifactBackendUploaderConfig) (Uploader, error) {
+			return NewArtifactoryUploader(l, ArtifactoryUploaderConfig{
+				Destination: c.Destination,
+				DebugHTTP:   c.DebugHTTP,
+			})
+		},
+		NewDownloader: func(l logger.Logger, c ArtifactBackendDownloaderConfig) (Downloader, error) {
+			return NewArtifactoryDownloader(l, ArtifactoryDownloaderConfig{
+				Repository:        c.Source,
+				Path:              c.Path,
+				Destination:       c.Destination,
+				Retries:           c.Retries,
+				DebugHTTP:         c.DebugHTTP,
+				Size:              c.Size,
+				FailFastIfMissing: c.FailFastIfMissing,
+			}), nil
+		},
+	})
+
+	RegisterArtifactBackend("file", ArtifactBackend{
+		Name: "a directory",
+		NewUploader: func(l logger.Logger, c ArtifactBackendUploaderConfig) (Uploader, error) {
+			return NewFileUploader(l, FileUploaderConfig{
+				Destination: c.Destination,
+			})
+		},
+		NewDownloader: func(l logger.Logger, c ArtifactBackendDownloaderConfig) (Downloader, error) {
+			return NewFileDownloader(l, FileDownloaderConfig{
+				Source:      c.Source,
+				Path:        c.Path,
+				Destination: c.Destination,
+			}), nil
+		},
+		NewBlobStore: func(_ logger.Logger, destination string) (BlobStore, error) {
+			return NewFileBlobStore(destination)
+		},
+	})
+
+	httpBackend := ArtifactBackend{
+		Name: "an HTTP server",
+		NewUploader: func(l logger.Logger, c ArtifactBackendUploaderConfig) (Uploader, error) {
+			return NewHTTPUploader(l, HTTPUploaderConfig{
+				Destination: c.Destination,
+				DebugHTTP:   c.DebugHTTP,
+			})
+		},
+		NewDownloader: func(l logger.Logger, c ArtifactBackendDownloaderConfig) (Downloader, error) {
+			return NewHTTPDownloader(l, HTTPDownloaderConfig{
+				Source:            c.Source,
+				Path:              c.Path,
+				Destination:       c.Destination,
+				Retries:           c.Retries,
+				DebugHTTP:         c.DebugHTTP,
+				Size:              c.Size,
+				FailFastIfMissing: c.FailFastIfMissing,
+			}), nil
+		},
+	}
+	RegisterArtifactBackend("http", httpBackend)
+	RegisterArtifactBackend("https", httpBackend)
+
+	RegisterArtifactBackend("exec", ArtifactBackend{
+		Name: "an artifact plugin",
+		NewUploader: func(l logger.Logger, c ArtifactBackendUploaderConfig) (Uploader, error) {
+			return NewExecUploader(l, ExecUploaderConfig{
+				Destination: c.Destination,
+			})
+		},
+		NewDownloader: func(l logger.Logger, c ArtifactBackendDownloaderConfig) (Downloader, error) {
+			return NewExecDownloader(l, ExecDownloaderConfig{
+				Source:      c.Source,
+				Path:        c.Path,
+				Destination: c.Destination,
+				Retries:     c.Retries,
+			}), nil
+		},
+	})
+
+	RegisterArtifactBackend("https", ArtifactBackend{
+		Name:  "Azure Blob storage",
+		Match: artifact.IsAzureBlobPath,
+		NewUploader: func(l logger.Logger, c ArtifactBackendUploaderConfig) (Uploader, error) {
+			return artifact.NewAzureBlobUploader(l, artifact.AzureBlobUploaderConfig{
+				Destination: c.Destination,
+				Throttle:    artifactBandwidthThrottle(),
+			})
+		},
+		NewDownloader: func(l logger.Logger, c ArtifactBackendDownloaderConfig) (Downloader, error) {
+			return artifact.NewAzureBlobDownloader(l, artifact.AzureBlobDownloaderConfig{
+				Repository:  c.Source,
+				Path:        c.Path,
+				Destination: c.Destination,
+				Retries:     c.Retries,
+				DebugHTTP:   c.DebugHTTP,
+				Throttle:    artifactBandwidthThrottle(),
+			}), nil
+		},
+	})
+}
@@ -0,0 +1,28 @@
+package agent
+
+import "testing"
+
+func TestArtifactBackendFor(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		destination string
+		want        string
+	}{
+		{"s3://bucket/path", "Amazon S3"},
+		{"gs://bucket/path", "Google Cloud Storage"},
+		{"rt://repo/path", "Artifactory"},
+		{"https://account.blob.core.windows.net/container/path", "Azure Blob storage"},
+		{"exec://sftp/path", "an artifact plugin"},
+		{"https://example.com/path", "an HTTP server"},
+		{"file:///mnt/artifacts", "a directory"},
+		{"llamas", ""},
+	}
+
+	for _, test := range tests {
+		backend, _ := artifactBackendFor(test.destination)
+		if got := backend.Name; got != test.want {
+			t.Errorf("artifactBackendFor(%q).Name = %q, want %q", test.destination, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// A blob store keeps artifacts by content, so that identical files uploaded by
+// different jobs (or builds) are stored once. Each file is stored as a blob
+// under its SHA-256 digest:
+//
+//	<store>/sha256/<first two hex digits>/<digest>
+//
+// Each job that uploads a file also leaves a reference to its blob:
+//
+//	<store>/refs/<digest>/<job id>
+//
+// so that blobs can be cleaned up once no job refers to them any more (see
+// PruneBlobStore).
+//
+// Artifacts stored in a blob store are registered with an upload destination
+// of blob+<store>, which tells downloaders to find them by digest.
+const (
+	blobStoreBlobsDir          = "sha256"
+	blobStoreRefsDir           = "refs"
+	blobStoreDestinationPrefix = "blob+"
+)
+
+// BlobStore is the part of an artifact backend that manages a blob store. Keys
+// are slash-separated paths relative to the store's destination.
+type BlobStore interface {
+	// Exists reports whether an object exists.
+	Exists(ctx context.Context, key string) (bool, error)
+
+	// List lists the objects with keys starting with the prefix.
+	List(ctx context.Context, prefix string) ([]BlobStoreObject, error)
+
+	// Delete deletes an object.
+	Delete(ctx context.Context, key string) error
+}
+
+// BlobStoreObject is an object listed in a blob store.
+type BlobStoreObject struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// blobKey returns the key of the blob with the SHA-256 digest.
+func blobKey(sha256sum string) string {
+	return path.Join(blobStoreBlobsDir, sha256sum[:2], sha256sum)
+}
+
+// blobRefKey returns the key of a job's reference to a blob.
+func blobRefKey(sha256sum, jobID string) string {
+	return path.Join(blobStoreRefsDir, sha256sum, jobID)
+}
+
+// NewBlobStore creates a BlobStore for a destination, if its artifact backend
+// supports blob stores.
+func NewBlobStore(l logger.Logger, destination string) (BlobStore, error) {
+	backend, ok := artifactBackendFor(destination)
+	if !ok || backend.NewBlobStore == nil {
+		return nil, fmt.Errorf("%q can't be used as a blob store. Only s3://, gs:// and file:// destinations are supported", destination)
+	}
+	return backend.NewBlobStore(l, destination)
+}
+
+// blobArtifact returns a copy of the artifact, with the blob's key as its path,
+// for uploading the artifact to a blob store.
+func blobArtifact(artifact *api.Artifact) *api.Artifact {
+	blob := *artifact
+	blob.Path = blobKey(artifact.Sha256Sum)
+	return &blob
+}
+
+// uploadBlob uploads an artifact to a blob store, unless the blob is already
+// there. The job's reference to the blob is written first, so that a prune
+// running at the same time won't delete the blob.
+func (a *ArtifactUploader) uploadBlob(ctx context.Context, uploader Uploader, store BlobStore, refFile string, artifact *api.Artifact) error {
+	ref := &api.Artifact{
+		Path:         blobRefKey(artifact.Sha256Sum, a.conf.JobID),
+		AbsolutePath: refFile,
+		ContentType:  "application/octet-stream",
+	}
+	if err := uploader.Upload(ctx, ref); err != nil {
+		return fmt.Errorf("writing reference to blob %s: %w", artifact.Sha256Sum, err)
+	}
+
+	blob := blobArtifact(artifact)
+	exists, err := store.Exists(ctx, blob.Path)
+	if err != nil {
+		return fmt.Errorf("checking for blob %s: %w", artifact.Sha256Sum, err)
+	}
+	if exists {
+		a.logger.Info("Artifact %s is already stored as blob %s, skipping upload", artifact.Path, artifact.Sha256Sum)
+		return nil
+	}
+	return uploader.Upload(ctx, blob)
+}
+
+// blobDownloader downloads an artifact from a blob store. The blob is
+// downloaded into a temporary directory, then moved to the artifact's path.
+type blobDownloader struct {
+	backend  ArtifactBackend
+	conf     ArtifactBackendDownloaderConfig
+	artifact *api.Artifact
+	logger   logger.Logger
+}
+
+func (d blobDownloader) Start(ctx context.Context) error {
+	if d.artifact.Sha256Sum == "" {
+		return fmt.Errorf("artifact %s is stored in a blob store, but has no SHA-256 checksum", d.artifact.Path)
+	}
+
+	targetFile := getTargetPath(d.conf.Path, d.conf.Destination)
+	// Actual file permissions will be reduced by umask, and won't be 0777 unless the user has manually changed the umask to 000
+	if err := os.MkdirAll(filepath.Dir(targetFile), 0777); err != nil {
+		return fmt.Errorf("Failed to create folder for %s (%T: %v)", targetFile, err, err)
+	}
+
+	// Download next to the target, so it can be renamed into place.
+	tmp, err := os.MkdirTemp(filepath.Dir(targetFile), ".buildkite-blob-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	conf := d.conf
+	conf.Destination = tmp
+	conf.Path = blobKey(d.artifact.Sha256Sum)
+	dler, err := d.backend.NewDownloader(d.logger, conf)
+	if err != nil {
+		return err
+	}
+	if err := dler.Start(ctx); err != nil {
+		return err
+	}
+
+	return os.Rename(filepath.Join(tmp, filepath.FromSlash(conf.Path)), targetFile)
+}
+
+// PruneBlobStoreConfig configures PruneBlobStore.
+type PruneBlobStoreConfig struct {
+	// References older than this are removed
+	OlderThan time.Time
+
+	// Only log what would be removed
+	DryRun bool
+}
+
+// PruneBlobStoreResult summarises what PruneBlobStore removed.
+type PruneBlobStoreResult struct {
+	RefsRemoved  int
+	BlobsRemoved int
+	BytesFreed   int64
+}
+
+// PruneBlobStore removes references to blobs that are older than the cutoff,
+// then removes blobs that no longer have any references. Blobs newer than the
+// cutoff are kept, even without references.
+func PruneBlobStore(ctx context.Context, l logger.Logger, store BlobStore, c PruneBlobStoreConfig) (PruneBlobStoreResult, error) {
+	var result PruneBlobStoreResult
+
+	refs, err := store.List(ctx, blobStoreRefsDir+"/")
+	if err != nil {
+		return result, fmt.Errorf("listing blob references: %w", err)
+	}
+
+	// Count the references to each blob that will remain.
+	remaining := make(map[string]int)
+	for _, ref := range refs {
+		sha256sum := strings.Split(strings.TrimPrefix(ref.Key, blobStoreRefsDir+"/"), "/")[0]
+		if !ref.ModTime.Before(c.OlderThan) {
+			remaining[sha256sum]++
+			continue
+		}
+
+		l.Debug("Removing blob reference %s from %s", ref.Key, ref.ModTime.Format(time.RFC3339))
+		if !c.DryRun {
+			if err := store.Delete(ctx, ref.Key); err != nil {
+				return result, fmt.Errorf("removing blob reference %s: %w", ref.Key, err)
+			}
+		}
+		result.RefsRemoved++
+	}
+
+	blobs, err := store.List(ctx, blobStoreBlobsDir+"/")
+	if err != nil {
+		return result, fmt.Errorf("listing blobs: %w", err)
+	}
+
+	for _, blob := range blobs {
+		sha256sum := path.Base(blob.Key)
+		if remaining[sha256sum] > 0 || !blob.ModTime.Before(c.OlderThan) {
+			continue
+		}
+
+		// A job may have started referring to the blob since the references
+		// were listed.
+		if !c.DryRun {
+			refs, err := store.List(ctx, path.Join(blobStoreRefsDir, sha256sum)+"/")
+			if err != nil {
+				return result, fmt.Errorf("listing references to blob %s: %w", sha256sum, err)
+			}
+			if len(refs) > 0 {
+				continue
+			}
+		}
+
+		l.Info("Removing unreferenced blob %s (%d bytes)", sha256sum, blob.Size)
+		if !c.DryRun {
+			if err := store.Delete(ctx, blob.Key); err != nil {
+				return result, fmt.Errorf("removing blob %s: %w", sha256sum, err)
+			}
+		}
+		result.BlobsRemoved++
+		result.BytesFreed += blob.Size
+	}
+
+	return result, nil
+}
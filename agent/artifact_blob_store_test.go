@@ -0,0 +1,217 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/google/go-cmp/cmp"
+)
+
+func fileDestination(dir string) string {
+	if runtime.GOOS == "windows" {
+		return "file:///" + filepath.ToSlash(dir)
+	}
+	return "file://" + filepath.ToSlash(dir)
+}
+
+func TestArtifactBlobStoreRoundTrip(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	store := t.TempDir()
+	blobStore := fileDestination(store)
+
+	src := filepath.Join(t.TempDir(), "tool")
+	if err := os.WriteFile(src, []byte("llamas"), 0o666); err != nil {
+		t.Fatalf("os.WriteFile(%q) error = %v", src, err)
+	}
+
+	var (
+		mu           sync.Mutex
+		destinations []string
+		registered   []*api.Artifact
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.Method == "POST":
+			var batch api.ArtifactBatch
+			if err := json.NewDecoder(req.Body).Decode(&batch); err != nil {
+				t.Errorf("decoding artifact batch: %v", err)
+			}
+			mu.Lock()
+			destinations = append(destinations, batch.UploadDestination)
+			for _, artifact := range batch.Artifacts {
+				artifact.UploadDestination = batch.UploadDestination
+				registered = append(registered, artifact)
+			}
+			mu.Unlock()
+			json.NewEncoder(rw).Encode(api.ArtifactBatchCreateResponse{
+				ID:          batch.ID,
+				ArtifactIDs: []string{api.NewUUID()},
+			})
+
+		case req.Method == "PUT":
+			fmt.Fprint(rw, `{}`)
+
+		case req.URL.Path == "/builds/my-build/artifacts/search":
+			mu.Lock()
+			json.NewEncoder(rw).Encode(registered[:1])
+			mu.Unlock()
+
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamas",
+	})
+
+	var blobPath string
+	for i, jobID := range []string{"job-1", "job-2"} {
+		uploader := NewArtifactUploader(logger.Discard, client, ArtifactUploaderConfig{
+			JobID:     jobID,
+			BlobStore: blobStore,
+		})
+		artifact, err := uploader.build("vendor/tool", src)
+		if err != nil {
+			t.Fatalf("uploader.build(...) error = %v", err)
+		}
+		blobPath = filepath.Join(store, "sha256", artifact.Sha256Sum[:2], artifact.Sha256Sum)
+
+		if err := uploader.upload(ctx, []*api.Artifact{artifact}); err != nil {
+			t.Fatalf("uploader.upload(ctx, ...) error = %v", err)
+		}
+
+		if got, want := artifact.URL, fileDestination(blobPath); got != want {
+			t.Errorf("artifact.URL = %q, want %q", got, want)
+		}
+		if _, err := os.Stat(filepath.Join(store, "refs", artifact.Sha256Sum, jobID)); err != nil {
+			t.Errorf("reference for %s: os.Stat error = %v", jobID, err)
+		}
+
+		if i == 0 {
+			// Backdate the blob, so we can tell if it's uploaded again.
+			old := time.Now().Add(-time.Hour).Truncate(time.Second)
+			if err := os.Chtimes(blobPath, old, old); err != nil {
+				t.Fatalf("os.Chtimes(%q) error = %v", blobPath, err)
+			}
+		}
+	}
+
+	info, err := os.Stat(blobPath)
+	if err != nil {
+		t.Fatalf("os.Stat(%q) error = %v", blobPath, err)
+	}
+	if time.Since(info.ModTime()) < 30*time.Minute {
+		t.Errorf("blob was modified at %v, want the second upload to be skipped", info.ModTime())
+	}
+
+	wantDestination := "blob+" + blobStore
+	if diff := cmp.Diff(destinations, []string{wantDestination, wantDestination}); diff != "" {
+		t.Errorf("registered upload destinations diff (-got +want):\n%s", diff)
+	}
+
+	// The artifact can be downloaded from the blob store, by its digest.
+	dest := t.TempDir()
+	downloader := NewArtifactDownloader(logger.Discard, client, ArtifactDownloaderConfig{
+		BuildID:     "my-build",
+		Destination: dest,
+	})
+	if err := downloader.Download(ctx); err != nil {
+		t.Fatalf("downloader.Download(ctx) error = %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(dest, "vendor", "tool"))
+	if err != nil {
+		t.Fatalf("os.ReadFile(vendor/tool) error = %v", err)
+	}
+	if string(got) != "llamas" {
+		t.Errorf("downloaded artifact = %q, want %q", got, "llamas")
+	}
+}
+
+func TestPruneBlobStore(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+
+	store := t.TempDir()
+	objects := []struct {
+		key     string
+		modTime time.Time
+	}{
+		// Only referenced a long time ago
+		{"sha256/aa/aaaa", old},
+		{"refs/aaaa/job-1", old},
+
+		// Referenced a long time ago, and recently
+		{"sha256/bb/bbbb", old},
+		{"refs/bbbb/job-1", old},
+		{"refs/bbbb/job-2", now},
+
+		// Not referenced, but uploaded recently
+		{"sha256/cc/cccc", now},
+
+		// Not referenced at all
+		{"sha256/dd/dddd", old},
+	}
+	for _, obj := range objects {
+		p := filepath.Join(store, filepath.FromSlash(obj.key))
+		if err := os.MkdirAll(filepath.Dir(p), 0o777); err != nil {
+			t.Fatalf("os.MkdirAll(%q) error = %v", filepath.Dir(p), err)
+		}
+		if err := os.WriteFile(p, []byte("blob"), 0o666); err != nil {
+			t.Fatalf("os.WriteFile(%q) error = %v", p, err)
+		}
+		if err := os.Chtimes(p, obj.modTime, obj.modTime); err != nil {
+			t.Fatalf("os.Chtimes(%q) error = %v", p, err)
+		}
+	}
+
+	blobStore, err := NewFileBlobStore(fileDestination(store))
+	if err != nil {
+		t.Fatalf("NewFileBlobStore(...) error = %v", err)
+	}
+
+	want := PruneBlobStoreResult{RefsRemoved: 2, BlobsRemoved: 2, BytesFreed: 8}
+	for _, dryRun := range []bool{true, false} {
+		got, err := PruneBlobStore(ctx, logger.Discard, blobStore, PruneBlobStoreConfig{
+			OlderThan: now.Add(-time.Hour),
+			DryRun:    dryRun,
+		})
+		if err != nil {
+			t.Fatalf("PruneBlobStore(DryRun: %t) error = %v", dryRun, err)
+		}
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Errorf("PruneBlobStore(DryRun: %t) diff (-got +want):\n%s", dryRun, diff)
+		}
+	}
+
+	remaining, err := blobStore.List(ctx, "")
+	if err != nil {
+		t.Fatalf("blobStore.List(ctx, \"\") error = %v", err)
+	}
+	var keys []string
+	for _, obj := range remaining {
+		keys = append(keys, obj.Key)
+	}
+	wantKeys := []string{"refs/bbbb/job-2", "sha256/bb/bbbb", "sha256/cc/cccc"}
+	if diff := cmp.Diff(keys, wantKeys); diff != "" {
+		t.Errorf("remaining objects diff (-got +want):\n%s", diff)
+	}
+}
@@ -0,0 +1,554 @@
+package agent
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ArtifactBundleManifestName is the name of the manifest within an artifact
+// bundle. It is always the first entry.
+const ArtifactBundleManifestName = ".buildkite-artifact-manifest.json"
+
+// Artifact bundle formats, chosen by the bundle name's extension.
+const (
+	bundleFormatTarGz  = "tar.gz"
+	bundleFormatTarZst = "tar.zst"
+	bundleFormatZip    = "zip"
+)
+
+// ArtifactBundleManifest lists the files in an artifact bundle.
+type ArtifactBundleManifest struct {
+	Version int                       `json:"version"`
+	Files   []ArtifactBundleFileEntry `json:"files"`
+}
+
+// ArtifactBundleFileEntry describes a file in an artifact bundle.
+type ArtifactBundleFileEntry struct {
+	Path   string      `json:"path"`
+	Mode   fs.FileMode `json:"mode"`
+	Size   int64       `json:"size"`
+	SHA256 string      `json:"sha256,omitempty"`
+	Link   string      `json:"link,omitempty"` // the target, if the file is a symlink
+}
+
+// artifactBundleFormat returns the format of a bundle from its name, or "" if
+// the name isn't a bundle.
+func artifactBundleFormat(name string) string {
+	switch name = strings.ToLower(name); {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return bundleFormatTarGz
+	case strings.HasSuffix(name, ".tar.zst"), strings.HasSuffix(name, ".tzst"):
+		return bundleFormatTarZst
+	case strings.HasSuffix(name, ".zip"):
+		return bundleFormatZip
+	default:
+		return ""
+	}
+}
+
+// bundleWriter writes entries into an archive in either format.
+type bundleWriter interface {
+	writeFile(name string, mode fs.FileMode, modTime time.Time, size int64, r io.Reader) error
+	writeSymlink(name, target string, mode fs.FileMode, modTime time.Time) error
+	Close() error
+}
+
+// tarBundleWriter writes a tar archive, compressed by c.
+type tarBundleWriter struct {
+	c  io.WriteCloser
+	tw *tar.Writer
+}
+
+func (w *tarBundleWriter) writeFile(name string, mode fs.FileMode, modTime time.Time, size int64, r io.Reader) error {
+	err := w.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     int64(mode.Perm()),
+		Size:     size,
+		ModTime:  modTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w.tw, r)
+	return err
+}
+
+func (w *tarBundleWriter) writeSymlink(name, target string, mode fs.FileMode, modTime time.Time) error {
+	return w.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeSymlink,
+		Name:     name,
+		Linkname: target,
+		Mode:     int64(mode.Perm()),
+		ModTime:  modTime,
+	})
+}
+
+func (w *tarBundleWriter) Close() error {
+	if err := w.tw.Close(); err != nil {
+		return err
+	}
+	return w.c.Close()
+}
+
+type zipBundleWriter struct {
+	zw *zip.Writer
+}
+
+func (w *zipBundleWriter) writeFile(name string, mode fs.FileMode, modTime time.Time, size int64, r io.Reader) error {
+	fh := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modTime}
+	fh.SetMode(mode.Perm())
+	fw, err := w.zw.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, r)
+	return err
+}
+
+func (w *zipBundleWriter) writeSymlink(name, target string, mode fs.FileMode, modTime time.Time) error {
+	// Zip stores symlinks as entries with the symlink mode, whose contents
+	// are the target.
+	fh := &zip.FileHeader{Name: name, Method: zip.Store, Modified: modTime}
+	fh.SetMode(fs.ModeSymlink | mode.Perm())
+	fw, err := w.zw.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(fw, target)
+	return err
+}
+
+func (w *zipBundleWriter) Close() error {
+	return w.zw.Close()
+}
+
+// writeArtifactBundle writes the artifacts into an archive at archivePath,
+// preceded by a manifest. Symlinks are stored as symlinks, rather than as the
+// files they link to.
+func writeArtifactBundle(archivePath, format string, artifacts []*api.Artifact) (err error) {
+	f, err := os.Create(archivePath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	var bw bundleWriter
+	switch format {
+	case bundleFormatTarGz:
+		gz := gzip.NewWriter(f)
+		bw = &tarBundleWriter{c: gz, tw: tar.NewWriter(gz)}
+	case bundleFormatTarZst:
+		zw, err := zstd.NewWriter(f)
+		if err != nil {
+			return err
+		}
+		bw = &tarBundleWriter{c: zw, tw: tar.NewWriter(zw)}
+	case bundleFormatZip:
+		bw = &zipBundleWriter{zw: zip.NewWriter(f)}
+	default:
+		return fmt.Errorf("unknown artifact bundle format %q", format)
+	}
+
+	manifest := ArtifactBundleManifest{Version: 1}
+	infos := make([]fs.FileInfo, len(artifacts))
+	for i, artifact := range artifacts {
+		info, err := os.Lstat(artifact.AbsolutePath)
+		if err != nil {
+			return err
+		}
+		infos[i] = info
+
+		entry := ArtifactBundleFileEntry{
+			Path: filepath.ToSlash(artifact.Path),
+			Mode: info.Mode(),
+			Size: artifact.FileSize,
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if entry.Link, err = os.Readlink(artifact.AbsolutePath); err != nil {
+				return err
+			}
+			entry.Size = 0
+		} else {
+			entry.SHA256 = artifact.Sha256Sum
+		}
+		manifest.Files = append(manifest.Files, entry)
+	}
+
+	mj, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding artifact bundle manifest: %w", err)
+	}
+	if err := bw.writeFile(ArtifactBundleManifestName, 0o644, time.Now(), int64(len(mj)), strings.NewReader(string(mj))); err != nil {
+		return err
+	}
+
+	for i, entry := range manifest.Files {
+		info := infos[i]
+		if entry.Link != "" {
+			if err := bw.writeSymlink(entry.Path, filepath.ToSlash(entry.Link), info.Mode(), info.ModTime()); err != nil {
+				return err
+			}
+			continue
+		}
+		src, err := os.Open(artifacts[i].AbsolutePath)
+		if err != nil {
+			return err
+		}
+		err = bw.writeFile(entry.Path, info.Mode(), info.ModTime(), info.Size(), src)
+		src.Close()
+		if err != nil {
+			return fmt.Errorf("adding %s to artifact bundle: %w", entry.Path, err)
+		}
+	}
+
+	return bw.Close()
+}
+
+// bundleEntry is an entry read from an archive.
+type bundleEntry struct {
+	name    string
+	mode    fs.FileMode
+	link    string // the target, if the entry is a symlink
+	modTime time.Time
+	open    func() (io.ReadCloser, error)
+}
+
+// openTarBundle opens a tar artifact bundle for reading. The returned function
+// closes it.
+func openTarBundle(archivePath, format string) (*tar.Reader, func(), error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch format {
+	case bundleFormatTarGz:
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return tar.NewReader(gz), func() { f.Close() }, nil
+
+	case bundleFormatTarZst:
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return tar.NewReader(zr), func() { zr.Close(); f.Close() }, nil
+	}
+	f.Close()
+	return nil, nil, fmt.Errorf("%s is not a tar artifact bundle", archivePath)
+}
+
+// ExtractArtifactBundle unpacks an artifact bundle into a directory,
+// preserving file modes and symlinks. Every entry must be listed in the
+// bundle's manifest, and every file must match the size and SHA-256 digest
+// the manifest records for it. Entries that would be written outside of the
+// directory are rejected.
+func ExtractArtifactBundle(archivePath, dir string) error {
+	var entries func(yield func(bundleEntry) error) error
+
+	switch format := artifactBundleFormat(archivePath); format {
+	case bundleFormatTarGz, bundleFormatTarZst:
+		entries = func(yield func(bundleEntry) error) error {
+			tr, closeTar, err := openTarBundle(archivePath, format)
+			if err != nil {
+				return err
+			}
+			defer closeTar()
+			for {
+				hdr, err := tr.Next()
+				if errors.Is(err, io.EOF) {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				entry := bundleEntry{
+					name:    hdr.Name,
+					mode:    fs.FileMode(hdr.Mode).Perm(),
+					modTime: hdr.ModTime,
+					open:    func() (io.ReadCloser, error) { return io.NopCloser(tr), nil },
+				}
+				switch hdr.Typeflag {
+				case tar.TypeReg:
+				case tar.TypeSymlink:
+					entry.link = hdr.Linkname
+				case tar.TypeDir:
+					continue
+				default:
+					return fmt.Errorf("unsupported entry %s in artifact bundle", hdr.Name)
+				}
+				if err := yield(entry); err != nil {
+					return err
+				}
+			}
+		}
+
+	case bundleFormatZip:
+		entries = func(yield func(bundleEntry) error) error {
+			zr, err := zip.OpenReader(archivePath)
+			if err != nil {
+				return err
+			}
+			defer zr.Close()
+			for _, zf := range zr.File {
+				zf := zf
+				entry := bundleEntry{
+					name:    zf.Name,
+					mode:    zf.Mode().Perm(),
+					modTime: zf.Modified,
+					open:    zf.Open,
+				}
+				switch {
+				case zf.Mode()&fs.ModeSymlink != 0:
+					rc, err := zf.Open()
+					if err != nil {
+						return err
+					}
+					target, err := io.ReadAll(io.LimitReader(rc, 4096))
+					rc.Close()
+					if err != nil {
+						return err
+					}
+					entry.link = string(target)
+				case zf.Mode().IsDir():
+					continue
+				}
+				if err := yield(entry); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+	default:
+		return fmt.Errorf("%s is not an artifact bundle", archivePath)
+	}
+
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	// The manifest is the first entry, and lists every other entry.
+	var manifest map[string]ArtifactBundleFileEntry
+	extracted := make(map[string]bool)
+
+	err = entries(func(e bundleEntry) error {
+		if manifest == nil {
+			if e.name != ArtifactBundleManifestName {
+				return fmt.Errorf("%s has no artifact bundle manifest", archivePath)
+			}
+			m, err := readArtifactBundleManifest(e)
+			if err != nil {
+				return err
+			}
+			manifest = m
+			return nil
+		}
+
+		want, ok := manifest[e.name]
+		if !ok {
+			return fmt.Errorf("artifact bundle entry %s isn't listed in the manifest", e.name)
+		}
+		if extracted[e.name] {
+			return fmt.Errorf("artifact bundle entry %s appears more than once", e.name)
+		}
+		extracted[e.name] = true
+
+		target, err := bundleEntryTarget(dir, e.name)
+		if err != nil {
+			return err
+		}
+		// Refuse to write through symlinks extracted earlier, which could
+		// point outside of dir.
+		if err := checkWithinDir(dir, existingAncestor(filepath.Dir(target))); err != nil {
+			return fmt.Errorf("artifact bundle entry %s: %w", e.name, err)
+		}
+		// Actual file permissions will be reduced by umask, and won't be 0777 unless the user has manually changed the umask to 000
+		if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+			return err
+		}
+
+		// Replace whatever is there already, as tar does.
+		if err := os.Remove(target); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		if e.link != "" || want.Link != "" {
+			if e.link != want.Link {
+				return fmt.Errorf("artifact bundle entry %s links to %q, but the manifest lists %q", e.name, e.link, want.Link)
+			}
+			return os.Symlink(filepath.FromSlash(e.link), target)
+		}
+
+		rc, err := e.open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, e.mode)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		n, err := io.Copy(io.MultiWriter(f, h), rc)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("extracting %s: %w", e.name, err)
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		if err := verifyBundleEntry(want, n, hex.EncodeToString(h.Sum(nil))); err != nil {
+			// Don't leave a corrupt file behind for something to use.
+			os.Remove(target)
+			return fmt.Errorf("artifact bundle entry %s: %w", e.name, err)
+		}
+		// The umask may have reduced the mode when the file was created.
+		if err := os.Chmod(target, e.mode); err != nil {
+			return err
+		}
+		if !e.modTime.IsZero() {
+			return os.Chtimes(target, e.modTime, e.modTime)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if manifest == nil {
+		return fmt.Errorf("%s has no artifact bundle manifest", archivePath)
+	}
+	for path := range manifest {
+		if !extracted[path] {
+			return fmt.Errorf("artifact bundle entry %s is listed in the manifest, but missing from the bundle", path)
+		}
+	}
+	return nil
+}
+
+// readArtifactBundleManifest reads the manifest entry of a bundle, and returns
+// the files it lists by path.
+func readArtifactBundleManifest(e bundleEntry) (map[string]ArtifactBundleFileEntry, error) {
+	rc, err := e.open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var manifest ArtifactBundleManifest
+	if err := json.NewDecoder(rc).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("decoding artifact bundle manifest: %w", err)
+	}
+	if manifest.Version != 1 {
+		return nil, fmt.Errorf("unsupported artifact bundle manifest version %d", manifest.Version)
+	}
+
+	files := make(map[string]ArtifactBundleFileEntry, len(manifest.Files))
+	for _, f := range manifest.Files {
+		files[f.Path] = f
+	}
+	return files, nil
+}
+
+// verifyBundleEntry checks an extracted file's size and (hex-encoded) SHA-256
+// digest against its manifest entry.
+func verifyBundleEntry(want ArtifactBundleFileEntry, size int64, sha256sum string) error {
+	if size != want.Size {
+		return fmt.Errorf("size is %d bytes, but the manifest lists %d", size, want.Size)
+	}
+	if want.SHA256 != "" && !strings.EqualFold(sha256sum, want.SHA256) {
+		return fmt.Errorf("SHA-256 digest is %s, but the manifest lists %s", sha256sum, want.SHA256)
+	}
+	return nil
+}
+
+// isArtifactBundle reports whether an archive is an artifact bundle, i.e. its
+// first entry is the bundle manifest. This avoids extracting ordinary archives
+// that happen to be uploaded as artifacts.
+func isArtifactBundle(archivePath string) bool {
+	switch format := artifactBundleFormat(archivePath); format {
+	case bundleFormatTarGz, bundleFormatTarZst:
+		tr, closeTar, err := openTarBundle(archivePath, format)
+		if err != nil {
+			return false
+		}
+		defer closeTar()
+		hdr, err := tr.Next()
+		return err == nil && hdr.Name == ArtifactBundleManifestName
+
+	case bundleFormatZip:
+		zr, err := zip.OpenReader(archivePath)
+		if err != nil {
+			return false
+		}
+		defer zr.Close()
+		return len(zr.File) > 0 && zr.File[0].Name == ArtifactBundleManifestName
+	}
+	return false
+}
+
+// bundleEntryTarget returns where an entry should be extracted to within dir.
+func bundleEntryTarget(dir, name string) (string, error) {
+	// fs.ValidPath rejects absolute paths, and paths containing "..".
+	name = filepath.ToSlash(name)
+	if !fs.ValidPath(name) || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("invalid artifact bundle entry %q", name)
+	}
+	return filepath.Join(dir, filepath.FromSlash(name)), nil
+}
+
+// checkWithinDir checks that p, after resolving symlinks, is within dir.
+func checkWithinDir(dir, p string) error {
+	resolvedDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	resolved, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(resolvedDir, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s is outside of %s", p, dir)
+	}
+	return nil
+}
+
+// existingAncestor returns p, or its closest ancestor that exists.
+func existingAncestor(p string) string {
+	for {
+		if _, err := os.Lstat(p); err == nil {
+			return p
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return p
+		}
+		p = parent
+	}
+}
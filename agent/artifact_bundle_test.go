@@ -0,0 +1,320 @@
+package agent
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestArtifactBundleRoundTrip(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes and symlinks aren't preserved on Windows")
+	}
+
+	src := t.TempDir()
+	files := map[string]fs.FileMode{
+		"coverage/index.html":   0o644,
+		"coverage/js/report.js": 0o600,
+		"bin/run.sh":            0o755,
+	}
+	var artifacts []*api.Artifact
+	for path, mode := range files {
+		abs := filepath.Join(src, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(abs), 0o777); err != nil {
+			t.Fatalf("os.MkdirAll(%q) error = %v", filepath.Dir(abs), err)
+		}
+		if err := os.WriteFile(abs, []byte(path), mode); err != nil {
+			t.Fatalf("os.WriteFile(%q) error = %v", abs, err)
+		}
+		if err := os.Chmod(abs, mode); err != nil {
+			t.Fatalf("os.Chmod(%q) error = %v", abs, err)
+		}
+		artifacts = append(artifacts, &api.Artifact{
+			Path:         path,
+			AbsolutePath: abs,
+			FileSize:     int64(len(path)),
+			Sha256Sum:    sha256Hex(path),
+		})
+	}
+	link := filepath.Join(src, "coverage", "latest.html")
+	if err := os.Symlink("index.html", link); err != nil {
+		t.Fatalf("os.Symlink(...) error = %v", err)
+	}
+	artifacts = append(artifacts, &api.Artifact{Path: "coverage/latest.html", AbsolutePath: link})
+
+	for _, name := range []string{"bundle.tar.gz", "bundle.tar.zst", "bundle.zip"} {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			archive := filepath.Join(t.TempDir(), name)
+			if err := writeArtifactBundle(archive, artifactBundleFormat(name), artifacts); err != nil {
+				t.Fatalf("writeArtifactBundle(%q, ...) error = %v", archive, err)
+			}
+			if !isArtifactBundle(archive) {
+				t.Errorf("isArtifactBundle(%q) = false, want true", archive)
+			}
+
+			dest := t.TempDir()
+			if err := ExtractArtifactBundle(archive, dest); err != nil {
+				t.Fatalf("ExtractArtifactBundle(%q, %q) error = %v", archive, dest, err)
+			}
+
+			for path, mode := range files {
+				abs := filepath.Join(dest, filepath.FromSlash(path))
+				got, err := os.ReadFile(abs)
+				if err != nil {
+					t.Fatalf("os.ReadFile(%q) error = %v", abs, err)
+				}
+				if diff := cmp.Diff(string(got), path); diff != "" {
+					t.Errorf("extracted %s diff (-got +want):\n%s", path, diff)
+				}
+				info, err := os.Stat(abs)
+				if err != nil {
+					t.Fatalf("os.Stat(%q) error = %v", abs, err)
+				}
+				if got := info.Mode().Perm(); got != mode {
+					t.Errorf("extracted %s mode = %v, want %v", path, got, mode)
+				}
+			}
+
+			target, err := os.Readlink(filepath.Join(dest, "coverage", "latest.html"))
+			if err != nil {
+				t.Fatalf("os.Readlink(latest.html) error = %v", err)
+			}
+			if target != "index.html" {
+				t.Errorf("os.Readlink(latest.html) = %q, want %q", target, "index.html")
+			}
+
+			if _, err := os.Stat(filepath.Join(dest, ArtifactBundleManifestName)); !os.IsNotExist(err) {
+				t.Errorf("os.Stat(manifest) error = %v, want the manifest not to be extracted", err)
+			}
+		})
+	}
+}
+
+func TestExtractArtifactBundleRejectsEscapes(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks aren't supported on Windows")
+	}
+
+	tests := []struct {
+		name    string
+		entries []testBundleEntry
+	}{
+		{
+			name:    "parent directory",
+			entries: []testBundleEntry{{name: "../escaped.txt", data: "escaped"}},
+		},
+		{
+			name:    "absolute path",
+			entries: []testBundleEntry{{name: "/tmp/escaped.txt", data: "escaped"}},
+		},
+		{
+			name: "through a symlink",
+			entries: []testBundleEntry{
+				{name: "outside", link: ".."},
+				{name: "outside/escaped.txt", data: "escaped"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			archive := writeTestBundle(t, testBundleManifest(test.entries), test.entries)
+
+			parent := t.TempDir()
+			dest := filepath.Join(parent, "dest")
+			if err := ExtractArtifactBundle(archive, dest); err == nil {
+				t.Errorf("ExtractArtifactBundle(%q, %q) error = %v, want an error", archive, dest, err)
+			}
+			if _, err := os.Stat(filepath.Join(parent, "escaped.txt")); !os.IsNotExist(err) {
+				t.Errorf("os.Stat(escaped.txt) error = %v, want the file not to exist", err)
+			}
+		})
+	}
+}
+
+func TestExtractArtifactBundleVerifiesManifest(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks aren't supported on Windows")
+	}
+
+	entries := []testBundleEntry{
+		{name: "report.txt", data: "all good"},
+		{name: "latest.txt", link: "report.txt"},
+	}
+
+	tests := []struct {
+		name              string
+		manifest          *ArtifactBundleManifest
+		entries           []testBundleEntry
+		wantErrContaining string
+		wantMissing       string
+	}{
+		{
+			name:              "no manifest",
+			entries:           entries,
+			wantErrContaining: "has no artifact bundle manifest",
+		},
+		{
+			name:              "unlisted entry",
+			manifest:          testBundleManifest(entries),
+			entries:           append(entries[:2:2], testBundleEntry{name: "extra.txt", data: "sneaky"}),
+			wantErrContaining: "extra.txt isn't listed in the manifest",
+			wantMissing:       "extra.txt",
+		},
+		{
+			name:              "duplicate entry",
+			manifest:          testBundleManifest(entries),
+			entries:           append(entries[:2:2], entries[0]),
+			wantErrContaining: "report.txt appears more than once",
+		},
+		{
+			name:     "wrong size",
+			manifest: testBundleManifest(entries),
+			entries: []testBundleEntry{
+				{name: "report.txt", data: "all good, and then some"},
+				entries[1],
+			},
+			wantErrContaining: "size is 23 bytes, but the manifest lists 8",
+			wantMissing:       "report.txt",
+		},
+		{
+			name:     "wrong digest",
+			manifest: testBundleManifest(entries),
+			entries: []testBundleEntry{
+				{name: "report.txt", data: "all bad!"},
+				entries[1],
+			},
+			wantErrContaining: "SHA-256 digest is " + sha256Hex("all bad!"),
+			wantMissing:       "report.txt",
+		},
+		{
+			name:     "wrong symlink target",
+			manifest: testBundleManifest(entries),
+			entries: []testBundleEntry{
+				entries[0],
+				{name: "latest.txt", link: "/etc/passwd"},
+			},
+			wantErrContaining: `latest.txt links to "/etc/passwd", but the manifest lists "report.txt"`,
+			wantMissing:       "latest.txt",
+		},
+		{
+			name:              "missing file",
+			manifest:          testBundleManifest(entries),
+			entries:           entries[:1],
+			wantErrContaining: "latest.txt is listed in the manifest, but missing from the bundle",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			archive := writeTestBundle(t, test.manifest, test.entries)
+			dest := t.TempDir()
+			err := ExtractArtifactBundle(archive, dest)
+			if err == nil || !strings.Contains(err.Error(), test.wantErrContaining) {
+				t.Errorf("ExtractArtifactBundle(%q, %q) error = %v, want error containing %q", archive, dest, err, test.wantErrContaining)
+			}
+			if test.wantMissing != "" {
+				if _, err := os.Lstat(filepath.Join(dest, test.wantMissing)); !os.IsNotExist(err) {
+					t.Errorf("os.Lstat(%s) error = %v, want the file not to exist", test.wantMissing, err)
+				}
+			}
+		})
+	}
+}
+
+// testBundleEntry is a file or symlink in a bundle written by writeTestBundle.
+type testBundleEntry struct {
+	name, data, link string
+}
+
+// testBundleManifest returns a manifest that correctly lists the entries.
+func testBundleManifest(entries []testBundleEntry) *ArtifactBundleManifest {
+	manifest := &ArtifactBundleManifest{Version: 1}
+	for _, e := range entries {
+		entry := ArtifactBundleFileEntry{Path: e.name, Mode: 0o644, Link: e.link}
+		if e.link == "" {
+			entry.Size = int64(len(e.data))
+			entry.SHA256 = sha256Hex(e.data)
+		}
+		manifest.Files = append(manifest.Files, entry)
+	}
+	return manifest
+}
+
+// writeTestBundle writes a tar.gz bundle containing the manifest (if not nil)
+// followed by the entries, and returns its path.
+func writeTestBundle(t *testing.T, manifest *ArtifactBundleManifest, entries []testBundleEntry) string {
+	t.Helper()
+
+	archive := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatalf("os.Create(%q) error = %v", archive, err)
+	}
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	writeEntry := func(hdr *tar.Header, data []byte) {
+		t.Helper()
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("tw.WriteHeader(%q) error = %v", hdr.Name, err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatalf("tw.Write(%q) error = %v", hdr.Name, err)
+		}
+	}
+
+	if manifest != nil {
+		data, err := json.Marshal(manifest)
+		if err != nil {
+			t.Fatalf("json.Marshal(manifest) error = %v", err)
+		}
+		writeEntry(&tar.Header{Name: ArtifactBundleManifestName, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(data))}, data)
+	}
+	for _, e := range entries {
+		if e.link != "" {
+			writeEntry(&tar.Header{Name: e.name, Typeflag: tar.TypeSymlink, Linkname: e.link, Mode: 0o777}, nil)
+			continue
+		}
+		writeEntry(&tar.Header{Name: e.name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(e.data))}, []byte(e.data))
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tw.Close() error = %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("gz.Close() error = %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("f.Close() error = %v", err)
+	}
+	return archive
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
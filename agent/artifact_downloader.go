@@ -10,9 +10,7 @@ import (
 	"runtime"
 	"strings"
 
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/buildkite/agent/v3/api"
-	iartifact "github.com/buildkite/agent/v3/internal/artifact"
 	"github.com/buildkite/agent/v3/logger"
 	"github.com/buildkite/agent/v3/pool"
 )
@@ -35,6 +33,17 @@ type ArtifactDownloaderConfig struct {
 
 	// Whether to show HTTP debugging
 	DebugHTTP bool
+
+	// Whether to extract artifact bundles (.tar.gz, .tgz, .tar.zst, .tzst and
+	// .zip artifacts containing a bundle manifest) after downloading them
+	Extract bool
+
+	// What to do when a downloaded artifact doesn't match its checksum. One
+	// of ArtifactVerifyPolicies, defaulting to ArtifactVerifyRetry.
+	Verify string
+
+	// How many artifacts to download at once (defaults to 10 per CPU)
+	Concurrency int
 }
 
 type ArtifactDownloader struct {
@@ -82,12 +91,8 @@ func (a *ArtifactDownloader) Download(ctx context.Context) error {
 
 	a.logger.Info("Found %d artifacts. Starting to download to: %s", artifactCount, destination)
 
-	p := pool.New(pool.MaxConcurrencyLimit)
+	p := pool.New(artifactConcurrency(a.conf.Concurrency))
 	errors := []error{}
-	s3Clients, err := a.generateS3Clients(artifacts)
-	if err != nil {
-		return fmt.Errorf("failed to generate S3 clients for artifact upload: %w", err)
-	}
 
 	for _, artifact := range artifacts {
 		// Create new instance of the artifact for the goroutine
@@ -102,12 +107,12 @@ func (a *ArtifactDownloader) Download(ctx context.Context) error {
 				path = strings.Replace(path, `\`, `/`, -1)
 			}
 
-			dler := a.createDownloader(artifact, path, destination, s3Clients)
+			err := a.download(ctx, artifact, path, destination)
 
 			// If the downloaded encountered an error, lock
 			// the pool, collect it, then unlock the pool
 			// again.
-			if err := dler.Start(ctx); err != nil {
+			if err != nil {
 				a.logger.Error("Failed to download artifact: %s", err)
 
 				p.Lock()
@@ -123,86 +128,128 @@ func (a *ArtifactDownloader) Download(ctx context.Context) error {
 		return fmt.Errorf("There were errors with downloading some of the artifacts")
 	}
 
+	if a.conf.Extract {
+		return a.extractBundles(artifacts, destination)
+	}
+
 	return nil
 }
 
-// We want to have as few S3 clients as possible, as creating them is kind of an expensive operation
-// But it's also theoretically possible that we'll have multiple artifacts with different S3 buckets, and each
-// S3Client only applies to one bucket, so we need to store the S3 clients in a map, one for each bucket
-func (a *ArtifactDownloader) generateS3Clients(artifacts []*api.Artifact) (map[string]*s3.S3, error) {
-	s3Clients := map[string]*s3.S3{}
+// download downloads an artifact, and verifies it against the checksum
+// recorded when it was uploaded.
+func (a *ArtifactDownloader) download(ctx context.Context, artifact *api.Artifact, path, destination string) error {
+	policy := a.conf.Verify
+	if policy == "" {
+		policy = ArtifactVerifyRetry
+	}
 
-	for _, artifact := range artifacts {
-		if !strings.HasPrefix(artifact.UploadDestination, "s3://") {
-			continue
+	attempts := 1
+	if policy == ArtifactVerifyRetry {
+		attempts = artifactVerifyAttempts
+	}
+
+	targetFile := getTargetPath(path, destination)
+	for attempt := 1; ; attempt++ {
+		dler, err := a.createDownloader(artifact, path, destination)
+		if err != nil {
+			return err
+		}
+		if err := dler.Start(ctx); err != nil {
+			return err
 		}
 
-		bucketName, _ := ParseS3Destination(artifact.UploadDestination)
-		if _, has := s3Clients[bucketName]; !has {
-			client, err := NewS3Client(a.logger, bucketName)
-			if err != nil {
-				return nil, fmt.Errorf("failed to create S3 client for bucket %s: %w", bucketName, err)
+		verified, err := verifyArtifactChecksum(targetFile, artifact)
+		if err == nil {
+			if !verified {
+				a.logger.Debug("Artifact %s has no checksum to verify", artifact.Path)
 			}
+			return nil
+		}
+
+		var mismatch *artifactChecksumError
+		switch {
+		case !errors.As(err, &mismatch):
+			return err
+
+		case policy == ArtifactVerifyWarn:
+			a.logger.Warn("%s", err)
+			return nil
+
+		case attempt < attempts:
+			a.logger.Warn("%s, downloading it again (attempt %d/%d)", err, attempt, attempts)
 
-			s3Clients[bucketName] = client
+		default:
+			// Don't leave a corrupted file where later commands would use it.
+			if rmErr := os.Remove(targetFile); rmErr != nil {
+				a.logger.Warn("Couldn't remove %s: %v", targetFile, rmErr)
+			}
+			return err
 		}
 	}
-
-	return s3Clients, nil
 }
 
-type downloader interface {
-	Start(context.Context) error
-}
+// createDownloader finds the registered artifact backend the artifact was
+// uploaded to, and creates a downloader with it. Artifacts in Buildkite's own
+// storage are downloaded from their URL.
+func (a *ArtifactDownloader) createDownloader(artifact *api.Artifact, path, destination string) (Downloader, error) {
+	source, inBlobStore := strings.CutPrefix(artifact.UploadDestination, blobStoreDestinationPrefix)
 
-func (a *ArtifactDownloader) createDownloader(artifact *api.Artifact, path, destination string, s3Clients map[string]*s3.S3) downloader {
-	// Handle downloading from S3, GS, RT, or Azure
-	switch {
-	case strings.HasPrefix(artifact.UploadDestination, "s3://"):
-		bucketName, _ := ParseS3Destination(artifact.UploadDestination)
-		return NewS3Downloader(a.logger, S3DownloaderConfig{
-			S3Client:    s3Clients[bucketName],
+	backend, ok := artifactBackendFor(source)
+	if !ok {
+		return NewDownload(a.logger, http.DefaultClient, DownloadConfig{
+			URL:         artifact.URL,
 			Path:        path,
-			S3Path:      artifact.UploadDestination,
 			Destination: destination,
 			Retries:     5,
 			DebugHTTP:   a.conf.DebugHTTP,
-		})
+			Size:        artifact.FileSize,
+		}), nil
+	}
 
-	case strings.HasPrefix(artifact.UploadDestination, "gs://"):
-		return NewGSDownloader(a.logger, GSDownloaderConfig{
-			Path:        path,
-			Bucket:      artifact.UploadDestination,
-			Destination: destination,
-			Retries:     5,
-			DebugHTTP:   a.conf.DebugHTTP,
-		})
+	conf := ArtifactBackendDownloaderConfig{
+		Source:      source,
+		Path:        path,
+		Destination: destination,
+		Retries:     5,
+		DebugHTTP:   a.conf.DebugHTTP,
+		Size:        artifact.FileSize,
+	}
+	if inBlobStore {
+		return blobDownloader{
+			backend:  backend,
+			conf:     conf,
+			artifact: artifact,
+			logger:   a.logger,
+		}, nil
+	}
+	return backend.NewDownloader(a.logger, conf)
+}
 
-	case strings.HasPrefix(artifact.UploadDestination, "rt://"):
-		return NewArtifactoryDownloader(a.logger, ArtifactoryDownloaderConfig{
-			Path:        path,
-			Repository:  artifact.UploadDestination,
-			Destination: destination,
-			Retries:     5,
-			DebugHTTP:   a.conf.DebugHTTP,
-		})
+// extractBundles extracts the downloaded artifacts that are artifact bundles
+// into the destination, and removes the archives.
+func (a *ArtifactDownloader) extractBundles(artifacts []*api.Artifact, destination string) error {
+	for _, artifact := range artifacts {
+		path := artifact.Path
+		if runtime.GOOS != "windows" {
+			path = strings.Replace(path, `\`, `/`, -1)
+		}
+		if artifactBundleFormat(path) == "" {
+			continue
+		}
 
-	case iartifact.IsAzureBlobPath(artifact.UploadDestination):
-		return iartifact.NewAzureBlobDownloader(a.logger, iartifact.AzureBlobDownloaderConfig{
-			Path:        path,
-			Repository:  artifact.UploadDestination,
-			Destination: destination,
-			Retries:     5,
-			DebugHTTP:   a.conf.DebugHTTP,
-		})
+		archivePath := getTargetPath(path, destination)
+		if !isArtifactBundle(archivePath) {
+			a.logger.Debug("Not extracting %s, which has no bundle manifest", path)
+			continue
+		}
 
-	default:
-		return NewDownload(a.logger, http.DefaultClient, DownloadConfig{
-			URL:         artifact.URL,
-			Path:        path,
-			Destination: destination,
-			Retries:     5,
-			DebugHTTP:   a.conf.DebugHTTP,
-		})
+		a.logger.Info("Extracting %s into %s", path, destination)
+		if err := ExtractArtifactBundle(archivePath, destination); err != nil {
+			return fmt.Errorf("extracting %s: %w", path, err)
+		}
+		if err := os.Remove(archivePath); err != nil {
+			a.logger.Warn("Couldn't remove %s after extracting it: %v", archivePath, err)
+		}
 	}
+	return nil
 }
@@ -2,10 +2,14 @@ package agent
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 
 	"github.com/buildkite/agent/v3/api"
@@ -48,3 +52,112 @@ func TestArtifactDownloaderConnectsToEndpoint(t *testing.T) {
 		t.Errorf("d.Download() = %v", err)
 	}
 }
+
+func TestArtifactDownloaderVerifiesChecksums(t *testing.T) {
+	t.Parallel()
+
+	sum := sha256.Sum256([]byte("llamas"))
+	sha256sum := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name          string
+		verify        string
+		corruptions   int32 // how many downloads are corrupted
+		wantErr       bool
+		wantDownloads int32
+		wantContent   string // empty if the file shouldn't exist
+	}{
+		{
+			name:          "matching",
+			verify:        "",
+			wantDownloads: 1,
+			wantContent:   "llamas",
+		},
+		{
+			name:          "retry recovers",
+			verify:        ArtifactVerifyRetry,
+			corruptions:   1,
+			wantDownloads: 2,
+			wantContent:   "llamas",
+		},
+		{
+			name:          "retry gives up",
+			verify:        ArtifactVerifyRetry,
+			corruptions:   artifactVerifyAttempts,
+			wantErr:       true,
+			wantDownloads: artifactVerifyAttempts,
+		},
+		{
+			name:          "fail",
+			verify:        ArtifactVerifyFail,
+			corruptions:   1,
+			wantErr:       true,
+			wantDownloads: 1,
+		},
+		{
+			name:          "warn",
+			verify:        ArtifactVerifyWarn,
+			corruptions:   1,
+			wantDownloads: 1,
+			wantContent:   "alpaca",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			var downloads atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				switch req.URL.RequestURI() {
+				case "/builds/my-build/artifacts/search?state=finished":
+					fmt.Fprintf(rw, `[{
+						"id": "4600ac5c-5a13-4e92-bb83-f86f218f7b32",
+						"file_size": 6,
+						"path": "llamas.txt",
+						"sha256sum": %q,
+						"url": "http://%s/download"
+					}]`, sha256sum, req.Host)
+				case "/download":
+					if downloads.Add(1) <= test.corruptions {
+						fmt.Fprint(rw, "alpaca")
+						return
+					}
+					fmt.Fprint(rw, "llamas")
+				default:
+					http.Error(rw, "Not found", http.StatusNotFound)
+				}
+			}))
+			defer server.Close()
+
+			ac := api.NewClient(logger.Discard, api.Config{
+				Endpoint: server.URL,
+				Token:    "llamasforever",
+			})
+
+			dest := t.TempDir()
+			d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+				BuildID:     "my-build",
+				Destination: dest,
+				Verify:      test.verify,
+			})
+
+			err := d.Download(context.Background())
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Errorf("d.Download() = %v, want error = %t", err, test.wantErr)
+			}
+			if got := downloads.Load(); got != test.wantDownloads {
+				t.Errorf("downloads = %d, want %d", got, test.wantDownloads)
+			}
+
+			got, err := os.ReadFile(filepath.Join(dest, "llamas.txt"))
+			switch {
+			case test.wantContent == "" && !os.IsNotExist(err):
+				t.Errorf("os.ReadFile(llamas.txt) = %q, %v, want the file not to exist", got, err)
+			case test.wantContent != "" && string(got) != test.wantContent:
+				t.Errorf("os.ReadFile(llamas.txt) = %q, %v, want %q", got, err, test.wantContent)
+			}
+		})
+	}
+}
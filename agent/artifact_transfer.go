@@ -0,0 +1,309 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buildkite/agent/v3/pool"
+	"github.com/buildkite/roko"
+	"golang.org/x/time/rate"
+	"google.golang.org/api/googleapi"
+)
+
+// artifactConcurrency returns the pool size for transferring artifacts.
+func artifactConcurrency(concurrency int) int {
+	if concurrency <= 0 {
+		return pool.MaxConcurrencyLimit
+	}
+	return concurrency
+}
+
+// artifactBandwidth limits the rate of all artifact uploads and downloads in
+// the process. It's nil (unlimited) unless SetArtifactBandwidthLimit is called.
+var artifactBandwidth atomic.Pointer[rate.Limiter]
+
+// The most bytes read at once under a bandwidth limit, so that transfers
+// sharing the limit take turns.
+const maxBandwidthBurst = 256 * 1024
+
+// SetArtifactBandwidthLimit limits artifact uploads and downloads in the
+// process to a total number of bytes per second. Zero removes the limit.
+func SetArtifactBandwidthLimit(bytesPerSecond int64) {
+	if bytesPerSecond <= 0 {
+		artifactBandwidth.Store(nil)
+		return
+	}
+	burst := int(min(bytesPerSecond, maxBandwidthBurst))
+	artifactBandwidth.Store(rate.NewLimiter(rate.Limit(bytesPerSecond), burst))
+}
+
+// artifactBandwidthLimit returns the artifact bandwidth limit in bytes per
+// second, or zero if there isn't one.
+func artifactBandwidthLimit() int64 {
+	limiter := artifactBandwidth.Load()
+	if limiter == nil {
+		return 0
+	}
+	return int64(limiter.Limit())
+}
+
+// artifactBandwidthThrottle returns a func that limits a reader by the artifact
+// bandwidth limit, for backends outside this package, or nil if there isn't a
+// limit.
+func artifactBandwidthThrottle() func(io.Reader) io.Reader {
+	if artifactBandwidth.Load() == nil {
+		return nil
+	}
+	return func(r io.Reader) io.Reader {
+		return bandwidthLimitedReader{r: r}
+	}
+}
+
+// waitForBandwidth waits until n bytes may be transferred, or fewer if n is
+// more than can be transferred at once, and returns how many may be.
+func waitForBandwidth(n int) int {
+	limiter := artifactBandwidth.Load()
+	if limiter == nil || n == 0 {
+		return n
+	}
+	n = min(n, limiter.Burst())
+	// Waiting only fails if the context is done, which it never is.
+	limiter.WaitN(context.Background(), n)
+	return n
+}
+
+// bandwidthLimitedReader limits reads from r by the artifact bandwidth limit.
+type bandwidthLimitedReader struct {
+	r io.Reader
+}
+
+func (b bandwidthLimitedReader) Read(p []byte) (int, error) {
+	return b.r.Read(p[:waitForBandwidth(len(p))])
+}
+
+// bandwidthLimitedFile is a file opened for uploading, whose reads are limited
+// by the artifact bandwidth limit. It only has the methods uploaders need, so
+// that nothing can bypass the limit (e.g. with (*os.File).WriteTo).
+type bandwidthLimitedFile struct {
+	f *os.File
+}
+
+// openArtifactFile opens a file for uploading.
+func openArtifactFile(name string) (*bandwidthLimitedFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &bandwidthLimitedFile{f: f}, nil
+}
+
+func (b *bandwidthLimitedFile) Read(p []byte) (int, error) {
+	return b.f.Read(p[:waitForBandwidth(len(p))])
+}
+
+func (b *bandwidthLimitedFile) ReadAt(p []byte, off int64) (int, error) {
+	// Unlike Read, ReadAt must fill p unless there's an error.
+	var read int
+	for read < len(p) {
+		n, err := b.f.ReadAt(p[read:read+waitForBandwidth(len(p)-read)], off+int64(read))
+		read += n
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+func (b *bandwidthLimitedFile) Seek(offset int64, whence int) (int64, error) {
+	return b.f.Seek(offset, whence)
+}
+
+func (b *bandwidthLimitedFile) Stat() (fs.FileInfo, error) {
+	return b.f.Stat()
+}
+
+func (b *bandwidthLimitedFile) Readdir(count int) ([]fs.FileInfo, error) {
+	return b.f.Readdir(count)
+}
+
+func (b *bandwidthLimitedFile) Close() error {
+	return b.f.Close()
+}
+
+// artifactHTTPError is an unsuccessful response from an artifact backend.
+type artifactHTTPError struct {
+	message    string
+	statusCode int
+	retryAfter time.Duration
+}
+
+func newArtifactHTTPError(message string, response *http.Response) *artifactHTTPError {
+	return &artifactHTTPError{
+		message:    message,
+		statusCode: response.StatusCode,
+		retryAfter: parseRetryAfter(response.Header.Get("Retry-After")),
+	}
+}
+
+func (e *artifactHTTPError) Error() string {
+	return e.message
+}
+
+func (e *artifactHTTPError) StatusCode() int {
+	return e.statusCode
+}
+
+func (e *artifactHTTPError) RetryAfter() time.Duration {
+	return e.retryAfter
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or a date.
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
+
+// isThrottled reports whether an error is an artifact backend saying it's
+// overloaded (429 Too Many Requests or 503 Service Unavailable, e.g. S3's
+// SlowDown), and how long it asked us to wait, if it did.
+func isThrottled(err error) (bool, time.Duration) {
+	var statusCode int
+	var withStatus interface{ StatusCode() int }
+	var gErr *googleapi.Error
+	switch {
+	case errors.As(err, &withStatus):
+		statusCode = withStatus.StatusCode()
+	case errors.As(err, &gErr):
+		statusCode = gErr.Code
+	default:
+		return false, 0
+	}
+	if statusCode != http.StatusTooManyRequests && statusCode != http.StatusServiceUnavailable {
+		return false, 0
+	}
+
+	var withRetryAfter interface{ RetryAfter() time.Duration }
+	if errors.As(err, &withRetryAfter) {
+		return true, withRetryAfter.RetryAfter()
+	}
+	return true, 0
+}
+
+// isMissing reports whether an error is an artifact backend saying the file
+// doesn't exist, or can't be accessed (404 Not Found or 403 Forbidden, which S3
+// returns for missing objects when the caller can't list the bucket).
+// Retrying won't change the answer.
+func isMissing(err error) bool {
+	var withStatus interface{ StatusCode() int }
+	if !errors.As(err, &withStatus) {
+		return false
+	}
+	switch withStatus.StatusCode() {
+	case http.StatusNotFound, http.StatusForbidden:
+		return true
+	}
+	return false
+}
+
+// Bounds of the backoff when artifact backends are overloaded
+const (
+	minThrottleBackoff = time.Second
+	maxThrottleBackoff = time.Minute
+)
+
+// artifactThrottle makes all artifact transfers in the process back off when
+// a backend says it's overloaded, rather than each transfer retrying on its
+// own schedule and keeping the backend overloaded. The backoff doubles each
+// time a transfer is throttled, and halves each time one succeeds.
+var artifactThrottle transferThrottle
+
+type transferThrottle struct {
+	mu      sync.Mutex
+	backoff time.Duration
+	until   time.Time
+}
+
+// wait waits until transfers may continue.
+func (t *transferThrottle) wait(ctx context.Context) error {
+	t.mu.Lock()
+	d := time.Until(t.until)
+	t.mu.Unlock()
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttled backs off all transfers, for at least retryAfter.
+func (t *transferThrottle) throttled(retryAfter time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.backoff = min(max(t.backoff*2, minThrottleBackoff), maxThrottleBackoff)
+	// Add jitter, so transfers don't all start again at once.
+	d := max(t.backoff, retryAfter) + time.Duration(rand.Int63n(int64(t.backoff/2)))
+	if until := time.Now().Add(d); until.After(t.until) {
+		t.until = until
+	}
+}
+
+// succeeded eases off the backoff after a successful transfer.
+func (t *transferThrottle) succeeded() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.backoff /= 2
+	if t.backoff < minThrottleBackoff {
+		t.backoff = 0
+	}
+}
+
+// doArtifactTransfer runs a transfer with the retrier, waiting while
+// artifact transfers are throttled, and backing off if the transfer is.
+func doArtifactTransfer(ctx context.Context, r *roko.Retrier, transfer func(*roko.Retrier) error) error {
+	return r.DoWithContext(ctx, func(r *roko.Retrier) error {
+		if err := artifactThrottle.wait(ctx); err != nil {
+			r.Break()
+			return err
+		}
+
+		err := transfer(r)
+		if err == nil {
+			artifactThrottle.succeeded()
+			return nil
+		}
+
+		// The throttle deadline is absolute, so the retrier's own interval
+		// overlaps with it, rather than adding to it.
+		if throttled, retryAfter := isThrottled(err); throttled {
+			artifactThrottle.throttled(retryAfter)
+		}
+		return err
+	})
+}
@@ -0,0 +1,121 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestIsThrottled(t *testing.T) {
+	t.Parallel()
+
+	response := func(statusCode int, retryAfter string) *http.Response {
+		resp := &http.Response{StatusCode: statusCode, Header: http.Header{}}
+		if retryAfter != "" {
+			resp.Header.Set("Retry-After", retryAfter)
+		}
+		return resp
+	}
+
+	tests := []struct {
+		name           string
+		err            error
+		wantThrottled  bool
+		wantRetryAfter time.Duration
+	}{
+		{
+			name: "other error",
+			err:  errors.New("connection reset by peer"),
+		},
+		{
+			name: "not found",
+			err:  newArtifactHTTPError("404 Not Found", response(http.StatusNotFound, "")),
+		},
+		{
+			name:          "too many requests",
+			err:           newArtifactHTTPError("429 Too Many Requests", response(http.StatusTooManyRequests, "")),
+			wantThrottled: true,
+		},
+		{
+			name:           "slow down, with retry after",
+			err:            fmt.Errorf("uploading: %w", newArtifactHTTPError("503 Slow Down", response(http.StatusServiceUnavailable, "7"))),
+			wantThrottled:  true,
+			wantRetryAfter: 7 * time.Second,
+		},
+		{
+			name:          "google cloud storage",
+			err:           fmt.Errorf("uploading: %w", &googleapi.Error{Code: http.StatusTooManyRequests}),
+			wantThrottled: true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			throttled, retryAfter := isThrottled(test.err)
+			if throttled != test.wantThrottled || retryAfter != test.wantRetryAfter {
+				t.Errorf("isThrottled(%v) = (%t, %v), want (%t, %v)", test.err, throttled, retryAfter, test.wantThrottled, test.wantRetryAfter)
+			}
+		})
+	}
+}
+
+func TestTransferThrottleBackoff(t *testing.T) {
+	t.Parallel()
+
+	var throttle transferThrottle
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		throttle.throttled(0)
+		if throttle.backoff != want {
+			t.Errorf("throttle.backoff after throttled(0) = %v, want %v", throttle.backoff, want)
+		}
+	}
+
+	// The deadline includes up to half the backoff in jitter.
+	if d := time.Until(throttle.until); d < 4*time.Second || d > 6*time.Second {
+		t.Errorf("time until throttle.until = %v, want between 4s and 6s", d)
+	}
+
+	// A longer Retry-After is respected.
+	throttle.throttled(time.Minute)
+	if d := time.Until(throttle.until); d < 59*time.Second {
+		t.Errorf("time until throttle.until after throttled(time.Minute) = %v, want at least a minute", d)
+	}
+
+	for _, want := range []time.Duration{4 * time.Second, 2 * time.Second, time.Second, 0} {
+		throttle.succeeded()
+		if throttle.backoff != want {
+			t.Errorf("throttle.backoff after succeeded() = %v, want %v", throttle.backoff, want)
+		}
+	}
+}
+
+// TestArtifactBandwidthLimit isn't parallel, because the limit applies to the
+// whole process.
+func TestArtifactBandwidthLimit(t *testing.T) {
+	SetArtifactBandwidthLimit(64 * 1024)
+	t.Cleanup(func() { SetArtifactBandwidthLimit(0) })
+
+	// The first 64KiB is the limiter's burst, and the next 64KiB should take
+	// about a second.
+	data := make([]byte, 128*1024)
+	start := time.Now()
+	n, err := io.Copy(io.Discard, bandwidthLimitedReader{r: bytes.NewReader(data)})
+	if err != nil {
+		t.Fatalf("io.Copy(...) error = %v", err)
+	}
+	if n != int64(len(data)) {
+		t.Errorf("io.Copy(...) = %d, want %d", n, len(data))
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("reading %d bytes at 64KiB/s took %v, want at least a second", len(data), elapsed)
+	}
+}
@@ -17,7 +17,6 @@ import (
 
 	"github.com/DrJosh9000/zzglob"
 	"github.com/buildkite/agent/v3/api"
-	"github.com/buildkite/agent/v3/internal/artifact"
 	"github.com/buildkite/agent/v3/internal/experiments"
 	"github.com/buildkite/agent/v3/internal/mime"
 	"github.com/buildkite/agent/v3/logger"
@@ -53,6 +52,19 @@ type ArtifactUploaderConfig struct {
 
 	// Whether to not upload symlinks
 	UploadSkipSymlinks bool
+
+	// If set, the files are bundled into a single archive artifact with this
+	// path, instead of being uploaded individually. The format (.tar.gz, .tgz,
+	// .tar.zst, .tzst or .zip) is chosen by the extension.
+	Bundle string
+
+	// If set, artifacts are stored by content in this blob store (e.g.
+	// s3://my-bucket/blobs) instead of the destination, and files that are
+	// already in the blob store aren't uploaded again.
+	BlobStore string
+
+	// How many artifacts to upload at once (defaults to 10 per CPU)
+	Concurrency int
 }
 
 type ArtifactUploader struct {
@@ -87,6 +99,11 @@ func (a *ArtifactUploader) Upload(ctx context.Context) error {
 	}
 
 	a.logger.Info("Found %d files that match %q", len(artifacts), a.conf.Paths)
+
+	if a.conf.Bundle != "" {
+		return a.uploadBundle(ctx, artifacts)
+	}
+
 	if err := a.upload(ctx, artifacts); err != nil {
 		return fmt.Errorf("uploading artifacts: %w", err)
 	}
@@ -94,6 +111,40 @@ func (a *ArtifactUploader) Upload(ctx context.Context) error {
 	return nil
 }
 
+// uploadBundle bundles the artifacts into an archive, and uploads that.
+func (a *ArtifactUploader) uploadBundle(ctx context.Context, artifacts []*api.Artifact) error {
+	format := artifactBundleFormat(a.conf.Bundle)
+	if format == "" {
+		return fmt.Errorf("invalid bundle name %q: must end with .tar.gz, .tgz, .tar.zst, .tzst or .zip", a.conf.Bundle)
+	}
+
+	dir, err := os.MkdirTemp("", "buildkite-artifact-bundle")
+	if err != nil {
+		return fmt.Errorf("creating temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	archivePath := filepath.Join(dir, filepath.Base(a.conf.Bundle))
+	if err := writeArtifactBundle(archivePath, format, artifacts); err != nil {
+		return fmt.Errorf("bundling artifacts: %w", err)
+	}
+
+	a.logger.Info("Bundled %d files into %s", len(artifacts), a.conf.Bundle)
+	return a.uploadFile(ctx, filepath.ToSlash(a.conf.Bundle), archivePath)
+}
+
+// uploadFile uploads a single file as an artifact, named path.
+func (a *ArtifactUploader) uploadFile(ctx context.Context, path, absolutePath string) error {
+	artifact, err := a.build(path, absolutePath)
+	if err != nil {
+		return fmt.Errorf("building artifact: %w", err)
+	}
+	if err := a.upload(ctx, []*api.Artifact{artifact}); err != nil {
+		return fmt.Errorf("uploading artifact: %w", err)
+	}
+	return nil
+}
+
 func isSymlink(path string) bool {
 	fi, err := os.Lstat(path)
 	if err != nil {
@@ -357,73 +408,83 @@ func (a *ArtifactUploader) build(path string, absolutePath string) (*api.Artifac
 	return artifact, nil
 }
 
-// createUploader applies some heuristics to the destination to infer which
-// uploader to use.
-func (a *ArtifactUploader) createUploader() (uploader Uploader, err error) {
-	var dest string
-	defer func() {
-		if err != nil || dest == "" {
-			return
-		}
-		a.logger.Info("Uploading to %s (%q), using your agent configuration", dest, a.conf.Destination)
-	}()
-
-	switch {
-	case a.conf.Destination == "":
+// createUploader finds the registered artifact backend for the destination,
+// and creates an uploader with it.
+func (a *ArtifactUploader) createUploader(destination string) (Uploader, error) {
+	if destination == "" {
 		a.logger.Info("Uploading to default Buildkite artifact storage")
 		return NewFormUploader(a.logger, FormUploaderConfig{
 			DebugHTTP: a.conf.DebugHTTP,
 		}), nil
+	}
 
-	case strings.HasPrefix(a.conf.Destination, "s3://"):
-		dest = "Amazon S3"
-		return NewS3Uploader(a.logger, S3UploaderConfig{
-			Destination: a.conf.Destination,
-			DebugHTTP:   a.conf.DebugHTTP,
-		})
+	backend, ok := artifactBackendFor(destination)
+	if !ok {
+		return nil, fmt.Errorf("invalid upload destination: '%v'. Only %s destinations are allowed. Did you forget to surround your artifact upload pattern in double quotes?", destination, strings.Join(artifactBackendSchemes(), ", "))
+	}
 
-	case strings.HasPrefix(a.conf.Destination, "gs://"):
-		dest = "Google Cloud Storage"
-		return NewGSUploader(a.logger, GSUploaderConfig{
-			Destination: a.conf.Destination,
-			DebugHTTP:   a.conf.DebugHTTP,
-		})
+	uploader, err := backend.NewUploader(a.logger, ArtifactBackendUploaderConfig{
+		Destination: destination,
+		DebugHTTP:   a.conf.DebugHTTP,
+	})
+	if err != nil {
+		return nil, err
+	}
+	a.logger.Info("Uploading to %s (%q), using your agent configuration", backend.Name, destination)
+	return uploader, nil
+}
 
-	case strings.HasPrefix(a.conf.Destination, "rt://"):
-		dest = "Artifactory"
-		return NewArtifactoryUploader(a.logger, ArtifactoryUploaderConfig{
-			Destination: a.conf.Destination,
-			DebugHTTP:   a.conf.DebugHTTP,
-		})
+func (a *ArtifactUploader) upload(ctx context.Context, artifacts []*api.Artifact) error {
+	destination, uploadDestination := a.conf.Destination, a.conf.Destination
+
+	// With a blob store, artifacts are uploaded to (and registered with) the
+	// blob store instead
+	var blobStore BlobStore
+	var blobRefFile string
+	if a.conf.BlobStore != "" {
+		if a.conf.Destination != "" {
+			return fmt.Errorf("an upload destination (%q) and a blob store (%q) can't both be used", a.conf.Destination, a.conf.BlobStore)
+		}
 
-	case artifact.IsAzureBlobPath(a.conf.Destination):
-		dest = "Azure Blob storage"
-		return artifact.NewAzureBlobUploader(a.logger, artifact.AzureBlobUploaderConfig{
-			Destination: a.conf.Destination,
-		})
+		var err error
+		blobStore, err = NewBlobStore(a.logger, a.conf.BlobStore)
+		if err != nil {
+			return fmt.Errorf("creating blob store: %w", err)
+		}
+
+		// References to blobs are empty files.
+		f, err := os.CreateTemp("", "buildkite-blob-ref")
+		if err != nil {
+			return fmt.Errorf("creating blob reference file: %w", err)
+		}
+		f.Close()
+		defer os.Remove(f.Name())
 
-	default:
-		return nil, fmt.Errorf("invalid upload destination: '%v'. Only s3://*, gs://*, rt://*, or https://*.blob.core.windows.net destinations are allowed. Did you forget to surround your artifact upload pattern in double quotes?", a.conf.Destination)
+		destination = a.conf.BlobStore
+		uploadDestination = blobStoreDestinationPrefix + a.conf.BlobStore
+		blobRefFile = f.Name()
 	}
-}
 
-func (a *ArtifactUploader) upload(ctx context.Context, artifacts []*api.Artifact) error {
 	// Determine what uploader to use
-	uploader, err := a.createUploader()
+	uploader, err := a.createUploader(destination)
 	if err != nil {
 		return fmt.Errorf("creating uploader: %v", err)
 	}
 
 	// Set the URLs of the artifacts based on the uploader
 	for _, artifact := range artifacts {
-		artifact.URL = uploader.URL(artifact)
+		if blobStore != nil {
+			artifact.URL = uploader.URL(blobArtifact(artifact))
+		} else {
+			artifact.URL = uploader.URL(artifact)
+		}
 	}
 
 	// Create the artifacts on Buildkite
 	batchCreator := NewArtifactBatchCreator(a.logger, a.apiClient, ArtifactBatchCreatorConfig{
 		JobID:                  a.conf.JobID,
 		Artifacts:              artifacts,
-		UploadDestination:      a.conf.Destination,
+		UploadDestination:      uploadDestination,
 		CreateArtifactsTimeout: 10 * time.Second,
 	})
 
@@ -433,7 +494,7 @@ func (a *ArtifactUploader) upload(ctx context.Context, artifacts []*api.Artifact
 	}
 
 	// Prepare a concurrency pool to upload the artifacts
-	p := pool.New(pool.MaxConcurrencyLimit)
+	p := pool.New(artifactConcurrency(a.conf.Concurrency))
 	errors := []error{}
 	var errorsMutex sync.Mutex
 
@@ -538,11 +599,17 @@ func (a *ArtifactUploader) upload(ctx context.Context, artifacts []*api.Artifact
 			// Upload the artifact and then set the state depending
 			// on whether or not it passed. We'll retry the upload
 			// a couple of times before giving up.
-			err := roko.NewRetrier(
+			err := doArtifactTransfer(ctx, roko.NewRetrier(
 				roko.WithMaxAttempts(10),
 				roko.WithStrategy(roko.Constant(5*time.Second)),
-			).DoWithContext(ctx, func(r *roko.Retrier) error {
-				if err := uploader.Upload(ctx, artifact); err != nil {
+			), func(r *roko.Retrier) error {
+				var err error
+				if blobStore != nil {
+					err = a.uploadBlob(ctx, uploader, blobStore, blobRefFile, artifact)
+				} else {
+					err = uploader.Upload(ctx, artifact)
+				}
+				if err != nil {
 					a.logger.Warn("%s (%s)", err, r)
 					return err
 				}
@@ -579,6 +646,10 @@ func (a *ArtifactUploader) upload(ctx context.Context, artifacts []*api.Artifact
 	// Wait for the pool to finish
 	p.Wait()
 
+	if pu, ok := uploader.(partialUploader); ok {
+		pu.AbortPartialUploads(context.WithoutCancel(ctx))
+	}
+
 	a.logger.Debug("Uploads complete, waiting for upload status to be sent to buildkite...")
 
 	// Wait for the statuses to finish uploading
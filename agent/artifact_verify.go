@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// What to do when a downloaded artifact doesn't match the checksum recorded
+// when it was uploaded.
+const (
+	// Download the artifact again, and fail if it still doesn't match
+	ArtifactVerifyRetry = "retry"
+
+	// Fail without downloading the artifact again
+	ArtifactVerifyFail = "fail"
+
+	// Log a warning, and keep the downloaded file
+	ArtifactVerifyWarn = "warn"
+)
+
+var ArtifactVerifyPolicies = []string{ArtifactVerifyRetry, ArtifactVerifyFail, ArtifactVerifyWarn}
+
+// How many times an artifact is downloaded with the retry policy, before
+// giving up on it matching its checksum
+const artifactVerifyAttempts = 3
+
+// artifactChecksumError is returned when a downloaded artifact doesn't match
+// its checksum.
+type artifactChecksumError struct {
+	path      string
+	algorithm string
+	got, want string
+}
+
+func (e *artifactChecksumError) Error() string {
+	return fmt.Sprintf("%s checksum of %s is %s, expected %s", e.algorithm, e.path, e.got, e.want)
+}
+
+// verifyArtifactChecksum checks a downloaded artifact against the SHA-256
+// checksum recorded when it was uploaded, or the SHA-1 checksum for artifacts
+// uploaded by older agents. It returns false if the artifact has no checksum
+// to verify.
+func verifyArtifactChecksum(path string, artifact *api.Artifact) (bool, error) {
+	var (
+		h         hash.Hash
+		algorithm string
+		want      string
+	)
+	switch {
+	case artifact.Sha256Sum != "":
+		h, algorithm, want = sha256.New(), "SHA-256", artifact.Sha256Sum
+	case artifact.Sha1Sum != "":
+		h, algorithm, want = sha1.New(), "SHA-1", artifact.Sha1Sum
+	default:
+		return false, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return true, err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return true, fmt.Errorf("reading %s to verify its checksum: %w", path, err)
+	}
+
+	if got := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(got, want) {
+		return true, &artifactChecksumError{
+			path:      artifact.Path,
+			algorithm: algorithm,
+			got:       got,
+			want:      want,
+		}
+	}
+	return true, nil
+}
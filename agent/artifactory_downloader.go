@@ -30,6 +30,12 @@ type ArtifactoryDownloaderConfig struct {
 
 	// If failed responses should be dumped to the log
 	DebugHTTP bool
+
+	// The size of the artifact, if known
+	Size int64
+
+	// Whether to give up without retrying if the artifact doesn't exist
+	FailFastIfMissing bool
 }
 
 type ArtifactoryDownloader struct {
@@ -70,12 +76,14 @@ func (d ArtifactoryDownloader) Start(ctx context.Context) error {
 
 	// We can now cheat and pass the URL onto our regular downloader
 	return NewDownload(d.logger, http.DefaultClient, DownloadConfig{
-		URL:         fullURL,
-		Path:        d.conf.Path,
-		Destination: d.conf.Destination,
-		Retries:     d.conf.Retries,
-		Headers:     headers,
-		DebugHTTP:   d.conf.DebugHTTP,
+		URL:               fullURL,
+		Path:              d.conf.Path,
+		Destination:       d.conf.Destination,
+		Retries:           d.conf.Retries,
+		Headers:           headers,
+		DebugHTTP:         d.conf.DebugHTTP,
+		Size:              d.conf.Size,
+		FailFastIfMissing: d.conf.FailFastIfMissing,
 	}).Start(ctx)
 }
 
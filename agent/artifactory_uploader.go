@@ -99,22 +99,32 @@ func (u *ArtifactoryUploader) URL(artifact *api.Artifact) string {
 	return url.String()
 }
 
+// Upload deploys the file to Artifactory in one request, which can't be
+// resumed, so a retry sends the whole file again.
 func (u *ArtifactoryUploader) Upload(_ context.Context, artifact *api.Artifact) error {
 	// Open file from filesystem
 	u.logger.Debug("Reading file \"%s\"", artifact.AbsolutePath)
-	f, err := os.Open(artifact.AbsolutePath)
+	f, err := openArtifactFile(artifact.AbsolutePath)
 	if err != nil {
 		return fmt.Errorf("failed to open file %q (%v)", artifact.AbsolutePath, err)
 	}
+	defer f.Close()
 
 	// Upload the file to Artifactory.
 	u.logger.Debug("Uploading \"%s\" to `%s`", artifact.Path, u.URL(artifact))
 
 	req, err := http.NewRequest("PUT", u.URL(artifact), f)
+	if err != nil {
+		return err
+	}
 	req.SetBasicAuth(u.user, u.password)
+
+	// The request can't tell the length of the bandwidth limited file
+	info, err := f.Stat()
 	if err != nil {
 		return err
 	}
+	req.ContentLength = info.Size()
 
 	md5Checksum, err := checksumFile(md5.New(), artifact.AbsolutePath)
 	if err != nil {
@@ -145,6 +155,8 @@ func (u *ArtifactoryUploader) Upload(_ context.Context, artifact *api.Artifact)
 	return nil
 }
 
+// checksumFile hashes a local file. It only reads from disk, so unlike the
+// upload itself, it isn't limited by the artifact bandwidth limit.
 func checksumFile(hasher hash.Hash, path string) (string, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -1,7 +1,18 @@
 package agent
 
 import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
 )
 
 func TestParseArtifactoryDestination(t *testing.T) {
@@ -26,3 +37,55 @@ func TestParseArtifactoryDestination(t *testing.T) {
 		}
 	}
 }
+
+// TestArtifactoryUploaderBandwidthLimit isn't parallel, because the limit
+// applies to the whole process.
+func TestArtifactoryUploaderBandwidthLimit(t *testing.T) {
+	data := bytes.Repeat([]byte("llamas"), 128*1024/6)
+
+	var got []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength != int64(len(data)) {
+			t.Errorf("request ContentLength = %d, want %d", r.ContentLength, len(data))
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("io.ReadAll(r.Body) error = %v", err)
+		}
+		got = body
+	}))
+	defer server.Close()
+
+	t.Setenv("BUILDKITE_ARTIFACTORY_URL", server.URL)
+	t.Setenv("BUILDKITE_ARTIFACTORY_USER", "llama")
+	t.Setenv("BUILDKITE_ARTIFACTORY_PASSWORD", "alpaca")
+
+	src := filepath.Join(t.TempDir(), "llamas.txt")
+	if err := os.WriteFile(src, data, 0o666); err != nil {
+		t.Fatalf("os.WriteFile(%q) error = %v", src, err)
+	}
+
+	uploader, err := NewArtifactoryUploader(logger.Discard, ArtifactoryUploaderConfig{
+		Destination: "rt://my-repo/some/prefix",
+	})
+	if err != nil {
+		t.Fatalf("NewArtifactoryUploader(...) error = %v", err)
+	}
+
+	SetArtifactBandwidthLimit(64 * 1024)
+	t.Cleanup(func() { SetArtifactBandwidthLimit(0) })
+
+	// The first 64KiB is the limiter's burst, and the next 64KiB should take
+	// about a second.
+	start := time.Now()
+	artifact := &api.Artifact{Path: "llamas.txt", AbsolutePath: src, FileSize: int64(len(data))}
+	if err := uploader.Upload(context.Background(), artifact); err != nil {
+		t.Fatalf("uploader.Upload(ctx, artifact) error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("uploading %d bytes at 64KiB/s took %v, want at least a second", len(data), elapsed)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("uploaded %d bytes, which don't match the %d byte file", len(got), len(data))
+	}
+}
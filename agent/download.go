@@ -2,13 +2,16 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httputil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/buildkite/agent/v3/logger"
@@ -34,8 +37,31 @@ type DownloadConfig struct {
 
 	// If failed responses should be dumped to the log
 	DebugHTTP bool
+
+	// Whether to give up without retrying if the file doesn't exist, for
+	// callers that probe for files that may not be there
+	FailFastIfMissing bool
+
+	// The size of the file, if it's known. Files larger than PartSize are
+	// downloaded in parts, in parallel, if the server supports range requests.
+	Size int64
+
+	// The size of each part of a ranged download (default 16 MiB)
+	PartSize int64
+
+	// How many parts of a ranged download to download at once (default 4)
+	Concurrency int
 }
 
+const (
+	defaultDownloadPartSize    = 16 * 1024 * 1024
+	defaultDownloadConcurrency = 4
+
+	// Files are downloaded to a partial file next to the target file, which
+	// is renamed into place once the download is complete.
+	downloadPartialSuffix = ".partial"
+)
+
 type Download struct {
 	// The download config
 	conf DownloadConfig
@@ -45,6 +71,33 @@ type Download struct {
 
 	// The HTTP client to use for downloading
 	client *http.Client
+
+	// Overrides how long to sleep between retries, for testing
+	retrySleepFunc func(time.Duration)
+}
+
+// downloadProgress tracks how much of a download has been written to the
+// partial file, so that retries resume where the previous attempt stopped
+// rather than starting again.
+type downloadProgress struct {
+	// For a streamed download, how many bytes have been written
+	written int64
+
+	// For a ranged download, the total size, and how many bytes of each part
+	// have been written
+	size  int64
+	parts []int64
+}
+
+func (p *downloadProgress) reset() {
+	*p = downloadProgress{}
+}
+
+func (p *downloadProgress) total() int64 {
+	if p.parts != nil {
+		return p.size
+	}
+	return p.written
 }
 
 func NewDownload(l logger.Logger, client *http.Client, c DownloadConfig) *Download {
@@ -56,16 +109,43 @@ func NewDownload(l logger.Logger, client *http.Client, c DownloadConfig) *Downlo
 }
 
 func (d Download) Start(ctx context.Context) error {
-	return roko.NewRetrier(
+	if d.conf.PartSize <= 0 {
+		d.conf.PartSize = defaultDownloadPartSize
+	}
+	if d.conf.Concurrency <= 0 {
+		d.conf.Concurrency = defaultDownloadConcurrency
+	}
+
+	targetFile := getTargetPath(d.conf.Path, d.conf.Destination)
+	partialFile := targetFile + downloadPartialSuffix
+
+	progress := &downloadProgress{}
+	err := doArtifactTransfer(ctx, roko.NewRetrier(
 		roko.WithMaxAttempts(d.conf.Retries),
 		roko.WithStrategy(roko.Constant(5*time.Second)),
-	).DoWithContext(ctx, func(r *roko.Retrier) error {
-		if err := d.try(ctx); err != nil {
+		roko.WithSleepFunc(d.retrySleepFunc),
+	), func(r *roko.Retrier) error {
+		if err := d.try(ctx, targetFile, partialFile, progress); err != nil {
 			d.logger.Warn("Error trying to download %s (%s) %s", d.conf.URL, err, r)
+			if d.conf.FailFastIfMissing && isMissing(err) {
+				r.Break()
+			}
 			return err
 		}
 		return nil
 	})
+	if err != nil {
+		os.Remove(partialFile)
+		return err
+	}
+
+	if err := os.Rename(partialFile, targetFile); err != nil {
+		os.Remove(partialFile)
+		return fmt.Errorf("Failed to move download into place at %s (%T: %v)", targetFile, err, err)
+	}
+
+	d.logger.Info("Successfully downloaded \"%s\" %s", d.conf.Path, humanize.IBytes(uint64(progress.total())))
+	return nil
 }
 
 func getTargetPath(path string, destination string) string {
@@ -98,30 +178,226 @@ func getTargetPath(path string, destination string) string {
 	return targetFile
 }
 
-func (d Download) try(ctx context.Context) error {
-	targetFile := getTargetPath(d.conf.Path, d.conf.Destination)
+func (d Download) try(ctx context.Context, targetFile, partialFile string, progress *downloadProgress) error {
 	targetDirectory, _ := filepath.Split(targetFile)
 
 	// Show a nice message that we're starting to download the file
 	d.logger.Debug("Downloading %s to %s", d.conf.URL, targetFile)
 
-	request, err := http.NewRequestWithContext(ctx, "GET", d.conf.URL, nil)
+	// Now make the folder for our file
+	// Actual file permissions will be reduced by umask, and won't be 0777 unless the user has manually changed the umask to 000
+	if err := os.MkdirAll(targetDirectory, 0777); err != nil {
+		return fmt.Errorf("Failed to create folder for %s (%T: %v)", targetFile, err, err)
+	}
+
+	f, err := os.OpenFile(partialFile, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return fmt.Errorf("Failed to create file %s (%T: %v)", partialFile, err, err)
+	}
+	defer f.Close()
+
+	switch {
+	case progress.parts != nil:
+		err = d.downloadParts(ctx, f, progress)
+
+	case progress.written == 0 && d.conf.Size > d.conf.PartSize && d.conf.Concurrency > 1:
+		err = d.startRanged(ctx, f, progress)
+
+	default:
+		err = d.downloadStream(ctx, f, progress)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("Failed to write file %s (%T: %v)", partialFile, err, err)
+	}
+
+	return nil
+}
+
+// downloadStream downloads the file in one request, continuing from where a
+// previous attempt stopped if the server supports it.
+func (d Download) downloadStream(ctx context.Context, f *os.File, progress *downloadProgress) error {
+	var rangeHeader string
+	if progress.written > 0 {
+		d.logger.Debug("Resuming download of %s from %d bytes", d.conf.URL, progress.written)
+		rangeHeader = fmt.Sprintf("bytes=%d-", progress.written)
+	}
+
+	response, err := d.get(ctx, rangeHeader)
+	if err != nil {
+		if errors.Is(err, errRangeNotSatisfiable) {
+			progress.reset()
+		}
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusPartialContent {
+		// The server sent the whole file, so start it again.
+		progress.written = 0
+	}
+	if err := f.Truncate(progress.written); err != nil {
+		return fmt.Errorf("Failed to truncate file %s (%T: %v)", f.Name(), err, err)
+	}
+
+	// Copy the data to the file
+	w := &countingWriter{w: io.NewOffsetWriter(f, progress.written), n: &progress.written}
+	if _, err := io.Copy(w, bandwidthLimitedReader{response.Body}); err != nil {
+		return fmt.Errorf("Error when copying data %s (%T: %v)", d.conf.URL, err, err)
+	}
+
+	if d.conf.Size > 0 && progress.written != d.conf.Size {
+		progress.reset()
+		return fmt.Errorf("downloaded %d bytes of %s, expected %d", progress.written, d.conf.URL, d.conf.Size)
+	}
+	return nil
+}
+
+// startRanged requests the first part of the file. If the server supports
+// range requests, the rest of the file is downloaded in parallel parts;
+// otherwise the response is used to download the whole file.
+func (d Download) startRanged(ctx context.Context, f *os.File, progress *downloadProgress) error {
+	response, err := d.get(ctx, fmt.Sprintf("bytes=0-%d", d.conf.PartSize-1))
 	if err != nil {
 		return err
 	}
+
+	size, ok := contentRangeSize(response)
+	if !ok {
+		response.Body.Close()
+		d.logger.Debug("%s doesn't support range requests, downloading it in one request", d.conf.URL)
+		return d.downloadStream(ctx, f, progress)
+	}
+
+	progress.size = size
+	progress.parts = make([]int64, (size+d.conf.PartSize-1)/d.conf.PartSize)
+	if err := f.Truncate(size); err != nil {
+		response.Body.Close()
+		return fmt.Errorf("Failed to allocate file %s (%T: %v)", f.Name(), err, err)
+	}
+
+	err = d.copyPart(f, response, 0, progress)
+	response.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	return d.downloadParts(ctx, f, progress)
+}
+
+// downloadParts downloads the parts of the file that haven't been downloaded
+// yet, in parallel.
+func (d Download) downloadParts(ctx context.Context, f *os.File, progress *downloadProgress) error {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	sem := make(chan struct{}, d.conf.Concurrency)
+
+	for i := range progress.parts {
+		start, end := d.partRange(i, progress)
+		if start > end {
+			continue // this part is complete
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			err := d.downloadPart(ctx, f, i, progress)
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if errors.Is(firstErr, errDownloadChanged) {
+		progress.reset()
+	}
+	return firstErr
+}
+
+func (d Download) downloadPart(ctx context.Context, f *os.File, i int, progress *downloadProgress) error {
+	start, end := d.partRange(i, progress)
+	response, err := d.get(ctx, fmt.Sprintf("bytes=%d-%d", start, end))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if size, ok := contentRangeSize(response); !ok || size != progress.size {
+		return fmt.Errorf("part %d of %s: %w", i, d.conf.URL, errDownloadChanged)
+	}
+	return d.copyPart(f, response, i, progress)
+}
+
+// partRange returns the range of bytes still to download for part i.
+func (d Download) partRange(i int, progress *downloadProgress) (start, end int64) {
+	start = int64(i)*d.conf.PartSize + progress.parts[i]
+	end = min(int64(i+1)*d.conf.PartSize, progress.size) - 1
+	return start, end
+}
+
+func (d Download) copyPart(f *os.File, response *http.Response, i int, progress *downloadProgress) error {
+	start, end := d.partRange(i, progress)
+	w := &countingWriter{w: io.NewOffsetWriter(f, start), n: &progress.parts[i]}
+	n, err := io.Copy(w, io.LimitReader(bandwidthLimitedReader{response.Body}, end-start+1))
+	if err != nil {
+		return fmt.Errorf("Error when copying data %s (%T: %v)", d.conf.URL, err, err)
+	}
+	if n != end-start+1 {
+		return fmt.Errorf("Error when copying data %s: part %d ended after %d of %d bytes", d.conf.URL, i, n, end-start+1)
+	}
+	return nil
+}
+
+var (
+	errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+	// The file changed between requests, or the server stopped honouring
+	// range requests. Either way, the download has to start again.
+	errDownloadChanged = errors.New("the server didn't return the requested range")
+)
+
+// get requests the file (or a range of it) and checks the response status.
+func (d Download) get(ctx context.Context, rangeHeader string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", d.conf.URL, nil)
+	if err != nil {
+		return nil, err
+	}
 	for k, v := range d.conf.Headers {
 		request.Header.Add(k, v)
 	}
+	if rangeHeader != "" {
+		request.Header.Set("Range", rangeHeader)
+	}
 
-	// Start by downloading the file
 	response, err := d.client.Do(request)
 	if err != nil {
-		return fmt.Errorf("Error while downloading %s (%T: %v)", d.conf.URL, err, err)
+		return nil, fmt.Errorf("Error while downloading %s (%T: %v)", d.conf.URL, err, err)
+	}
+
+	if response.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		response.Body.Close()
+		return nil, errRangeNotSatisfiable
 	}
-	defer response.Body.Close()
 
 	// Double check the status
 	if response.StatusCode/100 != 2 && response.StatusCode/100 != 3 {
+		defer response.Body.Close()
 		if d.conf.DebugHTTP {
 			responseDump, err := httputil.DumpResponse(response, true)
 			if err != nil {
@@ -131,37 +407,37 @@ func (d Download) try(ctx context.Context) error {
 			}
 		}
 
-		return &downloadError{response.Status}
+		return nil, newArtifactHTTPError(response.Status, response)
 	}
 
-	// Now make the folder for our file
-	// Actual file permissions will be reduced by umask, and won't be 0777 unless the user has manually changed the umask to 000
-	if err := os.MkdirAll(targetDirectory, 0777); err != nil {
-		return fmt.Errorf("Failed to create folder for %s (%T: %v)", targetFile, err, err)
-	}
+	return response, nil
+}
 
-	// Create a file to handle the file
-	fileBuffer, err := os.Create(targetFile)
-	if err != nil {
-		return fmt.Errorf("Failed to create file %s (%T: %v)", targetFile, err, err)
+// contentRangeSize returns the size of the whole file from a partial content
+// response, e.g. 1000 for "Content-Range: bytes 0-99/1000".
+func contentRangeSize(response *http.Response) (int64, bool) {
+	if response.StatusCode != http.StatusPartialContent {
+		return 0, false
 	}
-	defer fileBuffer.Close()
-
-	// Copy the data to the file
-	bytes, err := io.Copy(fileBuffer, response.Body)
+	_, size, ok := strings.Cut(response.Header.Get("Content-Range"), "/")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(size, 10, 64)
 	if err != nil {
-		return fmt.Errorf("Error when copying data %s (%T: %v)", d.conf.URL, err, err)
+		return 0, false
 	}
-
-	d.logger.Info("Successfully downloaded \"%s\" %s", d.conf.Path, humanize.IBytes(uint64(bytes)))
-
-	return nil
+	return n, true
 }
 
-type downloadError struct {
-	s string
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n *int64
 }
 
-func (e *downloadError) Error() string {
-	return e.s
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	*c.n += int64(n)
+	return n, err
 }
@@ -4,8 +4,21 @@
 package agent
 
 import (
-	"github.com/stretchr/testify/assert"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestGetTargetPath(t *testing.T) {
@@ -51,3 +64,175 @@ func TestGetTargetPath(t *testing.T) {
 	assert.Equal(t, "foo/app/logs/a.log", getTargetPath("app/logs/a.log", "foo/app"))
 	assert.Equal(t, "app/logs/a.log", getTargetPath("app/logs/a.log", "."))
 }
+
+// downloadTestServer serves content, supporting range requests, and records
+// the Range header of each request.
+type downloadTestServer struct {
+	content []byte
+
+	// If set, the first response is cut off after this many bytes
+	cutOffAfter int
+
+	mu     sync.Mutex
+	ranges []string
+}
+
+func (s *downloadTestServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	s.ranges = append(s.ranges, req.Header.Get("Range"))
+	first := len(s.ranges) == 1
+	s.mu.Unlock()
+
+	if first && s.cutOffAfter > 0 {
+		rw.Header().Set("Content-Length", fmt.Sprint(len(s.content)))
+		rw.Write(s.content[:s.cutOffAfter])
+		return
+	}
+	http.ServeContent(rw, req, "llamas.txt", time.Time{}, bytes.NewReader(s.content))
+}
+
+func TestDownloadInParallelParts(t *testing.T) {
+	t.Parallel()
+
+	content := bytes.Repeat([]byte("0123456789"), 10)
+	ts := &downloadTestServer{content: content}
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	dest := t.TempDir()
+	err := NewDownload(logger.Discard, http.DefaultClient, DownloadConfig{
+		URL:         server.URL,
+		Destination: dest,
+		Path:        "llamas.txt",
+		Retries:     1,
+		Size:        int64(len(content)),
+		PartSize:    16,
+		Concurrency: 3,
+	}).Start(context.Background())
+	if err != nil {
+		t.Fatalf("Download.Start() error = %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dest, "llamas.txt"))
+	if err != nil {
+		t.Fatalf("os.ReadFile(llamas.txt) error = %v", err)
+	}
+	if diff := cmp.Diff(got, content); diff != "" {
+		t.Errorf("downloaded content diff (-got +want):\n%s", diff)
+	}
+
+	// The first part is requested on its own, then the rest in parallel.
+	if got, want := ts.ranges[0], "bytes=0-15"; got != want {
+		t.Errorf("first request Range = %q, want %q", got, want)
+	}
+	if got, want := len(ts.ranges), 7; got != want {
+		t.Errorf("len(requests) = %d, want %d (ranges: %q)", got, want, ts.ranges)
+	}
+}
+
+func TestDownloadResumesAfterFailure(t *testing.T) {
+	t.Parallel()
+
+	content := bytes.Repeat([]byte("0123456789"), 10)
+	ts := &downloadTestServer{content: content, cutOffAfter: 40}
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	dest := t.TempDir()
+	d := NewDownload(logger.Discard, http.DefaultClient, DownloadConfig{
+		URL:         server.URL,
+		Destination: dest,
+		Path:        "llamas.txt",
+		Retries:     3,
+		Size:        int64(len(content)),
+	})
+	d.retrySleepFunc = func(time.Duration) {}
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Download.Start() error = %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dest, "llamas.txt"))
+	if err != nil {
+		t.Fatalf("os.ReadFile(llamas.txt) error = %v", err)
+	}
+	if diff := cmp.Diff(got, content); diff != "" {
+		t.Errorf("downloaded content diff (-got +want):\n%s", diff)
+	}
+	if diff := cmp.Diff(ts.ranges, []string{"", "bytes=40-"}); diff != "" {
+		t.Errorf("request ranges diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestDownloadRetriesMissingFiles(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		status            int
+		failFastIfMissing bool
+		wantRequests      int32
+	}{
+		{status: http.StatusNotFound, failFastIfMissing: false, wantRequests: 3},
+		{status: http.StatusForbidden, failFastIfMissing: false, wantRequests: 3},
+		{status: http.StatusNotFound, failFastIfMissing: true, wantRequests: 1},
+		{status: http.StatusForbidden, failFastIfMissing: true, wantRequests: 1},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(fmt.Sprintf("%d/FailFastIfMissing=%t", test.status, test.failFastIfMissing), func(t *testing.T) {
+			t.Parallel()
+
+			var requests atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				w.WriteHeader(test.status)
+			}))
+			defer server.Close()
+
+			d := NewDownload(logger.Discard, http.DefaultClient, DownloadConfig{
+				URL:               server.URL,
+				Destination:       t.TempDir(),
+				Path:              "llamas.txt",
+				Retries:           3,
+				FailFastIfMissing: test.failFastIfMissing,
+			})
+			d.retrySleepFunc = func(time.Duration) {}
+			if err := d.Start(context.Background()); err == nil {
+				t.Errorf("Download.Start() error = %v, want an error", err)
+			}
+			if got := requests.Load(); got != test.wantRequests {
+				t.Errorf("requests = %d, want %d", got, test.wantRequests)
+			}
+		})
+	}
+}
+
+func TestDownloadSizeMismatch(t *testing.T) {
+	t.Parallel()
+
+	content := []byte("llamas")
+	server := httptest.NewServer(&downloadTestServer{content: content})
+	defer server.Close()
+
+	dest := t.TempDir()
+	d := NewDownload(logger.Discard, http.DefaultClient, DownloadConfig{
+		URL:         server.URL,
+		Destination: dest,
+		Path:        "llamas.txt",
+		Retries:     2,
+		Size:        int64(len("alpacas")),
+	})
+	d.retrySleepFunc = func(time.Duration) {}
+	if err := d.Start(context.Background()); err == nil {
+		t.Errorf("Download.Start() error = %v, want a size mismatch error", err)
+	}
+
+	// Neither the file nor the partial download should be left behind.
+	entries, err := os.ReadDir(dest)
+	if err != nil {
+		t.Fatalf("os.ReadDir(%q) error = %v", dest, err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("os.ReadDir(%q) = %v, want no files", dest, entries)
+	}
+}
@@ -0,0 +1,258 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/roko"
+)
+
+// Artifact plugins are external programs that store artifacts, so that
+// artifacts can be kept in places the agent doesn't support natively. An
+// exec://<name>/<prefix> destination uses the plugin called
+// buildkite-agent-artifact-<name>, found in PATH.
+//
+// The agent runs the plugin once per artifact, with the operation ("upload" or
+// "download") as its only argument. The agent writes an execArtifactRequest as
+// JSON to the plugin's stdin. The plugin may write an execArtifactResponse as
+// JSON to its stdout. The operation fails if the plugin exits non-zero or
+// responds with an error.
+//
+// The agent can't limit how fast a plugin transfers artifacts, so it passes on
+// the artifact bandwidth limit (--bandwidth-limit), for the plugin to respect.
+const execArtifactPluginPrefix = "buildkite-agent-artifact-"
+
+// execArtifactRequest is sent to an artifact plugin.
+type execArtifactRequest struct {
+	// "upload" or "download"
+	Operation string `json:"operation"`
+
+	// The upload destination, e.g. exec://sftp/some/prefix
+	Destination string `json:"destination"`
+
+	// Where the artifact is stored, i.e. its path after the prefix
+	Key string `json:"key"`
+
+	// The artifact's path, relative to the working directory it was
+	// uploaded from
+	Path string `json:"path"`
+
+	// The local file to upload from, or download to
+	File string `json:"file"`
+
+	// Details of the artifact being uploaded
+	ContentType string `json:"content_type,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	SHA1        string `json:"sha1,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+
+	// The artifact bandwidth limit in bytes per second, if there is one.
+	// It's shared by all the artifacts being transferred at once.
+	BandwidthLimit int64 `json:"bandwidth_limit,omitempty"`
+}
+
+// execArtifactResponse is optionally sent back by an artifact plugin.
+type execArtifactResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+// parseExecArtifactDestination splits an exec:// destination into the plugin
+// name and the prefix within the plugin's storage.
+func parseExecArtifactDestination(destination string) (name, prefix string, err error) {
+	rest, ok := strings.CutPrefix(destination, "exec://")
+	if !ok {
+		return "", "", fmt.Errorf("%q is not an exec:// destination", destination)
+	}
+	name, prefix, _ = strings.Cut(rest, "/")
+	if name == "" {
+		return "", "", fmt.Errorf("exec:// destination %q has no plugin name", destination)
+	}
+	return name, strings.Trim(prefix, "/"), nil
+}
+
+// execArtifactKey joins the prefix and artifact path into a key.
+func execArtifactKey(prefix, path string) string {
+	path = strings.TrimPrefix(filepath.ToSlash(path), "/")
+	if prefix == "" {
+		return path
+	}
+	return prefix + "/" + path
+}
+
+// runExecArtifactPlugin runs an artifact plugin with the request.
+func runExecArtifactPlugin(ctx context.Context, l logger.Logger, name string, req execArtifactRequest) error {
+	bin, err := exec.LookPath(execArtifactPluginPrefix + name)
+	if err != nil {
+		return fmt.Errorf("finding artifact plugin %q: %w", name, err)
+	}
+
+	input, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("encoding artifact plugin request: %w", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, bin, req.Operation)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	l.Debug("[ExecArtifactPlugin] Running %s %s for %s", bin, req.Operation, req.Key)
+	runErr := cmd.Run()
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		l.Debug("[ExecArtifactPlugin] %s: %s", name, msg)
+	}
+
+	var resp execArtifactResponse
+	if out := bytes.TrimSpace(stdout.Bytes()); len(out) > 0 {
+		if err := json.Unmarshal(out, &resp); err != nil && runErr == nil {
+			return fmt.Errorf("decoding artifact plugin %q response: %w", name, err)
+		}
+	}
+
+	switch {
+	case resp.Error != "":
+		return fmt.Errorf("artifact plugin %q failed to %s %s: %s", name, req.Operation, req.Key, resp.Error)
+	case runErr != nil:
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("artifact plugin %q failed to %s %s: %w: %s", name, req.Operation, req.Key, runErr, msg)
+		}
+		return fmt.Errorf("artifact plugin %q failed to %s %s: %w", name, req.Operation, req.Key, runErr)
+	}
+	return nil
+}
+
+type ExecUploaderConfig struct {
+	// The destination, which includes the plugin name and the prefix, e.g.
+	// exec://sftp/some/prefix
+	Destination string
+}
+
+// ExecUploader uploads artifacts with an artifact plugin.
+type ExecUploader struct {
+	// The plugin name and prefix, from the destination
+	PluginName string
+	Prefix     string
+
+	// The configuration
+	conf ExecUploaderConfig
+
+	// The logger instance to use
+	logger logger.Logger
+}
+
+func NewExecUploader(l logger.Logger, c ExecUploaderConfig) (*ExecUploader, error) {
+	name, prefix, err := parseExecArtifactDestination(c.Destination)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := exec.LookPath(execArtifactPluginPrefix + name); err != nil {
+		return nil, fmt.Errorf("finding artifact plugin %q: %w", name, err)
+	}
+	return &ExecUploader{
+		PluginName: name,
+		Prefix:     prefix,
+		conf:       c,
+		logger:     l,
+	}, nil
+}
+
+func (u *ExecUploader) URL(artifact *api.Artifact) string {
+	return "exec://" + u.PluginName + "/" + execArtifactKey(u.Prefix, artifact.Path)
+}
+
+func (u *ExecUploader) Upload(ctx context.Context, artifact *api.Artifact) error {
+	return runExecArtifactPlugin(ctx, u.logger, u.PluginName, execArtifactRequest{
+		Operation:      "upload",
+		Destination:    u.conf.Destination,
+		Key:            execArtifactKey(u.Prefix, artifact.Path),
+		Path:           artifact.Path,
+		File:           artifact.AbsolutePath,
+		ContentType:    artifact.ContentType,
+		Size:           artifact.FileSize,
+		SHA1:           artifact.Sha1Sum,
+		SHA256:         artifact.Sha256Sum,
+		BandwidthLimit: artifactBandwidthLimit(),
+	})
+}
+
+type ExecDownloaderConfig struct {
+	// The destination the artifact was uploaded to, e.g.
+	// exec://sftp/some/prefix
+	Source string
+
+	// The root directory of the download
+	Destination string
+
+	// The relative path that should be preserved in the download folder,
+	// also its location after the prefix
+	Path string
+
+	// How many times should it retry the download before giving up
+	Retries int
+}
+
+// ExecDownloader downloads artifacts with an artifact plugin.
+type ExecDownloader struct {
+	// The download config
+	conf ExecDownloaderConfig
+
+	// The logger instance to use
+	logger logger.Logger
+}
+
+func NewExecDownloader(l logger.Logger, c ExecDownloaderConfig) *ExecDownloader {
+	return &ExecDownloader{
+		logger: l,
+		conf:   c,
+	}
+}
+
+func (d ExecDownloader) Start(ctx context.Context) error {
+	name, prefix, err := parseExecArtifactDestination(d.conf.Source)
+	if err != nil {
+		return err
+	}
+
+	targetFile := getTargetPath(d.conf.Path, d.conf.Destination)
+
+	// Actual file permissions will be reduced by umask, and won't be 0777 unless the user has manually changed the umask to 000
+	if err := os.MkdirAll(filepath.Dir(targetFile), 0777); err != nil {
+		return fmt.Errorf("Failed to create folder for %s (%T: %v)", targetFile, err, err)
+	}
+
+	req := execArtifactRequest{
+		Operation:      "download",
+		Destination:    d.conf.Source,
+		Key:            execArtifactKey(prefix, d.conf.Path),
+		Path:           d.conf.Path,
+		File:           targetFile,
+		BandwidthLimit: artifactBandwidthLimit(),
+	}
+
+	err = roko.NewRetrier(
+		roko.WithMaxAttempts(d.conf.Retries),
+		roko.WithStrategy(roko.Constant(5*time.Second)),
+	).DoWithContext(ctx, func(r *roko.Retrier) error {
+		if err := runExecArtifactPlugin(ctx, d.logger, name, req); err != nil {
+			d.logger.Warn("%s (%s)", err, r)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	d.logger.Info("Successfully downloaded \"%s\"", d.conf.Path)
+	return nil
+}
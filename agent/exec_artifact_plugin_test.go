@@ -0,0 +1,156 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/google/go-cmp/cmp"
+)
+
+// When the test binary is run as an artifact plugin (via a symlink), it acts
+// as a plugin storing artifacts in the directory $FAKE_ARTIFACT_STORE.
+func init() {
+	if !strings.HasPrefix(filepath.Base(os.Args[0]), execArtifactPluginPrefix) {
+		return
+	}
+	if err := fakeArtifactPlugin(os.Args[1], os.Getenv("FAKE_ARTIFACT_STORE")); err != nil {
+		json.NewEncoder(os.Stdout).Encode(execArtifactResponse{Error: err.Error()})
+	}
+	os.Exit(0)
+}
+
+func fakeArtifactPlugin(op, store string) error {
+	var req execArtifactRequest
+	if err := json.NewDecoder(os.Stdin).Decode(&req); err != nil {
+		return err
+	}
+	if req.Operation != op {
+		return fmt.Errorf("operation %q doesn't match argument %q", req.Operation, op)
+	}
+
+	stored := filepath.Join(store, filepath.FromSlash(req.Key))
+	switch op {
+	case "upload":
+		if err := os.MkdirAll(filepath.Dir(stored), 0o777); err != nil {
+			return err
+		}
+		return copyFile(req.File, stored)
+	case "download":
+		return copyFile(stored, req.File)
+	default:
+		return fmt.Errorf("unknown operation %q", op)
+	}
+}
+
+func copyFile(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+func TestExecArtifactPlugin(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake plugin is installed with a symlink")
+	}
+	ctx := context.Background()
+
+	// Install the test binary as the "fake" artifact plugin.
+	binDir := t.TempDir()
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatalf("os.Executable() error = %v", err)
+	}
+	if err := os.Symlink(self, filepath.Join(binDir, execArtifactPluginPrefix+"fake")); err != nil {
+		t.Fatalf("os.Symlink(...) error = %v", err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	store := t.TempDir()
+	t.Setenv("FAKE_ARTIFACT_STORE", store)
+
+	src := filepath.Join(t.TempDir(), "llamas.txt")
+	if err := os.WriteFile(src, []byte("llamas"), 0o666); err != nil {
+		t.Fatalf("os.WriteFile(%q) error = %v", src, err)
+	}
+
+	const destination = "exec://fake/some/prefix"
+	backend, ok := artifactBackendFor(destination)
+	if !ok {
+		t.Fatalf("artifactBackendFor(%q) found no backend", destination)
+	}
+
+	uploader, err := backend.NewUploader(logger.Discard, ArtifactBackendUploaderConfig{Destination: destination})
+	if err != nil {
+		t.Fatalf("backend.NewUploader(...) error = %v", err)
+	}
+	artifact := &api.Artifact{Path: "pkg/llamas.txt", AbsolutePath: src, FileSize: 6}
+	if got, want := uploader.URL(artifact), "exec://fake/some/prefix/pkg/llamas.txt"; got != want {
+		t.Errorf("uploader.URL(artifact) = %q, want %q", got, want)
+	}
+	if err := uploader.Upload(ctx, artifact); err != nil {
+		t.Fatalf("uploader.Upload(ctx, artifact) error = %v", err)
+	}
+
+	stored, err := os.ReadFile(filepath.Join(store, "some", "prefix", "pkg", "llamas.txt"))
+	if err != nil {
+		t.Fatalf("reading stored artifact: %v", err)
+	}
+	if diff := cmp.Diff(string(stored), "llamas"); diff != "" {
+		t.Errorf("stored artifact diff (-got +want):\n%s", diff)
+	}
+
+	dest := t.TempDir()
+	downloader, err := backend.NewDownloader(logger.Discard, ArtifactBackendDownloaderConfig{
+		Source:      destination,
+		Path:        "pkg/llamas.txt",
+		Destination: dest,
+		Retries:     1,
+	})
+	if err != nil {
+		t.Fatalf("backend.NewDownloader(...) error = %v", err)
+	}
+	if err := downloader.Start(ctx); err != nil {
+		t.Fatalf("downloader.Start(ctx) error = %v", err)
+	}
+	downloaded, err := os.ReadFile(filepath.Join(dest, "pkg", "llamas.txt"))
+	if err != nil {
+		t.Fatalf("reading downloaded artifact: %v", err)
+	}
+	if diff := cmp.Diff(string(downloaded), "llamas"); diff != "" {
+		t.Errorf("downloaded artifact diff (-got +want):\n%s", diff)
+	}
+
+	// A missing artifact is reported by the plugin.
+	downloader, err = backend.NewDownloader(logger.Discard, ArtifactBackendDownloaderConfig{
+		Source:      destination,
+		Path:        "pkg/alpacas.txt",
+		Destination: dest,
+		Retries:     1,
+	})
+	if err != nil {
+		t.Fatalf("backend.NewDownloader(...) error = %v", err)
+	}
+	if err := downloader.Start(ctx); err == nil {
+		t.Errorf("downloader.Start(ctx) error = %v, want an error for a missing artifact", err)
+	}
+}
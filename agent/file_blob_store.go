@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileBlobStore is a blob store in a directory.
+type FileBlobStore struct {
+	// The directory the blob store is in
+	Directory string
+}
+
+func NewFileBlobStore(destination string) (*FileBlobStore, error) {
+	dir, err := ParseFileDestination(destination)
+	if err != nil {
+		return nil, err
+	}
+	return &FileBlobStore{Directory: dir}, nil
+}
+
+func (s *FileBlobStore) Exists(_ context.Context, key string) (bool, error) {
+	_, err := os.Stat(filepath.Join(s.Directory, filepath.FromSlash(key)))
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, os.ErrNotExist):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func (s *FileBlobStore) List(_ context.Context, prefix string) ([]BlobStoreObject, error) {
+	// Walk the deepest directory the prefix names, and filter by the rest.
+	dir := prefix[:strings.LastIndex(prefix, "/")+1]
+
+	var objects []BlobStoreObject
+	err := filepath.WalkDir(filepath.Join(s.Directory, filepath.FromSlash(dir)), func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.Directory, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		// Skip files being written by FileUploader, and other prefixes.
+		if !strings.HasPrefix(key, prefix) || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, BlobStoreObject{
+			Key:     key,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+		return nil
+	})
+	return objects, err
+}
+
+func (s *FileBlobStore) Delete(_ context.Context, key string) error {
+	p := filepath.Join(s.Directory, filepath.FromSlash(key))
+	if err := os.Remove(p); err != nil {
+		return err
+	}
+
+	// Tidy up the directory if it's now empty, which fails harmlessly if not.
+	os.Remove(filepath.Dir(p))
+	return nil
+}
@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/dustin/go-humanize"
+)
+
+type FileDownloaderConfig struct {
+	// The destination the artifact was uploaded to, e.g.
+	// file:///mnt/artifacts/foo/bar
+	Source string
+
+	// The root directory of the download
+	Destination string
+
+	// The relative path that should be preserved in the download folder,
+	// also its location in the source directory
+	Path string
+}
+
+// FileDownloader downloads artifacts by copying them out of a directory.
+type FileDownloader struct {
+	// The download config
+	conf FileDownloaderConfig
+
+	// The logger instance to use
+	logger logger.Logger
+}
+
+func NewFileDownloader(l logger.Logger, c FileDownloaderConfig) *FileDownloader {
+	return &FileDownloader{
+		logger: l,
+		conf:   c,
+	}
+}
+
+func (d FileDownloader) Start(ctx context.Context) error {
+	dir, err := ParseFileDestination(d.conf.Source)
+	if err != nil {
+		return err
+	}
+	source := filepath.Join(dir, filepath.FromSlash(d.conf.Path))
+	targetFile := getTargetPath(d.conf.Path, d.conf.Destination)
+
+	d.logger.Debug("Copying %s to %s", source, targetFile)
+
+	// Actual file permissions will be reduced by umask, and won't be 0777 unless the user has manually changed the umask to 000
+	if err := os.MkdirAll(filepath.Dir(targetFile), 0777); err != nil {
+		return fmt.Errorf("Failed to create folder for %s (%T: %v)", targetFile, err, err)
+	}
+	if err := copyFileAtomic(source, targetFile); err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(targetFile); err == nil {
+		d.logger.Info("Successfully downloaded \"%s\" %s", d.conf.Path, humanize.IBytes(uint64(info.Size())))
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+type FileUploaderConfig struct {
+	// The destination, which is a directory (such as a shared NFS mount) and
+	// an optional prefix, e.g. file:///mnt/artifacts/foo/bar
+	Destination string
+
+	// The URL the directory is served from, if any. Artifact URLs registered
+	// with Buildkite are based on it. Defaults to
+	// $BUILDKITE_ARTIFACT_PUBLIC_URL.
+	PublicURL string
+}
+
+// FileUploader uploads artifacts by copying them into a directory.
+type FileUploader struct {
+	// The directory set from the destination
+	Directory string
+
+	// The configuration
+	conf FileUploaderConfig
+
+	// The logger instance to use
+	logger logger.Logger
+}
+
+func NewFileUploader(l logger.Logger, c FileUploaderConfig) (*FileUploader, error) {
+	dir, err := ParseFileDestination(c.Destination)
+	if err != nil {
+		return nil, err
+	}
+	if c.PublicURL == "" {
+		c.PublicURL = os.Getenv("BUILDKITE_ARTIFACT_PUBLIC_URL")
+	}
+	return &FileUploader{
+		Directory: dir,
+		conf:      c,
+		logger:    l,
+	}, nil
+}
+
+// ParseFileDestination returns the directory in a file:// destination.
+func ParseFileDestination(destination string) (string, error) {
+	dir, ok := strings.CutPrefix(destination, "file://")
+	if !ok {
+		return "", fmt.Errorf("%q is not a file:// destination", destination)
+	}
+	dir = filepath.FromSlash(dir)
+	// file:///C:/artifacts is C:\artifacts on Windows
+	if vol := filepath.VolumeName(strings.TrimPrefix(dir, string(filepath.Separator))); vol != "" {
+		dir = strings.TrimPrefix(dir, string(filepath.Separator))
+	}
+	if !filepath.IsAbs(dir) {
+		return "", fmt.Errorf("file:// destination %q must be an absolute path", destination)
+	}
+	return filepath.Clean(dir), nil
+}
+
+func (u *FileUploader) URL(artifact *api.Artifact) string {
+	if u.conf.PublicURL != "" {
+		return publicArtifactURL(u.conf.PublicURL, artifact.Path)
+	}
+	return (&url.URL{
+		Scheme: "file",
+		Path:   path.Join(filepath.ToSlash(u.Directory), filepath.ToSlash(artifact.Path)),
+	}).String()
+}
+
+func (u *FileUploader) Upload(_ context.Context, artifact *api.Artifact) error {
+	target := filepath.Join(u.Directory, filepath.FromSlash(artifact.Path))
+	u.logger.Debug("Copying \"%s\" to %s", artifact.Path, target)
+
+	// Actual file permissions will be reduced by umask, and won't be 0777 unless the user has manually changed the umask to 000
+	if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+		return fmt.Errorf("failed to create directory for %s (%v)", target, err)
+	}
+	return copyFileAtomic(artifact.AbsolutePath, target)
+}
+
+// copyFileAtomic copies a file. The copy is written to a temporary file that
+// is renamed into place, so that readers never see a partial file.
+func copyFileAtomic(from, to string) error {
+	src, err := openArtifactFile(from)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q (%v)", from, err)
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(to), "."+filepath.Base(to)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op after a successful rename
+
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to copy %q to %q (%v)", from, to, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// CreateTemp creates files with mode 0600, but the artifact should be
+	// readable by whoever can read the directory.
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), to)
+}
+
+// publicArtifactURL joins a public base URL and an artifact path.
+func publicArtifactURL(base, artifactPath string) string {
+	u, err := url.Parse(base)
+	if err != nil {
+		return strings.TrimSuffix(base, "/") + "/" + filepath.ToSlash(artifactPath)
+	}
+	return u.JoinPath(strings.Split(filepath.ToSlash(artifactPath), "/")...).String()
+}
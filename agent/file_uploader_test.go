@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFileUploaderAndDownloader(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	src := filepath.Join(t.TempDir(), "llamas.txt")
+	if err := os.WriteFile(src, []byte("llamas"), 0o666); err != nil {
+		t.Fatalf("os.WriteFile(%q) error = %v", src, err)
+	}
+
+	store := t.TempDir()
+	destination := "file://" + filepath.ToSlash(filepath.Join(store, "some", "prefix"))
+	if runtime.GOOS == "windows" {
+		destination = "file:///" + filepath.ToSlash(filepath.Join(store, "some", "prefix"))
+	}
+
+	uploader, err := NewFileUploader(logger.Discard, FileUploaderConfig{
+		Destination: destination,
+		PublicURL:   "https://nfs.example.com/artifacts/",
+	})
+	if err != nil {
+		t.Fatalf("NewFileUploader(...) error = %v", err)
+	}
+
+	artifact := &api.Artifact{Path: "pkg/llamas and alpacas.txt", AbsolutePath: src}
+	if got, want := uploader.URL(artifact), "https://nfs.example.com/artifacts/pkg/llamas%20and%20alpacas.txt"; got != want {
+		t.Errorf("uploader.URL(artifact) = %q, want %q", got, want)
+	}
+	if err := uploader.Upload(ctx, artifact); err != nil {
+		t.Fatalf("uploader.Upload(ctx, artifact) error = %v", err)
+	}
+
+	stored, err := os.ReadFile(filepath.Join(store, "some", "prefix", "pkg", "llamas and alpacas.txt"))
+	if err != nil {
+		t.Fatalf("reading stored artifact: %v", err)
+	}
+	if diff := cmp.Diff(string(stored), "llamas"); diff != "" {
+		t.Errorf("stored artifact diff (-got +want):\n%s", diff)
+	}
+
+	dest := t.TempDir()
+	err = NewFileDownloader(logger.Discard, FileDownloaderConfig{
+		Source:      destination,
+		Path:        artifact.Path,
+		Destination: dest,
+	}).Start(ctx)
+	if err != nil {
+		t.Fatalf("FileDownloader.Start(ctx) error = %v", err)
+	}
+	downloaded, err := os.ReadFile(filepath.Join(dest, "pkg", "llamas and alpacas.txt"))
+	if err != nil {
+		t.Fatalf("reading downloaded artifact: %v", err)
+	}
+	if diff := cmp.Diff(string(downloaded), "llamas"); diff != "" {
+		t.Errorf("downloaded artifact diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestParseFileDestination(t *testing.T) {
+	t.Parallel()
+
+	if _, err := ParseFileDestination("file://relative/path"); err == nil {
+		t.Errorf("ParseFileDestination(file://relative/path) error = %v, want an error", err)
+	}
+	if _, err := ParseFileDestination("s3://bucket"); err == nil {
+		t.Errorf("ParseFileDestination(s3://bucket) error = %v, want an error", err)
+	}
+}
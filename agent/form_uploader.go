@@ -16,7 +16,6 @@ import (
 	// "net/http/httputil"
 	"errors"
 	"net/url"
-	"os"
 
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/logger"
@@ -25,6 +24,8 @@ import (
 var ArtifactPathVariableRegex = regexp.MustCompile("\\$\\{artifact\\:path\\}")
 
 // FormUploader uploads to S3 as a single signed POST, which have a hard limit of 5Gb.
+// The POST can't be split into parts or resumed, so a retry sends the whole
+// file again.
 var maxFormUploadedArtifactSize = int64(5368709120)
 
 type FormUploaderConfig struct {
@@ -126,7 +127,7 @@ func (u *FormUploader) Upload(_ context.Context, artifact *api.Artifact) error {
 
 			// Return a custom error with the response body from the page
 			message := fmt.Sprintf("%s (%d)", body, response.StatusCode)
-			return errors.New(message)
+			return newArtifactHTTPError(message, response)
 		}
 	}
 
@@ -149,7 +150,7 @@ func createUploadRequest(l logger.Logger, artifact *api.Artifact) (*http.Request
 		}
 	}
 
-	fh, err := os.Open(artifact.AbsolutePath)
+	fh, err := openArtifactFile(artifact.AbsolutePath)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,39 @@
+package agent
+
+import (
+	"context"
+	"time"
+
+	"github.com/buildkite/agent/v3/internal/gitmirrors"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/dustin/go-humanize"
+)
+
+// maintainGitMirrors prunes and garbage collects the git mirrors every
+// maintenance interval, until the context is done.
+func maintainGitMirrors(ctx context.Context, l logger.Logger, conf AgentConfiguration) {
+	ticker := time.NewTicker(conf.GitMirrorsMaintenanceInterval)
+	defer ticker.Stop()
+
+	for {
+		l.Debug("Maintaining git mirrors in %s", conf.GitMirrorsPath)
+		result, err := gitmirrors.Prune(ctx, l, gitmirrors.PruneConfig{
+			Path:    conf.GitMirrorsPath,
+			MaxAge:  conf.GitMirrorsMaxAge,
+			MaxSize: int64(conf.GitMirrorsMaxSizeBytes),
+			GC:      true,
+		})
+		switch {
+		case err != nil:
+			l.Warn("Couldn't maintain git mirrors: %v", err)
+		case result.MirrorsRemoved > 0:
+			l.Info("Removed %d git mirrors (%s)", result.MirrorsRemoved, humanize.IBytes(uint64(result.BytesFreed)))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
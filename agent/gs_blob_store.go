@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+	"google.golang.org/api/googleapi"
+	storage "google.golang.org/api/storage/v1"
+)
+
+// GSBlobStore is a blob store in a Google Cloud Storage bucket.
+type GSBlobStore struct {
+	// The bucket, and the path within it, of the blob store
+	BucketName string
+	BucketPath string
+
+	service *storage.Service
+}
+
+func NewGSBlobStore(l logger.Logger, destination string) (*GSBlobStore, error) {
+	client, err := newGoogleClient(storage.DevstorageFullControlScope)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating Google Cloud Storage client: %v", err)
+	}
+	service, err := storage.New(client)
+	if err != nil {
+		return nil, err
+	}
+	bucketName, bucketPath := ParseGSDestination(destination)
+	return &GSBlobStore{
+		BucketName: bucketName,
+		BucketPath: bucketPath,
+		service:    service,
+	}, nil
+}
+
+func (s *GSBlobStore) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.service.Objects.Get(s.BucketName, path.Join(s.BucketPath, key)).Context(ctx).Do()
+	var apiErr *googleapi.Error
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func (s *GSBlobStore) List(ctx context.Context, prefix string) ([]BlobStoreObject, error) {
+	root := s.BucketPath
+	if root != "" {
+		root += "/"
+	}
+
+	var objects []BlobStoreObject
+	err := s.service.Objects.List(s.BucketName).Prefix(root+prefix).Pages(ctx, func(page *storage.Objects) error {
+		for _, obj := range page.Items {
+			modTime, err := time.Parse(time.RFC3339, obj.Updated)
+			if err != nil {
+				return fmt.Errorf("parsing update time of %s: %w", obj.Name, err)
+			}
+			objects = append(objects, BlobStoreObject{
+				Key:     obj.Name[len(root):],
+				Size:    int64(obj.Size),
+				ModTime: modTime,
+			})
+		}
+		return nil
+	})
+	return objects, err
+}
+
+func (s *GSBlobStore) Delete(ctx context.Context, key string) error {
+	return s.service.Objects.Delete(s.BucketName, path.Join(s.BucketPath, key)).Context(ctx).Do()
+}
@@ -26,6 +26,12 @@ type GSDownloaderConfig struct {
 
 	// If failed responses should be dumped to the log
 	DebugHTTP bool
+
+	// The size of the artifact, if known
+	Size int64
+
+	// Whether to give up without retrying if the artifact doesn't exist
+	FailFastIfMissing bool
 }
 
 type GSDownloader struct {
@@ -53,11 +59,13 @@ func (d GSDownloader) Start(ctx context.Context) error {
 
 	// We can now cheat and pass the URL onto our regular downloader
 	return NewDownload(d.logger, client, DownloadConfig{
-		URL:         url,
-		Path:        d.conf.Path,
-		Destination: d.conf.Destination,
-		Retries:     d.conf.Retries,
-		DebugHTTP:   d.conf.DebugHTTP,
+		URL:               url,
+		Path:              d.conf.Path,
+		Destination:       d.conf.Destination,
+		Retries:           d.conf.Retries,
+		DebugHTTP:         d.conf.DebugHTTP,
+		Size:              d.conf.Size,
+		FailFastIfMissing: d.conf.FailFastIfMissing,
 	}).Start(ctx)
 }
 
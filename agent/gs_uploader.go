@@ -119,7 +119,7 @@ func (u *GSUploader) URL(artifact *api.Artifact) string {
 	return artifactURL.String()
 }
 
-func (u *GSUploader) Upload(_ context.Context, artifact *api.Artifact) error {
+func (u *GSUploader) Upload(ctx context.Context, artifact *api.Artifact) error {
 	permission := os.Getenv("BUILDKITE_GS_ACL")
 
 	// The dirtiest validation method ever...
@@ -144,23 +144,30 @@ func (u *GSUploader) Upload(_ context.Context, artifact *api.Artifact) error {
 		ContentType:        artifact.ContentType,
 		ContentDisposition: u.contentDisposition(artifact),
 	}
-	file, err := os.Open(artifact.AbsolutePath)
+	file, err := openArtifactFile(artifact.AbsolutePath)
 	if err != nil {
 		return errors.New(fmt.Sprintf("Failed to open file \"%q\" (%v)", artifact.AbsolutePath, err))
 	}
-	call := u.service.Objects.Insert(u.BucketName, object)
+	defer file.Close()
+
+	call := u.service.Objects.Insert(u.BucketName, object).Context(ctx)
 	if permission != "" {
 		call = call.PredefinedAcl(permission)
 	}
-	if res, err := call.Media(file, googleapi.ContentType("")).Do(); err == nil {
+	// Large files are uploaded in chunks with a resumable upload, which
+	// retries each chunk rather than the whole file.
+	if res, err := call.Media(file, googleapi.ContentType(""), googleapi.ChunkSize(gsUploadChunkSize)).Do(); err == nil {
 		u.logger.Debug("Created object %v at location %v\n\n", res.Name, res.SelfLink)
 	} else {
-		return errors.New(fmt.Sprintf("Failed to PUT file \"%s\" (%v)", u.artifactPath(artifact), err))
+		return fmt.Errorf("Failed to PUT file \"%s\" (%w)", u.artifactPath(artifact), err)
 	}
 
 	return nil
 }
 
+// The size of each chunk of a resumable upload to Google Cloud Storage
+const gsUploadChunkSize = 16 * 1024 * 1024
+
 func (u *GSUploader) artifactPath(artifact *api.Artifact) string {
 	parts := []string{u.BucketPath, artifact.Path}
 
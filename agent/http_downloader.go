@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/buildkite/agent/v3/logger"
+)
+
+type HTTPDownloaderConfig struct {
+	// The destination the artifact was uploaded to, e.g.
+	// https://artifacts.example.com/foo/bar
+	Source string
+
+	// The root directory of the download
+	Destination string
+
+	// The relative path that should be preserved in the download folder,
+	// also its location under the source URL
+	Path string
+
+	// How many times should it retry the download before giving up
+	Retries int
+
+	// If failed responses should be dumped to the log
+	DebugHTTP bool
+
+	// The size of the artifact, if known
+	Size int64
+
+	// Whether to give up without retrying if the artifact doesn't exist
+	FailFastIfMissing bool
+}
+
+// HTTPDownloader downloads artifacts uploaded by HTTPUploader.
+type HTTPDownloader struct {
+	// The download config
+	conf HTTPDownloaderConfig
+
+	// The logger instance to use
+	logger logger.Logger
+}
+
+func NewHTTPDownloader(l logger.Logger, c HTTPDownloaderConfig) *HTTPDownloader {
+	return &HTTPDownloader{
+		logger: l,
+		conf:   c,
+	}
+}
+
+func (d HTTPDownloader) Start(ctx context.Context) error {
+	base, err := url.Parse(d.conf.Source)
+	if err != nil {
+		return fmt.Errorf("invalid artifact source %q: %w", d.conf.Source, err)
+	}
+
+	auth := make(http.Header)
+	addHTTPArtifactAuth(auth)
+	headers := map[string]string{}
+	if v := auth.Get("Authorization"); v != "" {
+		headers["Authorization"] = v
+	}
+
+	// We can now cheat and pass the URL onto our regular downloader
+	return NewDownload(d.logger, http.DefaultClient, DownloadConfig{
+		URL:               httpArtifactURL(base, d.conf.Path).String(),
+		Path:              d.conf.Path,
+		Destination:       d.conf.Destination,
+		Retries:           d.conf.Retries,
+		Headers:           headers,
+		DebugHTTP:         d.conf.DebugHTTP,
+		Size:              d.conf.Size,
+		FailFastIfMissing: d.conf.FailFastIfMissing,
+	}).Start(ctx)
+}
@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+type HTTPUploaderConfig struct {
+	// The destination, which is the base URL artifacts are PUT to, e.g.
+	// https://artifacts.example.com/foo/bar
+	Destination string
+
+	// The URL artifacts can be fetched from, if it is different to the
+	// destination. Artifact URLs registered with Buildkite are based on it.
+	// Defaults to $BUILDKITE_ARTIFACT_PUBLIC_URL.
+	PublicURL string
+
+	// Whether or not HTTP calls should be debugged
+	DebugHTTP bool
+}
+
+// HTTPUploader uploads artifacts with HTTP PUT requests, as supported by
+// WebDAV servers and many simple artifact servers.
+//
+// Requests are authenticated with a bearer token from
+// $BUILDKITE_ARTIFACT_HTTP_TOKEN, or basic auth credentials from
+// $BUILDKITE_ARTIFACT_HTTP_USER and $BUILDKITE_ARTIFACT_HTTP_PASSWORD, if set.
+type HTTPUploader struct {
+	// The base URL set from the destination
+	BaseURL *url.URL
+
+	// The client to use
+	client *http.Client
+
+	// The configuration
+	conf HTTPUploaderConfig
+
+	// The logger instance to use
+	logger logger.Logger
+}
+
+func NewHTTPUploader(l logger.Logger, c HTTPUploaderConfig) (*HTTPUploader, error) {
+	base, err := url.Parse(c.Destination)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upload destination %q: %w", c.Destination, err)
+	}
+	if c.PublicURL == "" {
+		c.PublicURL = os.Getenv("BUILDKITE_ARTIFACT_PUBLIC_URL")
+	}
+	return &HTTPUploader{
+		BaseURL: base,
+		client:  &http.Client{},
+		conf:    c,
+		logger:  l,
+	}, nil
+}
+
+// httpArtifactURL returns the URL of an artifact under a base URL.
+func httpArtifactURL(base *url.URL, artifactPath string) *url.URL {
+	return base.JoinPath(strings.Split(filepath.ToSlash(artifactPath), "/")...)
+}
+
+// addHTTPArtifactAuth adds credentials from the environment to a request.
+func addHTTPArtifactAuth(headers http.Header) {
+	if token := os.Getenv("BUILDKITE_ARTIFACT_HTTP_TOKEN"); token != "" {
+		headers.Set("Authorization", "Bearer "+token)
+		return
+	}
+	if user := os.Getenv("BUILDKITE_ARTIFACT_HTTP_USER"); user != "" {
+		headers.Set("Authorization", "Basic "+getBasicAuthHeader(user, os.Getenv("BUILDKITE_ARTIFACT_HTTP_PASSWORD")))
+	}
+}
+
+func (u *HTTPUploader) URL(artifact *api.Artifact) string {
+	if u.conf.PublicURL != "" {
+		return publicArtifactURL(u.conf.PublicURL, artifact.Path)
+	}
+	return httpArtifactURL(u.BaseURL, artifact.Path).String()
+}
+
+// Upload PUTs the file in one request. There's no standard way to upload to an
+// HTTP server in parts, so unlike S3 uploads, a retry sends the whole file
+// again.
+func (u *HTTPUploader) Upload(ctx context.Context, artifact *api.Artifact) error {
+	f, err := openArtifactFile(artifact.AbsolutePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q (%v)", artifact.AbsolutePath, err)
+	}
+	defer f.Close()
+
+	target := httpArtifactURL(u.BaseURL, artifact.Path)
+	u.logger.Debug("Uploading \"%s\" to `%s`", artifact.Path, target)
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", target.String(), f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = artifact.FileSize
+	if artifact.ContentType != "" {
+		req.Header.Set("Content-Type", artifact.ContentType)
+	}
+	addHTTPArtifactAuth(req.Header)
+
+	res, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		if u.conf.DebugHTTP {
+			if dump, err := httputil.DumpResponse(res, true); err == nil {
+				u.logger.Debug("\n%s", string(dump))
+			}
+		}
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return newArtifactHTTPError(fmt.Sprintf("uploading %s to %s: %s %s", artifact.Path, target, res.Status, strings.TrimSpace(string(body))), res)
+	}
+	return nil
+}
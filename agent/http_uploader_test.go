@@ -0,0 +1,109 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHTTPUploaderAndDownloader(t *testing.T) {
+	t.Setenv("BUILDKITE_ARTIFACT_HTTP_TOKEN", "llamas")
+	t.Setenv("BUILDKITE_ARTIFACT_PUBLIC_URL", "")
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	files := make(map[string][]byte)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if got, want := req.Header.Get("Authorization"), "Bearer llamas"; got != want {
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch req.Method {
+		case "PUT":
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			files[req.URL.Path] = body
+			rw.WriteHeader(http.StatusCreated)
+		case "GET":
+			body, ok := files[req.URL.Path]
+			if !ok {
+				http.Error(rw, "Not Found", http.StatusNotFound)
+				return
+			}
+			rw.Write(body)
+		default:
+			http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+	defer server.Close()
+
+	src := filepath.Join(t.TempDir(), "llamas.txt")
+	if err := os.WriteFile(src, []byte("llamas"), 0o666); err != nil {
+		t.Fatalf("os.WriteFile(%q) error = %v", src, err)
+	}
+
+	destination := server.URL + "/some/prefix"
+	uploader, err := NewHTTPUploader(logger.Discard, HTTPUploaderConfig{Destination: destination})
+	if err != nil {
+		t.Fatalf("NewHTTPUploader(...) error = %v", err)
+	}
+
+	artifact := &api.Artifact{Path: "pkg/llamas.txt", AbsolutePath: src, FileSize: 6}
+	if got, want := uploader.URL(artifact), destination+"/pkg/llamas.txt"; got != want {
+		t.Errorf("uploader.URL(artifact) = %q, want %q", got, want)
+	}
+	if err := uploader.Upload(ctx, artifact); err != nil {
+		t.Fatalf("uploader.Upload(ctx, artifact) error = %v", err)
+	}
+	if diff := cmp.Diff(string(files["/some/prefix/pkg/llamas.txt"]), "llamas"); diff != "" {
+		t.Errorf("uploaded file diff (-got +want):\n%s", diff)
+	}
+
+	dest := t.TempDir()
+	err = NewHTTPDownloader(logger.Discard, HTTPDownloaderConfig{
+		Source:      destination,
+		Path:        artifact.Path,
+		Destination: dest,
+		Retries:     1,
+	}).Start(ctx)
+	if err != nil {
+		t.Fatalf("HTTPDownloader.Start(ctx) error = %v", err)
+	}
+	downloaded, err := os.ReadFile(filepath.Join(dest, "pkg", "llamas.txt"))
+	if err != nil {
+		t.Fatalf("reading downloaded artifact: %v", err)
+	}
+	if diff := cmp.Diff(string(downloaded), "llamas"); diff != "" {
+		t.Errorf("downloaded artifact diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestHTTPUploaderPublicURL(t *testing.T) {
+	t.Parallel()
+
+	uploader, err := NewHTTPUploader(logger.Discard, HTTPUploaderConfig{
+		Destination: "https://webdav.internal/artifacts",
+		PublicURL:   "https://artifacts.example.com/builds",
+	})
+	if err != nil {
+		t.Fatalf("NewHTTPUploader(...) error = %v", err)
+	}
+	artifact := &api.Artifact{Path: "pkg/llamas.txt"}
+	if got, want := uploader.URL(artifact), "https://artifacts.example.com/builds/pkg/llamas.txt"; got != want {
+		t.Errorf("uploader.URL(artifact) = %q, want %q", got, want)
+	}
+}
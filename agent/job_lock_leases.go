@@ -0,0 +1,84 @@
+package agent
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/lock"
+	"github.com/buildkite/agent/v3/status"
+)
+
+// lockLeaseRenewInterval is how often the job runner renews the leases on the
+// job's locks. It leaves time for a couple of failed renewals within the
+// shortest lease.
+const lockLeaseRenewInterval = lock.MinLeaseTTL / 3
+
+// lockLeaseRenewer renews the leases on locks acquired by the job (with
+// `buildkite-agent lock acquire --lock-lease-ttl`, for example) while the job
+// is running. The process that acquired a lock usually exits long before the
+// job finishes, so the job runner holds the lease on its behalf.
+func (r *JobRunner) lockLeaseRenewer(ctx context.Context, wg *sync.WaitGroup) {
+	ctx, setStat, done := status.AddSimpleItem(ctx, "Lock Lease Renewer")
+	defer done()
+	setStat("Starting...")
+
+	defer func() {
+		// Mark this routine as done in the wait group
+		wg.Done()
+
+		r.agentLogger.Debug("[JobRunner] Routine that renews lock leases has finished")
+	}()
+
+	select {
+	case <-r.process.Started():
+	case <-ctx.Done():
+		return
+	}
+
+	for {
+		// Sleep first - nothing can have acquired a lock with a lease that is
+		// about to expire the moment the process starts.
+		setStat("😴 Sleeping for a bit")
+		select {
+		case <-time.After(lockLeaseRenewInterval):
+		case <-ctx.Done():
+			return
+		case <-r.process.Done():
+			return
+		}
+
+		setStat("🔒 Renewing lock leases")
+		client, err := lock.NewClient(ctx, r.conf.AgentConfiguration.SocketsPath)
+		if err != nil {
+			r.agentLogger.Debug("[JobRunner] Couldn't connect to the Agent API to renew lock leases: %v", err)
+			continue
+		}
+		if err := client.RenewJobLeases(ctx, r.conf.Job.ID); err != nil {
+			// Try again soon - the leases outlast a few failed renewals.
+			r.agentLogger.Warn("[JobRunner] Couldn't renew lock leases for job %s: %v", r.conf.Job.ID, err)
+		}
+	}
+}
+
+// releaseLockLeases releases the locks with leases that the job still holds
+// once it has finished, so that other jobs don't have to wait for the leases
+// to expire.
+func (r *JobRunner) releaseLockLeases(ctx context.Context) {
+	// Don't hold up finishing the job if the Agent API is unresponsive.
+	ctx, cancel := context.WithTimeout(ctx, lockLeaseRenewInterval)
+	defer cancel()
+
+	client, err := lock.NewClient(ctx, r.conf.AgentConfiguration.SocketsPath)
+	if err != nil {
+		r.agentLogger.Debug("[JobRunner] Couldn't connect to the Agent API to release lock leases: %v", err)
+		return
+	}
+	released, err := client.ReleaseJobLeases(ctx, r.conf.Job.ID)
+	if err != nil {
+		r.agentLogger.Warn("[JobRunner] Couldn't release lock leases for job %s: %v", r.conf.Job.ID, err)
+	}
+	for _, key := range released {
+		r.agentLogger.Info("Released lock %q held by job %s", key, r.conf.Job.ID)
+	}
+}
@@ -62,6 +62,7 @@ var ProtectedEnv = map[string]struct{}{
 	"BUILDKITE_BUILD_PATH":               {},
 	"BUILDKITE_GIT_MIRRORS_PATH":         {},
 	"BUILDKITE_GIT_MIRRORS_SKIP_UPDATE":  {},
+	"BUILDKITE_GIT_MIRRORS_SEED_PATH":    {},
 	"BUILDKITE_HOOKS_PATH":               {},
 	"BUILDKITE_PLUGINS_PATH":             {},
 	"BUILDKITE_SSH_KEYSCAN":              {},
@@ -136,6 +137,9 @@ type JobRunner struct {
 	// The internal log streamer. Don't write to this directly, use `jobLogs` instead
 	logStreamer *LogStreamer
 
+	// Counts the requests made by the log streamer, and how well the log compressed
+	logUploadStats logUploadStats
+
 	// jobLogs is an io.Writer that sends data to the job logs
 	jobLogs io.Writer
 
@@ -197,11 +201,26 @@ func NewJobRunner(ctx context.Context, l logger.Logger, apiClient APIClient, con
 
 	// The log streamer that will take the output chunks, and send them to
 	// the Buildkite Agent API
-	r.logStreamer = NewLogStreamer(r.agentLogger, r.onUploadChunk, LogStreamerConfig{
+	logStreamerConf := LogStreamerConfig{
 		Concurrency:       3,
 		MaxChunkSizeBytes: r.conf.Job.ChunksMaxSizeBytes,
 		MaxSizeBytes:      r.conf.Job.LogMaxSizeBytes,
-	})
+		LimitPolicy:       conf.AgentConfiguration.JobLogLimitPolicy,
+		TailSizeBytes:     conf.AgentConfiguration.JobLogTailSizeBytes,
+	}
+	if logStreamerConf.LimitPolicy != "" && logStreamerConf.LimitPolicy != LogLimitWarn {
+		// Keep the full log, so it can be uploaded as an artifact if the
+		// streamed log is limited.
+		fullLogDir := conf.AgentConfiguration.JobLogPath
+		if fullLogDir == "" {
+			fullLogDir = os.TempDir()
+		}
+		logStreamerConf.FullLogPath = filepath.Join(fullLogDir, fmt.Sprintf("job-log-full-%s.log", r.conf.Job.ID))
+	}
+	if conf.AgentConfiguration.SpoolJobLogs && conf.AgentConfiguration.BuildPath != "" {
+		logStreamerConf.SpoolDir = logSpoolDir(conf.AgentConfiguration.BuildPath, r.conf.Job.ID)
+	}
+	r.logStreamer = NewLogStreamer(r.agentLogger, r.onUploadChunk, logStreamerConf)
 
 	// TempDir is not guaranteed to exist
 	tempDir := os.TempDir()
@@ -463,6 +482,7 @@ func (r *JobRunner) createEnvironment(ctx context.Context) ([]string, error) {
 	env["BUILDKITE_SOCKETS_PATH"] = r.conf.AgentConfiguration.SocketsPath
 	env["BUILDKITE_GIT_MIRRORS_PATH"] = r.conf.AgentConfiguration.GitMirrorsPath
 	env["BUILDKITE_GIT_MIRRORS_SKIP_UPDATE"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.GitMirrorsSkipUpdate)
+	env["BUILDKITE_GIT_MIRRORS_SEED_PATH"] = r.conf.AgentConfiguration.GitMirrorsSeedPath
 	env["BUILDKITE_HOOKS_PATH"] = r.conf.AgentConfiguration.HooksPath
 	env["BUILDKITE_PLUGINS_PATH"] = r.conf.AgentConfiguration.PluginsPath
 	env["BUILDKITE_SSH_KEYSCAN"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.SSHKeyscan)
@@ -479,6 +499,9 @@ func (r *JobRunner) createEnvironment(ctx context.Context) ([]string, error) {
 	env["BUILDKITE_SHELL"] = r.conf.AgentConfiguration.Shell
 	env["BUILDKITE_AGENT_EXPERIMENT"] = strings.Join(experiments.Enabled(ctx), ",")
 	env["BUILDKITE_REDACTED_VARS"] = strings.Join(r.conf.AgentConfiguration.RedactedVars, ",")
+	env["BUILDKITE_REDACTED_DETECTORS"] = strings.Join(r.conf.AgentConfiguration.RedactedDetectors, ",")
+	// Patterns are regular expressions, which may well contain commas.
+	env["BUILDKITE_REDACTED_PATTERNS"] = strings.Join(r.conf.AgentConfiguration.RedactedPatterns, "\n")
 	env["BUILDKITE_STRICT_SINGLE_HOOKS"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.StrictSingleHooks)
 
 	// propagate CancelSignal to bootstrap, unless it's the default SIGTERM
@@ -522,6 +545,12 @@ func (r *JobRunner) createEnvironment(ctx context.Context) ([]string, error) {
 		env["BUILDKITE_TRACING_SERVICE_NAME"] = r.conf.AgentConfiguration.TracingServiceName
 	}
 
+	if r.conf.AgentConfiguration.MetricsDatadog {
+		env["BUILDKITE_METRICS_DATADOG"] = "true"
+		env["BUILDKITE_METRICS_DATADOG_HOST"] = r.conf.AgentConfiguration.MetricsDatadogHost
+		env["BUILDKITE_METRICS_DATADOG_DISTRIBUTIONS"] = fmt.Sprint(r.conf.AgentConfiguration.MetricsDatadogDistributions)
+	}
+
 	// see documentation for BuildkiteMessageMax
 	if err := truncateEnv(r.agentLogger, env, BuildkiteMessageName, BuildkiteMessageMax); err != nil {
 		r.agentLogger.Warn("failed to truncate %s: %v", BuildkiteMessageName, err)
@@ -724,6 +753,13 @@ func (r *JobRunner) onUploadHeaderTime(ctx context.Context, cursor, total int, t
 // onUploadChunk uploads a log streamer chunk. If a valid chunk cannot be
 // uploaded, it will retry for a long time.
 func (r *JobRunner) onUploadChunk(ctx context.Context, chunk *LogStreamerChunk) error {
+	return uploadChunk(ctx, r.agentLogger, r.apiClient, r.conf.Job.ID, chunk, &r.logUploadStats)
+}
+
+// uploadChunk uploads a log chunk for a job. If a valid chunk cannot be
+// uploaded, it will retry for a long time. Each attempt is recorded in stats,
+// if it is not nil.
+func uploadChunk(ctx context.Context, l logger.Logger, apiClient APIClient, jobID string, chunk *LogStreamerChunk, stats *logUploadStats) error {
 	// We consider logs to be an important thing, and we shouldn't give up
 	// on sending the chunk data back to Buildkite. In the event Buildkite
 	// is having downtime or there are connection problems, we'll want to
@@ -740,18 +776,19 @@ func (r *JobRunner) onUploadChunk(ctx context.Context, chunk *LogStreamerChunk)
 		roko.WithStrategy(roko.Constant(5*time.Second)),
 		roko.WithJitter(),
 	).DoWithContext(ctx, func(retrier *roko.Retrier) error {
-		response, err := r.apiClient.UploadChunk(ctx, r.conf.Job.ID, &api.Chunk{
+		response, err := apiClient.UploadChunk(ctx, jobID, &api.Chunk{
 			Data:     chunk.Data,
 			Sequence: chunk.Order,
 			Offset:   chunk.Offset,
 			Size:     chunk.Size,
 		})
+		stats.recordRequest(chunk, response, err)
 		if err != nil {
 			if response != nil && (response.StatusCode >= 400 && response.StatusCode <= 499) {
-				r.agentLogger.Warn("Buildkite rejected the chunk upload (%s)", err)
+				l.Warn("Buildkite rejected the chunk upload (%s)", err)
 				retrier.Break()
 			} else {
-				r.agentLogger.Warn("%s (%s)", err, retrier)
+				l.Warn("%s (%s)", err, retrier)
 			}
 		}
 
@@ -0,0 +1,245 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/gofrs/flock"
+)
+
+// logSpoolDirName is the directory within the build path where job log chunks
+// are spooled.
+const logSpoolDirName = ".log-spool"
+
+// logSpoolLockName is the lock file within a spool directory. It is locked by
+// the agent process that is using the spool (either streaming the job's log,
+// or replaying it), so that other agent processes sharing the build path leave
+// the spool alone.
+const logSpoolLockName = ".lock"
+
+// logSpoolDir returns the directory that chunks for a job are spooled to.
+func logSpoolDir(buildPath, jobID string) string {
+	return filepath.Join(buildPath, logSpoolDirName, jobID)
+}
+
+// logSpool durably stores job log chunks on disk until they have been uploaded.
+// Each chunk is stored in its own file, named after its order and offset.
+type logSpool struct {
+	dir  string
+	lock *flock.Flock
+}
+
+// newLogSpool creates a logSpool, creating the directory if necessary, and
+// locks it until close is called.
+func newLogSpool(dir string) (*logSpool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating log spool directory: %w", err)
+	}
+	spool, err := lockLogSpool(dir)
+	if err != nil {
+		return nil, err
+	}
+	if spool == nil {
+		return nil, fmt.Errorf("log spool %s is in use by another process", dir)
+	}
+	return spool, nil
+}
+
+// lockLogSpool locks an existing spool directory. It returns nil if another
+// process has the spool locked.
+func lockLogSpool(dir string) (*logSpool, error) {
+	lock := flock.New(filepath.Join(dir, logSpoolLockName))
+	locked, err := lock.TryLock()
+	if err != nil {
+		return nil, fmt.Errorf("locking log spool: %w", err)
+	}
+	if !locked {
+		return nil, nil
+	}
+	return &logSpool{dir: dir, lock: lock}, nil
+}
+
+// close unlocks the spool, so that another agent process can replay it.
+func (s *logSpool) close() error {
+	if s.lock == nil {
+		return nil
+	}
+	return s.lock.Unlock()
+}
+
+func (s *logSpool) path(chunk *LogStreamerChunk) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d-%020d.chunk", chunk.Order, chunk.Offset))
+}
+
+// write stores a chunk. The chunk is written to a temporary file that is
+// renamed into place, so a partially-written chunk is never replayed.
+func (s *logSpool) write(chunk *LogStreamerChunk) error {
+	f, err := os.CreateTemp(s.dir, ".chunk-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // no-op after a successful rename
+
+	if _, err := f.Write(chunk.Data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.path(chunk))
+}
+
+// read reads the data of a stored chunk.
+func (s *logSpool) read(chunk *LogStreamerChunk) ([]byte, error) {
+	return os.ReadFile(s.path(chunk))
+}
+
+// remove deletes a stored chunk, once it has been uploaded.
+func (s *logSpool) remove(chunk *LogStreamerChunk) error {
+	err := os.Remove(s.path(chunk))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// chunks reads all the stored chunks, sorted by order.
+func (s *logSpool) chunks() ([]*LogStreamerChunk, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var chunks []*LogStreamerChunk
+	for _, e := range entries {
+		var order, offset uint64
+		if _, err := fmt.Sscanf(e.Name(), "%d-%d.chunk", &order, &offset); err != nil {
+			// Not a chunk (e.g. a leftover temporary file).
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, &LogStreamerChunk{
+			Data:   data,
+			Order:  order,
+			Offset: offset,
+			Size:   uint64(len(data)),
+		})
+	}
+
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Order < chunks[j].Order })
+	return chunks, nil
+}
+
+// removeAll deletes the spool directory and anything left in it.
+func (s *logSpool) removeAll() error {
+	return os.RemoveAll(s.dir)
+}
+
+// removeIfEmpty deletes the spool directory if every chunk has been uploaded.
+func (s *logSpool) removeIfEmpty() (bool, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".chunk") {
+			return false, nil
+		}
+	}
+	return true, s.removeAll()
+}
+
+// leftoverLogSpools lists the spool directories within the build path. Some
+// may still be in use by jobs running in other agent processes, which
+// replayLogSpools skips because they are locked.
+func leftoverLogSpools(buildPath string) []string {
+	root := filepath.Join(buildPath, logSpoolDirName)
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil
+	}
+	var dirs []string
+	for _, e := range entries {
+		if e.IsDir() {
+			dirs = append(dirs, filepath.Join(root, e.Name()))
+		}
+	}
+	return dirs
+}
+
+// replayLogSpools uploads the chunks in spool directories left behind by jobs
+// that didn't finish uploading their logs, for example because the agent was
+// stopped during an API outage. Chunks are uploaded in their original order,
+// with their original offsets.
+func replayLogSpools(ctx context.Context, l logger.Logger, apiClient APIClient, dirs []string) {
+	for _, dir := range dirs {
+		jobID := filepath.Base(dir)
+
+		// Claim the spool by locking it, so that another agent process sharing
+		// the build path doesn't replay it too. A spool that is already locked
+		// belongs to a job that is still running (or is being replayed).
+		spool, err := lockLogSpool(dir)
+		if err != nil {
+			l.Debug("[LogSpool] Skipping %s, which couldn't be claimed: %v", dir, err)
+			continue
+		}
+		if spool == nil {
+			l.Debug("[LogSpool] Skipping %s, which is in use by another process", dir)
+			continue
+		}
+
+		chunks, err := spool.chunks()
+		if err != nil {
+			spool.close()
+			if errors.Is(err, os.ErrNotExist) {
+				// Another process replayed it in the meantime.
+				continue
+			}
+			l.Error("[LogSpool] Couldn't read spooled log chunks for job %s: %v", jobID, err)
+			continue
+		}
+
+		l.Info("Uploading %d spooled log chunks for job %s", len(chunks), jobID)
+		failed := 0
+		for _, chunk := range chunks {
+			if err := uploadChunk(ctx, l, apiClient, jobID, chunk, nil); err != nil {
+				if ctx.Err() != nil {
+					// The agent is stopping. The rest will be replayed
+					// next time.
+					spool.close()
+					return
+				}
+				failed++
+				l.Error("[LogSpool] Giving up on uploading spooled chunk %d for job %s: %v", chunk.Order, jobID, err)
+				continue
+			}
+			if err := spool.remove(chunk); err != nil {
+				l.Warn("[LogSpool] Couldn't remove uploaded chunk %d for job %s: %v", chunk.Order, jobID, err)
+			}
+		}
+
+		// Anything left was rejected by Buildkite, or failed to upload for a
+		// very long time, so trying again won't help.
+		if err := spool.removeAll(); err != nil {
+			l.Warn("[LogSpool] Couldn't remove log spool %s: %v", dir, err)
+		}
+		spool.close()
+		if failed > 0 {
+			l.Warn("%d spooled log chunks for job %s couldn't be uploaded", failed, jobID)
+		}
+	}
+}
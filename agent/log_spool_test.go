@@ -0,0 +1,243 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLogStreamerSpoolsFailedChunks(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	dir := logSpoolDir(t.TempDir(), "job-uuid")
+	callback := func(ctx context.Context, chunk *LogStreamerChunk) error {
+		if chunk.Order == 2 {
+			return errors.New("the API is down")
+		}
+		return nil
+	}
+
+	ls := NewLogStreamer(logger.Discard, callback, LogStreamerConfig{
+		Concurrency:       3,
+		MaxChunkSizeBytes: 10,
+		MaxSizeBytes:      1024,
+		SpoolDir:          dir,
+	})
+	if err := ls.Start(ctx); err != nil {
+		t.Fatalf("LogStreamer.Start(ctx) = %v", err)
+	}
+
+	input := "0123456789abcdefghijklmnopqrstuvwxyz" // 36 bytes
+	if err := ls.Process(ctx, []byte(input)); err != nil {
+		t.Errorf("LogStreamer.Process(ctx, %q) = %v", input, err)
+	}
+	ls.Stop()
+
+	// Only the chunk that failed to upload should be left in the spool.
+	got, err := (&logSpool{dir: dir}).chunks()
+	if err != nil {
+		t.Fatalf("logSpool.chunks() error = %v", err)
+	}
+	want := []*LogStreamerChunk{{
+		Data:   []byte("abcdefghij"),
+		Order:  2,
+		Offset: 10,
+		Size:   10,
+	}}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("logSpool.chunks() diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestLogStreamerRemovesSpoolWhenUploaded(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	dir := logSpoolDir(t.TempDir(), "job-uuid")
+	callback := func(ctx context.Context, chunk *LogStreamerChunk) error { return nil }
+
+	ls := NewLogStreamer(logger.Discard, callback, LogStreamerConfig{
+		Concurrency:       3,
+		MaxChunkSizeBytes: 10,
+		MaxSizeBytes:      1024,
+		SpoolDir:          dir,
+	})
+	if err := ls.Start(ctx); err != nil {
+		t.Fatalf("LogStreamer.Start(ctx) = %v", err)
+	}
+	if err := ls.Process(ctx, []byte("llamas and alpacas")); err != nil {
+		t.Errorf("LogStreamer.Process(ctx, ...) = %v", err)
+	}
+	ls.Stop()
+
+	if _, err := os.Stat(dir); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("os.Stat(%q) error = %v, want %v", dir, err, os.ErrNotExist)
+	}
+}
+
+func TestLogStreamerUploadsFailedChunksFromSpool(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	dir := logSpoolDir(t.TempDir(), "job-uuid")
+
+	// Chunk 2 fails to upload the first time (for example, during an outage),
+	// and then uploading works again.
+	var mu sync.Mutex
+	var uploads []string
+	failedOnce := false
+	callback := func(ctx context.Context, chunk *LogStreamerChunk) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if chunk.Order == 2 && !failedOnce {
+			failedOnce = true
+			return errors.New("the API is down")
+		}
+		uploads = append(uploads, fmt.Sprintf("%d:%s", chunk.Order, chunk.Data))
+		return nil
+	}
+
+	ls := NewLogStreamer(logger.Discard, callback, LogStreamerConfig{
+		Concurrency:       1,
+		MaxChunkSizeBytes: 10,
+		MaxSizeBytes:      1024,
+		SpoolDir:          dir,
+	})
+	if err := ls.Start(ctx); err != nil {
+		t.Fatalf("LogStreamer.Start(ctx) = %v", err)
+	}
+	input := "0123456789abcdefghijklmnopqrst" // 30 bytes
+	if err := ls.Process(ctx, []byte(input)); err != nil {
+		t.Errorf("LogStreamer.Process(ctx, %q) = %v", input, err)
+	}
+	ls.Stop()
+
+	want := []string{"1:0123456789", "3:klmnopqrst", "2:abcdefghij"}
+	if diff := cmp.Diff(uploads, want); diff != "" {
+		t.Errorf("uploads diff (-got +want):\n%s", diff)
+	}
+	if got := ls.FailedChunks(); got != 0 {
+		t.Errorf("LogStreamer.FailedChunks() = %d, want 0", got)
+	}
+	if _, err := os.Stat(dir); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("os.Stat(%q) error = %v, want %v", dir, err, os.ErrNotExist)
+	}
+}
+
+func TestReplayLogSpoolsSkipsSpoolsInUse(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	buildPath := t.TempDir()
+
+	// A job that is still running in another agent process.
+	dir := logSpoolDir(buildPath, "job-uuid")
+	spool, err := newLogSpool(dir)
+	if err != nil {
+		t.Fatalf("newLogSpool(%q) error = %v", dir, err)
+	}
+	t.Cleanup(func() { spool.close() })
+	chunk := &LogStreamerChunk{Data: []byte("0123456789"), Order: 1, Offset: 0, Size: 10}
+	if err := spool.write(chunk); err != nil {
+		t.Fatalf("spool.write(%v) error = %v", chunk, err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		t.Errorf("Unexpected request %s %s", req.Method, req.URL.Path)
+		http.Error(rw, "Not found", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	client := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamas",
+	})
+
+	replayLogSpools(ctx, logger.Discard, client, leftoverLogSpools(buildPath))
+
+	got, err := spool.chunks()
+	if err != nil {
+		t.Fatalf("spool.chunks() error = %v", err)
+	}
+	if diff := cmp.Diff(got, []*LogStreamerChunk{chunk}); diff != "" {
+		t.Errorf("spool.chunks() diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestReplayLogSpools(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	buildPath := t.TempDir()
+
+	// Chunks left behind by a previous agent process, written out of order.
+	spool, err := newLogSpool(logSpoolDir(buildPath, "job-uuid"))
+	if err != nil {
+		t.Fatalf("newLogSpool(...) error = %v", err)
+	}
+	for _, chunk := range []*LogStreamerChunk{
+		{Data: []byte("klmnopqrst"), Order: 3, Offset: 20, Size: 10},
+		{Data: []byte("0123456789"), Order: 1, Offset: 0, Size: 10},
+	} {
+		if err := spool.write(chunk); err != nil {
+			t.Fatalf("spool.write(%v) error = %v", chunk, err)
+		}
+	}
+	if err := spool.close(); err != nil {
+		t.Fatalf("spool.close() error = %v", err)
+	}
+
+	var mu sync.Mutex
+	var uploads []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/jobs/job-uuid/chunks" {
+			t.Errorf("Unknown endpoint %s %s", req.Method, req.URL.Path)
+			http.Error(rw, "Not found", http.StatusNotFound)
+			return
+		}
+		q := req.URL.Query()
+		mu.Lock()
+		uploads = append(uploads, fmt.Sprintf("sequence=%s offset=%s size=%s", q.Get("sequence"), q.Get("offset"), q.Get("size")))
+		mu.Unlock()
+		rw.WriteHeader(http.StatusCreated)
+		fmt.Fprint(rw, `{}`)
+	}))
+	defer server.Close()
+
+	client := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamas",
+	})
+
+	spools := leftoverLogSpools(buildPath)
+	if len(spools) != 1 {
+		t.Fatalf("leftoverLogSpools(%q) = %v, want 1 directory", buildPath, spools)
+	}
+	replayLogSpools(ctx, logger.Discard, client, spools)
+
+	want := []string{
+		"sequence=1 offset=0 size=10",
+		"sequence=3 offset=20 size=10",
+	}
+	if diff := cmp.Diff(uploads, want); diff != "" {
+		t.Errorf("uploads diff (-got +want):\n%s", diff)
+	}
+
+	if got := leftoverLogSpools(buildPath); len(got) != 0 {
+		t.Errorf("leftoverLogSpools(%q) = %v, want none after replaying", buildPath, got)
+	}
+	if _, err := os.Stat(filepath.Join(buildPath, logSpoolDirName)); err != nil {
+		t.Errorf("os.Stat(spool root) error = %v", err)
+	}
+}
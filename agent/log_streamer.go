@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"os"
 	"sync"
 	"sync/atomic"
 
@@ -14,6 +15,27 @@ import (
 
 const defaultLogMaxSize = 1024 * 1024 * 1024 // 1 GiB
 
+// What the log streamer does once the log exceeds the maximum size.
+const (
+	// LogLimitWarn keeps streaming the log after warning about it.
+	LogLimitWarn = "warn"
+
+	// LogLimitTruncate stops streaming the log at the maximum size, and marks
+	// where it was truncated.
+	LogLimitTruncate = "truncate"
+
+	// LogLimitHeadTail streams the start of the log, then keeps a rolling tail
+	// of the output that is streamed when the job finishes.
+	LogLimitHeadTail = "head-tail"
+)
+
+// LogLimitPolicies lists the valid values for LogStreamerConfig.LimitPolicy.
+var LogLimitPolicies = []string{LogLimitWarn, LogLimitTruncate, LogLimitHeadTail}
+
+// logLimitMarkerReserve is room left below the maximum log size for the
+// markers written into a limited log.
+const logLimitMarkerReserve = 1024
+
 // Returned from Process after Stop has been called.
 var errStreamerStopped = errors.New("streamer stopped")
 
@@ -27,6 +49,23 @@ type LogStreamerConfig struct {
 
 	// The maximum size of the log
 	MaxSizeBytes uint64
+
+	// If set, chunks are spooled to files in this directory before they are
+	// uploaded, and removed once uploaded. Chunks that fail to upload are left
+	// in the spool to be uploaded later (see replayLogSpools).
+	SpoolDir string
+
+	// What to do when the log exceeds MaxSizeBytes (one of LogLimitPolicies).
+	// The default is LogLimitWarn.
+	LimitPolicy string
+
+	// How much of the end of the log to keep with LogLimitHeadTail. The
+	// default is a quarter of MaxSizeBytes, and at most half is used.
+	TailSizeBytes uint64
+
+	// If set, the full log is also written to this file, so that it is
+	// available even if the streamed log is limited.
+	FullLogPath string
 }
 
 // LogStreamer divides job log output into chunks (Process), and log streamer
@@ -65,6 +104,43 @@ type LogStreamer struct {
 
 	// Have we stopped?
 	stopped bool
+
+	// Where chunks are spooled, if spooling is enabled
+	spool *logSpool
+
+	// Have we logged a warning about spooling?
+	warnedAboutSpool bool
+
+	// Spooled chunks that failed to upload, to be uploaded again once
+	// uploading works again. Only their order and offset are kept - the data
+	// is read back from the spool.
+	spoolFailedMu sync.Mutex
+	spoolFailed   []*LogStreamerChunk
+
+	// Output that hasn't been made into a chunk yet
+	pending []byte
+
+	// How many chunks are queued or being uploaded
+	inflight int32
+
+	// The full log, if FullLogPath is set
+	fullLog *os.File
+
+	// The size the streamed log is limited to before the tail (if any)
+	headLimit uint64
+
+	// Has the output been limited?
+	limited bool
+
+	// How many bytes of output have been left out of the streamed log
+	omitted uint64
+
+	// The rolling tail of output kept with LogLimitHeadTail
+	tail *tailBuffer
+
+	// The context the workers were started with. Stop uses it to avoid
+	// waiting forever to queue the last chunk if the workers have gone.
+	workerCtx context.Context
 }
 
 type LogStreamerChunk struct {
@@ -105,6 +181,43 @@ func (ls *LogStreamer) Start(ctx context.Context) error {
 		ls.conf.MaxSizeBytes = defaultLogMaxSize
 	}
 
+	switch ls.conf.LimitPolicy {
+	case "", LogLimitWarn:
+		ls.conf.LimitPolicy = LogLimitWarn
+	case LogLimitTruncate:
+		ls.headLimit = ls.conf.MaxSizeBytes - min(ls.conf.MaxSizeBytes/2, logLimitMarkerReserve)
+	case LogLimitHeadTail:
+		tailSize := ls.conf.TailSizeBytes
+		if tailSize == 0 {
+			tailSize = ls.conf.MaxSizeBytes / 4
+		}
+		tailSize = min(tailSize, ls.conf.MaxSizeBytes/2)
+		ls.tail = newTailBuffer(int(tailSize))
+		ls.headLimit = ls.conf.MaxSizeBytes - tailSize - min(ls.conf.MaxSizeBytes/4, 2*logLimitMarkerReserve)
+	default:
+		return fmt.Errorf("unknown log limit policy %q, must be one of %v", ls.conf.LimitPolicy, LogLimitPolicies)
+	}
+
+	if ls.conf.FullLogPath != "" {
+		f, err := os.Create(ls.conf.FullLogPath)
+		if err != nil {
+			ls.logger.Warn("The full job log won't be kept: %v", err)
+		} else {
+			ls.fullLog = f
+		}
+	}
+
+	if ls.conf.SpoolDir != "" {
+		spool, err := newLogSpool(ls.conf.SpoolDir)
+		if err != nil {
+			// Spooling is a safety net, so carry on without it.
+			ls.logger.Warn("Job log chunks won't be spooled to disk: %v", err)
+		} else {
+			ls.spool = spool
+		}
+	}
+
+	ls.workerCtx = ctx
 	ls.workerWG.Add(ls.conf.Concurrency)
 	for i := 0; i < ls.conf.Concurrency; i++ {
 		go ls.worker(ctx, i)
@@ -129,47 +242,142 @@ func (ls *LogStreamer) Process(ctx context.Context, output []byte) error {
 		return errStreamerStopped
 	}
 
-	for len(output) > 0 {
-		// Have we exceeded the max size?
-		// (This check is also performed on the server side.)
-		if ls.bytes > ls.conf.MaxSizeBytes && !ls.warnedAboutSize {
-			ls.logger.Warn("The job log has reached %s in size, which has "+
-				"exceeded the maximum size (%s). Further logs may be dropped "+
-				"by the server, and a future version of the agent will stop "+
-				"sending logs at this point.",
-				humanize.IBytes(ls.bytes), humanize.IBytes(ls.conf.MaxSizeBytes))
-			ls.warnedAboutSize = true
-			// In a future version, this will error out, e.g.:
-			//return fmt.Errorf("%w (%d > %d)", errLogExceededMaxSize, ls.bytes, ls.conf.MaxSizeBytes)
+	if ls.fullLog != nil {
+		if _, err := ls.fullLog.Write(output); err != nil {
+			ls.logger.Warn("Couldn't write to the full job log %s: %v", ls.fullLog.Name(), err)
+			ls.fullLog.Close()
+			ls.fullLog = nil
 		}
+	}
 
-		// The next chunk will be up to MaxChunkSizeBytes in size.
-		size := ls.conf.MaxChunkSizeBytes
-		if lenout := uint64(len(output)); size > lenout {
-			size = lenout
-		}
+	ls.pending = append(ls.pending, ls.limit(output)...)
 
-		// Take the chunk from the start of output, leave the remainder for the
-		// next iteration.
-		ls.order++
-		chunk := &LogStreamerChunk{
-			Data:   output[:size],
-			Order:  ls.order,
-			Offset: ls.bytes,
-			Size:   size,
+	// Full-sized chunks are always queued straight away.
+	for uint64(len(ls.pending)) >= ls.conf.MaxChunkSizeBytes {
+		if err := ls.queueChunk(ctx, ls.conf.MaxChunkSizeBytes); err != nil {
+			return err
 		}
-		output = output[size:]
+	}
 
-		// Stream the chunk onto the queue!
-		select {
-		case ls.queue <- chunk:
-			// Streamed!
-		case <-ctx.Done(): // pack it up
-			return ctx.Err()
+	// While every worker is busy uploading, hold on to the remainder so that
+	// it can be coalesced with later output. Chatty jobs then send fewer,
+	// larger chunks (which also compress better), while quiet jobs still have
+	// their output sent as soon as a worker is free.
+	if len(ls.pending) > 0 && int(atomic.LoadInt32(&ls.inflight)) < ls.conf.Concurrency {
+		return ls.queueChunk(ctx, uint64(len(ls.pending)))
+	}
+
+	return nil
+}
+
+// limit applies the limit policy, returning the part of output to stream.
+func (ls *LogStreamer) limit(output []byte) []byte {
+	if ls.conf.LimitPolicy == LogLimitWarn {
+		return output
+	}
+
+	if ls.limited {
+		ls.omit(output)
+		return nil
+	}
+
+	accepted := ls.bytes + uint64(len(ls.pending))
+	room := ls.headLimit - min(accepted, ls.headLimit)
+	if uint64(len(output)) <= room {
+		return output
+	}
+
+	ls.limited = true
+	ls.omit(output[room:])
+	ls.logger.Warn("The job log has exceeded the maximum size (%s), so further output won't be streamed (policy: %s)",
+		humanize.IBytes(ls.conf.MaxSizeBytes), ls.conf.LimitPolicy)
+	return append(output[:room:room], ls.limitMarker()...)
+}
+
+// omit records output that was left out of the streamed log.
+func (ls *LogStreamer) omit(output []byte) {
+	ls.omitted += uint64(len(output))
+	if ls.tail != nil {
+		ls.tail.Write(output)
+	}
+}
+
+// limitMarker describes why the streamed log stops.
+func (ls *LogStreamer) limitMarker() string {
+	msg := fmt.Sprintf("\n\n~~~ ⚠️ The job log exceeded the maximum size of %s", humanize.IBytes(ls.conf.MaxSizeBytes))
+	if ls.tail != nil {
+		msg += fmt.Sprintf(". The last %s of output will be shown when the job finishes", humanize.IBytes(uint64(ls.tail.max)))
+	} else {
+		msg += ", so the rest of the output has been omitted"
+	}
+	if ls.fullLog != nil {
+		msg += ". The full log will be uploaded as an artifact"
+	}
+	return msg + "\n"
+}
+
+// Limited reports whether the streamed log was limited, i.e. whether some of
+// the output was left out.
+func (ls *LogStreamer) Limited() bool {
+	ls.processMutex.Lock()
+	defer ls.processMutex.Unlock()
+	return ls.limited
+}
+
+// queueChunk takes a chunk of up to size bytes from the pending output, and
+// queues it for upload.
+func (ls *LogStreamer) queueChunk(ctx context.Context, size uint64) error {
+	// Have we exceeded the max size?
+	// (This check is also performed on the server side.)
+	if ls.bytes > ls.conf.MaxSizeBytes && !ls.warnedAboutSize {
+		ls.logger.Warn("The job log has reached %s in size, which has "+
+			"exceeded the maximum size (%s). Further logs may be dropped "+
+			"by the server, and a future version of the agent will stop "+
+			"sending logs at this point.",
+			humanize.IBytes(ls.bytes), humanize.IBytes(ls.conf.MaxSizeBytes))
+		ls.warnedAboutSize = true
+		// In a future version, this will error out, e.g.:
+		//return fmt.Errorf("%w (%d > %d)", errLogExceededMaxSize, ls.bytes, ls.conf.MaxSizeBytes)
+	}
+
+	if lenpending := uint64(len(ls.pending)); size > lenpending {
+		size = lenpending
+	}
+
+	// Take the chunk from the start of the pending output, leave the
+	// remainder for later.
+	ls.order++
+	chunk := &LogStreamerChunk{
+		Data:   ls.pending[:size:size],
+		Order:  ls.order,
+		Offset: ls.bytes,
+		Size:   size,
+	}
+	ls.pending = ls.pending[size:]
+	if len(ls.pending) == 0 {
+		ls.pending = nil
+	}
+
+	// Spool the chunk before queueing it, so that it survives if the
+	// upload fails or the agent stops.
+	if ls.spool != nil {
+		if err := ls.spool.write(chunk); err != nil && !ls.warnedAboutSpool {
+			ls.logger.Warn("Couldn't spool job log chunk %d to disk: %v", chunk.Order, err)
+			ls.warnedAboutSpool = true
 		}
-		ls.bytes += size
 	}
 
+	// Stream the chunk onto the queue!
+	atomic.AddInt32(&ls.inflight, 1)
+	select {
+	case ls.queue <- chunk:
+		// Streamed!
+	case <-ctx.Done(): // pack it up
+		atomic.AddInt32(&ls.inflight, -1)
+		return ctx.Err()
+	}
+	ls.bytes += size
+
 	return nil
 }
 
@@ -181,11 +389,46 @@ func (ls *LogStreamer) Stop() {
 		return
 	}
 	ls.stopped = true
+
+	// With LogLimitHeadTail, finish the log with the tail of the output.
+	if ls.limited && ls.tail != nil {
+		tail := ls.tail.Bytes()
+		if skipped := ls.omitted - uint64(len(tail)); skipped > 0 {
+			ls.pending = append(ls.pending, fmt.Sprintf("\n~~~ ✂️ %s of output omitted\n", humanize.IBytes(skipped))...)
+		}
+		ls.pending = append(ls.pending, tail...)
+	}
+
+	if ls.fullLog != nil {
+		if err := ls.fullLog.Close(); err != nil {
+			ls.logger.Warn("Couldn't write the full job log %s: %v", ls.fullLog.Name(), err)
+		}
+	}
+
+	// Send whatever output was being held for coalescing.
+	for len(ls.pending) > 0 && ls.workerCtx != nil {
+		if err := ls.queueChunk(ls.workerCtx, ls.conf.MaxChunkSizeBytes); err != nil {
+			break
+		}
+	}
 	close(ls.queue)
 	ls.processMutex.Unlock()
 
 	ls.logger.Debug("[LogStreamer] Waiting for workers to shut down")
 	ls.workerWG.Wait()
+
+	if ls.spool != nil {
+		empty, err := ls.spool.removeIfEmpty()
+		switch {
+		case err != nil:
+			ls.logger.Warn("Couldn't clean up job log spool %s: %v", ls.spool.dir, err)
+		case !empty:
+			ls.logger.Warn("Job log chunks that failed to upload have been kept in %s, and will be uploaded when the agent next starts", ls.spool.dir)
+		}
+		if err := ls.spool.close(); err != nil {
+			ls.logger.Warn("Couldn't unlock job log spool %s: %v", ls.spool.dir, err)
+		}
+	}
 }
 
 // The actual log streamer worker
@@ -218,10 +461,96 @@ func (ls *LogStreamer) worker(ctx context.Context, id int) {
 
 		// Upload the chunk
 		err := ls.callback(ctx, chunk)
+		atomic.AddInt32(&ls.inflight, -1)
 		if err != nil {
 			atomic.AddInt32(&ls.chunksFailedCount, 1)
 
-			ls.logger.Error("Giving up on uploading chunk %d, this will result in only a partial build log on Buildkite", chunk.Order)
+			if ls.spool == nil {
+				ls.logger.Error("Giving up on uploading chunk %d, this will result in only a partial build log on Buildkite", chunk.Order)
+				continue
+			}
+			ls.logger.Error("Giving up on uploading chunk %d for now, it will be uploaded from the spool once uploading works again", chunk.Order)
+			ls.spoolFailedMu.Lock()
+			ls.spoolFailed = append(ls.spoolFailed, &LogStreamerChunk{
+				Order:  chunk.Order,
+				Offset: chunk.Offset,
+				Size:   chunk.Size,
+			})
+			ls.spoolFailedMu.Unlock()
+			continue
+		}
+
+		if ls.spool != nil {
+			if err := ls.spool.remove(chunk); err != nil {
+				ls.logger.Warn("Couldn't remove uploaded chunk %d from the spool: %v", chunk.Order, err)
+			}
+
+			// Uploading works, so try the chunks that failed earlier again.
+			setStat("📨 Uploading spooled chunks")
+			ls.uploadSpoolFailed(ctx)
 		}
 	}
 }
+
+// uploadSpoolFailed uploads chunks that failed to upload earlier again, reading
+// them back from the spool. Chunks that fail again are kept for next time.
+func (ls *LogStreamer) uploadSpoolFailed(ctx context.Context) {
+	ls.spoolFailedMu.Lock()
+	failed := ls.spoolFailed
+	ls.spoolFailed = nil
+	ls.spoolFailedMu.Unlock()
+
+	for i, chunk := range failed {
+		data, err := ls.spool.read(chunk)
+		if err != nil {
+			ls.logger.Warn("Couldn't read chunk %d from the spool: %v", chunk.Order, err)
+			continue
+		}
+		redo := *chunk
+		redo.Data = data
+		if err := ls.callback(ctx, &redo); err != nil {
+			// Still failing - put the rest back to try again later.
+			ls.spoolFailedMu.Lock()
+			ls.spoolFailed = append(ls.spoolFailed, failed[i:]...)
+			ls.spoolFailedMu.Unlock()
+			return
+		}
+		atomic.AddInt32(&ls.chunksFailedCount, -1)
+		if err := ls.spool.remove(chunk); err != nil {
+			ls.logger.Warn("Couldn't remove uploaded chunk %d from the spool: %v", chunk.Order, err)
+		}
+	}
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func newTailBuffer(max int) *tailBuffer {
+	return &tailBuffer{max: max}
+}
+
+// Write appends p to the buffer, discarding old data beyond the last max
+// bytes. It never returns an error.
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	if len(p) >= t.max {
+		t.buf = append(t.buf[:0], p[len(p)-t.max:]...)
+		return len(p), nil
+	}
+	t.buf = append(t.buf, p...)
+	// Only compact occasionally, so that writes are amortised O(len(p)).
+	if len(t.buf) > 2*t.max {
+		t.buf = append(t.buf[:0], t.buf[len(t.buf)-t.max:]...)
+	}
+	return len(p), nil
+}
+
+// Bytes returns the last max (or fewer) bytes written.
+func (t *tailBuffer) Bytes() []byte {
+	if len(t.buf) > t.max {
+		return t.buf[len(t.buf)-t.max:]
+	}
+	return t.buf
+}
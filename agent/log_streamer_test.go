@@ -4,7 +4,9 @@ import (
 	"context"
 	"errors"
 	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
 	"testing"
 
@@ -93,3 +95,154 @@ func TestLogStreamer(t *testing.T) {
 		t.Errorf("after Stop: LogStreamer.Process(ctx, %q) err = %v, want %v", input, err, errStreamerStopped)
 	}
 }
+
+func TestLogStreamerCoalescesWhileWorkersAreBusy(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var got []*LogStreamerChunk
+	callback := func(ctx context.Context, chunk *LogStreamerChunk) error {
+		<-release
+		mu.Lock()
+		got = append(got, chunk)
+		mu.Unlock()
+		return nil
+	}
+
+	ls := NewLogStreamer(logger.Discard, callback, LogStreamerConfig{
+		Concurrency:       1,
+		MaxChunkSizeBytes: 10,
+		MaxSizeBytes:      1024,
+	})
+	if err := ls.Start(ctx); err != nil {
+		t.Fatalf("LogStreamer.Start(ctx) = %v", err)
+	}
+
+	// The first output is queued straight away, and keeps the only worker
+	// busy. Later output is held and coalesced until the worker is free, but
+	// never beyond the maximum chunk size.
+	for _, input := range []string{"abc", "def", "ghi", "jklmnopq"} {
+		if err := ls.Process(ctx, []byte(input)); err != nil {
+			t.Errorf("LogStreamer.Process(ctx, %q) = %v", input, err)
+		}
+	}
+	close(release)
+	ls.Stop()
+
+	want := []*LogStreamerChunk{
+		{Data: []byte("abc"), Order: 1, Offset: 0, Size: 3},
+		{Data: []byte("defghijklm"), Order: 2, Offset: 3, Size: 10},
+		{Data: []byte("nopq"), Order: 3, Offset: 13, Size: 4},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("LogStreamer chunks diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestLogStreamerLimitPolicies(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	input := strings.Repeat("0123456789abcdefghijklmnopqrstuvwxyz", 6)[:200]
+
+	tests := []struct {
+		policy string
+		want   func(ls *LogStreamer) string
+	}{
+		{
+			policy: LogLimitWarn,
+			want:   func(*LogStreamer) string { return input },
+		},
+		{
+			policy: LogLimitTruncate,
+			// Half of the maximum size is reserved for the marker.
+			want: func(ls *LogStreamer) string { return input[:50] + ls.limitMarker() },
+		},
+		{
+			policy: LogLimitHeadTail,
+			// The tail is 20 bytes, and a quarter of the maximum size is
+			// reserved for the markers.
+			want: func(ls *LogStreamer) string {
+				return input[:55] + ls.limitMarker() + "\n~~~ ✂️ 125 B of output omitted\n" + input[180:]
+			},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.policy, func(t *testing.T) {
+			t.Parallel()
+
+			var mu sync.Mutex
+			var got []*LogStreamerChunk
+			callback := func(ctx context.Context, chunk *LogStreamerChunk) error {
+				mu.Lock()
+				got = append(got, chunk)
+				mu.Unlock()
+				return nil
+			}
+
+			fullLogPath := filepath.Join(t.TempDir(), "full.log")
+			ls := NewLogStreamer(logger.Discard, callback, LogStreamerConfig{
+				Concurrency:       3,
+				MaxChunkSizeBytes: 10,
+				MaxSizeBytes:      100,
+				LimitPolicy:       test.policy,
+				TailSizeBytes:     20,
+				FullLogPath:       fullLogPath,
+			})
+			if err := ls.Start(ctx); err != nil {
+				t.Fatalf("LogStreamer.Start(ctx) = %v", err)
+			}
+
+			for i := 0; i < len(input); i += 30 {
+				part := input[i:min(i+30, len(input))]
+				if err := ls.Process(ctx, []byte(part)); err != nil {
+					t.Errorf("LogStreamer.Process(ctx, %q) = %v", part, err)
+				}
+			}
+			ls.Stop()
+
+			sort.Slice(got, func(i, j int) bool { return got[i].Order < got[j].Order })
+			var log strings.Builder
+			var offset uint64
+			for _, chunk := range got {
+				if chunk.Offset != offset {
+					t.Errorf("chunk %d Offset = %d, want %d", chunk.Order, chunk.Offset, offset)
+				}
+				offset += chunk.Size
+				log.Write(chunk.Data)
+			}
+
+			if diff := cmp.Diff(log.String(), test.want(ls)); diff != "" {
+				t.Errorf("streamed log diff (-got +want):\n%s", diff)
+			}
+
+			if got, want := ls.Limited(), test.policy != LogLimitWarn; got != want {
+				t.Errorf("LogStreamer.Limited() = %t, want %t", got, want)
+			}
+
+			full, err := os.ReadFile(fullLogPath)
+			if err != nil {
+				t.Fatalf("os.ReadFile(%q) error = %v", fullLogPath, err)
+			}
+			if diff := cmp.Diff(string(full), input); diff != "" {
+				t.Errorf("full log diff (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	t.Parallel()
+
+	tb := newTailBuffer(5)
+	for _, s := range []string{"ab", "cd", "efg", "h", "ijklmnop", "q"} {
+		tb.Write([]byte(s))
+	}
+	if got, want := string(tb.Bytes()), "mnopq"; got != want {
+		t.Errorf("tailBuffer.Bytes() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"sync/atomic"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/metrics"
+	"github.com/dustin/go-humanize"
+)
+
+// logUploadStats counts the requests made to upload a job's log, and how well
+// the log compressed.
+type logUploadStats struct {
+	requests        atomic.Int64
+	chunks          atomic.Int64
+	bytes           atomic.Int64
+	compressedBytes atomic.Int64
+}
+
+// recordRequest records an attempt to upload a chunk. If it succeeded, the
+// chunk's size before and after compression is recorded too.
+func (s *logUploadStats) recordRequest(chunk *LogStreamerChunk, response *api.Response, err error) {
+	if s == nil {
+		return
+	}
+	s.requests.Add(1)
+	if err != nil {
+		return
+	}
+	s.chunks.Add(1)
+	s.bytes.Add(int64(chunk.Size))
+	// UploadChunk sends the compressed chunk as the request body.
+	if response != nil && response.Request != nil && response.Request.ContentLength > 0 {
+		s.compressedBytes.Add(response.Request.ContentLength)
+	}
+}
+
+// compressionRatio returns the ratio of the uploaded log size to its
+// compressed size, or 0 if nothing has been uploaded.
+func (s *logUploadStats) compressionRatio() float64 {
+	compressed := s.compressedBytes.Load()
+	if compressed == 0 {
+		return 0
+	}
+	return float64(s.bytes.Load()) / float64(compressed)
+}
+
+// report logs the stats and sends them to the metrics scope.
+func (s *logUploadStats) report(l logger.Logger, scope *metrics.Scope) {
+	requests, chunks := s.requests.Load(), s.chunks.Load()
+	bytes, compressed := s.bytes.Load(), s.compressedBytes.Load()
+
+	l.Debug("[JobRunner] Uploaded %d log chunks in %d requests, compressing %s to %s (ratio %.2f)",
+		chunks, requests, humanize.IBytes(uint64(bytes)), humanize.IBytes(uint64(compressed)), s.compressionRatio())
+
+	scope.Count("logs.requests", requests)
+	scope.Count("logs.chunks", chunks)
+	scope.Count("logs.bytes", bytes)
+	scope.Count("logs.bytes.compressed", compressed)
+	if ratio := s.compressionRatio(); ratio > 0 {
+		scope.Gauge("logs.compression_ratio", ratio)
+	}
+}
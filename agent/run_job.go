@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/buildkite/agent/v3/hook"
+	"github.com/buildkite/agent/v3/internal/experiments"
 	"github.com/buildkite/agent/v3/kubernetes"
 	"github.com/buildkite/agent/v3/logger"
 	"github.com/buildkite/agent/v3/metrics"
@@ -26,6 +27,10 @@ const (
 	SignalReasonProcessRunError   = "process_run_error"
 )
 
+// fullLogArtifactPath is the artifact the full job log is uploaded as, when
+// the streamed log is limited.
+const fullLogArtifactPath = "buildkite-job-log.txt"
+
 type missingKeyError struct {
 	signature string
 }
@@ -161,6 +166,11 @@ func (r *JobRunner) Run(ctx context.Context) error {
 	go r.streamJobLogsAfterProcessStart(cctx, &wg)
 	go r.jobCancellationChecker(cctx, &wg)
 
+	if experiments.IsEnabled(ctx, experiments.AgentAPI) {
+		wg.Add(1)
+		go r.lockLeaseRenewer(cctx, &wg)
+	}
+
 	exit = r.runJob(cctx)
 
 	return nil
@@ -257,6 +267,9 @@ func (r *JobRunner) cleanup(ctx context.Context, wg *sync.WaitGroup, exit proces
 	// Stop the log streamer. This will block until all the chunks have been uploaded
 	r.logStreamer.Stop()
 
+	// If the streamed log was limited, upload the full log as an artifact
+	r.uploadFullLog(ctx)
+
 	// Stop the header time streamer. This will block until all the chunks have been uploaded
 	r.headerTimesStreamer.Stop()
 
@@ -269,6 +282,11 @@ func (r *JobRunner) cleanup(ctx context.Context, wg *sync.WaitGroup, exit proces
 	r.agentLogger.Debug("[JobRunner] Waiting for all other routines to finish")
 	wg.Wait()
 
+	// Release any locks the job still holds under a lease
+	if experiments.IsEnabled(ctx, experiments.AgentAPI) {
+		r.releaseLockLeases(ctx)
+	}
+
 	// Remove the env file, if any
 	if r.envFile != nil {
 		if err := os.Remove(r.envFile.Name()); err != nil {
@@ -287,6 +305,7 @@ func (r *JobRunner) cleanup(ctx context.Context, wg *sync.WaitGroup, exit proces
 		jobMetrics.Timing("jobs.duration.error", finishedAt.Sub(r.startedAt))
 		jobMetrics.Count("jobs.failed", 1)
 	}
+	r.logUploadStats.report(r.agentLogger, r.conf.MetricsScope)
 
 	// Finish the build in the Buildkite Agent API
 	// Once we tell the API we're finished it might assign us new work, so make sure everything else is done first.
@@ -295,6 +314,34 @@ func (r *JobRunner) cleanup(ctx context.Context, wg *sync.WaitGroup, exit proces
 	r.agentLogger.Info("Finished job %s", r.conf.Job.ID)
 }
 
+// uploadFullLog uploads the full job log as an artifact, if it was kept and the
+// streamed log was limited, and then removes it.
+func (r *JobRunner) uploadFullLog(ctx context.Context) {
+	path := r.logStreamer.conf.FullLogPath
+	if path == "" {
+		return
+	}
+	defer func() {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			r.agentLogger.Warn("[JobRunner] Error cleaning up full job log: %v", err)
+		}
+	}()
+
+	if !r.logStreamer.Limited() {
+		return
+	}
+
+	r.agentLogger.Info("Uploading the full job log as the artifact %s", fullLogArtifactPath)
+	uploader := NewArtifactUploader(r.agentLogger, r.apiClient, ArtifactUploaderConfig{
+		JobID:       r.conf.Job.ID,
+		ContentType: "text/plain",
+		DebugHTTP:   r.conf.DebugHTTP,
+	})
+	if err := uploader.uploadFile(ctx, fullLogArtifactPath, path); err != nil {
+		r.agentLogger.Error("Couldn't upload the full job log: %v", err)
+	}
+}
+
 // finishJob finishes the job in the Buildkite Agent API. If the FinishJob call
 // cannot return successfully, this will retry for a long time.
 func (r *JobRunner) finishJob(ctx context.Context, finishedAt time.Time, exit processExit, failedChunkCount int) error {
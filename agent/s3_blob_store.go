@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// S3BlobStore is a blob store in an S3 bucket.
+type S3BlobStore struct {
+	// The bucket, and the path within it, of the blob store
+	BucketName string
+	BucketPath string
+
+	client *s3.S3
+}
+
+func NewS3BlobStore(l logger.Logger, destination string) (*S3BlobStore, error) {
+	bucketName, bucketPath := ParseS3Destination(destination)
+	client, err := s3ClientFor(l, bucketName)
+	if err != nil {
+		return nil, err
+	}
+	return &S3BlobStore{
+		BucketName: bucketName,
+		BucketPath: bucketPath,
+		client:     client,
+	}, nil
+}
+
+func (s *S3BlobStore) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.BucketName),
+		Key:    aws.String(path.Join(s.BucketPath, key)),
+	})
+	var reqErr awserr.RequestFailure
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.As(err, &reqErr) && reqErr.StatusCode() == http.StatusNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func (s *S3BlobStore) List(ctx context.Context, prefix string) ([]BlobStoreObject, error) {
+	root := s.BucketPath
+	if root != "" {
+		root += "/"
+	}
+
+	var objects []BlobStoreObject
+	err := s.client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.BucketName),
+		Prefix: aws.String(root + prefix),
+	}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, obj := range page.Contents {
+			objects = append(objects, BlobStoreObject{
+				Key:     aws.StringValue(obj.Key)[len(root):],
+				Size:    aws.Int64Value(obj.Size),
+				ModTime: aws.TimeValue(obj.LastModified),
+			})
+		}
+		return true
+	})
+	return objects, err
+}
+
+func (s *S3BlobStore) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.BucketName),
+		Key:    aws.String(path.Join(s.BucketPath, key)),
+	})
+	return err
+}
@@ -31,6 +31,12 @@ type S3DownloaderConfig struct {
 
 	// If failed responses should be dumped to the log
 	DebugHTTP bool
+
+	// The size of the artifact, if known
+	Size int64
+
+	// Whether to give up without retrying if the artifact doesn't exist
+	FailFastIfMissing bool
 }
 
 type S3Downloader struct {
@@ -65,11 +71,13 @@ func (d S3Downloader) Start(ctx context.Context) error {
 
 	// We can now cheat and pass the URL onto our regular downloader
 	return NewDownload(d.logger, http.DefaultClient, DownloadConfig{
-		URL:         signedURL,
-		Path:        d.conf.Path,
-		Destination: d.conf.Destination,
-		Retries:     d.conf.Retries,
-		DebugHTTP:   d.conf.DebugHTTP,
+		URL:               signedURL,
+		Path:              d.conf.Path,
+		Destination:       d.conf.Destination,
+		Retries:           d.conf.Retries,
+		DebugHTTP:         d.conf.DebugHTTP,
+		Size:              d.conf.Size,
+		FailFastIfMissing: d.conf.FailFastIfMissing,
 	}).Start(ctx)
 }
 
@@ -2,18 +2,35 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/logger"
 )
 
+const (
+	// Files larger than the part size are uploaded to S3 in parts, several at
+	// once, and each part is retried on its own if it fails. If the upload
+	// still fails, the next attempt resumes it, only uploading the missing
+	// parts. The part size grows for very large files, as S3 allows at most
+	// 10,000 parts.
+	s3UploadPartSize    = 16 * 1024 * 1024
+	s3UploadConcurrency = 4
+	s3UploadPartRetries = 10
+)
+
 type S3UploaderConfig struct {
 	// The destination which includes the S3 bucket name and the path.
 	// For example, s3://my-bucket-name/foo/bar
@@ -38,6 +55,13 @@ type S3Uploader struct {
 
 	// The logger instance to use
 	logger logger.Logger
+
+	// Multipart uploads from failed attempts, by key, to resume on retry
+	uploadsMu sync.Mutex
+	uploads   map[string]*s3MultipartUpload
+
+	// Overrides the size of the parts that files are uploaded in, for testing
+	partSize int64
 }
 
 func NewS3Uploader(l logger.Logger, c S3UploaderConfig) (*S3Uploader, error) {
@@ -81,41 +105,266 @@ func (u *S3Uploader) URL(artifact *api.Artifact) string {
 	return url.String()
 }
 
-func (u *S3Uploader) Upload(_ context.Context, artifact *api.Artifact) error {
+func (u *S3Uploader) Upload(ctx context.Context, artifact *api.Artifact) error {
 
 	permission, err := u.resolvePermission()
 	if err != nil {
 		return err
 	}
 
-	// Create an uploader with the session and default options
-	uploader := s3manager.NewUploaderWithClient(u.client)
-
 	// Open file from filesystem
 	u.logger.Debug("Reading file \"%s\"", artifact.AbsolutePath)
-	f, err := os.Open(artifact.AbsolutePath)
+	f, err := openArtifactFile(artifact.AbsolutePath)
 	if err != nil {
 		return fmt.Errorf("failed to open file %q (%v)", artifact.AbsolutePath, err)
 	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
 
 	// Upload the file to S3.
-	u.logger.Debug("Uploading \"%s\" to bucket with permission `%s`", u.artifactPath(artifact), permission)
+	key := u.artifactPath(artifact)
+	u.logger.Debug("Uploading \"%s\" to bucket with permission `%s`", key, permission)
 
-	params := &s3manager.UploadInput{
-		Bucket:      aws.String(u.BucketName),
-		Key:         aws.String(u.artifactPath(artifact)),
-		ContentType: aws.String(artifact.ContentType),
-		ACL:         aws.String(permission),
-		Body:        f,
-	}
+	var sse *string
 	// if enabled we assign the sse configuration
 	if u.serverSideEncryptionEnabled() {
-		params.ServerSideEncryption = aws.String("AES256")
+		sse = aws.String("AES256")
+	}
+
+	size, partSize := info.Size(), u.uploadPartSize(info.Size())
+	if size <= partSize {
+		_, err := u.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+			Bucket:               aws.String(u.BucketName),
+			Key:                  aws.String(key),
+			ContentType:          aws.String(artifact.ContentType),
+			ACL:                  aws.String(permission),
+			ServerSideEncryption: sse,
+			Body:                 f,
+		}, s3UploadRetries)
+		return err
+	}
+
+	upload, err := u.startMultipartUpload(ctx, key, size, partSize, &s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(u.BucketName),
+		Key:                  aws.String(key),
+		ContentType:          aws.String(artifact.ContentType),
+		ACL:                  aws.String(permission),
+		ServerSideEncryption: sse,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := u.uploadParts(ctx, f, key, upload); err != nil {
+		u.forgetMultipartUploadIfGone(key, err)
+		return err
+	}
+
+	_, err = u.client.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(u.BucketName),
+		Key:             aws.String(key),
+		UploadId:        aws.String(upload.id),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: upload.completedParts()},
+	}, s3UploadRetries)
+	if err != nil {
+		u.forgetMultipartUploadIfGone(key, err)
+		return err
+	}
+
+	u.uploadsMu.Lock()
+	delete(u.uploads, key)
+	u.uploadsMu.Unlock()
+	return nil
+}
+
+// s3UploadRetries retries each request of an upload on its own, so that a
+// failed part doesn't fail the whole upload.
+func s3UploadRetries(r *request.Request) {
+	r.Retryer = client.DefaultRetryer{NumMaxRetries: s3UploadPartRetries}
+}
+
+// uploadPartSize returns the size of the parts to upload a file in.
+func (u *S3Uploader) uploadPartSize(size int64) int64 {
+	partSize := int64(s3UploadPartSize)
+	if u.partSize > 0 {
+		partSize = u.partSize
+	}
+	if size/partSize >= s3manager.MaxUploadParts {
+		partSize = size/s3manager.MaxUploadParts + 1
+	}
+	return partSize
+}
+
+// s3MultipartUpload is a multipart upload of a file to S3. It's kept between
+// attempts to upload the file, so that a retry only uploads the parts that
+// haven't been uploaded yet, rather than starting again.
+type s3MultipartUpload struct {
+	id       string
+	size     int64
+	partSize int64
+
+	mu sync.Mutex
+	// The parts that have been uploaded, by part number (from 1)
+	parts map[int64]*s3.CompletedPart
+}
+
+func (m *s3MultipartUpload) numParts() int64 {
+	return (m.size + m.partSize - 1) / m.partSize
+}
+
+func (m *s3MultipartUpload) isUploaded(part int64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.parts[part] != nil
+}
+
+func (m *s3MultipartUpload) uploaded(part int64, etag *string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.parts[part] = &s3.CompletedPart{PartNumber: aws.Int64(part), ETag: etag}
+}
+
+// completedParts lists the uploaded parts, in order.
+func (m *s3MultipartUpload) completedParts() []*s3.CompletedPart {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	parts := make([]*s3.CompletedPart, 0, len(m.parts))
+	for i := int64(1); i <= m.numParts(); i++ {
+		if p := m.parts[i]; p != nil {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
+
+// startMultipartUpload resumes the multipart upload of the key from a previous
+// attempt, or creates a new one.
+func (u *S3Uploader) startMultipartUpload(ctx context.Context, key string, size, partSize int64, input *s3.CreateMultipartUploadInput) (*s3MultipartUpload, error) {
+	u.uploadsMu.Lock()
+	upload := u.uploads[key]
+	u.uploadsMu.Unlock()
+
+	if upload != nil && upload.size == size && upload.partSize == partSize {
+		u.logger.Debug("Resuming upload of \"%s\" (%d of %d parts already uploaded)", key, len(upload.completedParts()), upload.numParts())
+		return upload, nil
+	}
+	if upload != nil {
+		// The file has changed since the last attempt, so its parts are no use
+		u.abortMultipartUpload(ctx, key, upload)
+	}
+
+	out, err := u.client.CreateMultipartUploadWithContext(ctx, input, s3UploadRetries)
+	if err != nil {
+		return nil, err
+	}
+	upload = &s3MultipartUpload{
+		id:       aws.StringValue(out.UploadId),
+		size:     size,
+		partSize: partSize,
+		parts:    make(map[int64]*s3.CompletedPart),
+	}
+	u.keepMultipartUpload(key, upload)
+	return upload, nil
+}
+
+func (u *S3Uploader) keepMultipartUpload(key string, upload *s3MultipartUpload) {
+	u.uploadsMu.Lock()
+	defer u.uploadsMu.Unlock()
+	if u.uploads == nil {
+		u.uploads = make(map[string]*s3MultipartUpload)
+	}
+	u.uploads[key] = upload
+}
+
+// forgetMultipartUploadIfGone forgets a multipart upload that S3 no longer
+// has (for example, because a lifecycle rule aborted it), so that the next
+// attempt starts a new one.
+func (u *S3Uploader) forgetMultipartUploadIfGone(key string, err error) {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) || aerr.Code() != s3.ErrCodeNoSuchUpload {
+		return
+	}
+	u.uploadsMu.Lock()
+	defer u.uploadsMu.Unlock()
+	delete(u.uploads, key)
+}
+
+// uploadParts uploads the parts of the file that haven't been uploaded yet, in
+// parallel.
+func (u *S3Uploader) uploadParts(ctx context.Context, f io.ReaderAt, key string, upload *s3MultipartUpload) error {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	sem := make(chan struct{}, s3UploadConcurrency)
+
+	for part := int64(1); part <= upload.numParts(); part++ {
+		if upload.isUploaded(part) {
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(part int64) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			offset := (part - 1) * upload.partSize
+			length := min(upload.partSize, upload.size-offset)
+			out, err := u.client.UploadPartWithContext(ctx, &s3.UploadPartInput{
+				Bucket:        aws.String(u.BucketName),
+				Key:           aws.String(key),
+				UploadId:      aws.String(upload.id),
+				PartNumber:    aws.Int64(part),
+				ContentLength: aws.Int64(length),
+				Body:          io.NewSectionReader(f, offset, length),
+			}, s3UploadRetries)
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("uploading part %d of %d: %w", part, upload.numParts(), err)
+				}
+				mu.Unlock()
+				return
+			}
+			upload.uploaded(part, out.ETag)
+		}(part)
 	}
+	wg.Wait()
 
-	_, err = uploader.Upload(params)
+	return firstErr
+}
 
-	return err
+// AbortPartialUploads abandons the multipart uploads that are left over from
+// artifacts that failed to upload, so that S3 doesn't keep (and charge for)
+// their parts.
+func (u *S3Uploader) AbortPartialUploads(ctx context.Context) {
+	u.uploadsMu.Lock()
+	uploads := u.uploads
+	u.uploads = nil
+	u.uploadsMu.Unlock()
+
+	for key, upload := range uploads {
+		u.abortMultipartUpload(ctx, key, upload)
+	}
+}
+
+func (u *S3Uploader) abortMultipartUpload(ctx context.Context, key string, upload *s3MultipartUpload) {
+	_, err := u.client.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(u.BucketName),
+		Key:      aws.String(key),
+		UploadId: aws.String(upload.id),
+	}, s3UploadRetries)
+	if err != nil {
+		u.logger.Warn("Couldn't abort the partial upload of \"%s\": %v", key, err)
+	}
 }
 
 func (u *S3Uploader) artifactPath(artifact *api.Artifact) string {
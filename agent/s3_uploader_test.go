@@ -1,9 +1,26 @@
 package agent
 
 import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"testing"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/google/go-cmp/cmp"
 	"github.com/stretchr/testify/require"
 )
 
@@ -88,3 +105,174 @@ func TestResolvePermission(t *testing.T) {
 		os.Unsetenv("BUILDKITE_S3_ACL")
 	}
 }
+
+// fakeS3 is just enough of S3 to upload objects to, in one request or in
+// parts.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte // parts by part number, by upload ID
+
+	creates   int
+	partPuts  map[int]int // requests to upload each part
+	failParts map[int]int // how many times to fail each part
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects:   make(map[string][]byte),
+		uploads:   make(map[string]map[int][]byte),
+		partPuts:  make(map[int]int),
+		failParts: make(map[int]int),
+	}
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	q := r.URL.Query()
+	uploadID := q.Get("uploadId")
+
+	switch {
+	case r.Method == http.MethodPut && uploadID == "":
+		s.objects[r.URL.Path] = body
+
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		s.creates++
+		uploadID = fmt.Sprintf("upload-%d", s.creates)
+		s.uploads[uploadID] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", uploadID)
+
+	case r.Method == http.MethodPut:
+		part, _ := strconv.Atoi(q.Get("partNumber"))
+		s.partPuts[part]++
+		if s.failParts[part] > 0 {
+			s.failParts[part]--
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "<Error><Code>BadDigest</Code><Message>llamas ate the part</Message></Error>")
+			return
+		}
+		s.uploads[uploadID][part] = body
+		w.Header().Set("ETag", fmt.Sprintf("%q", fmt.Sprintf("etag-%d", part)))
+
+	case r.Method == http.MethodPost:
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var object []byte
+		for _, p := range complete.Parts {
+			object = append(object, s.uploads[uploadID][p.PartNumber]...)
+		}
+		s.objects[r.URL.Path] = object
+		delete(s.uploads, uploadID)
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+
+	case r.Method == http.MethodDelete:
+		delete(s.uploads, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func newFakeS3Uploader(t *testing.T, server *httptest.Server) *S3Uploader {
+	t.Helper()
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(server.URL),
+		Region:           aws.String("us-east-1"),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("llama", "alpaca", ""),
+	})
+	if err != nil {
+		t.Fatalf("session.NewSession(...) error = %v", err)
+	}
+	return &S3Uploader{
+		BucketName: "my-bucket",
+		BucketPath: "some/prefix",
+		client:     s3.New(sess),
+		logger:     logger.Discard,
+		partSize:   1024,
+	}
+}
+
+func TestS3UploaderResumesMultipartUploads(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	fake := newFakeS3()
+	fake.failParts[2] = 1
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	uploader := newFakeS3Uploader(t, server)
+
+	// Three and a bit parts
+	data := bytes.Repeat([]byte("llamas!"), 3*1024/7+100)
+	src := filepath.Join(t.TempDir(), "llamas.txt")
+	if err := os.WriteFile(src, data, 0o666); err != nil {
+		t.Fatalf("os.WriteFile(%q) error = %v", src, err)
+	}
+	artifact := &api.Artifact{Path: "llamas.txt", AbsolutePath: src, FileSize: int64(len(data))}
+
+	// The first attempt fails to upload part 2, and the second attempt only
+	// uploads that part, in the same multipart upload.
+	if err := uploader.Upload(ctx, artifact); err == nil {
+		t.Fatalf("uploader.Upload(ctx, artifact) error = %v, want an error", err)
+	}
+	if err := uploader.Upload(ctx, artifact); err != nil {
+		t.Fatalf("uploader.Upload(ctx, artifact) error = %v", err)
+	}
+
+	if got := fake.objects["/my-bucket/some/prefix/llamas.txt"]; !bytes.Equal(got, data) {
+		t.Errorf("uploaded object is %d bytes, which don't match the %d byte file", len(got), len(data))
+	}
+	if got, want := fake.creates, 1; got != want {
+		t.Errorf("multipart uploads created = %d, want %d", got, want)
+	}
+	if diff := cmp.Diff(fake.partPuts, map[int]int{1: 1, 2: 2, 3: 1, 4: 1}); diff != "" {
+		t.Errorf("part upload requests diff (-got +want):\n%s", diff)
+	}
+	if len(uploader.uploads) != 0 {
+		t.Errorf("uploader.uploads = %v, want none left over", uploader.uploads)
+	}
+}
+
+func TestS3UploaderAbortsPartialUploads(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	fake := newFakeS3()
+	fake.failParts[1] = 1
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	uploader := newFakeS3Uploader(t, server)
+
+	src := filepath.Join(t.TempDir(), "llamas.txt")
+	if err := os.WriteFile(src, bytes.Repeat([]byte("l"), 2048), 0o666); err != nil {
+		t.Fatalf("os.WriteFile(%q) error = %v", src, err)
+	}
+	if err := uploader.Upload(ctx, &api.Artifact{Path: "llamas.txt", AbsolutePath: src}); err == nil {
+		t.Fatalf("uploader.Upload(ctx, artifact) error = %v, want an error", err)
+	}
+	if got, want := len(fake.uploads), 1; got != want {
+		t.Fatalf("multipart uploads in progress = %d, want %d", got, want)
+	}
+
+	uploader.AbortPartialUploads(ctx)
+	if got, want := len(fake.uploads), 0; got != want {
+		t.Errorf("multipart uploads in progress after AbortPartialUploads = %d, want %d", got, want)
+	}
+}
@@ -14,3 +14,13 @@ type Uploader interface {
 	// The actual uploading of the file
 	Upload(context.Context, *api.Artifact) error
 }
+
+// partialUploader is an Uploader that keeps what it has uploaded of an
+// artifact when an attempt fails, so that the next attempt resumes the upload.
+type partialUploader interface {
+	Uploader
+
+	// AbortPartialUploads abandons what's left of the uploads of artifacts
+	// that failed to upload, once there are no more attempts.
+	AbortPartialUploads(context.Context)
+}
@@ -5,8 +5,25 @@ import (
 	"compress/gzip"
 	"context"
 	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
 )
 
+// gzipWriters holds gzip writers for reuse between chunks. Each writer holds
+// several hundred KiB of compression state, which is wasteful to allocate for
+// every chunk of a chatty job.
+var gzipWriters = sync.Pool{
+	New: func() any { return gzip.NewWriter(nil) },
+}
+
+// zstdEncoder compresses chunks with zstd. A single encoder is shared by every
+// chunk upload (EncodeAll is safe for concurrent use), so its compression
+// state is only allocated once.
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+
 // Chunk represents a Buildkite Agent API Chunk
 type Chunk struct {
 	Data     []byte
@@ -17,13 +34,47 @@ type Chunk struct {
 
 // Uploads the chunk to the Buildkite Agent API. This request sends the
 // compressed log directly as a request body.
+//
+// Chunks are compressed with gzip, unless Buildkite has said it accepts zstd
+// (by listing it in an Accept-Encoding header in a response to an earlier
+// chunk upload), which compresses logs better and faster. If a zstd chunk is
+// rejected as an unsupported encoding, the chunk is uploaded again with gzip,
+// and so are later chunks.
 func (c *Client) UploadChunk(ctx context.Context, jobId string, chunk *Chunk) (*Response, error) {
+	encoding := "gzip"
+	if c.zstdChunks.Load() {
+		encoding = "zstd"
+	}
+
+	resp, err := c.uploadChunk(ctx, jobId, chunk, encoding)
+	if encoding == "zstd" && resp != nil && resp.StatusCode == http.StatusUnsupportedMediaType {
+		c.zstdChunks.Store(false)
+		return c.uploadChunk(ctx, jobId, chunk, "gzip")
+	}
+	if resp != nil && acceptsEncoding(resp.Header, "zstd") {
+		c.zstdChunks.Store(true)
+	}
+	return resp, err
+}
+
+func (c *Client) uploadChunk(ctx context.Context, jobId string, chunk *Chunk, encoding string) (*Response, error) {
 	// Create a compressed buffer of the log content
-	body := &bytes.Buffer{}
-	gzipper := gzip.NewWriter(body)
-	gzipper.Write(chunk.Data)
-	if err := gzipper.Close(); err != nil {
-		return nil, err
+	var body *bytes.Buffer
+	switch encoding {
+	case "zstd":
+		body = bytes.NewBuffer(zstdEncoder.EncodeAll(chunk.Data, nil))
+
+	default:
+		body = &bytes.Buffer{}
+		gzipper := gzipWriters.Get().(*gzip.Writer)
+		gzipper.Reset(body)
+		if _, err := gzipper.Write(chunk.Data); err != nil {
+			return nil, err
+		}
+		if err := gzipper.Close(); err != nil {
+			return nil, err
+		}
+		gzipWriters.Put(gzipper)
 	}
 
 	// Pass most params as query
@@ -35,7 +86,21 @@ func (c *Client) UploadChunk(ctx context.Context, jobId string, chunk *Chunk) (*
 
 	// Mark the request as a direct compressed log chunk
 	req.Header.Add("Content-Type", "text/plain")
-	req.Header.Add("Content-Encoding", "gzip")
+	req.Header.Add("Content-Encoding", encoding)
 
 	return c.doRequest(req, nil)
 }
+
+// acceptsEncoding reports whether the Accept-Encoding header (sent in a
+// response, per RFC 7694) lists the content coding.
+func acceptsEncoding(h http.Header, coding string) bool {
+	for _, v := range h.Values("Accept-Encoding") {
+		for _, part := range strings.Split(v, ",") {
+			name, _, _ := strings.Cut(part, ";")
+			if strings.EqualFold(strings.TrimSpace(name), coding) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+package api_test
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/google/go-cmp/cmp"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestUploadChunk(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	var got []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/jobs/job-uuid/chunks" {
+			http.Error(rw, fmt.Sprintf("not found; method = %q, path = %q", req.Method, req.URL.Path), http.StatusNotFound)
+			return
+		}
+		if got, want := req.Header.Get("Content-Encoding"), "gzip"; got != want {
+			http.Error(rw, fmt.Sprintf("Content-Encoding = %q, want %q", got, want), http.StatusBadRequest)
+			return
+		}
+		zr, err := gzip.NewReader(req.Body)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, err := io.ReadAll(zr)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		got = append(got, fmt.Sprintf("%s %s", req.URL.RawQuery, data))
+		rw.WriteHeader(http.StatusCreated)
+		fmt.Fprint(rw, `{}`)
+	}))
+	defer server.Close()
+
+	c := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamas",
+	})
+
+	// Upload more than one chunk, so that a reused gzip writer is exercised.
+	chunks := []*api.Chunk{
+		{Data: []byte("llamas"), Sequence: 1, Offset: 0, Size: 6},
+		{Data: []byte("alpacas"), Sequence: 2, Offset: 6, Size: 7},
+	}
+	for _, chunk := range chunks {
+		if _, err := c.UploadChunk(ctx, "job-uuid", chunk); err != nil {
+			t.Fatalf("c.UploadChunk(ctx, job-uuid, %v) error = %v", chunk, err)
+		}
+	}
+
+	want := []string{
+		"sequence=1&offset=0&size=6 llamas",
+		"sequence=2&offset=6&size=7 alpacas",
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("uploaded chunks diff (-got +want):\n%s", diff)
+	}
+}
+
+// chunkServer serves the chunks endpoint, decoding gzip and (if acceptZstd is
+// set) zstd chunks. It records each upload as its encoding, query and data.
+func chunkServer(t *testing.T, acceptZstd, advertiseZstd bool) (*httptest.Server, func() []string) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var got []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if advertiseZstd {
+			rw.Header().Set("Accept-Encoding", "zstd, gzip")
+		}
+		var r io.Reader
+		switch enc := req.Header.Get("Content-Encoding"); {
+		case enc == "gzip":
+			zr, err := gzip.NewReader(req.Body)
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			r = zr
+
+		case enc == "zstd" && acceptZstd:
+			zr, err := zstd.NewReader(req.Body)
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer zr.Close()
+			r = zr
+
+		default:
+			http.Error(rw, fmt.Sprintf("unsupported Content-Encoding %q", enc), http.StatusUnsupportedMediaType)
+			return
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		got = append(got, fmt.Sprintf("%s %s %s", req.Header.Get("Content-Encoding"), req.URL.RawQuery, data))
+		mu.Unlock()
+		rw.WriteHeader(http.StatusCreated)
+		fmt.Fprint(rw, `{}`)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return got
+	}
+}
+
+func TestUploadChunkNegotiatesZstd(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	tests := []struct {
+		desc                      string
+		acceptZstd, advertiseZstd bool
+		want                      []string
+	}{
+		{
+			desc:       "server doesn't advertise zstd",
+			acceptZstd: true,
+			want: []string{
+				"gzip sequence=1&offset=0&size=6 llamas",
+				"gzip sequence=2&offset=6&size=7 alpacas",
+			},
+		},
+		{
+			desc:          "server advertises zstd",
+			acceptZstd:    true,
+			advertiseZstd: true,
+			want: []string{
+				"gzip sequence=1&offset=0&size=6 llamas",
+				"zstd sequence=2&offset=6&size=7 alpacas",
+			},
+		},
+		{
+			desc:          "server advertises zstd, but rejects it",
+			advertiseZstd: true,
+			want: []string{
+				"gzip sequence=1&offset=0&size=6 llamas",
+				"gzip sequence=2&offset=6&size=7 alpacas",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			server, uploads := chunkServer(t, test.acceptZstd, test.advertiseZstd)
+			c := api.NewClient(logger.Discard, api.Config{
+				Endpoint: server.URL,
+				Token:    "llamas",
+			})
+
+			chunks := []*api.Chunk{
+				{Data: []byte("llamas"), Sequence: 1, Offset: 0, Size: 6},
+				{Data: []byte("alpacas"), Sequence: 2, Offset: 6, Size: 7},
+			}
+			for _, chunk := range chunks {
+				if _, err := c.UploadChunk(ctx, "job-uuid", chunk); err != nil {
+					t.Fatalf("c.UploadChunk(ctx, job-uuid, %v) error = %v", chunk, err)
+				}
+			}
+
+			if diff := cmp.Diff(uploads(), test.want); diff != "" {
+				t.Errorf("uploaded chunks diff (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
@@ -17,6 +17,7 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/buildkite/agent/v3/logger"
@@ -60,6 +61,9 @@ type Client struct {
 
 	// The logger used
 	logger logger.Logger
+
+	// Whether Buildkite accepts log chunks compressed with zstd
+	zstdChunks atomic.Bool
 }
 
 // NewClient returns a new Buildkite Agent API Client.
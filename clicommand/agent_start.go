@@ -25,6 +25,7 @@ import (
 	"github.com/buildkite/agent/v3/internal/agentapi"
 	"github.com/buildkite/agent/v3/internal/experiments"
 	"github.com/buildkite/agent/v3/internal/job/shell"
+	"github.com/buildkite/agent/v3/internal/redact"
 	"github.com/buildkite/agent/v3/internal/utils"
 	"github.com/buildkite/agent/v3/logger"
 	"github.com/buildkite/agent/v3/metrics"
@@ -33,6 +34,7 @@ import (
 	"github.com/buildkite/agent/v3/tracetools"
 	"github.com/buildkite/agent/v3/version"
 	"github.com/buildkite/shellwords"
+	"github.com/dustin/go-humanize"
 	"github.com/lestrrat-go/jwx/v2/jwk"
 	"github.com/mitchellh/go-homedir"
 	"github.com/urfave/cli"
@@ -72,6 +74,8 @@ type AgentStartConfig struct {
 	Spawn             int      `cli:"spawn"`
 	SpawnWithPriority bool     `cli:"spawn-with-priority"`
 	RedactedVars      []string `cli:"redacted-vars" normalize:"list"`
+	RedactedDetectors []string `cli:"redacted-detectors" normalize:"list"`
+	RedactedPatterns  string   `cli:"redacted-patterns"`
 	CancelSignal      string   `cli:"cancel-signal"`
 
 	SigningJWKSFile  string `cli:"signing-jwks-file" normalize:"filepath"`
@@ -88,6 +92,9 @@ type AgentStartConfig struct {
 
 	EnableJobLogTmpfile bool   `cli:"enable-job-log-tmpfile"`
 	JobLogPath          string `cli:"job-log-path" normalize:"filepath"`
+	SpoolJobLogs        bool   `cli:"spool-job-logs"`
+	JobLogLimitPolicy   string `cli:"job-log-limit-policy"`
+	JobLogTailSize      string `cli:"job-log-tail-size"`
 
 	LogFormat            string `cli:"log-format"`
 	WriteJobLogsToStdout bool   `cli:"write-job-logs-to-stdout"`
@@ -97,6 +104,9 @@ type AgentStartConfig struct {
 	SocketsPath string `cli:"sockets-path" normalize:"filepath"`
 	PluginsPath string `cli:"plugins-path" normalize:"filepath"`
 
+	LockBackend      string `cli:"lock-backend"`
+	LockBackendToken string `cli:"lock-backend-token"`
+
 	Shell           string `cli:"shell"`
 	BootstrapScript string `cli:"bootstrap-script" normalize:"commandpath"`
 	NoPTY           bool   `cli:"no-pty"`
@@ -118,15 +128,19 @@ type AgentStartConfig struct {
 	WaitForECSMetaDataTimeout string   `cli:"wait-for-ecs-meta-data-timeout"`
 	WaitForGCPLabelsTimeout   string   `cli:"wait-for-gcp-labels-timeout"`
 
-	GitCheckoutFlags      string `cli:"git-checkout-flags"`
-	GitCloneFlags         string `cli:"git-clone-flags"`
-	GitCloneMirrorFlags   string `cli:"git-clone-mirror-flags"`
-	GitCleanFlags         string `cli:"git-clean-flags"`
-	GitFetchFlags         string `cli:"git-fetch-flags"`
-	GitMirrorsPath        string `cli:"git-mirrors-path" normalize:"filepath"`
-	GitMirrorsLockTimeout int    `cli:"git-mirrors-lock-timeout"`
-	GitMirrorsSkipUpdate  bool   `cli:"git-mirrors-skip-update"`
-	NoGitSubmodules       bool   `cli:"no-git-submodules"`
+	GitCheckoutFlags              string        `cli:"git-checkout-flags"`
+	GitCloneFlags                 string        `cli:"git-clone-flags"`
+	GitCloneMirrorFlags           string        `cli:"git-clone-mirror-flags"`
+	GitCleanFlags                 string        `cli:"git-clean-flags"`
+	GitFetchFlags                 string        `cli:"git-fetch-flags"`
+	GitMirrorsPath                string        `cli:"git-mirrors-path" normalize:"filepath"`
+	GitMirrorsLockTimeout         int           `cli:"git-mirrors-lock-timeout"`
+	GitMirrorsSkipUpdate          bool          `cli:"git-mirrors-skip-update"`
+	GitMirrorsSeedPath            string        `cli:"git-mirrors-seed-path"`
+	GitMirrorsMaintenanceInterval time.Duration `cli:"git-mirrors-maintenance-interval"`
+	GitMirrorsMaxAge              time.Duration `cli:"git-mirrors-max-age"`
+	GitMirrorsMaxSize             string        `cli:"git-mirrors-max-size"`
+	NoGitSubmodules               bool          `cli:"no-git-submodules"`
 
 	NoSSHKeyscan        bool     `cli:"no-ssh-keyscan"`
 	NoCommandEval       bool     `cli:"no-command-eval"`
@@ -324,6 +338,23 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Location to store job logs created by configuring ′enable-job-log-tmpfile`, by default job log will be stored in TempDir",
 			EnvVar: "BUILDKITE_JOB_LOG_PATH",
 		},
+		cli.BoolFlag{
+			Name:   "spool-job-logs",
+			Usage:  "Spool job log chunks to disk (within the build path) until they have been uploaded, so that logs that couldn't be uploaded (e.g. during an outage, or if the agent stops) are uploaded once uploading works again, or when the agent next starts",
+			EnvVar: "BUILDKITE_SPOOL_JOB_LOGS",
+		},
+		cli.StringFlag{
+			Name:   "job-log-limit-policy",
+			Value:  agent.LogLimitWarn,
+			Usage:  fmt.Sprintf("What to do when a job log exceeds the maximum log size. One of: %v. With ′warn′, the whole log is streamed anyway. With ′truncate′, the log stops at the maximum size. With ′head-tail′, the start of the log and the last ′job-log-tail-size′ of output are kept. When the log is limited, the full log is uploaded as an artifact", agent.LogLimitPolicies),
+			EnvVar: "BUILDKITE_JOB_LOG_LIMIT_POLICY",
+		},
+		cli.StringFlag{
+			Name:   "job-log-tail-size",
+			Value:  "",
+			Usage:  "How much of the end of a job log to keep with the ′head-tail′ job log limit policy (e.g. ′10MiB′). Defaults to a quarter of the maximum log size",
+			EnvVar: "BUILDKITE_JOB_LOG_TAIL_SIZE",
+		},
 		cli.BoolFlag{
 			Name:   "write-job-logs-to-stdout",
 			Usage:  "Writes job logs to the agent process' stdout. This simplifies log collection if running agents in Docker.",
@@ -460,6 +491,28 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Skip updating the Git mirror",
 			EnvVar: "BUILDKITE_GIT_MIRRORS_SKIP_UPDATE",
 		},
+		cli.StringFlag{
+			Name:   "git-mirrors-seed-path",
+			Value:  "",
+			Usage:  "Directory or artifact location (e.g. s3://my-bucket/git-mirrors) to find bundles or tar archives to create missing git mirrors from, instead of cloning them",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_SEED_PATH",
+		},
+		cli.DurationFlag{
+			Name:   "git-mirrors-maintenance-interval",
+			Usage:  "How often to garbage collect git mirrors, and remove mirrors according to --git-mirrors-max-age and --git-mirrors-max-size. Mirrors aren't maintained if this is zero",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_MAINTENANCE_INTERVAL",
+		},
+		cli.DurationFlag{
+			Name:   "git-mirrors-max-age",
+			Usage:  "Remove git mirrors that haven't been used by a job for longer than this duration, for example ′720h′. Zero keeps mirrors regardless of age",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_MAX_AGE",
+		},
+		cli.StringFlag{
+			Name:   "git-mirrors-max-size",
+			Value:  "",
+			Usage:  "Remove the least recently used git mirrors while the mirrors use more disk space than this, for example ′50GB′",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_MAX_SIZE",
+		},
 		cli.StringFlag{
 			Name:   "bootstrap-script",
 			Value:  "",
@@ -484,6 +537,18 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Directory where the agent will place sockets",
 			EnvVar: "BUILDKITE_SOCKETS_PATH",
 		},
+		cli.StringFlag{
+			Name:   "lock-backend",
+			Value:  "memory",
+			Usage:  "Where the agent-api experiment stores locks: \"memory\", a file:// URL to persist locks across restarts, or the http(s):// URL of a lock server shared between hosts",
+			EnvVar: "BUILDKITE_LOCK_BACKEND",
+		},
+		cli.StringFlag{
+			Name:   "lock-backend-token",
+			Value:  "",
+			Usage:  "A bearer token to send to a http(s):// lock backend",
+			EnvVar: "BUILDKITE_LOCK_BACKEND_TOKEN",
+		},
 		cli.StringFlag{
 			Name:   "plugins-path",
 			Value:  "",
@@ -557,22 +622,9 @@ var AgentStartCommand = cli.Command{
 			Usage:  `A comma-separated list of regular expressions representing plugins the agent is allowed to use (for example, "^buildkite-plugins/.*$" or "^/var/lib/buildkite-plugins/.*")`,
 			EnvVar: "BUILDKITE_ALLOWED_PLUGINS",
 		},
-		cli.BoolFlag{
-			Name:   "metrics-datadog",
-			Usage:  "Send metrics to DogStatsD for Datadog",
-			EnvVar: "BUILDKITE_METRICS_DATADOG",
-		},
-		cli.StringFlag{
-			Name:   "metrics-datadog-host",
-			Usage:  "The dogstatsd instance to send metrics to using udp",
-			EnvVar: "BUILDKITE_METRICS_DATADOG_HOST",
-			Value:  "127.0.0.1:8125",
-		},
-		cli.BoolFlag{
-			Name:   "metrics-datadog-distributions",
-			Usage:  "Use Datadog Distributions for Timing metrics",
-			EnvVar: "BUILDKITE_METRICS_DATADOG_DISTRIBUTIONS",
-		},
+		MetricsDatadogFlag,
+		MetricsDatadogHostFlag,
+		MetricsDatadogDistributionsFlag,
 		cli.StringFlag{
 			Name:   "log-format",
 			Usage:  "The format to use for the logger output",
@@ -639,6 +691,8 @@ var AgentStartCommand = cli.Command{
 		ExperimentsFlag,
 		ProfileFlag,
 		RedactedVars,
+		RedactedDetectorsFlag,
+		RedactedPatternsFlag,
 		StrictSingleHooksFlag,
 
 		// Deprecated flags which will be removed in v4
@@ -707,6 +761,19 @@ var AgentStartCommand = cli.Command{
 			}
 		}
 
+		if cfg.JobLogLimitPolicy != "" && !slices.Contains(agent.LogLimitPolicies, cfg.JobLogLimitPolicy) {
+			return fmt.Errorf("invalid job log limit policy %q. Must be one of: %v", cfg.JobLogLimitPolicy, agent.LogLimitPolicies)
+		}
+
+		var jobLogTailSize uint64
+		if cfg.JobLogTailSize != "" {
+			size, err := humanize.ParseBytes(cfg.JobLogTailSize)
+			if err != nil {
+				return fmt.Errorf("invalid job log tail size %q: %w", cfg.JobLogTailSize, err)
+			}
+			jobLogTailSize = size
+		}
+
 		// Force some settings if on Windows (these aren't supported yet)
 		if runtime.GOOS == "windows" {
 			cfg.NoPTY = true
@@ -759,6 +826,15 @@ var AgentStartCommand = cli.Command{
 			cfg.DisconnectAfterIdleTimeout = cfg.DisconnectAfterJobTimeout
 		}
 
+		var gitMirrorsMaxSize uint64
+		if cfg.GitMirrorsMaxSize != "" {
+			size, err := humanize.ParseBytes(cfg.GitMirrorsMaxSize)
+			if err != nil {
+				return fmt.Errorf("invalid git mirrors max size %q: %w", cfg.GitMirrorsMaxSize, err)
+			}
+			gitMirrorsMaxSize = size
+		}
+
 		var ec2TagTimeout time.Duration
 		if t := cfg.WaitForEC2TagsTimeout; t != "" {
 			var err error
@@ -795,6 +871,11 @@ var AgentStartCommand = cli.Command{
 			}
 		}
 
+		redactedPatterns := splitRedactedPatterns(cfg.RedactedPatterns)
+		if _, err := redact.Patterns(cfg.RedactedDetectors, redactedPatterns); err != nil {
+			return err
+		}
+
 		if cfg.CancelGracePeriod <= cfg.SignalGracePeriodSeconds {
 			return errors.New("cancel-grace-period must be greater than signal-grace-period-seconds")
 		}
@@ -817,7 +898,11 @@ var AgentStartCommand = cli.Command{
 		}
 
 		if experiments.IsEnabled(ctx, experiments.AgentAPI) {
-			shutdown, err := runAgentAPI(ctx, l, cfg.SocketsPath)
+			lockStore, err := agentapi.NewLockStore(cfg.LockBackend, cfg.LockBackendToken)
+			if err != nil {
+				return err
+			}
+			shutdown, err := runAgentAPI(ctx, l, cfg.SocketsPath, lockStore, cfg.LockBackend)
 			if err != nil {
 				return err
 			}
@@ -843,43 +928,55 @@ var AgentStartCommand = cli.Command{
 
 		// AgentConfiguration is the runtime configuration for an agent
 		agentConf := agent.AgentConfiguration{
-			BootstrapScript:              cfg.BootstrapScript,
-			BuildPath:                    cfg.BuildPath,
-			SocketsPath:                  cfg.SocketsPath,
-			GitMirrorsPath:               cfg.GitMirrorsPath,
-			GitMirrorsLockTimeout:        cfg.GitMirrorsLockTimeout,
-			GitMirrorsSkipUpdate:         cfg.GitMirrorsSkipUpdate,
-			HooksPath:                    cfg.HooksPath,
-			PluginsPath:                  cfg.PluginsPath,
-			GitCheckoutFlags:             cfg.GitCheckoutFlags,
-			GitCloneFlags:                cfg.GitCloneFlags,
-			GitCloneMirrorFlags:          cfg.GitCloneMirrorFlags,
-			GitCleanFlags:                cfg.GitCleanFlags,
-			GitFetchFlags:                cfg.GitFetchFlags,
-			GitSubmodules:                !cfg.NoGitSubmodules,
-			SSHKeyscan:                   !cfg.NoSSHKeyscan,
-			CommandEval:                  !cfg.NoCommandEval,
-			PluginsEnabled:               !cfg.NoPlugins,
-			PluginValidation:             !cfg.NoPluginValidation,
-			LocalHooksEnabled:            !cfg.NoLocalHooks,
-			StrictSingleHooks:            cfg.StrictSingleHooks,
-			RunInPty:                     !cfg.NoPTY,
-			ANSITimestamps:               !cfg.NoANSITimestamps,
-			TimestampLines:               cfg.TimestampLines,
-			DisconnectAfterJob:           cfg.DisconnectAfterJob,
-			DisconnectAfterIdleTimeout:   cfg.DisconnectAfterIdleTimeout,
-			CancelGracePeriod:            cfg.CancelGracePeriod,
-			SignalGracePeriod:            signalGracePeriod,
-			EnableJobLogTmpfile:          cfg.EnableJobLogTmpfile,
-			JobLogPath:                   cfg.JobLogPath,
-			WriteJobLogsToStdout:         cfg.WriteJobLogsToStdout,
-			LogFormat:                    cfg.LogFormat,
-			Shell:                        cfg.Shell,
-			RedactedVars:                 cfg.RedactedVars,
-			AcquireJob:                   cfg.AcquireJob,
-			TracingBackend:               cfg.TracingBackend,
-			TracingServiceName:           cfg.TracingServiceName,
-			VerificationFailureBehaviour: cfg.VerificationFailureBehavior,
+			BootstrapScript:               cfg.BootstrapScript,
+			BuildPath:                     cfg.BuildPath,
+			SocketsPath:                   cfg.SocketsPath,
+			GitMirrorsPath:                cfg.GitMirrorsPath,
+			GitMirrorsLockTimeout:         cfg.GitMirrorsLockTimeout,
+			GitMirrorsSkipUpdate:          cfg.GitMirrorsSkipUpdate,
+			GitMirrorsSeedPath:            cfg.GitMirrorsSeedPath,
+			GitMirrorsMaintenanceInterval: cfg.GitMirrorsMaintenanceInterval,
+			GitMirrorsMaxAge:              cfg.GitMirrorsMaxAge,
+			GitMirrorsMaxSizeBytes:        gitMirrorsMaxSize,
+			HooksPath:                     cfg.HooksPath,
+			PluginsPath:                   cfg.PluginsPath,
+			GitCheckoutFlags:              cfg.GitCheckoutFlags,
+			GitCloneFlags:                 cfg.GitCloneFlags,
+			GitCloneMirrorFlags:           cfg.GitCloneMirrorFlags,
+			GitCleanFlags:                 cfg.GitCleanFlags,
+			GitFetchFlags:                 cfg.GitFetchFlags,
+			GitSubmodules:                 !cfg.NoGitSubmodules,
+			SSHKeyscan:                    !cfg.NoSSHKeyscan,
+			CommandEval:                   !cfg.NoCommandEval,
+			PluginsEnabled:                !cfg.NoPlugins,
+			PluginValidation:              !cfg.NoPluginValidation,
+			LocalHooksEnabled:             !cfg.NoLocalHooks,
+			StrictSingleHooks:             cfg.StrictSingleHooks,
+			RunInPty:                      !cfg.NoPTY,
+			ANSITimestamps:                !cfg.NoANSITimestamps,
+			TimestampLines:                cfg.TimestampLines,
+			DisconnectAfterJob:            cfg.DisconnectAfterJob,
+			DisconnectAfterIdleTimeout:    cfg.DisconnectAfterIdleTimeout,
+			CancelGracePeriod:             cfg.CancelGracePeriod,
+			SignalGracePeriod:             signalGracePeriod,
+			EnableJobLogTmpfile:           cfg.EnableJobLogTmpfile,
+			JobLogPath:                    cfg.JobLogPath,
+			SpoolJobLogs:                  cfg.SpoolJobLogs,
+			JobLogLimitPolicy:             cfg.JobLogLimitPolicy,
+			JobLogTailSizeBytes:           jobLogTailSize,
+			WriteJobLogsToStdout:          cfg.WriteJobLogsToStdout,
+			LogFormat:                     cfg.LogFormat,
+			Shell:                         cfg.Shell,
+			RedactedVars:                  cfg.RedactedVars,
+			RedactedDetectors:             cfg.RedactedDetectors,
+			RedactedPatterns:              redactedPatterns,
+			AcquireJob:                    cfg.AcquireJob,
+			TracingBackend:                cfg.TracingBackend,
+			TracingServiceName:            cfg.TracingServiceName,
+			MetricsDatadog:                cfg.MetricsDatadog,
+			MetricsDatadogHost:            cfg.MetricsDatadogHost,
+			MetricsDatadogDistributions:   cfg.MetricsDatadogDistributions,
+			VerificationFailureBehaviour:  cfg.VerificationFailureBehavior,
 
 			SigningJWKSFile:  cfg.SigningJWKSFile,
 			SigningJWKSKeyID: cfg.SigningJWKSKeyID,
@@ -1257,14 +1354,14 @@ func defaultSocketsPath() string {
 
 // runAgentAPI runs an API socket that can be used to interact with this
 // (top-level) agent. It returns a shutdown function.
-func runAgentAPI(ctx context.Context, l logger.Logger, socketsPath string) (func(), error) {
+func runAgentAPI(ctx context.Context, l logger.Logger, socketsPath string, lockStore agentapi.LockStore, lockBackend string) (func(), error) {
 	path := agentapi.DefaultSocketPath(socketsPath)
 	// There should be only one Agent API socket per agent process.
 	// If a previous agent crashed and left behind a socket, we can
 	// remove it.
 	os.Remove(path)
 
-	svr, err := agentapi.NewServer(path, l)
+	svr, err := agentapi.NewServer(path, l, agentapi.WithLockStore(lockStore))
 	if err != nil {
 		return nil, fmt.Errorf("couldn't create Agent API server: %w", err)
 	}
@@ -1280,7 +1377,9 @@ func runAgentAPI(ctx context.Context, l logger.Logger, socketsPath string) (func
 	}
 
 	// Whoever the leader is, ping them every so often as a health-check.
-	go leaderPinger(ctx, l, path, leaderPath)
+	// Lock state is only lost on a change of leader if it's held in memory.
+	inMemory := lockBackend == "" || lockBackend == "memory"
+	go leaderPinger(ctx, l, path, leaderPath, inMemory)
 
 	return func() {
 		svr.Shutdown(ctx)
@@ -1292,7 +1391,7 @@ func runAgentAPI(ctx context.Context, l logger.Logger, socketsPath string) (func
 
 // leaderPinger pings the leader socket for liveness, and takes over if it
 // fails.
-func leaderPinger(ctx context.Context, l logger.Logger, path, leaderPath string) {
+func leaderPinger(ctx context.Context, l logger.Logger, path, leaderPath string, locksInMemory bool) {
 	pingLeader := func() error {
 		d, err := os.Readlink(leaderPath)
 		if err != nil {
@@ -1317,7 +1416,9 @@ func leaderPinger(ctx context.Context, l logger.Logger, path, leaderPath string)
 	for range time.Tick(100 * time.Millisecond) {
 		if err := pingLeader(); err != nil {
 			l.Warn("Agent API: Leader ping failed, staging coup: %v", err)
-			l.Warn("Agent API: Leader state (locks) has been lost!")
+			if locksInMemory {
+				l.Warn("Agent API: Leader state (locks) has been lost!")
+			}
 			os.Remove(leaderPath)
 			os.Symlink(path, leaderPath)
 		}
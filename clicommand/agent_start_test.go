@@ -1,13 +1,18 @@
 package clicommand
 
 import (
+	"flag"
 	"os"
 	"path/filepath"
 	"runtime"
 	"testing"
 
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/internal/redact"
 	"github.com/buildkite/agent/v3/logger"
+	"github.com/google/go-cmp/cmp"
 	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli"
 )
 
 func setupHooksPath(t *testing.T) (string, func()) {
@@ -142,3 +147,53 @@ func TestAgentShutdownHook(t *testing.T) {
 		assert.Equal(t, []string{}, log.Messages)
 	})
 }
+
+func TestRedactedPatternsWithCommas(t *testing.T) {
+	// Patterns containing commas mustn't be split into several patterns
+	want := []string{`[A-Z]{3,5}`, `(a|b,c)`}
+
+	type config struct {
+		RedactedPatterns string `cli:"redacted-patterns"`
+	}
+
+	load := func(t *testing.T, opts ...configOpts) []string {
+		t.Helper()
+
+		set := flag.NewFlagSet("test", flag.ContinueOnError)
+		RedactedPatternsFlag.Apply(set)
+
+		var cfg config
+		loader := cliconfig.Loader{CLI: cli.NewContext(nil, set, nil), Config: &cfg}
+		for _, opt := range opts {
+			opt(&loader)
+		}
+		if _, err := loader.Load(); err != nil {
+			t.Fatalf("loader.Load() error = %v", err)
+		}
+
+		patterns := splitRedactedPatterns(cfg.RedactedPatterns)
+		if _, err := redact.Patterns(nil, patterns); err != nil {
+			t.Errorf("redact.Patterns(nil, %q) error = %v", patterns, err)
+		}
+		return patterns
+	}
+
+	t.Run("environment", func(t *testing.T) {
+		t.Setenv("BUILDKITE_REDACTED_PATTERNS", "[A-Z]{3,5}\n(a|b,c)\n")
+
+		if diff := cmp.Diff(load(t), want); diff != "" {
+			t.Errorf("redacted patterns diff (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("config file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "buildkite-agent.cfg")
+		if err := os.WriteFile(path, []byte(`redacted-patterns="[A-Z]{3,5}\n(a|b,c)"`+"\n"), 0o600); err != nil {
+			t.Fatalf("os.WriteFile(%q) error = %v", path, err)
+		}
+
+		if diff := cmp.Diff(load(t, withConfigFilePaths([]string{path})), want); diff != "" {
+			t.Errorf("redacted patterns diff (-got +want):\n%s", diff)
+		}
+	})
+}
@@ -3,6 +3,7 @@ package clicommand
 import (
 	"context"
 	"fmt"
+	"slices"
 
 	"github.com/buildkite/agent/v3/agent"
 	"github.com/buildkite/agent/v3/api"
@@ -44,7 +45,25 @@ jobs, you can target the particular job you want to download the artifact from:
 
     $ buildkite-agent artifact download "pkg/*.tar.gz" . --step "tests" --build xxx
 
-You can also use the step's jobs id (provided by the environment variable $BUILDKITE_JOB_ID)`
+You can also use the step's jobs id (provided by the environment variable $BUILDKITE_JOB_ID)
+
+Artifact bundles (uploaded with 'buildkite-agent artifact upload --bundle')
+can be unpacked into the destination after downloading them, keeping their
+file modes and symlinks. Each file is checked against the bundle's manifest,
+and the extraction fails if any file is missing, unlisted, or doesn't match
+its size and SHA-256 digest:
+
+    $ buildkite-agent artifact download "coverage.tar.gz" . --extract
+
+Downloaded artifacts are verified against the checksums recorded when they
+were uploaded. By default, an artifact that doesn't match is downloaded again,
+and the command fails if it still doesn't match. Use --verify fail to fail
+straight away, or --verify warn to only log a warning and keep the file.
+
+To avoid saturating the network, limit how many artifacts are downloaded at
+once, and the total download rate (in bytes per second):
+
+    $ buildkite-agent artifact download "pkg/*.tar.gz" . --concurrency 4 --bandwidth-limit 10MB`
 
 type ArtifactDownloadConfig struct {
 	Query              string `cli:"arg:0" label:"artifact search query" validate:"required"`
@@ -52,6 +71,12 @@ type ArtifactDownloadConfig struct {
 	Step               string `cli:"step"`
 	Build              string `cli:"build" validate:"required"`
 	IncludeRetriedJobs bool   `cli:"include-retried-jobs"`
+	Extract            bool   `cli:"extract"`
+	Verify             string `cli:"verify"`
+
+	// Transfer config
+	Concurrency    int    `cli:"concurrency"`
+	BandwidthLimit string `cli:"bandwidth-limit"`
 
 	// Global flags
 	Debug       bool     `cli:"debug"`
@@ -88,6 +113,21 @@ var ArtifactDownloadCommand = cli.Command{
 			EnvVar: "BUILDKITE_AGENT_INCLUDE_RETRIED_JOBS",
 			Usage:  "Include artifacts from retried jobs in the search",
 		},
+		cli.BoolFlag{
+			Name:   "extract",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_EXTRACT",
+			Usage:  "Extract artifact bundles into the destination after downloading them, and remove the archives",
+		},
+		cli.StringFlag{
+			Name:   "verify",
+			Value:  agent.ArtifactVerifyRetry,
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_VERIFY",
+			Usage:  fmt.Sprintf("What to do when a downloaded artifact doesn't match its checksum. One of: %v", agent.ArtifactVerifyPolicies),
+		},
+
+		// Transfer Flags
+		ArtifactConcurrencyFlag,
+		ArtifactBandwidthLimitFlag,
 
 		// API Flags
 		AgentAccessTokenFlag,
@@ -107,6 +147,14 @@ var ArtifactDownloadCommand = cli.Command{
 		ctx, cfg, l, _, done := setupLoggerAndConfig[ArtifactDownloadConfig](ctx, c)
 		defer done()
 
+		if cfg.Verify != "" && !slices.Contains(agent.ArtifactVerifyPolicies, cfg.Verify) {
+			return fmt.Errorf("invalid --verify value %q. Must be one of: %v", cfg.Verify, agent.ArtifactVerifyPolicies)
+		}
+
+		if err := setArtifactBandwidthLimit(cfg.BandwidthLimit); err != nil {
+			return err
+		}
+
 		// Create the API client
 		client := api.NewClient(l, loadAPIClientConfig(cfg, "AgentAccessToken"))
 
@@ -118,6 +166,9 @@ var ArtifactDownloadCommand = cli.Command{
 			Step:               cfg.Step,
 			IncludeRetriedJobs: cfg.IncludeRetriedJobs,
 			DebugHTTP:          cfg.DebugHTTP,
+			Extract:            cfg.Extract,
+			Verify:             cfg.Verify,
+			Concurrency:        cfg.Concurrency,
 		})
 
 		// Download the artifacts
@@ -0,0 +1,101 @@
+package clicommand
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/dustin/go-humanize"
+	"github.com/urfave/cli"
+)
+
+const pruneBlobsHelpDescription = `Usage:
+
+    buildkite-agent artifact prune-blobs [options...] <blob store>
+
+Description:
+
+Removes blobs that are no longer used from a blob store that artifacts were
+uploaded to with 'buildkite-agent artifact upload --blob-store'.
+
+Each job that uploads a file to a blob store leaves a reference to the file's
+blob. This command removes references older than --older-than, then removes
+the blobs that have no references left. Artifacts whose blobs are removed can
+no longer be downloaded, so --older-than should be at least as long as you
+keep builds' artifacts for.
+
+Example:
+
+    $ buildkite-agent artifact prune-blobs s3://name-of-your-s3-bucket/blobs --older-than 2160h
+
+Use --dry-run to see what would be removed, without removing anything.`
+
+type ArtifactPruneBlobsConfig struct {
+	BlobStore string `cli:"arg:0" label:"blob store" validate:"required"`
+	OlderThan string `cli:"older-than"`
+	DryRun    bool   `cli:"dry-run"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var ArtifactPruneBlobsCommand = cli.Command{
+	Name:        "prune-blobs",
+	Usage:       "Removes blobs that are no longer referenced from an artifact blob store",
+	Description: pruneBlobsHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "older-than",
+			Value:  "4320h",
+			Usage:  "Remove references to blobs older than this duration, then blobs with no references",
+			EnvVar: "BUILDKITE_ARTIFACT_PRUNE_BLOBS_OLDER_THAN",
+		},
+		cli.BoolFlag{
+			Name:   "dry-run",
+			Usage:  "Log what would be removed, without removing anything",
+			EnvVar: "BUILDKITE_ARTIFACT_PRUNE_BLOBS_DRY_RUN",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) error {
+		ctx := context.Background()
+		ctx, cfg, l, _, done := setupLoggerAndConfig[ArtifactPruneBlobsConfig](ctx, c)
+		defer done()
+
+		olderThan, err := time.ParseDuration(cfg.OlderThan)
+		if err != nil {
+			return fmt.Errorf("invalid --older-than value %q: %w", cfg.OlderThan, err)
+		}
+
+		store, err := agent.NewBlobStore(l, cfg.BlobStore)
+		if err != nil {
+			return err
+		}
+
+		result, err := agent.PruneBlobStore(ctx, l, store, agent.PruneBlobStoreConfig{
+			OlderThan: time.Now().Add(-olderThan),
+			DryRun:    cfg.DryRun,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to prune blob store: %w", err)
+		}
+
+		verb := "Removed"
+		if cfg.DryRun {
+			verb = "Would remove"
+		}
+		l.Info("%s %d references and %d blobs (%s)", verb, result.RefsRemoved, result.BlobsRemoved, humanize.IBytes(uint64(result.BytesFreed)))
+		return nil
+	},
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/buildkite/agent/v3/agent"
 	"github.com/buildkite/agent/v3/api"
+	"github.com/dustin/go-humanize"
 	"github.com/urfave/cli"
 )
 
@@ -21,8 +22,8 @@ You need to ensure that the paths are surrounded by quotes otherwise the
 built-in shell path globbing will provide the files, which is currently not
 supported.
 
-You can specify an alternate destination on Amazon S3, Google Cloud Storage
-or Artifactory as per the examples below. This may be specified in the
+You can specify an alternate destination on Amazon S3, Google Cloud Storage,
+Artifactory, a local directory or an HTTP server as per the examples below. This may be specified in the
 'destination' argument, or in the 'BUILDKITE_ARTIFACT_UPLOAD_DESTINATION'
 environment variable.  Otherwise, artifacts are uploaded to a
 Buildkite-managed Amazon S3 bucket, where they’re retained for six months.
@@ -55,16 +56,64 @@ Or upload directly to Artifactory:
     $ export BUILDKITE_ARTIFACTORY_PASSWORD=xxx
     $ buildkite-agent artifact upload "log/**/*.log" rt://name-of-your-artifactory-repo/$BUILDKITE_JOB_ID
 
+Or copy artifacts into a directory, such as a shared NFS mount:
+
+    $ buildkite-agent artifact upload "log/**/*.log" file:///mnt/artifacts/$BUILDKITE_JOB_ID
+
+Or upload them with HTTP PUT requests, e.g. to a WebDAV server. Requests are
+authenticated with a bearer token or basic auth, if set:
+
+    $ export BUILDKITE_ARTIFACT_HTTP_TOKEN=xxx # or:
+    $ export BUILDKITE_ARTIFACT_HTTP_USER=carol-danvers
+    $ export BUILDKITE_ARTIFACT_HTTP_PASSWORD=xxx
+    $ buildkite-agent artifact upload "log/**/*.log" https://dav.example.com/artifacts/$BUILDKITE_JOB_ID
+
+If a directory or HTTP server is served to users from a different URL, set
+BUILDKITE_ARTIFACT_PUBLIC_URL to the URL of the destination, and artifact
+links in Buildkite will point there:
+
+    $ export BUILDKITE_ARTIFACT_PUBLIC_URL=https://artifacts.example.com/$BUILDKITE_JOB_ID
+
+Or upload with an artifact plugin, to store artifacts somewhere else (such as
+an SFTP server). An exec://name/prefix destination runs the program
+'buildkite-agent-artifact-name' from your PATH for each artifact, with
+"upload" or "download" as its argument and a JSON request on stdin describing
+the artifact's key and local file. The plugin reports failure by exiting
+non-zero, or by printing {"error":"..."} to stdout:
+
+    $ buildkite-agent artifact upload "log/**/*.log" exec://sftp/$BUILDKITE_JOB_ID
+
 By default, symlinks to directories will not be explored when resolving the glob, but symlinks to
 files will be uploaded as the linked files. To ignore symlinks to files use:
 
     $ buildkite-agent artifact upload --upload-skip-symlinks "log/**/*.log"
 
-Note: uploading symlinks to files without following them is not supported.
-If you need to preserve them in a directory, we recommend creating a tar archive:
+Note: uploading symlinks to files without following them is not supported,
+unless the files are bundled.
+
+To upload many files at once, bundle them into a single archive artifact with
+--bundle. The archive format is chosen by the extension (.tar.gz, .tgz,
+.tar.zst, .tzst or .zip). Bundles keep file modes and symlinks, and contain a
+manifest of the files' sizes and SHA-256 digests, which
+'buildkite-agent artifact download --extract' verifies as it unpacks them:
+
+    $ buildkite-agent artifact upload --bundle coverage.tar.gz "coverage/**/*"
+
+To avoid uploading the same files again and again (such as vendored binaries),
+store artifacts by content in a blob store, instead of a destination. Each file
+is stored under its SHA-256 checksum, and is only uploaded if it isn't in the
+blob store already. Amazon S3, Google Cloud Storage and directories can be used
+as blob stores:
+
+    $ buildkite-agent artifact upload --blob-store s3://name-of-your-s3-bucket/blobs "vendor/bin/*"
+
+Blobs that are no longer used can be removed with 'buildkite-agent artifact
+prune-blobs'.
+
+To avoid saturating the network, limit how many artifacts are uploaded at once,
+and the total upload rate (in bytes per second):
 
-    $ tar -cvf log.tar log/**/*
-    $ buildkite-agent upload log.tar`
+    $ buildkite-agent artifact upload --concurrency 4 --bandwidth-limit 10MB "log/**/*.log"`
 
 type ArtifactUploadConfig struct {
 	UploadPaths string `cli:"arg:0" label:"upload paths" validate:"required"`
@@ -89,6 +138,13 @@ type ArtifactUploadConfig struct {
 	GlobResolveFollowSymlinks bool `cli:"glob-resolve-follow-symlinks"`
 	UploadSkipSymlinks        bool `cli:"upload-skip-symlinks"`
 
+	Bundle    string `cli:"bundle"`
+	BlobStore string `cli:"blob-store"`
+
+	// Transfer config
+	Concurrency    int    `cli:"concurrency"`
+	BandwidthLimit string `cli:"bandwidth-limit"`
+
 	// deprecated
 	FollowSymlinks bool `cli:"follow-symlinks" deprecated-and-renamed-to:"GlobResolveFollowSymlinks"`
 }
@@ -120,12 +176,28 @@ var ArtifactUploadCommand = cli.Command{
 			Usage:  "After the glob has been resolved to a list of files to upload, skip uploading those that are symlinks to files",
 			EnvVar: "BUILDKITE_ARTIFACT_UPLOAD_SKIP_SYMLINKS",
 		},
+		cli.StringFlag{
+			Name:   "bundle",
+			Value:  "",
+			Usage:  "Bundle the files into a single archive artifact with this path, instead of uploading them individually. The extension chooses the format: .tar.gz, .tgz, .tar.zst, .tzst or .zip",
+			EnvVar: "BUILDKITE_ARTIFACT_UPLOAD_BUNDLE",
+		},
+		cli.StringFlag{
+			Name:   "blob-store",
+			Value:  "",
+			Usage:  "Store the artifacts by content in this blob store (e.g. s3://my-bucket/blobs), instead of the destination, skipping files that are already stored",
+			EnvVar: "BUILDKITE_ARTIFACT_BLOB_STORE",
+		},
 		cli.BoolFlag{ // Deprecated
 			Name:   "follow-symlinks",
 			Usage:  "Follow symbolic links while resolving globs. Note this argument is deprecated. Use `--glob-resolve-follow-symlinks` instead",
 			EnvVar: "BUILDKITE_AGENT_ARTIFACT_SYMLINKS",
 		},
 
+		// Transfer Flags
+		ArtifactConcurrencyFlag,
+		ArtifactBandwidthLimitFlag,
+
 		// API Flags
 		AgentAccessTokenFlag,
 		EndpointFlag,
@@ -144,6 +216,10 @@ var ArtifactUploadCommand = cli.Command{
 		ctx, cfg, l, _, done := setupLoggerAndConfig[ArtifactUploadConfig](ctx, c)
 		defer done()
 
+		if err := setArtifactBandwidthLimit(cfg.BandwidthLimit); err != nil {
+			return err
+		}
+
 		// Create the API client
 		client := api.NewClient(l, loadAPIClientConfig(cfg, "AgentAccessToken"))
 
@@ -159,6 +235,9 @@ var ArtifactUploadCommand = cli.Command{
 			// this works as long as the user only sets one of the two flags
 			GlobResolveFollowSymlinks: (cfg.GlobResolveFollowSymlinks || cfg.FollowSymlinks),
 			UploadSkipSymlinks:        cfg.UploadSkipSymlinks,
+			Bundle:                    cfg.Bundle,
+			BlobStore:                 cfg.BlobStore,
+			Concurrency:               cfg.Concurrency,
 		})
 
 		// Upload the artifacts
@@ -169,3 +248,16 @@ var ArtifactUploadCommand = cli.Command{
 		return nil
 	},
 }
+
+// setArtifactBandwidthLimit parses and applies the --bandwidth-limit flag.
+func setArtifactBandwidthLimit(limit string) error {
+	if limit == "" {
+		return nil
+	}
+	bytesPerSecond, err := humanize.ParseBytes(limit)
+	if err != nil {
+		return fmt.Errorf("invalid --bandwidth-limit value %q: %w", limit, err)
+	}
+	agent.SetArtifactBandwidthLimit(int64(bytesPerSecond))
+	return nil
+}
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/buildkite/agent/v3/internal/job"
+	"github.com/buildkite/agent/v3/internal/redact"
 	"github.com/buildkite/agent/v3/process"
 	"github.com/urfave/cli"
 )
@@ -71,7 +72,10 @@ type BootstrapConfig struct {
 	GitMirrorsPath               string   `cli:"git-mirrors-path" normalize:"filepath"`
 	GitMirrorsLockTimeout        int      `cli:"git-mirrors-lock-timeout"`
 	GitMirrorsSkipUpdate         bool     `cli:"git-mirrors-skip-update"`
+	GitMirrorsSeedPath           string   `cli:"git-mirrors-seed-path"`
 	GitSubmoduleCloneConfig      []string `cli:"git-submodule-clone-config"`
+	GitSparseCheckoutPaths       []string `cli:"git-sparse-checkout-paths" normalize:"list"`
+	GitCloneFilter               string   `cli:"git-clone-filter"`
 	BinPath                      string   `cli:"bin-path" normalize:"filepath"`
 	BuildPath                    string   `cli:"build-path" normalize:"filepath"`
 	HooksPath                    string   `cli:"hooks-path" normalize:"filepath"`
@@ -93,8 +97,13 @@ type BootstrapConfig struct {
 	CancelSignal                 string   `cli:"cancel-signal"`
 	SignalGracePeriodSeconds     int      `cli:"signal-grace-period-seconds"`
 	RedactedVars                 []string `cli:"redacted-vars" normalize:"list"`
+	RedactedDetectors            []string `cli:"redacted-detectors" normalize:"list"`
+	RedactedPatterns             string   `cli:"redacted-patterns"`
 	TracingBackend               string   `cli:"tracing-backend"`
 	TracingServiceName           string   `cli:"tracing-service-name"`
+	MetricsDatadog               bool     `cli:"metrics-datadog"`
+	MetricsDatadogHost           string   `cli:"metrics-datadog-host"`
+	MetricsDatadogDistributions  bool     `cli:"metrics-datadog-distributions"`
 }
 
 var BootstrapCommand = cli.Command{
@@ -239,6 +248,18 @@ var BootstrapCommand = cli.Command{
 			Usage:  "Comma separated key=value git config pairs applied before git submodule clone commands. For example, ′update --init′. If the config is needed to be applied to all git commands, supply it in a global git config file for the system that the agent runs in instead.",
 			EnvVar: "BUILDKITE_GIT_SUBMODULE_CLONE_CONFIG",
 		},
+		cli.StringSliceFlag{
+			Name:   "git-sparse-checkout-paths",
+			Value:  &cli.StringSlice{},
+			Usage:  "Comma separated directories to check out with \"git sparse-checkout\" in cone mode, instead of the whole repository. Files at the root of the repository are always checked out",
+			EnvVar: "BUILDKITE_GIT_SPARSE_CHECKOUT_PATHS",
+		},
+		cli.StringFlag{
+			Name:   "git-clone-filter",
+			Value:  "",
+			Usage:  "Filter to pass to \"git clone --filter\" for a partial clone, for example ′blob:none′. Ignored when using git mirrors",
+			EnvVar: "BUILDKITE_GIT_CLONE_FILTER",
+		},
 		cli.StringFlag{
 			Name:   "git-mirrors-path",
 			Value:  "",
@@ -256,6 +277,12 @@ var BootstrapCommand = cli.Command{
 			Usage:  "Skip updating the Git mirror",
 			EnvVar: "BUILDKITE_GIT_MIRRORS_SKIP_UPDATE",
 		},
+		cli.StringFlag{
+			Name:   "git-mirrors-seed-path",
+			Value:  "",
+			Usage:  "Directory or artifact location (e.g. s3://my-bucket/git-mirrors) to find bundles or tar archives to create missing git mirrors from, instead of cloning them",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_SEED_PATH",
+		},
 		cli.StringFlag{
 			Name:   "bin-path",
 			Value:  "",
@@ -344,6 +371,8 @@ var BootstrapCommand = cli.Command{
 			Usage:  "Pattern of environment variable names containing sensitive values",
 			EnvVar: "BUILDKITE_REDACTED_VARS",
 		},
+		RedactedDetectorsFlag,
+		RedactedPatternsFlag,
 		cli.StringFlag{
 			Name:   "tracing-backend",
 			Usage:  "The name of the tracing backend to use.",
@@ -356,6 +385,9 @@ var BootstrapCommand = cli.Command{
 			EnvVar: "BUILDKITE_TRACING_SERVICE_NAME",
 			Value:  "buildkite-agent",
 		},
+		MetricsDatadogFlag,
+		MetricsDatadogHostFlag,
+		MetricsDatadogDistributionsFlag,
 		DebugFlag,
 		LogLevelFlag,
 		ExperimentsFlag,
@@ -390,6 +422,11 @@ var BootstrapCommand = cli.Command{
 
 		signalGracePeriod := time.Duration(cfg.SignalGracePeriodSeconds) * time.Second
 
+		redactedPatterns, err := redact.Patterns(cfg.RedactedDetectors, splitRedactedPatterns(cfg.RedactedPatterns))
+		if err != nil {
+			return err
+		}
+
 		// Configure the bootstraper
 		bootstrap := job.New(job.ExecutorConfig{
 			AgentName:                    cfg.AgentName,
@@ -414,8 +451,11 @@ var BootstrapCommand = cli.Command{
 			GitMirrorsLockTimeout:        cfg.GitMirrorsLockTimeout,
 			GitMirrorsPath:               cfg.GitMirrorsPath,
 			GitMirrorsSkipUpdate:         cfg.GitMirrorsSkipUpdate,
+			GitMirrorsSeedPath:           cfg.GitMirrorsSeedPath,
 			GitSubmodules:                cfg.GitSubmodules,
 			GitSubmoduleCloneConfig:      cfg.GitSubmoduleCloneConfig,
+			GitSparseCheckoutPaths:       cfg.GitSparseCheckoutPaths,
+			GitCloneFilter:               cfg.GitCloneFilter,
 			HooksPath:                    cfg.HooksPath,
 			JobID:                        cfg.JobID,
 			LocalHooksEnabled:            cfg.LocalHooksEnabled,
@@ -431,6 +471,7 @@ var BootstrapCommand = cli.Command{
 			PullRequest:                  cfg.PullRequest,
 			Queue:                        cfg.Queue,
 			RedactedVars:                 cfg.RedactedVars,
+			RedactedPatterns:             redactedPatterns,
 			RefSpec:                      cfg.RefSpec,
 			Repository:                   cfg.Repository,
 			RunInPty:                     runInPty,
@@ -440,6 +481,9 @@ var BootstrapCommand = cli.Command{
 			Tag:                          cfg.Tag,
 			TracingBackend:               cfg.TracingBackend,
 			TracingServiceName:           cfg.TracingServiceName,
+			MetricsDatadog:               cfg.MetricsDatadog,
+			MetricsDatadogHost:           cfg.MetricsDatadogHost,
+			MetricsDatadogDistributions:  cfg.MetricsDatadogDistributions,
 		})
 
 		cctx, cancel := context.WithCancel(ctx)
@@ -21,6 +21,7 @@ var BuildkiteAgentCommands = []cli.Command{
 			ArtifactDownloadCommand,
 			ArtifactSearchCommand,
 			ArtifactShasumCommand,
+			ArtifactPruneBlobsCommand,
 		},
 	},
 	{
@@ -33,6 +34,15 @@ var BuildkiteAgentCommands = []cli.Command{
 			EnvUnsetCommand,
 		},
 	},
+	{
+		Name:  "git-mirrors",
+		Usage: "Manage the mirrors of git repositories kept by agents",
+		Subcommands: []cli.Command{
+			GitMirrorsBundleCommand,
+			GitMirrorsPruneCommand,
+			GitMirrorsSeedCommand,
+		},
+	},
 	{
 		Name:  "lock",
 		Usage: "Process lock subcommands",
@@ -40,8 +50,11 @@ var BuildkiteAgentCommands = []cli.Command{
 			LockAcquireCommand,
 			LockDoCommand,
 			LockDoneCommand,
+			LockForceReleaseCommand,
 			LockGetCommand,
+			LockListCommand,
 			LockReleaseCommand,
+			LockServeCommand,
 		},
 	},
 	{
@@ -68,6 +81,13 @@ var BuildkiteAgentCommands = []cli.Command{
 			PipelineUploadCommand,
 		},
 	},
+	{
+		Name:  "redactor",
+		Usage: "Redact values from the log output of the currently running job",
+		Subcommands: []cli.Command{
+			RedactorAddCommand,
+		},
+	},
 	{
 		Name:  "step",
 		Usage: "Get or update an attribute of a build step",
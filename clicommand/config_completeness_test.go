@@ -19,6 +19,7 @@ var commandConfigPairs = []configCommandPair{
 	{Config: AnnotateConfig{}, Command: AnnotateCommand},
 	{Config: AnnotationRemoveConfig{}, Command: AnnotationRemoveCommand},
 	{Config: ArtifactDownloadConfig{}, Command: ArtifactDownloadCommand},
+	{Config: ArtifactPruneBlobsConfig{}, Command: ArtifactPruneBlobsCommand},
 	{Config: ArtifactSearchConfig{}, Command: ArtifactSearchCommand},
 	{Config: ArtifactShasumConfig{}, Command: ArtifactShasumCommand},
 	{Config: ArtifactUploadConfig{}, Command: ArtifactUploadCommand},
@@ -27,17 +28,24 @@ var commandConfigPairs = []configCommandPair{
 	{Config: EnvDumpConfig{}, Command: EnvDumpCommand},
 	{Config: EnvSetConfig{}, Command: EnvSetCommand},
 	{Config: EnvUnsetConfig{}, Command: EnvUnsetCommand},
+	{Config: GitMirrorsBundleConfig{}, Command: GitMirrorsBundleCommand},
+	{Config: GitMirrorsPruneConfig{}, Command: GitMirrorsPruneCommand},
+	{Config: GitMirrorsSeedConfig{}, Command: GitMirrorsSeedCommand},
 	{Config: LockAcquireConfig{}, Command: LockAcquireCommand},
 	{Config: LockDoConfig{}, Command: LockDoCommand},
 	{Config: LockDoneConfig{}, Command: LockDoneCommand},
+	{Config: LockForceReleaseConfig{}, Command: LockForceReleaseCommand},
 	{Config: LockGetConfig{}, Command: LockGetCommand},
+	{Config: LockListConfig{}, Command: LockListCommand},
 	{Config: LockReleaseConfig{}, Command: LockReleaseCommand},
+	{Config: LockServeConfig{}, Command: LockServeCommand},
 	{Config: MetaDataExistsConfig{}, Command: MetaDataExistsCommand},
 	{Config: MetaDataGetConfig{}, Command: MetaDataGetCommand},
 	{Config: MetaDataKeysConfig{}, Command: MetaDataKeysCommand},
 	{Config: MetaDataSetConfig{}, Command: MetaDataSetCommand},
 	{Config: OIDCTokenConfig{}, Command: OIDCRequestTokenCommand},
 	{Config: PipelineUploadConfig{}, Command: PipelineUploadCommand},
+	{Config: RedactorAddConfig{}, Command: RedactorAddCommand},
 	{Config: StepGetConfig{}, Command: StepGetCommand},
 	{Config: StepUpdateConfig{}, Command: StepUpdateCommand},
 	{Config: ToolKeygenConfig{}, Command: ToolKeygenCommand},
@@ -0,0 +1,84 @@
+package clicommand
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/buildkite/agent/v3/internal/gitmirrors"
+	"github.com/urfave/cli"
+)
+
+const gitMirrorsBundleHelpDescription = `Usage:
+
+    buildkite-agent git-mirrors bundle [options...] <repository> <output>
+
+Description:
+
+Writes a seed for the mirror of a repository in the git mirrors path, that
+missing mirrors can be created from with 'buildkite-agent git-mirrors seed' (or
+by jobs, when the agent is started with --git-mirrors-seed-path).
+
+The format of the seed depends on the output's extension: a .bundle file is a
+git bundle of all the mirror's refs, and a .tar.gz file is an archive of the
+whole mirror. Bundles are smaller, but mirrors are quicker to create from
+archives. If the output is a directory, a bundle is written in it, named like
+seeds are looked for.
+
+Example:
+
+    $ buildkite-agent git-mirrors bundle --git-mirrors-path /var/lib/buildkite-agent/git-mirrors git@github.com:acme-inc/my-project.git .
+    $ aws s3 cp git-github-com-acme-inc-my-project-git.bundle s3://my-bucket/git-mirrors/`
+
+type GitMirrorsBundleConfig struct {
+	Repository     string `cli:"arg:0" label:"repository" validate:"required"`
+	Output         string `cli:"arg:1" label:"output" validate:"required"`
+	GitMirrorsPath string `cli:"git-mirrors-path" normalize:"filepath" validate:"required"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var GitMirrorsBundleCommand = cli.Command{
+	Name:        "bundle",
+	Usage:       "Writes a bundle or tar archive of a git mirror, to seed other mirrors from",
+	Description: gitMirrorsBundleHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "git-mirrors-path",
+			Value:  "",
+			Usage:  "Path to where mirrors of git repositories are stored",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_PATH",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) error {
+		ctx := context.Background()
+		ctx, cfg, l, _, done := setupLoggerAndConfig[GitMirrorsBundleConfig](ctx, c)
+		defer done()
+
+		mirrorDir := filepath.Join(cfg.GitMirrorsPath, gitmirrors.DirForRepository(cfg.Repository))
+
+		output := cfg.Output
+		if info, err := os.Stat(output); err == nil && info.IsDir() {
+			output = filepath.Join(output, gitmirrors.SeedName(cfg.Repository, gitmirrors.SeedFormatBundle))
+		}
+
+		l.Info("Writing a seed for %s from %s to %s", cfg.Repository, mirrorDir, output)
+		if err := gitmirrors.Bundle(ctx, mirrorDir, output); err != nil {
+			return fmt.Errorf("failed to bundle git mirror: %w", err)
+		}
+		return nil
+	},
+}
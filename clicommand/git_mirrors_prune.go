@@ -0,0 +1,137 @@
+package clicommand
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/buildkite/agent/v3/internal/gitmirrors"
+	"github.com/dustin/go-humanize"
+	"github.com/urfave/cli"
+)
+
+const gitMirrorsPruneHelpDescription = `Usage:
+
+    buildkite-agent git-mirrors prune [options...]
+
+Description:
+
+Removes unused mirrors of git repositories from the git mirrors path, and
+garbage collects the rest.
+
+Jobs record when they last used each mirror. Mirrors that haven't been used
+for longer than --max-age are removed, then the least recently used mirrors are
+removed until the mirrors use less disk space than --max-size. Mirrors that a
+job is cloning, updating or checking out from are never removed or garbage
+collected.
+
+Checkouts that borrow objects from a removed mirror are cloned again by the
+next job that uses them.
+
+Agents can do this periodically themselves, with 'buildkite-agent start
+--git-mirrors-maintenance-interval'.
+
+Example:
+
+    $ buildkite-agent git-mirrors prune --git-mirrors-path /var/lib/buildkite-agent/git-mirrors --max-age 720h --max-size 50GB
+
+Use --dry-run to see what would be removed, without removing anything.`
+
+type GitMirrorsPruneConfig struct {
+	GitMirrorsPath string `cli:"git-mirrors-path" normalize:"filepath" validate:"required"`
+	MaxAge         string `cli:"max-age"`
+	MaxSize        string `cli:"max-size"`
+	NoGC           bool   `cli:"no-gc"`
+	DryRun         bool   `cli:"dry-run"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var GitMirrorsPruneCommand = cli.Command{
+	Name:        "prune",
+	Usage:       "Removes unused git mirrors and garbage collects the rest",
+	Description: gitMirrorsPruneHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "git-mirrors-path",
+			Value:  "",
+			Usage:  "Path to where mirrors of git repositories are stored",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_PATH",
+		},
+		cli.StringFlag{
+			Name:   "max-age",
+			Value:  "",
+			Usage:  "Remove mirrors that haven't been used by a job for longer than this duration",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_MAX_AGE",
+		},
+		cli.StringFlag{
+			Name:   "max-size",
+			Value:  "",
+			Usage:  "Remove the least recently used mirrors while the mirrors use more disk space than this, for example ′50GB′",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_MAX_SIZE",
+		},
+		cli.BoolFlag{
+			Name:   "no-gc",
+			Usage:  "Don't garbage collect the mirrors that are kept",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_PRUNE_NO_GC",
+		},
+		cli.BoolFlag{
+			Name:   "dry-run",
+			Usage:  "Log what would be done, without changing anything",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_PRUNE_DRY_RUN",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) error {
+		ctx := context.Background()
+		ctx, cfg, l, _, done := setupLoggerAndConfig[GitMirrorsPruneConfig](ctx, c)
+		defer done()
+
+		var maxAge time.Duration
+		if cfg.MaxAge != "" {
+			var err error
+			maxAge, err = time.ParseDuration(cfg.MaxAge)
+			if err != nil {
+				return fmt.Errorf("invalid --max-age value %q: %w", cfg.MaxAge, err)
+			}
+		}
+
+		var maxSize uint64
+		if cfg.MaxSize != "" {
+			var err error
+			maxSize, err = humanize.ParseBytes(cfg.MaxSize)
+			if err != nil {
+				return fmt.Errorf("invalid --max-size value %q: %w", cfg.MaxSize, err)
+			}
+		}
+
+		result, err := gitmirrors.Prune(ctx, l, gitmirrors.PruneConfig{
+			Path:    cfg.GitMirrorsPath,
+			MaxAge:  maxAge,
+			MaxSize: int64(maxSize),
+			GC:      !cfg.NoGC,
+			DryRun:  cfg.DryRun,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to prune git mirrors: %w", err)
+		}
+
+		verb := "Removed"
+		if cfg.DryRun {
+			verb = "Would remove"
+		}
+		l.Info("%s %d git mirrors (%s)", verb, result.MirrorsRemoved, humanize.IBytes(uint64(result.BytesFreed)))
+		return nil
+	},
+}
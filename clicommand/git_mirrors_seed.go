@@ -0,0 +1,160 @@
+package clicommand
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/internal/gitmirrors"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/urfave/cli"
+)
+
+const gitMirrorsSeedHelpDescription = `Usage:
+
+    buildkite-agent git-mirrors seed [options...] <repository>
+
+Description:
+
+Creates the mirror of a repository in the git mirrors path from a seed (a git
+bundle or a tar archive of a mirror, made with 'buildkite-agent git-mirrors
+bundle'), rather than cloning the whole repository. The next job to use the
+mirror only fetches what's changed since the seed was made.
+
+Seeds are looked for in --seed-path, which is either a directory, or a location
+that artifacts can be downloaded from (such as s3://my-bucket/git-mirrors).
+The seed for a repository is named after its mirror, with a .bundle or .tar.gz
+extension, for example git-github-com-acme-inc-my-project-git.bundle.
+
+Jobs seed missing mirrors themselves if the agent is started with
+--git-mirrors-seed-path. This command is for seeding mirrors ahead of time,
+such as while building an agent's machine image.
+
+Example:
+
+    $ buildkite-agent git-mirrors seed --git-mirrors-path /var/lib/buildkite-agent/git-mirrors --seed-path s3://my-bucket/git-mirrors git@github.com:acme-inc/my-project.git`
+
+type GitMirrorsSeedConfig struct {
+	Repository            string `cli:"arg:0" label:"repository" validate:"required"`
+	GitMirrorsPath        string `cli:"git-mirrors-path" normalize:"filepath" validate:"required"`
+	GitMirrorsLockTimeout int    `cli:"git-mirrors-lock-timeout"`
+	SeedPath              string `cli:"seed-path" validate:"required"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var GitMirrorsSeedCommand = cli.Command{
+	Name:        "seed",
+	Usage:       "Creates a git mirror from a bundle or tar archive",
+	Description: gitMirrorsSeedHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "git-mirrors-path",
+			Value:  "",
+			Usage:  "Path to where mirrors of git repositories are stored",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_PATH",
+		},
+		cli.IntFlag{
+			Name:   "git-mirrors-lock-timeout",
+			Value:  300,
+			Usage:  "Seconds to wait for another process cloning the mirror",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_LOCK_TIMEOUT",
+		},
+		cli.StringFlag{
+			Name:   "seed-path",
+			Value:  "",
+			Usage:  "Directory or artifact location (e.g. s3://my-bucket/git-mirrors) to find seeds in",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_SEED_PATH",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) error {
+		ctx := context.Background()
+		ctx, cfg, l, _, done := setupLoggerAndConfig[GitMirrorsSeedConfig](ctx, c)
+		defer done()
+
+		mirrorDir := filepath.Join(cfg.GitMirrorsPath, gitmirrors.DirForRepository(cfg.Repository))
+
+		// Actual file permissions will be reduced by umask, and won't be 0777 unless the user has manually changed the umask to 000
+		if err := os.MkdirAll(cfg.GitMirrorsPath, 0o777); err != nil {
+			return err
+		}
+
+		// Lock the mirror like a job cloning it would, so that only one
+		// process downloads the seed.
+		lockCtx, cancel := context.WithTimeout(ctx, time.Duration(cfg.GitMirrorsLockTimeout)*time.Second)
+		defer cancel()
+		lock, err := gitmirrors.LockClone(lockCtx, mirrorDir)
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+
+		if _, err := os.Stat(mirrorDir); err == nil {
+			l.Info("A mirror of %s already exists at %s", cfg.Repository, mirrorDir)
+			return nil
+		}
+
+		// Download into the mirrors path, which has to have room for the
+		// mirror anyway. The leading dot keeps it from being seen as a mirror.
+		tmp, err := os.MkdirTemp(cfg.GitMirrorsPath, ".seed-download-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+
+		seed, err := findGitMirrorSeed(ctx, l, cfg.SeedPath, cfg.Repository, tmp)
+		if err != nil {
+			return err
+		}
+
+		l.Info("Seeding a mirror of %s at %s from %s", cfg.Repository, mirrorDir, seed)
+		if err := gitmirrors.Seed(ctx, cfg.Repository, mirrorDir, seed); err != nil {
+			return fmt.Errorf("failed to seed git mirror: %w", err)
+		}
+		return nil
+	},
+}
+
+// findGitMirrorSeed finds the seed for a repository in the seed path,
+// downloading it into the directory if the seed path isn't local.
+func findGitMirrorSeed(ctx context.Context, l logger.Logger, seedPath, repository, dir string) (string, error) {
+	var errs []error
+	for _, format := range gitmirrors.SeedFormats {
+		name := gitmirrors.SeedName(repository, format)
+
+		if !strings.Contains(seedPath, "://") {
+			seed := filepath.Join(seedPath, name)
+			if _, err := os.Stat(seed); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			return seed, nil
+		}
+
+		seed, err := agent.DownloadFromArtifactBackend(ctx, l, seedPath, name, dir)
+		if err != nil {
+			l.Debug("Couldn't download %s from %s: %v", name, seedPath, err)
+			errs = append(errs, fmt.Errorf("downloading %s: %w", name, err))
+			continue
+		}
+		return seed, nil
+	}
+	return "", fmt.Errorf("no seed for %s found in %s: %w", repository, seedPath, errors.Join(errs...))
+}
@@ -85,6 +85,18 @@ var StrictSingleHooksFlag = cli.BoolFlag{
 	EnvVar: "BUILDKITE_STRICT_SINGLE_HOOKS",
 }
 
+var ArtifactConcurrencyFlag = cli.IntFlag{
+	Name:   "concurrency",
+	Usage:  "How many artifacts to transfer at once. Defaults to 10 per CPU",
+	EnvVar: "BUILDKITE_ARTIFACT_CONCURRENCY",
+}
+
+var ArtifactBandwidthLimitFlag = cli.StringFlag{
+	Name:   "bandwidth-limit",
+	Usage:  "Limit artifact transfers to this many bytes per second in total, e.g. 10MB. Defaults to no limit",
+	EnvVar: "BUILDKITE_ARTIFACT_BANDWIDTH_LIMIT",
+}
+
 var ExperimentsFlag = cli.StringSliceFlag{
 	Name:   "experiment",
 	Value:  &cli.StringSlice{},
@@ -92,6 +104,51 @@ var ExperimentsFlag = cli.StringSliceFlag{
 	EnvVar: "BUILDKITE_AGENT_EXPERIMENT",
 }
 
+var MetricsDatadogFlag = cli.BoolFlag{
+	Name:   "metrics-datadog",
+	Usage:  "Send metrics to DogStatsD for Datadog",
+	EnvVar: "BUILDKITE_METRICS_DATADOG",
+}
+
+var MetricsDatadogHostFlag = cli.StringFlag{
+	Name:   "metrics-datadog-host",
+	Usage:  "The dogstatsd instance to send metrics to using udp",
+	EnvVar: "BUILDKITE_METRICS_DATADOG_HOST",
+	Value:  "127.0.0.1:8125",
+}
+
+var MetricsDatadogDistributionsFlag = cli.BoolFlag{
+	Name:   "metrics-datadog-distributions",
+	Usage:  "Use Datadog Distributions for Timing metrics",
+	EnvVar: "BUILDKITE_METRICS_DATADOG_DISTRIBUTIONS",
+}
+
+var RedactedDetectorsFlag = cli.StringSliceFlag{
+	Name:   "redacted-detectors",
+	Usage:  "Built-in detectors for secrets to redact from job output by their content, such as aws-access-key-id, github-token, jwt or pem-private-key (or all)",
+	EnvVar: "BUILDKITE_REDACTED_DETECTORS",
+	Value:  &cli.StringSlice{},
+}
+
+// Patterns are separated by newlines rather than commas, as regular
+// expressions often contain commas (for example, [a-z]{3,5}).
+var RedactedPatternsFlag = cli.StringFlag{
+	Name:   "redacted-patterns",
+	Usage:  "Newline-separated regular expressions matching secrets to redact from job output by their content",
+	EnvVar: "BUILDKITE_REDACTED_PATTERNS",
+}
+
+// splitRedactedPatterns splits the value of --redacted-patterns into patterns.
+func splitRedactedPatterns(patterns string) []string {
+	var exprs []string
+	for _, expr := range strings.Split(patterns, "\n") {
+		if expr != "" {
+			exprs = append(exprs, expr)
+		}
+	}
+	return exprs
+}
+
 var RedactedVars = cli.StringSliceFlag{
 	Name:   "redacted-vars",
 	Usage:  "Pattern of environment variable names containing sensitive values",
@@ -21,9 +21,21 @@ forever) until it can acquire the lock, if the lock is already held by
 another process. If multiple processes are waiting for the same lock, there
 is no ordering guarantee of which one will be given the lock next.
 
+With ′--max N′ (where N is greater than 1), the lock is a counting semaphore:
+up to N processes can hold it at once, and processes waiting for it are
+given it in the order they started waiting. Every process using the same key
+must pass the same ′--max′.
+
 To prevent separate processes unlocking each other, the output from ′lock
 acquire′ should be stored, and passed to ′lock release′.
 
+If ′--lock-lease-ttl′ is set, the lock is held under a lease, which the agent
+running the job renews until the job finishes. The lock is then released,
+even if the job didn't release it. If the agent stops renewing the lease (for
+example, because the host crashed), the lock is released once the TTL has
+elapsed, so that it doesn't block other jobs forever. The lock records the
+job ID and hostname that acquired it, which can be inspected with ′lock list′.
+
 Note that this subcommand is only available when an agent has been started
 with the ′agent-api′ experiment enabled.
 
@@ -32,6 +44,17 @@ Examples:
     #!/bin/bash
     token=$(buildkite-agent lock acquire llama)
     # your critical section here...
+    buildkite-agent lock release llama "${token}"
+
+    #!/bin/bash
+    # At most 2 jobs on this host may run the emulator at once.
+    token=$(buildkite-agent lock acquire --max 2 emulator)
+    # run the emulator here...
+    buildkite-agent lock release emulator "${token}"
+
+    #!/bin/bash
+    token=$(buildkite-agent lock acquire --lock-lease-ttl 1m llama)
+    # your critical section here...
     buildkite-agent lock release llama "${token}"`
 
 type LockAcquireConfig struct {
@@ -40,6 +63,8 @@ type LockAcquireConfig struct {
 	SocketsPath string `cli:"sockets-path" normalize:"filepath"`
 
 	LockWaitTimeout time.Duration `cli:"lock-wait-timeout"`
+	LockLeaseTTL    time.Duration `cli:"lock-lease-ttl"`
+	Max             int           `cli:"max"`
 
 	// Global flags
 	Debug       bool     `cli:"debug"`
@@ -57,6 +82,13 @@ func lockAcquireFlags() []cli.Flag {
 				Usage:  "Sets a maximum duration to wait for a lock before giving up",
 				EnvVar: "BUILDKITE_LOCK_WAIT_TIMEOUT",
 			},
+			lockLeaseTTLFlag,
+			cli.IntFlag{
+				Name:   "max",
+				Value:  1,
+				Usage:  "Turns the lock into a counting semaphore that up to this many processes can hold at once",
+				EnvVar: "BUILDKITE_LOCK_MAX",
+			},
 		},
 		lockCommonFlags...,
 	)
@@ -85,18 +117,31 @@ func lockAcquireAction(c *cli.Context) error {
 		return errors.New("only 'machine' scope for locks is supported in this version.")
 	}
 
+	if cfg.Max < 1 {
+		return fmt.Errorf("invalid --max %d: must be at least 1", cfg.Max)
+	}
+
+	if err := validateLockLeaseTTL(cfg.LockLeaseTTL); err != nil {
+		return err
+	}
+
 	if cfg.LockWaitTimeout != 0 {
 		cctx, canc := context.WithTimeout(ctx, cfg.LockWaitTimeout)
 		defer canc()
 		ctx = cctx
 	}
 
-	client, err := lock.NewClient(ctx, cfg.SocketsPath)
+	client, err := lock.NewClient(ctx, cfg.SocketsPath, lock.WithLeaseTTL(cfg.LockLeaseTTL))
 	if err != nil {
 		return fmt.Errorf(lockClientErrMessage, err)
 	}
 
-	token, err := client.Lock(ctx, key)
+	var token string
+	if cfg.Max == 1 {
+		token, err = client.Lock(ctx, key)
+	} else {
+		token, err = client.Acquire(ctx, key, cfg.Max)
+	}
 	if err != nil {
 		return fmt.Errorf("could not acquire lock: %w", err)
 	}
@@ -1,6 +1,12 @@
 package clicommand
 
-import "github.com/urfave/cli"
+import (
+	"fmt"
+	"time"
+
+	"github.com/buildkite/agent/v3/lock"
+	"github.com/urfave/cli"
+)
 
 const lockClientErrMessage = `Could not connect to Agent API: %v
 This command can only be used when at least one agent is running with the
@@ -22,3 +28,19 @@ var lockCommonFlags = []cli.Flag{
 		EnvVar: "BUILDKITE_SOCKETS_PATH",
 	},
 }
+
+// lockLeaseTTLFlag is used by subcommands that write lock values.
+var lockLeaseTTLFlag = cli.DurationFlag{
+	Name:   "lock-lease-ttl",
+	Usage:  "If set, the lock expires unless its lease is renewed within this long, so that a lock held by a job that crashes doesn't block other jobs forever. The agent running the job renews the lease until the job finishes, and then releases the lock. Must be at least 30s",
+	EnvVar: "BUILDKITE_LOCK_LEASE_TTL",
+}
+
+// validateLockLeaseTTL checks that a lease TTL can be renewed reliably by the
+// agent running the job.
+func validateLockLeaseTTL(ttl time.Duration) error {
+	if ttl != 0 && ttl < lock.MinLeaseTTL {
+		return fmt.Errorf("invalid --lock-lease-ttl %v: must be at least %v", ttl, lock.MinLeaseTTL)
+	}
+	return nil
+}
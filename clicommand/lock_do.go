@@ -45,6 +45,7 @@ type LockDoConfig struct {
 	SocketsPath string `cli:"sockets-path" normalize:"filepath"`
 
 	LockWaitTimeout time.Duration `cli:"lock-wait-timeout"`
+	LockLeaseTTL    time.Duration `cli:"lock-lease-ttl"`
 
 	// Global flags
 	Debug       bool     `cli:"debug"`
@@ -62,6 +63,7 @@ func lockDoFlags() []cli.Flag {
 				Usage:  "Sets a maximum duration to wait for a lock before giving up",
 				EnvVar: "BUILDKITE_LOCK_WAIT_TIMEOUT",
 			},
+			lockLeaseTTLFlag,
 		},
 		lockCommonFlags...,
 	)
@@ -90,13 +92,17 @@ func lockDoAction(c *cli.Context) error {
 		return errors.New("only 'machine' scope for locks is supported in this version.")
 	}
 
+	if err := validateLockLeaseTTL(cfg.LockLeaseTTL); err != nil {
+		return err
+	}
+
 	if cfg.LockWaitTimeout != 0 {
 		cctx, canc := context.WithTimeout(ctx, cfg.LockWaitTimeout)
 		defer canc()
 		ctx = cctx
 	}
 
-	client, err := lock.NewClient(ctx, cfg.SocketsPath)
+	client, err := lock.NewClient(ctx, cfg.SocketsPath, lock.WithLeaseTTL(cfg.LockLeaseTTL))
 	if err != nil {
 		return fmt.Errorf(lockClientErrMessage, err)
 	}
@@ -0,0 +1,85 @@
+package clicommand
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/buildkite/agent/v3/lock"
+	"github.com/urfave/cli"
+)
+
+const lockForceReleaseHelpDescription = `Usage:
+
+    buildkite-agent lock force-release [key]
+
+Description:
+
+Releases a lock regardless of which process holds it, and prints the value
+that was released. This is intended for operators recovering from a lock
+left behind by a job that crashed. Ordinary jobs should use ′lock release′
+(or ′lock done′) instead.
+
+Force-releasing a do-once lock that is marked 'done' will cause the work to
+be done again by the next ′lock do′.
+
+Note that this subcommand is only available when an agent has been started
+with the ′agent-api′ experiment enabled.
+
+Examples:
+
+    $ buildkite-agent lock list
+    $ buildkite-agent lock force-release llama`
+
+type LockForceReleaseConfig struct {
+	// Common config options
+	LockScope   string `cli:"lock-scope"`
+	SocketsPath string `cli:"sockets-path" normalize:"filepath"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var LockForceReleaseCommand = cli.Command{
+	Name:        "force-release",
+	Usage:       "Releases a lock held by any process",
+	Description: lockForceReleaseHelpDescription,
+	Flags:       append(globalFlags(), lockCommonFlags...),
+	Action:      lockForceReleaseAction,
+}
+
+func lockForceReleaseAction(c *cli.Context) error {
+	if c.NArg() != 1 {
+		fmt.Fprint(c.App.ErrWriter, lockForceReleaseHelpDescription)
+		return &SilentExitError{code: 1}
+	}
+	key := c.Args()[0]
+
+	ctx, cfg, l, _, done := setupLoggerAndConfig[LockForceReleaseConfig](context.Background(), c)
+	defer done()
+
+	if cfg.LockScope != "machine" {
+		return errors.New("only 'machine' scope for locks is supported in this version.")
+	}
+
+	client, err := lock.NewClient(ctx, cfg.SocketsPath)
+	if err != nil {
+		return fmt.Errorf(lockClientErrMessage, err)
+	}
+
+	v, err := client.ForceRelease(ctx, key)
+	if err != nil {
+		return fmt.Errorf("couldn't force-release lock: %w", err)
+	}
+	if v == "" {
+		l.Warn("Lock %q was not held", key)
+		return nil
+	}
+
+	_, err = fmt.Fprintln(c.App.Writer, v)
+	return err
+}
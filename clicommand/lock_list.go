@@ -0,0 +1,105 @@
+package clicommand
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/buildkite/agent/v3/lock"
+	"github.com/urfave/cli"
+)
+
+const lockListHelpDescription = `Usage:
+
+    buildkite-agent lock list [options...]
+
+Description:
+
+Lists the lock keys that are currently in use, along with their values, the
+job and host that wrote them, and when their leases expire.
+
+Note that this subcommand is only available when an agent has been started
+with the ′agent-api′ experiment enabled.
+
+Examples:
+
+    $ buildkite-agent lock list
+    KEY     VALUE                         JOB                                   HOST     EXPIRES
+    llama   acquired(pid=1234,otp=01...)  0190f0a4-8b6e-4f3a-9c1d-2e5b7a8c9d0e  builder  2024-07-01T12:34:56Z
+    alpaca  done                                                                builder  never
+
+    $ buildkite-agent lock list --format json`
+
+type LockListConfig struct {
+	Format string `cli:"format"`
+
+	// Common config options
+	LockScope   string `cli:"lock-scope"`
+	SocketsPath string `cli:"sockets-path" normalize:"filepath"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var LockListCommand = cli.Command{
+	Name:        "list",
+	Usage:       "Lists the locks currently in use",
+	Description: lockListHelpDescription,
+	Flags: append(append(globalFlags(), lockCommonFlags...),
+		cli.StringFlag{
+			Name:   "format",
+			Value:  "table",
+			Usage:  "The output format: table or json",
+			EnvVar: "BUILDKITE_LOCK_LIST_FORMAT",
+		},
+	),
+	Action: lockListAction,
+}
+
+func lockListAction(c *cli.Context) error {
+	ctx, cfg, _, _, done := setupLoggerAndConfig[LockListConfig](context.Background(), c)
+	defer done()
+
+	if cfg.LockScope != "machine" {
+		return errors.New("only 'machine' scope for locks is supported in this version.")
+	}
+
+	client, err := lock.NewClient(ctx, cfg.SocketsPath)
+	if err != nil {
+		return fmt.Errorf(lockClientErrMessage, err)
+	}
+
+	locks, err := client.List(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't list locks: %w", err)
+	}
+
+	switch cfg.Format {
+	case "json":
+		enc := json.NewEncoder(c.App.Writer)
+		enc.SetIndent("", "  ")
+		return enc.Encode(locks)
+
+	case "table":
+		tw := tabwriter.NewWriter(c.App.Writer, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "KEY\tVALUE\tJOB\tHOST\tEXPIRES")
+		for _, l := range locks {
+			expires := "never"
+			if !l.Expires.IsZero() {
+				expires = l.Expires.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", l.Key, l.Value, l.Owner.JobID, l.Owner.Hostname, expires)
+		}
+		return tw.Flush()
+
+	default:
+		return fmt.Errorf("invalid format %q: must be table or json", cfg.Format)
+	}
+}
@@ -0,0 +1,110 @@
+package clicommand
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/buildkite/agent/v3/internal/agentapi"
+	"github.com/urfave/cli"
+)
+
+const lockServeHelpDescription = `Usage:
+
+    buildkite-agent lock serve [options...]
+
+Description:
+
+Runs a standalone lock server over HTTP. Agents started with
+′--lock-backend http://<host>:<port>′ (and the ′agent-api′ experiment)
+forward their lock operations to this server, which allows ′lock acquire′,
+′lock do′, ′lock done′ and friends to coordinate agents running on different
+hosts.
+
+By default the server keeps locks in memory. Use ′--state-file′ to persist
+locks to a file so they survive restarts of the lock server.
+
+Examples:
+
+    $ buildkite-agent lock serve --listen 0.0.0.0:8181 --state-file /var/lib/buildkite-agent/locks.json`
+
+type LockServeConfig struct {
+	Listen    string `cli:"listen"`
+	StateFile string `cli:"state-file" normalize:"filepath"`
+	Token     string `cli:"token"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var LockServeCommand = cli.Command{
+	Name:        "serve",
+	Usage:       "Runs a lock server that can be shared by agents on many hosts",
+	Description: lockServeHelpDescription,
+	Flags: append(globalFlags(),
+		cli.StringFlag{
+			Name:   "listen",
+			Value:  "127.0.0.1:8181",
+			Usage:  "The address to listen on",
+			EnvVar: "BUILDKITE_LOCK_SERVE_LISTEN",
+		},
+		cli.StringFlag{
+			Name:   "state-file",
+			Value:  "",
+			Usage:  "A file to persist locks to. If not set, locks are kept in memory",
+			EnvVar: "BUILDKITE_LOCK_SERVE_STATE_FILE",
+		},
+		cli.StringFlag{
+			Name:   "token",
+			Value:  "",
+			Usage:  "If set, clients must send this as a bearer token",
+			EnvVar: "BUILDKITE_LOCK_SERVE_TOKEN",
+		},
+	),
+	Action: lockServeAction,
+}
+
+func lockServeAction(c *cli.Context) error {
+	ctx, cfg, l, _, done := setupLoggerAndConfig[LockServeConfig](context.Background(), c)
+	defer done()
+
+	store := agentapi.NewMemoryLockStore()
+	if cfg.StateFile != "" {
+		fs, err := agentapi.NewFileLockStore(cfg.StateFile)
+		if err != nil {
+			return fmt.Errorf("couldn't open lock state file: %w", err)
+		}
+		store = fs
+	}
+
+	svr := &http.Server{
+		Addr:    cfg.Listen,
+		Handler: agentapi.NewLockHandler(l, store, cfg.Token),
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		<-ctx.Done()
+		l.Info("Shutting down lock server...")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		svr.Shutdown(shutdownCtx)
+	}()
+
+	l.Info("Lock server listening on %s", cfg.Listen)
+	if err := svr.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("lock server: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package clicommand
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/buildkite/agent/v3/jobapi"
+	"github.com/urfave/cli"
+)
+
+const redactorAddHelpDescription = `Usage:
+
+    buildkite-agent redactor add [options...] [file]
+
+Description:
+
+Adds values to redact from the remainder of the current job's log output.
+If you fetch secrets during a job (for example, from a secrets manager in a
+pre-command hook), use this command to ensure they are redacted from any
+subsequent output, even if they never pass through an environment variable.
+
+The values are read from the given file, or from standard input if no file
+(or "-") is given. Values shorter than 6 bytes are rejected, in the same way
+as short values of redacted environment variables are ignored.
+
+Note that this subcommand is only available from within the job executor with the job-api experiment enabled.
+
+Examples:
+
+Redacting the contents of the file ′id_ed25519′:
+
+    $ buildkite-agent redactor add id_ed25519
+
+Redacting the string ′llamasecret′:
+
+    $ echo llamasecret | buildkite-agent redactor add
+
+Redacting several values at once, using a flat JSON object supplied over
+standard input (only the values are redacted, not the keys):
+
+    $ echo '{"db":"hunter2hunter2","api":"llamasecret"}' | \
+        buildkite-agent redactor add --format json`
+
+type RedactorAddConfig struct {
+	File   string `cli:"arg:0"`
+	Format string `cli:"format"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var RedactorAddCommand = cli.Command{
+	Name:        "add",
+	Usage:       "Add values to redact from the job log",
+	Description: redactorAddHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "format",
+			Usage:  "Input format: none (the whole input is one value) or json (a flat object whose values are each redacted)",
+			EnvVar: "BUILDKITE_AGENT_REDACTOR_ADD_FORMAT",
+			Value:  "none",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: redactorAddAction,
+}
+
+func redactorAddAction(c *cli.Context) error {
+	ctx := context.Background()
+	ctx, cfg, l, _, done := setupLoggerAndConfig[RedactorAddConfig](ctx, c)
+	defer done()
+
+	var input io.Reader = os.Stdin
+	if cfg.File != "" && cfg.File != "-" {
+		f, err := os.Open(cfg.File)
+		if err != nil {
+			return fmt.Errorf("couldn't open the file to redact: %w", err)
+		}
+		defer f.Close()
+		input = f
+	}
+
+	values, err := parseRedactorInput(input, cfg.Format)
+	if err != nil {
+		return err
+	}
+	if len(values) == 0 {
+		return fmt.Errorf("no values to redact were provided")
+	}
+
+	client, err := jobapi.NewDefaultClient(ctx)
+	if err != nil {
+		return fmt.Errorf(envClientErrMessage, err)
+	}
+
+	if err := client.RedactionCreate(ctx, values); err != nil {
+		return fmt.Errorf("couldn't add values to redact: %w", err)
+	}
+
+	l.Info("Added %d value(s) to redact", len(values))
+	return nil
+}
+
+// parseRedactorInput reads the values to redact from input in the given format.
+func parseRedactorInput(input io.Reader, format string) ([]string, error) {
+	switch format {
+	case "none":
+		b, err := io.ReadAll(input)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read the input: %w", err)
+		}
+		// Most tools print a trailing newline after a secret, which isn't part
+		// of the secret.
+		value := strings.TrimRight(string(b), "\r\n")
+		if value == "" {
+			return nil, nil
+		}
+		return []string{value}, nil
+
+	case "json":
+		var obj map[string]string
+		if err := json.NewDecoder(input).Decode(&obj); err != nil {
+			return nil, fmt.Errorf("couldn't parse the input as a flat JSON object of strings: %w", err)
+		}
+		values := make([]string, 0, len(obj))
+		for _, v := range obj {
+			values = append(values, v)
+		}
+		return values, nil
+
+	default:
+		return nil, fmt.Errorf("invalid input format %q", format)
+	}
+}
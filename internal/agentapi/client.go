@@ -53,13 +53,15 @@ func (c *Client) LockGet(ctx context.Context, key string) (string, error) {
 
 // LockCompareAndSwap atomically compares-and-swaps the old value for the new
 // value, or performs no modification. It returns the most up-to-date value for
-// the key, and reports whether the new value was written.
-func (c *Client) LockCompareAndSwap(ctx context.Context, key, old, new string) (string, bool, error) {
+// the key, and reports whether the new value was written. The lease is attached
+// to the new value.
+func (c *Client) LockCompareAndSwap(ctx context.Context, key, old, new string, lease LockLease) (string, bool, error) {
 	uk := "?key=" + url.QueryEscape(key)
 
 	req := LockCASRequest{
-		Old: old,
-		New: new,
+		Old:   old,
+		New:   new,
+		Lease: lease,
 	}
 	var resp LockCASResponse
 	if err := c.sc.Do(ctx, "PATCH", lockAPIPrefix+uk, &req, &resp); err != nil {
@@ -67,3 +69,62 @@ func (c *Client) LockCompareAndSwap(ctx context.Context, key, old, new string) (
 	}
 	return resp.Value, resp.Swapped, nil
 }
+
+// LockWait waits until the value of the lock key is no longer old, or until
+// the timeout elapses, and returns the current value. A zero timeout uses the
+// server's default.
+func (c *Client) LockWait(ctx context.Context, key, old string, timeout time.Duration) (string, error) {
+	q := url.Values{"key": {key}, "value": {old}}
+	if timeout > 0 {
+		q.Set("timeout", timeout.String())
+	}
+
+	var resp ValueResponse
+	if err := c.sc.Do(ctx, "GET", lockAPIPrefix+"wait?"+q.Encode(), nil, &resp); err != nil {
+		return "", err
+	}
+	return resp.Value, nil
+}
+
+// LockList lists the locks currently in use.
+func (c *Client) LockList(ctx context.Context) ([]Lock, error) {
+	var resp LockListResponse
+	if err := c.sc.Do(ctx, "GET", lockAPIPrefix+"list", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Locks, nil
+}
+
+// SemaphoreAcquire tries to acquire one of max slots in the counting semaphore
+// for key, or (re)joins the queue of waiters. If wait is non-zero, the server
+// keeps trying for up to that long before responding. It reports whether the
+// slot was acquired, and otherwise the 1-based position of the token in the
+// queue. Waiters must call SemaphoreAcquire again to keep their place.
+func (c *Client) SemaphoreAcquire(ctx context.Context, key, token string, max int, lease LockLease, wait time.Duration) (bool, int, error) {
+	uk := "?key=" + url.QueryEscape(key)
+
+	req := SemaphoreAcquireRequest{
+		Token: token,
+		Max:   max,
+		Lease: lease,
+		Wait:  wait,
+	}
+	var resp SemaphoreAcquireResponse
+	if err := c.sc.Do(ctx, "POST", lockAPIPrefix+"semaphore"+uk, &req, &resp); err != nil {
+		return false, 0, err
+	}
+	return resp.Acquired, resp.Position, nil
+}
+
+// SemaphoreRelease releases the token's slot in the counting semaphore for key
+// (or its place in the queue). It reports whether the token was found.
+func (c *Client) SemaphoreRelease(ctx context.Context, key, token string) (bool, error) {
+	uk := "?key=" + url.QueryEscape(key)
+
+	req := SemaphoreReleaseRequest{Token: token}
+	var resp SemaphoreReleaseResponse
+	if err := c.sc.Do(ctx, "POST", lockAPIPrefix+"semaphore/release"+uk, &req, &resp); err != nil {
+		return false, err
+	}
+	return resp.Released, nil
+}
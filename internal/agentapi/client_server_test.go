@@ -81,7 +81,7 @@ func TestLockOperations(t *testing.T) {
 
 	// CAS should succeed at changing it from empty to another value.
 	from, to := "", "Kuzco"
-	got, ok, err := cli.LockCompareAndSwap(ctx, key, from, to)
+	got, ok, err := cli.LockCompareAndSwap(ctx, key, from, to, LockLease{})
 	if err != nil {
 		t.Errorf("cli.LockCompareAndSwap(ctx, %q, %q, %q) = error %v", key, from, to, err)
 	}
@@ -93,7 +93,7 @@ func TestLockOperations(t *testing.T) {
 	// (Unless something has concurrently changed it back, but we're not testing
 	// that.)
 	to2 := "Yzma"
-	got, ok, err = cli.LockCompareAndSwap(ctx, key, from, to2)
+	got, ok, err = cli.LockCompareAndSwap(ctx, key, from, to2, LockLease{})
 	if err != nil {
 		t.Errorf("cli.LockCompareAndSwap(ctx, %q, %q, %q) = error %v", key, from, to2, err)
 	}
@@ -0,0 +1,89 @@
+package agentapi
+
+import (
+	"sort"
+	"time"
+)
+
+// LockOwner identifies the job that wrote a lock value. The agent running the
+// job renews the leases on its locks, so the job (rather than the short-lived
+// process that wrote the value) is what holds the lock.
+type LockOwner struct {
+	JobID    string `json:"job_id,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+}
+
+// LockLease is the lease attached to a lock value when it is written. A lock
+// with a lease expires (becomes "") once the TTL has elapsed, unless the lease
+// is renewed by swapping the value for itself. A zero TTL means the value never
+// expires.
+type LockLease struct {
+	Owner LockOwner     `json:"owner"`
+	TTL   time.Duration `json:"ttl,omitempty"`
+}
+
+// Lock describes a lock key that is currently in use.
+type Lock struct {
+	Key     string        `json:"key"`
+	Value   string        `json:"value"`
+	Owner   LockOwner     `json:"owner"`
+	TTL     time.Duration `json:"ttl,omitempty"`     // how long each renewal of the lease lasts
+	Expires time.Time     `json:"expires,omitempty"` // zero if the lock never expires
+}
+
+// expired reports whether the lock's lease has expired at the time now.
+func (l Lock) expired(now time.Time) bool {
+	return !l.Expires.IsZero() && !now.Before(l.Expires)
+}
+
+// loadLock returns the current lock for the key, reaping it from the map if
+// the lease has expired.
+func loadLock(locks map[string]Lock, now time.Time, key string) Lock {
+	l, ok := locks[key]
+	if !ok {
+		return Lock{Key: key}
+	}
+	if l.expired(now) {
+		delete(locks, key)
+		return Lock{Key: key}
+	}
+	return l
+}
+
+// casLock implements compare-and-swap for a map of locks. Swapping a value for
+// itself renews the lease. Empty values are removed from the map.
+func casLock(locks map[string]Lock, now time.Time, key, old, new string, lease LockLease) (string, bool) {
+	cur := loadLock(locks, now, key)
+	if cur.Value != old {
+		return cur.Value, false
+	}
+	if new == "" {
+		delete(locks, key)
+		return new, true
+	}
+	l := Lock{
+		Key:   key,
+		Value: new,
+		Owner: lease.Owner,
+	}
+	if lease.TTL > 0 {
+		l.TTL = lease.TTL
+		l.Expires = now.Add(lease.TTL)
+	}
+	locks[key] = l
+	return new, true
+}
+
+// listLocks returns all unexpired locks in the map, reaping expired ones.
+func listLocks(locks map[string]Lock, now time.Time) []Lock {
+	out := make([]Lock, 0, len(locks))
+	for key, l := range locks {
+		if l.expired(now) {
+			delete(locks, key)
+			continue
+		}
+		out = append(out, l)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
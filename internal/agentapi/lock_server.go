@@ -2,25 +2,30 @@ package agentapi
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/buildkite/agent/v3/internal/socket"
 	"github.com/buildkite/agent/v3/logger"
 	"github.com/go-chi/chi/v5"
 )
 
-// lockServer serves lock requests using a lockState.
+// lockServer serves lock requests using a LockStore.
 type lockServer struct {
-	logger logger.Logger
-	locks  *lockState
+	logger  logger.Logger
+	locks   LockStore
+	changes *changeNotifier
 }
 
-// newLockServer creates a lockServer containing a new empty lockState.
-func newLockServer(logger logger.Logger) *lockServer {
+// newLockServer creates a lockServer using the given store.
+func newLockServer(logger logger.Logger, store LockStore) *lockServer {
+	changes := newChangeNotifier()
 	return &lockServer{
-		logger: logger,
-		locks:  newLockState(),
+		logger:  logger,
+		locks:   notifyingStore{LockStore: store, changes: changes},
+		changes: changes,
 	}
 }
 
@@ -28,6 +33,10 @@ func newLockServer(logger logger.Logger) *lockServer {
 func (s *lockServer) routes(r chi.Router) {
 	r.Get("/", s.getLock)
 	r.Patch("/", s.patchLock)
+	r.Get("/list", s.listLocks)
+	r.Get("/wait", s.waitLock)
+	r.Post("/semaphore", s.acquireSemaphore)
+	r.Post("/semaphore/release", s.releaseSemaphore)
 }
 
 // getLock atomically retrieves the current lock value.
@@ -39,8 +48,16 @@ func (s *lockServer) getLock(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	v, err := s.locks.Load(r.Context(), key)
+	if err != nil {
+		s.logger.Error("Agent API: couldn't load lock %q: %v", key, err)
+		if err := socket.WriteError(w, fmt.Sprintf("couldn't load lock: %v", err), http.StatusInternalServerError); err != nil {
+			s.logger.Error("Agent API: couldn't write error: %v", err)
+		}
+		return
+	}
 	resp := &ValueResponse{
-		Value: s.locks.load(key),
+		Value: v,
 	}
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		s.logger.Error("Agent API: couldn't encode response body: %v", err)
@@ -65,7 +82,14 @@ func (s *lockServer) patchLock(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	v, ok := s.locks.cas(key, req.Old, req.New)
+	v, ok, err := s.locks.CompareAndSwap(r.Context(), key, req.Old, req.New, req.Lease)
+	if err != nil {
+		s.logger.Error("Agent API: couldn't update lock %q: %v", key, err)
+		if err := socket.WriteError(w, fmt.Sprintf("couldn't update lock: %v", err), http.StatusInternalServerError); err != nil {
+			s.logger.Error("Agent API: couldn't write error: %v", err)
+		}
+		return
+	}
 	resp := &LockCASResponse{
 		Value:   v,
 		Swapped: ok,
@@ -81,3 +105,165 @@ func (s *lockServer) patchLock(w http.ResponseWriter, r *http.Request) {
 		s.logger.Error("Agent API: couldn't encode response body: %v", err)
 	}
 }
+
+// waitLock waits until the lock value is different to the value query
+// parameter, or until the timeout query parameter (default 10s, max 30s) has
+// elapsed, and then returns the current value. This lets waiters wake as soon
+// as a lock is released, instead of polling.
+func (s *lockServer) waitLock(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	key := query.Get("key")
+	if key == "" {
+		if err := socket.WriteError(w, "key missing", http.StatusNotFound); err != nil {
+			s.logger.Error("Agent API: couldn't write error: %v", err)
+		}
+		return
+	}
+	timeout, err := lockWaitDuration(query.Get("timeout"))
+	if err != nil {
+		if err := socket.WriteError(w, fmt.Sprintf("invalid timeout: %v", err), http.StatusBadRequest); err != nil {
+			s.logger.Error("Agent API: couldn't write error: %v", err)
+		}
+		return
+	}
+
+	ctx, old := r.Context(), query.Get("value")
+	deadline := time.Now().Add(timeout)
+	for {
+		changed := s.changes.changed(key)
+		v, err := s.locks.Load(ctx, key)
+		if err != nil {
+			s.logger.Error("Agent API: couldn't load lock %q: %v", key, err)
+			if err := socket.WriteError(w, fmt.Sprintf("couldn't load lock: %v", err), http.StatusInternalServerError); err != nil {
+				s.logger.Error("Agent API: couldn't write error: %v", err)
+			}
+			return
+		}
+		if v != old || !waitForChange(ctx, changed, deadline) {
+			if err := json.NewEncoder(w).Encode(&ValueResponse{Value: v}); err != nil {
+				s.logger.Error("Agent API: couldn't encode response body: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// listLocks lists all the locks currently in use.
+func (s *lockServer) listLocks(w http.ResponseWriter, r *http.Request) {
+	locks, err := s.locks.List(r.Context())
+	if err != nil {
+		s.logger.Error("Agent API: couldn't list locks: %v", err)
+		if err := socket.WriteError(w, fmt.Sprintf("couldn't list locks: %v", err), http.StatusInternalServerError); err != nil {
+			s.logger.Error("Agent API: couldn't write error: %v", err)
+		}
+		return
+	}
+	if err := json.NewEncoder(w).Encode(&LockListResponse{Locks: locks}); err != nil {
+		s.logger.Error("Agent API: couldn't encode response body: %v", err)
+	}
+}
+
+// acquireSemaphore tries to acquire a slot in a counting semaphore, or
+// (re)joins the queue of waiters for one. If the request has a wait, it keeps
+// trying for up to that long. Waiters must call again to keep their place in
+// the queue, and holders may call again to renew their lease.
+func (s *lockServer) acquireSemaphore(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		if err := socket.WriteError(w, "key missing", http.StatusNotFound); err != nil {
+			s.logger.Error("Agent API: couldn't write error: %v", err)
+		}
+		return
+	}
+
+	var req SemaphoreAcquireRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if err := socket.WriteError(w, fmt.Sprintf("couldn't decode request body: %v", err), http.StatusBadRequest); err != nil {
+			s.logger.Error("Agent API: couldn't write error: %v", err)
+		}
+		return
+	}
+	if req.Token == "" || req.Max < 1 {
+		if err := socket.WriteError(w, "token must not be empty, and max must be at least 1", http.StatusUnprocessableEntity); err != nil {
+			s.logger.Error("Agent API: couldn't write error: %v", err)
+		}
+		return
+	}
+
+	// If asked to wait, keep trying until the slot is acquired or the wait is
+	// over.
+	ctx := r.Context()
+	deadline := time.Now().Add(min(max(req.Wait, 0), maxLockWait))
+	var pos int
+	for {
+		changed := s.changes.changed(key)
+		err := updateSemaphore(ctx, s.locks, key, func(sem *semaphoreState) error {
+			p, err := sem.acquire(time.Now(), req.Token, req.Max, req.Lease)
+			pos = p
+			return err
+		})
+		if err != nil {
+			s.writeSemaphoreError(w, key, err)
+			return
+		}
+		if pos == 0 || !waitForChange(ctx, changed, deadline) {
+			break
+		}
+	}
+
+	resp := &SemaphoreAcquireResponse{
+		Acquired: pos == 0,
+		Position: pos,
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		s.logger.Error("Agent API: couldn't encode response body: %v", err)
+	}
+}
+
+// releaseSemaphore releases a slot in a counting semaphore, or gives up a place
+// in the queue of waiters.
+func (s *lockServer) releaseSemaphore(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		if err := socket.WriteError(w, "key missing", http.StatusNotFound); err != nil {
+			s.logger.Error("Agent API: couldn't write error: %v", err)
+		}
+		return
+	}
+
+	var req SemaphoreReleaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if err := socket.WriteError(w, fmt.Sprintf("couldn't decode request body: %v", err), http.StatusBadRequest); err != nil {
+			s.logger.Error("Agent API: couldn't write error: %v", err)
+		}
+		return
+	}
+
+	var released bool
+	err := updateSemaphore(r.Context(), s.locks, key, func(sem *semaphoreState) error {
+		released = sem.release(time.Now(), req.Token)
+		return nil
+	})
+	if err != nil {
+		s.writeSemaphoreError(w, key, err)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(&SemaphoreReleaseResponse{Released: released}); err != nil {
+		s.logger.Error("Agent API: couldn't encode response body: %v", err)
+	}
+}
+
+// writeSemaphoreError writes a semaphore error with an appropriate status.
+func (s *lockServer) writeSemaphoreError(w http.ResponseWriter, key string, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, errNotSemaphore), errors.Is(err, errSemaphoreMax):
+		code = http.StatusConflict
+	default:
+		s.logger.Error("Agent API: couldn't update semaphore %q: %v", key, err)
+	}
+	if err := socket.WriteError(w, fmt.Sprintf("semaphore %q: %v", key, err), code); err != nil {
+		s.logger.Error("Agent API: couldn't write error: %v", err)
+	}
+}
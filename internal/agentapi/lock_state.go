@@ -1,17 +1,21 @@
 package agentapi
 
-import "sync"
+import (
+	"context"
+	"sync"
+	"time"
+)
 
 // lockState is really just a concurrent map.
 type lockState struct {
 	mu    sync.Mutex
-	locks map[string]string
+	locks map[string]Lock
 }
 
 // newLockState creates a new empty lockServer.
 func newLockState() *lockState {
 	return &lockState{
-		locks: make(map[string]string),
+		locks: make(map[string]Lock),
 	}
 }
 
@@ -19,18 +23,32 @@ func newLockState() *lockState {
 func (s *lockState) load(key string) string {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return s.locks[key]
+	return loadLock(s.locks, time.Now(), key).Value
 }
 
 // cas atomically attempts to swap the old value for the key for a new
 // value. It reports whether the swap succeeded, returning the (new or existing)
 // value.
-func (s *lockState) cas(key, old, new string) (string, bool) {
+func (s *lockState) cas(key, old, new string, lease LockLease) (string, bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if s.locks[key] == old {
-		s.locks[key] = new
-		return new, true
-	}
-	return s.locks[key], false
+	return casLock(s.locks, time.Now(), key, old, new, lease)
+}
+
+// Load implements LockStore.
+func (s *lockState) Load(_ context.Context, key string) (string, error) {
+	return s.load(key), nil
+}
+
+// CompareAndSwap implements LockStore.
+func (s *lockState) CompareAndSwap(_ context.Context, key, old, new string, lease LockLease) (string, bool, error) {
+	v, ok := s.cas(key, old, new, lease)
+	return v, ok, nil
+}
+
+// List implements LockStore.
+func (s *lockState) List(context.Context) ([]Lock, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return listLocks(s.locks, time.Now()), nil
 }
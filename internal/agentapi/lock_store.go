@@ -0,0 +1,71 @@
+package agentapi
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// LockStore is the storage backend used by the lock service. Implementations
+// must make CompareAndSwap atomic with respect to every other caller sharing
+// the same store, which is what allows a shared store to coordinate locks
+// between agents on different hosts.
+type LockStore interface {
+	// Load retrieves the current value for the lock key. Keys that are not in
+	// use have the value "".
+	Load(ctx context.Context, key string) (string, error)
+
+	// CompareAndSwap atomically swaps the old value for the key for a new value,
+	// or performs no modification. It returns the most up-to-date value for the
+	// key, and reports whether the new value was written. The lease is attached
+	// to the new value; swapping a value for itself renews the lease.
+	CompareAndSwap(ctx context.Context, key, old, new string, lease LockLease) (string, bool, error)
+
+	// List returns all lock keys currently in use, sorted by key. Locks with
+	// expired leases are not included.
+	List(ctx context.Context) ([]Lock, error)
+}
+
+// NewMemoryLockStore creates a LockStore that keeps locks in memory. The locks
+// are lost when the agent exits.
+func NewMemoryLockStore() LockStore {
+	return newLockState()
+}
+
+// NewLockStore creates a LockStore from a backend specification:
+//
+//   - "" or "memory" keeps locks in memory (the default);
+//   - "file:///path/to/locks.json" (or "file:path") persists locks to a file,
+//     so they survive agent restarts;
+//   - "http://host:port" or "https://host:port" uses a remote lock server, such
+//     as one started by `buildkite-agent lock serve`. The token, if not empty,
+//     is sent as a bearer token.
+func NewLockStore(spec, token string) (LockStore, error) {
+	if spec == "" || spec == "memory" {
+		return NewMemoryLockStore(), nil
+	}
+
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("parsing lock backend %q: %w", spec, err)
+	}
+
+	switch u.Scheme {
+	case "file":
+		path := u.Path
+		if u.Opaque != "" {
+			path = u.Opaque
+		}
+		if path == "" {
+			return nil, fmt.Errorf("lock backend %q is missing a file path", spec)
+		}
+		return NewFileLockStore(path)
+
+	case "http", "https":
+		return NewHTTPLockStore(strings.TrimSuffix(spec, "/"), token), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported lock backend %q: must be \"memory\", a file:// URL, or an http(s):// URL", spec)
+	}
+}
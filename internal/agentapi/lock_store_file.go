@@ -0,0 +1,150 @@
+package agentapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+// FileLockStore is a LockStore that persists locks to a JSON file after every
+// change, so that lock state survives agent restarts. The file is read again
+// for every operation, while holding an exclusive flock on a lock file next to
+// it, so every process using the same file (such as each agent that becomes
+// the leader in turn) sees the same locks.
+type FileLockStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+// How often to retry taking the flock while another process holds it.
+const fileLockRetryDelay = 10 * time.Millisecond
+
+// NewFileLockStore creates a FileLockStore that keeps lock state in the file at
+// path.
+func NewFileLockStore(path string) (*FileLockStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("creating lock file directory: %w", err)
+	}
+
+	s := &FileLockStore{path: path}
+
+	// Check the existing state can be read, so a bad file is reported early.
+	if err := s.with(context.Background(), func(map[string]Lock) bool { return false }); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Load implements LockStore. Expired leases are reaped from the file the next
+// time it is written.
+func (s *FileLockStore) Load(ctx context.Context, key string) (string, error) {
+	var v string
+	err := s.with(ctx, func(locks map[string]Lock) bool {
+		v = loadLock(locks, time.Now(), key).Value
+		return false
+	})
+	return v, err
+}
+
+// CompareAndSwap implements LockStore. The swap is only reported as successful
+// once the new state has been written to the file.
+func (s *FileLockStore) CompareAndSwap(ctx context.Context, key, old, new string, lease LockLease) (string, bool, error) {
+	var (
+		v  string
+		ok bool
+	)
+	err := s.with(ctx, func(locks map[string]Lock) bool {
+		v, ok = casLock(locks, time.Now(), key, old, new, lease)
+		return ok
+	})
+	if err != nil {
+		return "", false, err
+	}
+	return v, ok, nil
+}
+
+// List implements LockStore.
+func (s *FileLockStore) List(ctx context.Context) ([]Lock, error) {
+	var locks []Lock
+	err := s.with(ctx, func(state map[string]Lock) bool {
+		locks = listLocks(state, time.Now())
+		return false
+	})
+	return locks, err
+}
+
+// with reads the lock state from the file and calls f with it, while holding
+// the flock. If f reports that it changed the state, the state is written back
+// before the flock is released.
+func (s *FileLockStore) with(ctx context.Context, f func(map[string]Lock) bool) error {
+	// The flock is per process (or file descriptor), so also serialise callers
+	// within this process.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The flock is taken on a separate file, as the lock file is replaced
+	// whenever it's written.
+	fl := flock.New(s.path + ".flock")
+	if _, err := fl.TryLockContext(ctx, fileLockRetryDelay); err != nil {
+		return fmt.Errorf("locking lock file: %w", err)
+	}
+	defer fl.Unlock()
+
+	locks := make(map[string]Lock)
+	data, err := os.ReadFile(s.path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		// No locks yet
+
+	case err != nil:
+		return fmt.Errorf("reading lock file: %w", err)
+
+	case len(data) > 0:
+		if err := json.Unmarshal(data, &locks); err != nil {
+			return fmt.Errorf("decoding lock file %q: %w", s.path, err)
+		}
+	}
+
+	if !f(locks) {
+		return nil
+	}
+	return s.save(locks)
+}
+
+// save writes the lock state to a temporary file and renames it into place,
+// so that the file is never left partially written.
+func (s *FileLockStore) save(locks map[string]Lock) error {
+	data, err := json.Marshal(locks)
+	if err != nil {
+		return fmt.Errorf("encoding lock state: %w", err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("creating temporary lock file: %w", err)
+	}
+	defer os.Remove(f.Name()) // no-op after a successful rename
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("writing temporary lock file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("syncing temporary lock file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("closing temporary lock file: %w", err)
+	}
+	if err := os.Rename(f.Name(), s.path); err != nil {
+		return fmt.Errorf("renaming temporary lock file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package agentapi
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/buildkite/agent/v3/internal/socket"
+)
+
+// HTTPLockStore is a LockStore backed by a remote lock server (see
+// NewLockHandler). Pointing the agents on many hosts at the same lock server
+// allows them to coordinate locks across the fleet.
+type HTTPLockStore struct {
+	base string
+	cli  *socket.Client
+}
+
+// NewHTTPLockStore creates a new HTTPLockStore that talks to the lock server at
+// the base URL. If token is not empty, it is sent as a bearer token.
+func NewHTTPLockStore(base, token string) *HTTPLockStore {
+	return &HTTPLockStore{
+		base: base,
+		cli:  socket.NewHTTPClient(&http.Client{Timeout: 30 * time.Second}, token),
+	}
+}
+
+// Load implements LockStore.
+func (s *HTTPLockStore) Load(ctx context.Context, key string) (string, error) {
+	var resp ValueResponse
+	if err := s.cli.Do(ctx, "GET", s.lockURL(key), nil, &resp); err != nil {
+		return "", err
+	}
+	return resp.Value, nil
+}
+
+// CompareAndSwap implements LockStore.
+func (s *HTTPLockStore) CompareAndSwap(ctx context.Context, key, old, new string, lease LockLease) (string, bool, error) {
+	req := LockCASRequest{
+		Old:   old,
+		New:   new,
+		Lease: lease,
+	}
+	var resp LockCASResponse
+	if err := s.cli.Do(ctx, "PATCH", s.lockURL(key), &req, &resp); err != nil {
+		return "", false, err
+	}
+	return resp.Value, resp.Swapped, nil
+}
+
+// List implements LockStore.
+func (s *HTTPLockStore) List(ctx context.Context) ([]Lock, error) {
+	var resp LockListResponse
+	if err := s.cli.Do(ctx, "GET", s.base+"/lock/list", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Locks, nil
+}
+
+func (s *HTTPLockStore) lockURL(key string) string {
+	return s.base + "/lock/?key=" + url.QueryEscape(key)
+}
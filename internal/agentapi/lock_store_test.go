@@ -0,0 +1,200 @@
+package agentapi
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFileLockStorePersists(t *testing.T) {
+	t.Parallel()
+	ctx, canc := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(canc)
+
+	path := filepath.Join(t.TempDir(), "locks", "locks.json")
+
+	store, err := NewFileLockStore(path)
+	if err != nil {
+		t.Fatalf("NewFileLockStore(%q) = error %v", path, err)
+	}
+
+	const key, value = "llama", "Kuzco"
+	if got, ok, err := store.CompareAndSwap(ctx, key, "", value, LockLease{}); err != nil || !ok || got != value {
+		t.Fatalf("store.CompareAndSwap(ctx, %q, %q, %q) = (%q, %t, %v); want (%q, true, nil)", key, "", value, got, ok, err, value)
+	}
+
+	// A new store using the same file (like a restarted agent) should see the
+	// lock.
+	reopened, err := NewFileLockStore(path)
+	if err != nil {
+		t.Fatalf("NewFileLockStore(%q) = error %v", path, err)
+	}
+	got, err := reopened.Load(ctx, key)
+	if err != nil {
+		t.Errorf("reopened.Load(ctx, %q) = error %v", key, err)
+	}
+	if got != value {
+		t.Errorf("reopened.Load(ctx, %q) = %q, want %q", key, got, value)
+	}
+
+	// Releasing the lock should also persist.
+	if _, ok, err := reopened.CompareAndSwap(ctx, key, value, "", LockLease{}); err != nil || !ok {
+		t.Fatalf("reopened.CompareAndSwap(ctx, %q, %q, %q) = (_, %t, %v); want (_, true, nil)", key, value, "", ok, err)
+	}
+	again, err := NewFileLockStore(path)
+	if err != nil {
+		t.Fatalf("NewFileLockStore(%q) = error %v", path, err)
+	}
+	if got, err := again.Load(ctx, key); err != nil || got != "" {
+		t.Errorf("again.Load(ctx, %q) = (%q, %v), want (%q, nil)", key, got, err, "")
+	}
+}
+
+func TestFileLockStoreSharedBetweenStores(t *testing.T) {
+	t.Parallel()
+	ctx, canc := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(canc)
+
+	path := filepath.Join(t.TempDir(), "locks.json")
+
+	// Two stores using the same file, like the old and new leader agents
+	// after a takeover.
+	oldLeader, err := NewFileLockStore(path)
+	if err != nil {
+		t.Fatalf("NewFileLockStore(%q) = error %v", path, err)
+	}
+	newLeader, err := NewFileLockStore(path)
+	if err != nil {
+		t.Fatalf("NewFileLockStore(%q) = error %v", path, err)
+	}
+
+	const key = "llama"
+	if _, ok, err := oldLeader.CompareAndSwap(ctx, key, "", "Kuzco", LockLease{}); err != nil || !ok {
+		t.Fatalf("oldLeader.CompareAndSwap(ctx, %q, %q, %q) = (_, %t, %v); want (_, true, nil)", key, "", "Kuzco", ok, err)
+	}
+
+	// The lock granted by the old leader must not be granted again.
+	if got, ok, err := newLeader.CompareAndSwap(ctx, key, "", "Pacha", LockLease{}); err != nil || ok || got != "Kuzco" {
+		t.Errorf("newLeader.CompareAndSwap(ctx, %q, %q, %q) = (%q, %t, %v); want (%q, false, nil)", key, "", "Pacha", got, ok, err, "Kuzco")
+	}
+
+	// Changes made through either store are seen by the other.
+	if _, ok, err := newLeader.CompareAndSwap(ctx, key, "Kuzco", "", LockLease{}); err != nil || !ok {
+		t.Fatalf("newLeader.CompareAndSwap(ctx, %q, %q, %q) = (_, %t, %v); want (_, true, nil)", key, "Kuzco", "", ok, err)
+	}
+	if got, err := oldLeader.Load(ctx, key); err != nil || got != "" {
+		t.Errorf("oldLeader.Load(ctx, %q) = (%q, %v), want (%q, nil)", key, got, err, "")
+	}
+
+	// When both stores race for the same lock, exactly one gets it.
+	var wg sync.WaitGroup
+	var winners atomic.Int32
+	for i := 0; i < 20; i++ {
+		store := oldLeader
+		if i%2 == 1 {
+			store = newLeader
+		}
+		value := fmt.Sprintf("job-%d", i)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, ok, err := store.CompareAndSwap(ctx, "contended", "", value, LockLease{})
+			if err != nil {
+				t.Errorf("store.CompareAndSwap(ctx, contended, %q, %q) error = %v", "", value, err)
+			}
+			if ok {
+				winners.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := winners.Load(); got != 1 {
+		t.Errorf("%d stores acquired the contended lock, want exactly 1", got)
+	}
+
+	locks, err := newLeader.List(ctx)
+	if err != nil {
+		t.Fatalf("newLeader.List(ctx) error = %v", err)
+	}
+	if len(locks) != 1 || locks[0].Key != "contended" {
+		t.Errorf("newLeader.List(ctx) = %v, want only the contended lock", locks)
+	}
+}
+
+func TestServerWithHTTPLockStore(t *testing.T) {
+	t.Parallel()
+	ctx, canc := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(canc)
+
+	// A shared lock server, as run by `buildkite-agent lock serve`.
+	const token = "alpacas"
+	shared := httptest.NewServer(NewLockHandler(testLogger(t), NewMemoryLockStore(), token))
+	t.Cleanup(shared.Close)
+
+	// Two agents on different "hosts" (sockets) using the shared server.
+	var clients []*Client
+	for i := 0; i < 2; i++ {
+		sockPath := testSocketPath()
+		store, err := NewLockStore(shared.URL, token)
+		if err != nil {
+			t.Fatalf("NewLockStore(%q, %q) = error %v", shared.URL, token, err)
+		}
+		svr, err := NewServer(sockPath, testLogger(t), WithLockStore(store))
+		if err != nil {
+			t.Fatalf("NewServer(%q, logger, WithLockStore(store)) = error %v", sockPath, err)
+		}
+		if err := svr.Start(); err != nil {
+			t.Fatalf("svr.Start() = %v", err)
+		}
+		t.Cleanup(func() { svr.Close() })
+
+		cli, err := NewClient(ctx, sockPath)
+		if err != nil {
+			t.Fatalf("NewClient(ctx, %q) = error %v", sockPath, err)
+		}
+		clients = append(clients, cli)
+	}
+
+	const key = "llama"
+	if _, ok, err := clients[0].LockCompareAndSwap(ctx, key, "", "Kuzco", LockLease{}); err != nil || !ok {
+		t.Fatalf("clients[0].LockCompareAndSwap(ctx, %q, %q, %q) = (_, %t, %v); want (_, true, nil)", key, "", "Kuzco", ok, err)
+	}
+
+	// The other agent should see the lock as held.
+	got, ok, err := clients[1].LockCompareAndSwap(ctx, key, "", "Yzma", LockLease{})
+	if err != nil {
+		t.Fatalf("clients[1].LockCompareAndSwap(ctx, %q, %q, %q) = error %v", key, "", "Yzma", err)
+	}
+	if got != "Kuzco" || ok {
+		t.Errorf("clients[1].LockCompareAndSwap(ctx, %q, %q, %q) = (%q, %t, nil); want (%q, false, nil)", key, "", "Yzma", got, ok, "Kuzco")
+	}
+
+	// A store with the wrong token should be refused.
+	bad := NewHTTPLockStore(shared.URL, "wrong")
+	if _, err := bad.Load(ctx, key); err == nil {
+		t.Errorf("bad.Load(ctx, %q) = nil error, want an authorization error", key)
+	}
+}
+
+func TestNewLockStore(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "locks.json")
+	for _, spec := range []string{"", "memory", "file://" + path, "file:" + path, "http://localhost:8181"} {
+		if _, err := NewLockStore(spec, ""); err != nil {
+			t.Errorf("NewLockStore(%q, %q) = error %v", spec, "", err)
+		}
+	}
+
+	for _, spec := range []string{"redis://localhost", "file://", "llamas"} {
+		if _, err := NewLockStore(spec, ""); err == nil {
+			t.Errorf("NewLockStore(%q, %q) = nil error, want an error", spec, "")
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package agentapi
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultLockWait and maxLockWait bound how long a long-poll request waits
+	// for a lock to change before responding anyway.
+	defaultLockWait = 10 * time.Second
+	maxLockWait     = 30 * time.Second
+
+	// lockWaitRecheckInterval is how often waiters check the store even
+	// without a notification. Changes can happen without a notification when
+	// leases expire, or when another agent changes a shared store.
+	lockWaitRecheckInterval = time.Second
+)
+
+// changeNotifier lets waiters wait for the next change to a lock key.
+type changeNotifier struct {
+	mu    sync.Mutex
+	chans map[string]chan struct{}
+}
+
+func newChangeNotifier() *changeNotifier {
+	return &changeNotifier{chans: make(map[string]chan struct{})}
+}
+
+// changed returns a channel that is closed at the next change to key. To avoid
+// missing a change, call changed before loading the current value.
+func (n *changeNotifier) changed(key string) <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ch, ok := n.chans[key]
+	if !ok {
+		ch = make(chan struct{})
+		n.chans[key] = ch
+	}
+	return ch
+}
+
+// notify wakes everything waiting for a change to key.
+func (n *changeNotifier) notify(key string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if ch, ok := n.chans[key]; ok {
+		close(ch)
+		delete(n.chans, key)
+	}
+}
+
+// notifyingStore wraps a LockStore, notifying waiters whenever a value is
+// changed through it.
+type notifyingStore struct {
+	LockStore
+	changes *changeNotifier
+}
+
+// CompareAndSwap implements LockStore.
+func (s notifyingStore) CompareAndSwap(ctx context.Context, key, old, new string, lease LockLease) (string, bool, error) {
+	v, ok, err := s.LockStore.CompareAndSwap(ctx, key, old, new, lease)
+	if ok && old != new {
+		s.changes.notify(key)
+	}
+	return v, ok, err
+}
+
+// waitForChange blocks until changed is closed, the recheck interval passes,
+// or the deadline passes. It reports false if the deadline has passed or ctx
+// is done, and the caller should stop waiting.
+func waitForChange(ctx context.Context, changed <-chan struct{}, deadline time.Time) bool {
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return false
+	}
+	t := time.NewTimer(min(remaining, lockWaitRecheckInterval))
+	defer t.Stop()
+	select {
+	case <-changed:
+		return true
+	case <-t.C:
+		return time.Now().Before(deadline)
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// lockWaitDuration parses a long-poll timeout, applying the default and the
+// maximum.
+func lockWaitDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return defaultLockWait, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	return min(max(d, 0), maxLockWait), nil
+}
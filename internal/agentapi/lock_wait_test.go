@@ -0,0 +1,87 @@
+package agentapi
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLockWait(t *testing.T) {
+	t.Parallel()
+	ctx, canc := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(canc)
+
+	svr, cli := testServerAndClient(t, ctx)
+	t.Cleanup(func() { svr.Close() })
+
+	const key = "llama"
+	if _, ok, err := cli.LockCompareAndSwap(ctx, key, "", "Kuzco", LockLease{}); err != nil || !ok {
+		t.Fatalf("cli.LockCompareAndSwap(ctx, %q, %q, Kuzco, LockLease{}) = (_, %t, %v), want (_, true, nil)", key, "", ok, err)
+	}
+
+	// Waiting for a change that doesn't happen should time out, returning the
+	// unchanged value.
+	got, err := cli.LockWait(ctx, key, "Kuzco", 100*time.Millisecond)
+	if err != nil || got != "Kuzco" {
+		t.Errorf("cli.LockWait(ctx, %q, Kuzco, 100ms) = (%q, %v), want (Kuzco, nil)", key, got, err)
+	}
+
+	// Waiting for a value that is already different returns immediately.
+	got, err = cli.LockWait(ctx, key, "", time.Minute)
+	if err != nil || got != "Kuzco" {
+		t.Errorf("cli.LockWait(ctx, %q, %q, 1m) = (%q, %v), want (Kuzco, nil)", key, "", got, err)
+	}
+
+	// A waiter should wake as soon as the lock is released.
+	type result struct {
+		value   string
+		err     error
+		elapsed time.Duration
+	}
+	results := make(chan result)
+	go func() {
+		start := time.Now()
+		v, err := cli.LockWait(ctx, key, "Kuzco", 8*time.Second)
+		results <- result{v, err, time.Since(start)}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	if _, ok, err := cli.LockCompareAndSwap(ctx, key, "Kuzco", "", LockLease{}); err != nil || !ok {
+		t.Fatalf("cli.LockCompareAndSwap(ctx, %q, Kuzco, %q, LockLease{}) = (_, %t, %v), want (_, true, nil)", key, "", ok, err)
+	}
+
+	res := <-results
+	if res.err != nil || res.value != "" {
+		t.Errorf("cli.LockWait(ctx, %q, Kuzco, 8s) = (%q, %v), want (%q, nil)", key, res.value, res.err, "")
+	}
+	if res.elapsed >= 8*time.Second {
+		t.Errorf("cli.LockWait(ctx, %q, Kuzco, 8s) took %v, want it to return when the lock was released", key, res.elapsed)
+	}
+}
+
+func TestSemaphoreAcquireWaits(t *testing.T) {
+	t.Parallel()
+	ctx, canc := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(canc)
+
+	svr, cli := testServerAndClient(t, ctx)
+	t.Cleanup(func() { svr.Close() })
+
+	const key = "emulator"
+	if acquired, _, err := cli.SemaphoreAcquire(ctx, key, "a", 1, LockLease{}, 0); err != nil || !acquired {
+		t.Fatalf("cli.SemaphoreAcquire(ctx, %q, a, 1, LockLease{}, 0) = (%t, _, %v), want (true, _, nil)", key, acquired, err)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		if _, err := cli.SemaphoreRelease(ctx, key, "a"); err != nil {
+			t.Errorf("cli.SemaphoreRelease(ctx, %q, a) = %v", key, err)
+		}
+	}()
+
+	// This should wait for the release, rather than responding immediately.
+	acquired, pos, err := cli.SemaphoreAcquire(ctx, key, "b", 1, LockLease{}, 8*time.Second)
+	if err != nil || !acquired || pos != 0 {
+		t.Errorf("cli.SemaphoreAcquire(ctx, %q, b, 1, LockLease{}, 8s) = (%t, %d, %v), want (true, 0, nil)", key, acquired, pos, err)
+	}
+}
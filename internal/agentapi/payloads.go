@@ -14,8 +14,9 @@ type ValueResponse struct {
 
 // LockCASRequest is the request body for the PATCH /lock/{key} endpoint.
 type LockCASRequest struct {
-	Old string `json:"old"`
-	New string `json:"new"`
+	Old   string    `json:"old"`
+	New   string    `json:"new"`
+	Lease LockLease `json:"lease"`
 }
 
 // LockCASResponse is the response body for the PATCH /lock/{key} endpoint.
@@ -23,3 +24,39 @@ type LockCASResponse struct {
 	Value   string `json:"value"`
 	Swapped bool   `json:"swapped"`
 }
+
+// LockListResponse is the response body for the GET /lock/list endpoint.
+type LockListResponse struct {
+	Locks []Lock `json:"locks"`
+}
+
+// SemaphoreAcquireRequest is the request body for the
+// POST /lock/semaphore endpoint.
+type SemaphoreAcquireRequest struct {
+	Token string    `json:"token"`
+	Max   int       `json:"max"`
+	Lease LockLease `json:"lease"`
+	// Wait is how long to wait for a slot before responding (max 30s).
+	Wait time.Duration `json:"wait,omitempty"`
+}
+
+// SemaphoreAcquireResponse is the response body for the
+// POST /lock/semaphore endpoint.
+type SemaphoreAcquireResponse struct {
+	Acquired bool `json:"acquired"`
+	// Position is the 1-based position of the token in the queue of waiters,
+	// or 0 if the token was acquired.
+	Position int `json:"position"`
+}
+
+// SemaphoreReleaseRequest is the request body for the
+// POST /lock/semaphore/release endpoint.
+type SemaphoreReleaseRequest struct {
+	Token string `json:"token"`
+}
+
+// SemaphoreReleaseResponse is the response body for the
+// POST /lock/semaphore/release endpoint.
+type SemaphoreReleaseResponse struct {
+	Released bool `json:"released"`
+}
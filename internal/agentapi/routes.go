@@ -30,6 +30,27 @@ func (s *Server) router(log logger.Logger) chi.Router {
 	return r
 }
 
+// NewLockHandler returns a HTTP handler that serves only the lock service,
+// backed by the given store. It is intended for running a lock server shared
+// by agents on many hosts (see HTTPLockStore). If token is not empty, requests
+// must include it as a bearer token.
+func NewLockHandler(log logger.Logger, store LockStore, token string) http.Handler {
+	r := chi.NewRouter()
+	r.Use(
+		socket.LoggerMiddleware("Lock server", log.Debug),
+		middleware.Recoverer,
+		socket.HeadersMiddleware(http.Header{"Content-Type": []string{"application/json"}}),
+	)
+	if token != "" {
+		r.Use(socket.AuthMiddleware(token, log.Error))
+	}
+
+	r.Get("/ping", pingHandler(log))
+	r.Route("/lock", newLockServer(log, store).routes)
+
+	return r
+}
+
 func pingHandler(log logger.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		resp := &PingResponse{Now: time.Now()}
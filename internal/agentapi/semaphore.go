@@ -0,0 +1,216 @@
+package agentapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// semaphoreWaitTTL is how long a waiter keeps its place in a semaphore queue
+// without asking again. Waiters that stop asking (e.g. because the process
+// waiting was killed) lose their place, so that they can't block the queue
+// forever.
+const semaphoreWaitTTL = 15 * time.Second
+
+// semaphorePrefix starts every semaphore value, distinguishing semaphores from
+// ordinary lock values.
+const semaphorePrefix = `{"semaphore":`
+
+var (
+	errNotSemaphore = errors.New("lock is in use, but not as a semaphore")
+	errSemaphoreMax = errors.New("semaphore is in use with a different max")
+)
+
+// semaphoreState is the state of a counting semaphore, which is stored as a
+// JSON lock value so that it works with any LockStore.
+type semaphoreState struct {
+	Max     int              `json:"max"`
+	Holders []semaphoreEntry `json:"holders"`
+	Queue   []semaphoreEntry `json:"queue"`
+}
+
+// semaphoreEntry is a holder of, or waiter for, a slot in a semaphore.
+type semaphoreEntry struct {
+	Token   string        `json:"token"`
+	Owner   LockOwner     `json:"owner"`
+	TTL     time.Duration `json:"ttl,omitempty"`     // how long each renewal of a holder's lease lasts
+	Expires time.Time     `json:"expires,omitempty"` // zero if the entry never expires
+}
+
+func (e semaphoreEntry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
+// parseSemaphore decodes a semaphore from a lock value. The empty value is an
+// unused semaphore.
+func parseSemaphore(v string) (*semaphoreState, error) {
+	if v == "" {
+		return &semaphoreState{}, nil
+	}
+	if !strings.HasPrefix(v, semaphorePrefix) {
+		return nil, errNotSemaphore
+	}
+	var wrapper struct {
+		Semaphore semaphoreState `json:"semaphore"`
+	}
+	if err := json.Unmarshal([]byte(v), &wrapper); err != nil {
+		return nil, fmt.Errorf("decoding semaphore: %w", err)
+	}
+	return &wrapper.Semaphore, nil
+}
+
+// encode encodes the semaphore as a lock value. A semaphore with no holders or
+// waiters is encoded as "", so the key is released.
+func (s *semaphoreState) encode() (string, error) {
+	if len(s.Holders) == 0 && len(s.Queue) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(struct {
+		Semaphore *semaphoreState `json:"semaphore"`
+	}{s})
+	if err != nil {
+		return "", fmt.Errorf("encoding semaphore: %w", err)
+	}
+	return string(b), nil
+}
+
+// SemaphoreHolder is a holder of a slot in a counting semaphore.
+type SemaphoreHolder struct {
+	Token string
+	Max   int
+	Lease LockLease
+}
+
+// SemaphoreHolders returns the holders of the semaphore stored in a lock
+// value, or nil if the value isn't a semaphore. Holders can renew their leases
+// by acquiring the semaphore again with the same token.
+func SemaphoreHolders(v string) []SemaphoreHolder {
+	sem, err := parseSemaphore(v)
+	if err != nil {
+		return nil
+	}
+	holders := make([]SemaphoreHolder, 0, len(sem.Holders))
+	for _, h := range sem.Holders {
+		holders = append(holders, SemaphoreHolder{
+			Token: h.Token,
+			Max:   sem.Max,
+			Lease: LockLease{Owner: h.Owner, TTL: h.TTL},
+		})
+	}
+	return holders
+}
+
+// prune removes expired holders and waiters.
+func (s *semaphoreState) prune(now time.Time) {
+	expired := func(e semaphoreEntry) bool { return e.expired(now) }
+	s.Holders = slices.DeleteFunc(s.Holders, expired)
+	s.Queue = slices.DeleteFunc(s.Queue, expired)
+}
+
+// acquire tries to acquire a slot for the token, joining the back of the queue
+// if necessary. Only the waiter at the front of the queue may take a free slot,
+// so slots are handed out in FIFO order. It returns the token's 1-based position
+// in the queue, or 0 if the token holds a slot.
+func (s *semaphoreState) acquire(now time.Time, token string, max int, lease LockLease) (int, error) {
+	s.prune(now)
+	if len(s.Holders) == 0 && len(s.Queue) == 0 {
+		s.Max = max
+	}
+	if s.Max != max {
+		return 0, fmt.Errorf("%w (%d)", errSemaphoreMax, s.Max)
+	}
+
+	holder := semaphoreEntry{Token: token, Owner: lease.Owner}
+	if lease.TTL > 0 {
+		holder.TTL = lease.TTL
+		holder.Expires = now.Add(lease.TTL)
+	}
+
+	// Already a holder? Then this is a renewal.
+	if i := s.index(s.Holders, token); i >= 0 {
+		s.Holders[i] = holder
+		return 0, nil
+	}
+
+	waiter := semaphoreEntry{Token: token, Owner: lease.Owner, Expires: now.Add(semaphoreWaitTTL)}
+	i := s.index(s.Queue, token)
+	switch {
+	case i < 0:
+		s.Queue = append(s.Queue, waiter)
+		i = len(s.Queue) - 1
+
+	case s.Queue[i].Expires.Sub(now) < semaphoreWaitTTL/2:
+		// Only refresh the place in the queue occasionally. Every change to
+		// the semaphore wakes the other waiters, so refreshing every time
+		// would keep them all busy.
+		s.Queue[i] = waiter
+	}
+
+	if i == 0 && len(s.Holders) < s.Max {
+		s.Queue = s.Queue[1:]
+		s.Holders = append(s.Holders, holder)
+		return 0, nil
+	}
+	return i + 1, nil
+}
+
+// release removes the token from the holders (or the queue, if it was still
+// waiting). It reports whether the token was found.
+func (s *semaphoreState) release(now time.Time, token string) bool {
+	s.prune(now)
+	if i := s.index(s.Holders, token); i >= 0 {
+		s.Holders = slices.Delete(s.Holders, i, i+1)
+		return true
+	}
+	if i := s.index(s.Queue, token); i >= 0 {
+		s.Queue = slices.Delete(s.Queue, i, i+1)
+		return true
+	}
+	return false
+}
+
+func (s *semaphoreState) index(entries []semaphoreEntry, token string) int {
+	return slices.IndexFunc(entries, func(e semaphoreEntry) bool { return e.Token == token })
+}
+
+// updateSemaphore applies f to the semaphore stored at key, retrying until the
+// compare-and-swap succeeds.
+func updateSemaphore(ctx context.Context, store LockStore, key string, f func(*semaphoreState) error) error {
+	cur, err := store.Load(ctx, key)
+	if err != nil {
+		return err
+	}
+	for {
+		sem, err := parseSemaphore(cur)
+		if err != nil {
+			return err
+		}
+		if err := f(sem); err != nil {
+			return err
+		}
+		next, err := sem.encode()
+		if err != nil {
+			return err
+		}
+		if next == cur {
+			return nil
+		}
+		// The semaphore's entries have their own expiry, so the lock value
+		// itself never expires.
+		v, ok, err := store.CompareAndSwap(ctx, key, cur, next, LockLease{})
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		cur = v
+	}
+}
@@ -0,0 +1,130 @@
+package agentapi
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSemaphoreFIFO(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	sem := &semaphoreState{}
+	acquire := func(token string) int {
+		t.Helper()
+		pos, err := sem.acquire(now, token, 2, LockLease{})
+		if err != nil {
+			t.Fatalf("sem.acquire(now, %q, 2, LockLease{}) error = %v", token, err)
+		}
+		return pos
+	}
+
+	// Two slots are free.
+	for _, token := range []string{"llama", "alpaca"} {
+		if pos := acquire(token); pos != 0 {
+			t.Errorf("acquire(%q) = %d, want 0", token, pos)
+		}
+	}
+
+	// The rest have to wait, in order.
+	for i, token := range []string{"guanaco", "vicuña"} {
+		if pos, want := acquire(token), i+1; pos != want {
+			t.Errorf("acquire(%q) = %d, want %d", token, pos, want)
+		}
+	}
+
+	// After a release, the second waiter can't jump the queue...
+	if !sem.release(now, "llama") {
+		t.Errorf("sem.release(now, llama) = false, want true")
+	}
+	if pos := acquire("vicuña"); pos != 2 {
+		t.Errorf("acquire(vicuña) = %d, want 2", pos)
+	}
+
+	// ...but the first waiter gets the slot.
+	if pos := acquire("guanaco"); pos != 0 {
+		t.Errorf("acquire(guanaco) = %d, want 0", pos)
+	}
+	if pos := acquire("vicuña"); pos != 1 {
+		t.Errorf("acquire(vicuña) = %d, want 1", pos)
+	}
+
+	// Acquiring with a different max is an error.
+	if _, err := sem.acquire(now, "camel", 3, LockLease{}); !errors.Is(err, errSemaphoreMax) {
+		t.Errorf("sem.acquire(now, camel, 3, LockLease{}) error = %v, want %v", err, errSemaphoreMax)
+	}
+}
+
+func TestSemaphoreExpiry(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	sem := &semaphoreState{}
+
+	// A holder with a lease, and a waiter.
+	if pos, err := sem.acquire(now, "llama", 1, LockLease{TTL: time.Minute}); err != nil || pos != 0 {
+		t.Fatalf("sem.acquire(now, llama, 1, 1m lease) = (%d, %v), want (0, nil)", pos, err)
+	}
+	if pos, err := sem.acquire(now, "alpaca", 1, LockLease{}); err != nil || pos != 1 {
+		t.Fatalf("sem.acquire(now, alpaca, 1, LockLease{}) = (%d, %v), want (1, nil)", pos, err)
+	}
+
+	// After the lease expires, the waiter gets the slot.
+	later := now.Add(time.Minute)
+	if pos, err := sem.acquire(later, "alpaca", 1, LockLease{}); err != nil || pos != 0 {
+		t.Errorf("sem.acquire(later, alpaca, 1, LockLease{}) = (%d, %v), want (0, nil)", pos, err)
+	}
+
+	// A waiter that stops asking loses its place.
+	if pos, err := sem.acquire(later, "guanaco", 1, LockLease{}); err != nil || pos != 1 {
+		t.Fatalf("sem.acquire(later, guanaco, 1, LockLease{}) = (%d, %v), want (1, nil)", pos, err)
+	}
+	sem.prune(later.Add(semaphoreWaitTTL))
+	if len(sem.Queue) != 0 {
+		t.Errorf("sem.Queue = %v, want empty after waiter expired", sem.Queue)
+	}
+}
+
+func TestSemaphoreOperations(t *testing.T) {
+	t.Parallel()
+	ctx, canc := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(canc)
+
+	svr, cli := testServerAndClient(t, ctx)
+	t.Cleanup(func() { svr.Close() })
+
+	const key = "emulator"
+
+	// Using an ordinary lock as a semaphore is a conflict.
+	if _, _, err := cli.LockCompareAndSwap(ctx, "llama", "", "Kuzco", LockLease{}); err != nil {
+		t.Fatalf("cli.LockCompareAndSwap(ctx, llama, %q, Kuzco, LockLease{}) error = %v", "", err)
+	}
+	if _, _, err := cli.SemaphoreAcquire(ctx, "llama", "token", 2, LockLease{}, 0); err == nil {
+		t.Errorf("cli.SemaphoreAcquire(ctx, llama, token, 2, LockLease{}, 0) error = nil, want a conflict")
+	}
+
+	for _, token := range []string{"a", "b"} {
+		acquired, pos, err := cli.SemaphoreAcquire(ctx, key, token, 2, LockLease{}, 0)
+		if err != nil || !acquired || pos != 0 {
+			t.Errorf("cli.SemaphoreAcquire(ctx, %q, %q, 2, LockLease{}, 0) = (%t, %d, %v), want (true, 0, nil)", key, token, acquired, pos, err)
+		}
+	}
+	acquired, pos, err := cli.SemaphoreAcquire(ctx, key, "c", 2, LockLease{}, 0)
+	if err != nil || acquired || pos != 1 {
+		t.Errorf("cli.SemaphoreAcquire(ctx, %q, c, 2, LockLease{}, 0) = (%t, %d, %v), want (false, 1, nil)", key, acquired, pos, err)
+	}
+
+	for _, token := range []string{"a", "b", "c"} {
+		released, err := cli.SemaphoreRelease(ctx, key, token)
+		if err != nil || !released {
+			t.Errorf("cli.SemaphoreRelease(ctx, %q, %q) = (%t, %v), want (true, nil)", key, token, released, err)
+		}
+	}
+
+	// With no holders or waiters, the key is released entirely.
+	if got, err := cli.LockGet(ctx, key); err != nil || got != "" {
+		t.Errorf("cli.LockGet(ctx, %q) = (%q, %v), want (%q, nil)", key, got, err, "")
+	}
+}
@@ -9,15 +9,33 @@ import (
 type Server struct {
 	*socket.Server
 
-	lockSvr *lockServer
+	lockStore LockStore
+	lockSvr   *lockServer
+}
+
+// ServerOpts configure a Server.
+type ServerOpts func(*Server)
+
+// WithLockStore sets the backend used to store locks. By default, locks are
+// kept in memory.
+func WithLockStore(store LockStore) ServerOpts {
+	return func(s *Server) {
+		s.lockStore = store
+	}
 }
 
 // NewServer creates a new Agent API server that, when started, listens on the
 // socketPath.
-func NewServer(socketPath string, log logger.Logger) (*Server, error) {
-	s := &Server{
-		lockSvr: newLockServer(log),
+func NewServer(socketPath string, log logger.Logger, opts ...ServerOpts) (*Server, error) {
+	s := &Server{}
+	for _, o := range opts {
+		o(s)
+	}
+	if s.lockStore == nil {
+		s.lockStore = NewMemoryLockStore()
 	}
+	s.lockSvr = newLockServer(log, s.lockStore)
+
 	svr, err := socket.NewServer(socketPath, s.router(log))
 	if err != nil {
 		return nil, err
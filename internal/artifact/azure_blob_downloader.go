@@ -2,6 +2,7 @@ package artifact
 
 import (
 	"context"
+	"io"
 	"os"
 	"path"
 
@@ -16,6 +17,10 @@ type AzureBlobDownloaderConfig struct {
 	Destination string
 	Retries     int
 	DebugHTTP   bool
+
+	// Optionally wraps the body of the download, such as to limit how fast
+	// it's read. The blob is downloaded as a stream if this is set.
+	Throttle func(io.Reader) io.Reader
 }
 
 // AzureBlobDownloader downloads files from Azure Blob storage.
@@ -57,13 +62,29 @@ func (d *AzureBlobDownloader) Start(ctx context.Context) error {
 	// Show a nice message that we're starting to download the file
 	d.logger.Debug("Downloading %s to %s", loc.URL(d.conf.Path), d.conf.Path)
 
-	opts := &azblob.DownloadFileOptions{
-		RetryReaderOptionsPerBlock: azblob.RetryReaderOptions{
-			MaxRetries: int32(d.conf.Retries),
-		},
+	retryOpts := azblob.RetryReaderOptions{
+		MaxRetries: int32(d.conf.Retries),
 	}
 	bc := client.NewContainerClient(loc.ContainerName).NewBlobClient(fullPath)
-	if _, err := bc.DownloadFile(ctx, f, opts); err != nil {
+	if d.conf.Throttle == nil {
+		opts := &azblob.DownloadFileOptions{
+			RetryReaderOptionsPerBlock: retryOpts,
+		}
+		if _, err := bc.DownloadFile(ctx, f, opts); err != nil {
+			return err
+		}
+		return f.Close()
+	}
+
+	// DownloadFile writes to the file directly, in parallel, so it can't be
+	// throttled. Download it as a stream instead.
+	resp, err := bc.DownloadStream(ctx, nil)
+	if err != nil {
+		return err
+	}
+	body := resp.NewRetryReader(ctx, &retryOpts)
+	defer body.Close()
+	if _, err := io.Copy(f, d.conf.Throttle(body)); err != nil {
 		return err
 	}
 
@@ -3,10 +3,12 @@ package artifact
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/service"
 	"github.com/buildkite/agent/v3/api"
@@ -18,8 +20,18 @@ type AzureBlobUploaderConfig struct {
 	// The destination which includes the storage account name and the path.
 	// For example, "https://my-storage-account.blob.core.windows.net/my-container/my-virtual-directory/artifacts-go-here/"
 	Destination string
+
+	// Optionally wraps the file being uploaded, such as to limit how fast
+	// it's read. The file is uploaded as a stream if this is set.
+	Throttle func(io.Reader) io.Reader
 }
 
+// Throttled files are uploaded in blocks of this size, this many at once.
+const (
+	azureBlobStreamBlockSize   = 8 * 1024 * 1024
+	azureBlobStreamConcurrency = 4
+)
+
 // AzureBlobUploader uploads artifacts to Azure Blob Storage.
 type AzureBlobUploader struct {
 	// Upload location in Azure Blob Storage.
@@ -102,6 +114,16 @@ func (u *AzureBlobUploader) Upload(ctx context.Context, artifact *api.Artifact)
 	u.logger.Debug("Uploading %s to %s", artifact.Path, u.loc.URL(blobName))
 
 	bbc := u.client.NewContainerClient(u.loc.ContainerName).NewBlockBlobClient(blobName)
-	_, err = bbc.UploadFile(ctx, f, nil)
+	if u.conf.Throttle == nil {
+		_, err = bbc.UploadFile(ctx, f, nil)
+		return err
+	}
+
+	// UploadFile reads the file directly, in parallel, so it can't be
+	// throttled. Upload it as a stream of blocks instead.
+	_, err = bbc.UploadStream(ctx, u.conf.Throttle(f), &blockblob.UploadStreamOptions{
+		BlockSize:   azureBlobStreamBlockSize,
+		Concurrency: azureBlobStreamConcurrency,
+	})
 	return err
 }
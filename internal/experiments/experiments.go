@@ -27,6 +27,7 @@ const (
 	DescendingSpawnPrioity     = "descending-spawn-priority"
 	JobAPI                     = "job-api"
 	KubernetesExec             = "kubernetes-exec"
+	NativeGit                  = "native-git"
 	NormalisedUploadPaths      = "normalised-upload-paths"
 	PTYRaw                     = "pty-raw"
 	PolyglotHooks              = "polyglot-hooks"
@@ -48,6 +49,7 @@ var (
 		DescendingSpawnPrioity:     {},
 		JobAPI:                     {},
 		KubernetesExec:             {},
+		NativeGit:                  {},
 		NormalisedUploadPaths:      {},
 		PolyglotHooks:              {},
 		ResolveCommitAfterCheckout: {},
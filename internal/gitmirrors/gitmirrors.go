@@ -0,0 +1,336 @@
+// Package gitmirrors maintains the mirrors of git repositories that jobs keep
+// under the agent's --git-mirrors-path. Mirrors are otherwise never cleaned up,
+// so without maintenance they grow (and accumulate) until the disk fills.
+//
+// Alongside each mirror, jobs keep lock files (see Executor.updateGitMirror)
+// and a file recording when the mirror was last used:
+//
+//	<path>/<mirror>              the bare repository
+//	<path>/<mirror>.clonelockf   held while the mirror is cloned
+//	<path>/<mirror>.updatelockf  held while the mirror is fetched into
+//	<path>/<mirror>.uselockf     shared by jobs checking out from the mirror
+//	<path>/<mirror>.lastused     modified whenever a job uses the mirror
+package gitmirrors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/gofrs/flock"
+)
+
+const (
+	// The lock files are named like the shell's LockFile names them, so
+	// maintenance and jobs take the same locks.
+	cloneLockSuffix  = ".clonelockf"
+	updateLockSuffix = ".updatelockf"
+	useLockSuffix    = ".uselockf"
+	lastUsedSuffix   = ".lastused"
+)
+
+// Mirrors used more recently than this aren't removed to save space, as a job
+// may still be cloning from them.
+const inUseGracePeriod = time.Hour
+
+// DirForRepository returns the name of the directory that a repository is
+// mirrored in.
+func DirForRepository(repository string) string {
+	badCharsPattern := regexp.MustCompile("[[:^alnum:]]")
+	return badCharsPattern.ReplaceAllString(repository, "-")
+}
+
+// MarkUsed records that a job is using a mirror.
+func MarkUsed(mirrorDir string) error {
+	path := mirrorDir + lastUsedSuffix
+	now := time.Now()
+	err := os.Chtimes(path, now, now)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Mirror is a mirror of a repository.
+type Mirror struct {
+	// Path of the bare repository
+	Dir string
+
+	// When a job last used the mirror
+	LastUsed time.Time
+
+	// Bytes used by the mirror
+	Size int64
+}
+
+// List lists the mirrors under a path, least recently used first.
+func List(path string) ([]Mirror, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var mirrors []Mirror
+	for _, entry := range entries {
+		dir := filepath.Join(path, entry.Name())
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || !isBareRepository(dir) {
+			continue
+		}
+
+		used, err := lastUsed(dir)
+		if err != nil {
+			return nil, err
+		}
+		size, err := dirSize(dir)
+		if err != nil {
+			return nil, err
+		}
+		mirrors = append(mirrors, Mirror{Dir: dir, LastUsed: used, Size: size})
+	}
+
+	sort.Slice(mirrors, func(i, j int) bool {
+		return mirrors[i].LastUsed.Before(mirrors[j].LastUsed)
+	})
+	return mirrors, nil
+}
+
+func isBareRepository(dir string) bool {
+	if _, err := os.Stat(filepath.Join(dir, "HEAD")); err != nil {
+		return false
+	}
+	info, err := os.Stat(filepath.Join(dir, "objects"))
+	return err == nil && info.IsDir()
+}
+
+// lastUsed returns when a mirror was last used. Mirrors created before usage
+// was recorded fall back to when the mirror's directory was last modified.
+func lastUsed(mirrorDir string) (time.Time, error) {
+	info, err := os.Stat(mirrorDir + lastUsedSuffix)
+	if errors.Is(err, fs.ErrNotExist) {
+		info, err = os.Stat(mirrorDir)
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Files can disappear while git is packing objects
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// PruneConfig configures Prune.
+type PruneConfig struct {
+	// Path where the mirrors are stored
+	Path string
+
+	// Mirrors that haven't been used for longer than this are removed (zero
+	// keeps them regardless of age)
+	MaxAge time.Duration
+
+	// Least recently used mirrors are removed while the mirrors take up more
+	// bytes than this (zero for no limit)
+	MaxSize int64
+
+	// Run "git gc --auto" in the mirrors that are kept
+	GC bool
+
+	// Only log what would be done
+	DryRun bool
+}
+
+// PruneResult summarises what Prune did.
+type PruneResult struct {
+	MirrorsRemoved   int
+	BytesFreed       int64
+	MirrorsCollected int
+}
+
+// Prune removes mirrors that haven't been used for longer than the maximum
+// age, then the least recently used mirrors until the rest fit in the maximum
+// size, then garbage collects the mirrors that are left. Mirrors that jobs are
+// cloning, updating or checking out from are skipped.
+//
+// Checkouts cloned with --reference to a removed mirror can no longer find
+// the objects they borrowed from it. Jobs recover by cloning such checkouts
+// again, but MaxAge should be long enough that it rarely happens.
+func Prune(ctx context.Context, l logger.Logger, c PruneConfig) (PruneResult, error) {
+	var result PruneResult
+
+	mirrors, err := List(c.Path)
+	if err != nil {
+		return result, fmt.Errorf("listing git mirrors: %w", err)
+	}
+
+	var total int64
+	for _, m := range mirrors {
+		total += m.Size
+	}
+
+	now := time.Now()
+	var kept []Mirror
+	for _, m := range mirrors {
+		var reason string
+		switch {
+		case c.MaxAge > 0 && now.Sub(m.LastUsed) > c.MaxAge:
+			reason = fmt.Sprintf("it hasn't been used since %s", m.LastUsed.Format(time.RFC3339))
+		case c.MaxSize > 0 && total > c.MaxSize && now.Sub(m.LastUsed) > inUseGracePeriod:
+			reason = fmt.Sprintf("git mirrors are using %d bytes, more than the limit of %d", total, c.MaxSize)
+		default:
+			kept = append(kept, m)
+			continue
+		}
+
+		if c.DryRun {
+			l.Info("Would remove git mirror %s (%d bytes), as %s", m.Dir, m.Size, reason)
+		} else {
+			removed, err := remove(m.Dir, m.LastUsed)
+			if err != nil {
+				return result, fmt.Errorf("removing git mirror %s: %w", m.Dir, err)
+			}
+			if !removed {
+				l.Debug("Not removing git mirror %s, as it's in use", m.Dir)
+				kept = append(kept, m)
+				continue
+			}
+			l.Info("Removed git mirror %s (%d bytes), as %s", m.Dir, m.Size, reason)
+		}
+		total -= m.Size
+		result.MirrorsRemoved++
+		result.BytesFreed += m.Size
+	}
+
+	if !c.GC {
+		return result, nil
+	}
+
+	for _, m := range kept {
+		if c.DryRun {
+			l.Info("Would garbage collect git mirror %s", m.Dir)
+			result.MirrorsCollected++
+			continue
+		}
+
+		collected, err := gc(ctx, m.Dir)
+		if err != nil {
+			// One broken mirror shouldn't stop the others being collected
+			l.Warn("Couldn't garbage collect git mirror %s: %v", m.Dir, err)
+			continue
+		}
+		if !collected {
+			l.Debug("Not garbage collecting git mirror %s, as it's in use", m.Dir)
+			continue
+		}
+		result.MirrorsCollected++
+	}
+
+	return result, nil
+}
+
+// remove removes a mirror, if no job is cloning, updating or checking out
+// from it, and no job has started using it since it was listed.
+func remove(mirrorDir string, listedLastUsed time.Time) (bool, error) {
+	useLock := flock.New(mirrorDir + useLockSuffix)
+	if locked, err := useLock.TryLock(); err != nil || !locked {
+		return false, err
+	}
+	defer useLock.Unlock()
+
+	cloneLock := flock.New(mirrorDir + cloneLockSuffix)
+	if locked, err := cloneLock.TryLock(); err != nil || !locked {
+		return false, err
+	}
+	defer cloneLock.Unlock()
+
+	updateLock := flock.New(mirrorDir + updateLockSuffix)
+	if locked, err := updateLock.TryLock(); err != nil || !locked {
+		return false, err
+	}
+	defer updateLock.Unlock()
+
+	// Jobs mark mirrors as used while holding the use lock, so a job that
+	// used the mirror since it was listed has now finished with it.
+	used, err := lastUsed(mirrorDir)
+	if err != nil {
+		return false, err
+	}
+	if used.After(listedLastUsed) {
+		return false, nil
+	}
+
+	if err := os.RemoveAll(mirrorDir); err != nil {
+		return false, err
+	}
+	// The lock files are left behind, as other processes may be waiting on
+	// them, and removing them would let two processes hold the same lock.
+	if err := os.Remove(mirrorDir + lastUsedSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return true, err
+	}
+	return true, nil
+}
+
+// gc garbage collects a mirror, if no job is cloning, updating or checking out
+// from it. "git gc --auto" only repacks and prunes the mirror if it needs it.
+func gc(ctx context.Context, mirrorDir string) (bool, error) {
+	// Jobs hold the use lock while they clone and fetch checkouts that
+	// borrow objects from the mirror, and repacking or pruning objects out
+	// from under them could break the checkout.
+	useLock := flock.New(mirrorDir + useLockSuffix)
+	if locked, err := useLock.TryLock(); err != nil || !locked {
+		return false, err
+	}
+	defer useLock.Unlock()
+
+	cloneLock := flock.New(mirrorDir + cloneLockSuffix)
+	if locked, err := cloneLock.TryLock(); err != nil || !locked {
+		return false, err
+	}
+	defer cloneLock.Unlock()
+
+	updateLock := flock.New(mirrorDir + updateLockSuffix)
+	if locked, err := updateLock.TryLock(); err != nil || !locked {
+		return false, err
+	}
+	defer updateLock.Unlock()
+
+	out, err := exec.CommandContext(ctx, "git", "--git-dir", mirrorDir, "gc", "--auto", "--quiet").CombinedOutput()
+	if err != nil {
+		return false, fmt.Errorf("git gc: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return true, nil
+}
@@ -0,0 +1,186 @@
+package gitmirrors
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/gofrs/flock"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDirForRepository(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		repository string
+		want       string
+	}{
+		{"git@github.com:acme-inc/my-project.git", "git-github-com-acme-inc-my-project-git"},
+		{"https://github.com/acme-inc/my-project.git", "https---github-com-acme-inc-my-project-git"},
+	}
+	for _, test := range tests {
+		if got := DirForRepository(test.repository); got != test.want {
+			t.Errorf("DirForRepository(%q) = %q, want %q", test.repository, got, test.want)
+		}
+	}
+}
+
+// createMirror creates an empty bare repository, last used the given time ago.
+func createMirror(t *testing.T, path, name string, age time.Duration) string {
+	t.Helper()
+
+	dir := filepath.Join(path, name)
+	if out, err := exec.Command("git", "init", "--bare", "--quiet", dir).CombinedOutput(); err != nil {
+		t.Fatalf("git init --bare %s error = %v\n%s", dir, err, out)
+	}
+	if err := MarkUsed(dir); err != nil {
+		t.Fatalf("MarkUsed(%q) error = %v", dir, err)
+	}
+	used := time.Now().Add(-age)
+	if err := os.Chtimes(dir+lastUsedSuffix, used, used); err != nil {
+		t.Fatalf("os.Chtimes(%q) error = %v", dir+lastUsedSuffix, err)
+	}
+	return dir
+}
+
+func remainingMirrors(t *testing.T, path string) []string {
+	t.Helper()
+
+	mirrors, err := List(path)
+	if err != nil {
+		t.Fatalf("List(%q) error = %v", path, err)
+	}
+	var names []string
+	for _, m := range mirrors {
+		names = append(names, filepath.Base(m.Dir))
+	}
+	return names
+}
+
+func TestPruneByAge(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	path := t.TempDir()
+	createMirror(t, path, "recent", time.Hour)
+	createMirror(t, path, "stale", 60*24*time.Hour)
+	createMirror(t, path, "older", 30*24*time.Hour)
+	if err := os.WriteFile(filepath.Join(path, "recent"+cloneLockSuffix), nil, 0o666); err != nil {
+		t.Fatalf("os.WriteFile(lock file) error = %v", err)
+	}
+
+	// Least recently used first
+	if diff := cmp.Diff(remainingMirrors(t, path), []string{"stale", "older", "recent"}); diff != "" {
+		t.Errorf("List(path) diff (-got +want):\n%s", diff)
+	}
+
+	for _, dryRun := range []bool{true, false} {
+		result, err := Prune(ctx, logger.Discard, PruneConfig{
+			Path:   path,
+			MaxAge: 7 * 24 * time.Hour,
+			DryRun: dryRun,
+		})
+		if err != nil {
+			t.Fatalf("Prune(DryRun: %t) error = %v", dryRun, err)
+		}
+		if got, want := result.MirrorsRemoved, 2; got != want {
+			t.Errorf("Prune(DryRun: %t).MirrorsRemoved = %d, want %d", dryRun, got, want)
+		}
+	}
+
+	if diff := cmp.Diff(remainingMirrors(t, path), []string{"recent"}); diff != "" {
+		t.Errorf("remaining mirrors diff (-got +want):\n%s", diff)
+	}
+	if _, err := os.Stat(filepath.Join(path, "stale"+lastUsedSuffix)); !os.IsNotExist(err) {
+		t.Errorf("os.Stat(stale.lastused) error = %v, want it to be removed", err)
+	}
+}
+
+func TestPruneBySize(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	path := t.TempDir()
+	createMirror(t, path, "a", 4*time.Hour)
+	createMirror(t, path, "b", 3*time.Hour)
+	createMirror(t, path, "c", 2*time.Hour)
+	createMirror(t, path, "in-use", time.Minute)
+
+	mirrors, err := List(path)
+	if err != nil {
+		t.Fatalf("List(%q) error = %v", path, err)
+	}
+	size := mirrors[0].Size
+
+	// Only room for two mirrors, but the mirror in use can't be removed.
+	result, err := Prune(ctx, logger.Discard, PruneConfig{
+		Path:    path,
+		MaxSize: 2 * size,
+		GC:      true,
+	})
+	if err != nil {
+		t.Fatalf("Prune(...) error = %v", err)
+	}
+	want := PruneResult{MirrorsRemoved: 2, BytesFreed: 2 * size, MirrorsCollected: 2}
+	if diff := cmp.Diff(result, want); diff != "" {
+		t.Errorf("Prune(...) diff (-got +want):\n%s", diff)
+	}
+	if diff := cmp.Diff(remainingMirrors(t, path), []string{"c", "in-use"}); diff != "" {
+		t.Errorf("remaining mirrors diff (-got +want):\n%s", diff)
+	}
+}
+
+func exclusiveLock(suffix string) func(dir string) (*flock.Flock, error) {
+	return func(dir string) (*flock.Flock, error) {
+		lock := flock.New(dir + suffix)
+		_, err := lock.TryLock()
+		return lock, err
+	}
+}
+
+func TestPruneSkipsLockedMirrors(t *testing.T) {
+	t.Parallel()
+
+	for name, lock := range map[string]func(dir string) (*flock.Flock, error){
+		"cloning":  exclusiveLock(cloneLockSuffix),
+		"updating": exclusiveLock(updateLockSuffix),
+		"using": func(dir string) (*flock.Flock, error) {
+			return LockUse(context.Background(), dir)
+		},
+	} {
+		name, lock := name, lock
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+
+			path := t.TempDir()
+			dir := createMirror(t, path, name, 60*24*time.Hour)
+
+			l, err := lock(dir)
+			if err != nil {
+				t.Fatalf("locking mirror error = %v", err)
+			}
+			defer l.Unlock()
+
+			result, err := Prune(ctx, logger.Discard, PruneConfig{
+				Path:   path,
+				MaxAge: time.Hour,
+				GC:     true,
+			})
+			if err != nil {
+				t.Fatalf("Prune(...) error = %v", err)
+			}
+			if diff := cmp.Diff(result, PruneResult{}); diff != "" {
+				t.Errorf("Prune(...) diff (-got +want):\n%s", diff)
+			}
+			if diff := cmp.Diff(remainingMirrors(t, path), []string{name}); diff != "" {
+				t.Errorf("remaining mirrors diff (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package gitmirrors
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+// A mirror can be seeded from either a git bundle of all of its refs, or a tar
+// archive of the whole mirror. Bundles are smaller, but tar archives keep the
+// mirror's packs, so they're quicker to seed from.
+const (
+	SeedFormatBundle = ".bundle"
+	SeedFormatTarGz  = ".tar.gz"
+)
+
+// SeedFormats are the seed formats, in the order they're looked for.
+var SeedFormats = []string{SeedFormatBundle, SeedFormatTarGz}
+
+// SeedName returns the name of the seed for a repository in a format. Seeds
+// are looked for under the seed path by these names.
+func SeedName(repository, format string) string {
+	return DirForRepository(repository) + format
+}
+
+// seedFormat returns the format of a seed from its name, or "" if it isn't a
+// seed format.
+func seedFormat(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".bundle"):
+		return SeedFormatBundle
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return SeedFormatTarGz
+	}
+	return ""
+}
+
+// LockClone takes the lock that jobs hold while cloning a mirror, waiting
+// until the context is done for it. The caller must unlock it.
+func LockClone(ctx context.Context, mirrorDir string) (*flock.Flock, error) {
+	return lockContext(ctx, mirrorDir+cloneLockSuffix)
+}
+
+// LockUse takes the lock that jobs hold while they check out from a mirror,
+// waiting until the context is done for it. It's shared with other jobs, but
+// keeps maintenance from removing or garbage collecting the mirror. The caller
+// must unlock it.
+func LockUse(ctx context.Context, mirrorDir string) (*flock.Flock, error) {
+	path := mirrorDir + useLockSuffix
+	lock := flock.New(path)
+	locked, err := lock.TryRLockContext(ctx, time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("acquiring lock on %s: %w", path, err)
+	}
+	if !locked {
+		return nil, fmt.Errorf("acquiring lock on %s: locked by another process", path)
+	}
+	return lock, nil
+}
+
+func lockContext(ctx context.Context, path string) (*flock.Flock, error) {
+	lock := flock.New(path)
+	locked, err := lock.TryLockContext(ctx, time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("acquiring lock on %s: %w", path, err)
+	}
+	if !locked {
+		return nil, fmt.Errorf("acquiring lock on %s: locked by another process", path)
+	}
+	return lock, nil
+}
+
+// Seed creates the mirror of a repository from a seed, so that it only needs
+// to fetch what's changed since the seed was made. The caller must hold the
+// clone lock (see LockClone), and the mirror mustn't exist yet.
+func Seed(ctx context.Context, repository, mirrorDir, seed string) error {
+	// Create the mirror next to where it belongs, so it can be renamed into
+	// place once it's complete. The leading dot keeps it out of List.
+	tmp, err := os.MkdirTemp(filepath.Dir(mirrorDir), "."+filepath.Base(mirrorDir)+".seed-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	switch seedFormat(seed) {
+	case SeedFormatBundle:
+		if err := runGit(ctx, "clone", "--mirror", "--", seed, tmp); err != nil {
+			return err
+		}
+
+	case SeedFormatTarGz:
+		if err := extractTarGz(seed, tmp); err != nil {
+			return fmt.Errorf("extracting %s: %w", seed, err)
+		}
+		if !isBareRepository(tmp) {
+			return fmt.Errorf("%s isn't an archive of a git mirror", seed)
+		}
+
+	default:
+		return fmt.Errorf("%s isn't a git bundle (.bundle) or tar archive (.tar.gz)", seed)
+	}
+
+	// Fetch from the repository from now on, rather than the seed.
+	if err := runGit(ctx, "--git-dir", tmp, "config", "remote.origin.url", repository); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, mirrorDir)
+}
+
+// Bundle writes a seed for a mirror, in the format given by the output's
+// extension. It holds the mirror's update lock while it does, so that the
+// mirror doesn't change underneath it.
+func Bundle(ctx context.Context, mirrorDir, output string) error {
+	format := seedFormat(output)
+	if format == "" {
+		return fmt.Errorf("%s doesn't have a seed extension (.bundle or .tar.gz)", output)
+	}
+	if !isBareRepository(mirrorDir) {
+		return fmt.Errorf("%s isn't a git mirror", mirrorDir)
+	}
+
+	lock, err := lockContext(ctx, mirrorDir+updateLockSuffix)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	// Write the seed next to where it belongs, so that nothing sees it until
+	// it's complete.
+	tmp := output + ".tmp"
+	defer os.Remove(tmp)
+
+	switch format {
+	case SeedFormatBundle:
+		if err := runGit(ctx, "--git-dir", mirrorDir, "bundle", "create", tmp, "--all"); err != nil {
+			return err
+		}
+
+	case SeedFormatTarGz:
+		if err := writeTarGz(mirrorDir, tmp); err != nil {
+			return fmt.Errorf("archiving %s: %w", mirrorDir, err)
+		}
+	}
+
+	return os.Rename(tmp, output)
+}
+
+func runGit(ctx context.Context, args ...string) error {
+	out, err := exec.CommandContext(ctx, "git", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// writeTarGz archives the contents of a directory.
+func writeTarGz(dir, output string) (err error) {
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// extractTarGz extracts an archive written by writeTarGz into a directory.
+// Only directories and regular files are extracted, and nothing may be
+// extracted outside the directory.
+func extractTarGz(archive, dir string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.FromSlash(hdr.Name)
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("%q would be extracted outside %s", hdr.Name, dir)
+		}
+		path := filepath.Join(dir, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0o777); err != nil {
+				return err
+			}
+
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0o777); err != nil {
+				return err
+			}
+			dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, hdr.FileInfo().Mode().Perm())
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(dst, tr); err != nil {
+				dst.Close()
+				return err
+			}
+			if err := dst.Close(); err != nil {
+				return err
+			}
+
+		default:
+			return fmt.Errorf("%q isn't a directory or regular file", hdr.Name)
+		}
+	}
+}
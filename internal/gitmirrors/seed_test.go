@@ -0,0 +1,127 @@
+package gitmirrors
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func git(t *testing.T, args ...string) string {
+	t.Helper()
+
+	out, err := exec.Command("git", args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s error = %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// createSourceMirror creates a repository with a commit, and a mirror of it
+// under path. It returns the repository and the mirror.
+func createSourceMirror(t *testing.T, path string) (string, string) {
+	t.Helper()
+
+	repo := filepath.Join(t.TempDir(), "repo")
+	git(t, "init", "--quiet", repo)
+	git(t, "-C", repo, "-c", "user.name=Test", "-c", "user.email=test@example.com", "commit", "--quiet", "--allow-empty", "-m", "Initial commit")
+
+	mirror := filepath.Join(path, DirForRepository(repo))
+	git(t, "clone", "--mirror", "--quiet", "--", repo, mirror)
+	return repo, mirror
+}
+
+func TestBundleAndSeed(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	repo, mirror := createSourceMirror(t, t.TempDir())
+	want := git(t, "--git-dir", mirror, "rev-parse", "HEAD")
+
+	for _, format := range SeedFormats {
+		format := format
+		t.Run(format, func(t *testing.T) {
+			t.Parallel()
+
+			seed := filepath.Join(t.TempDir(), SeedName(repo, format))
+			if err := Bundle(ctx, mirror, seed); err != nil {
+				t.Fatalf("Bundle(ctx, %q, %q) error = %v", mirror, seed, err)
+			}
+
+			seeded := filepath.Join(t.TempDir(), DirForRepository(repo))
+			if err := Seed(ctx, repo, seeded, seed); err != nil {
+				t.Fatalf("Seed(ctx, %q, %q, %q) error = %v", repo, seeded, seed, err)
+			}
+
+			if !isBareRepository(seeded) {
+				t.Errorf("isBareRepository(%q) = false, want true", seeded)
+			}
+			if got := git(t, "--git-dir", seeded, "rev-parse", "HEAD"); got != want {
+				t.Errorf("seeded mirror HEAD = %q, want %q", got, want)
+			}
+			if got := git(t, "--git-dir", seeded, "config", "remote.origin.url"); got != repo {
+				t.Errorf("seeded mirror remote.origin.url = %q, want %q", got, repo)
+			}
+
+			// The seeded mirror must be able to fetch from the repository.
+			git(t, "--git-dir", seeded, "fetch", "--quiet", "origin")
+		})
+	}
+}
+
+func TestSeedRejectsUnknownFormat(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	seed := filepath.Join(dir, "seed.zip")
+	if err := os.WriteFile(seed, nil, 0o666); err != nil {
+		t.Fatalf("os.WriteFile(%q) error = %v", seed, err)
+	}
+
+	mirror := filepath.Join(dir, "mirror")
+	if err := Seed(ctx, "https://example.com/repo.git", mirror, seed); err == nil {
+		t.Errorf("Seed(ctx, ..., %q) error = nil, want an error", seed)
+	}
+	if _, err := os.Stat(mirror); !os.IsNotExist(err) {
+		t.Errorf("os.Stat(%q) error = %v, want the mirror not to exist", mirror, err)
+	}
+}
+
+func TestExtractTarGzRejectsEscapes(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "evil.tar.gz")
+
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatalf("os.Create(%q) error = %v", archive, err)
+	}
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	if err := tw.WriteHeader(&tar.Header{Name: "../escaped", Mode: 0o644, Typeflag: tar.TypeReg}); err != nil {
+		t.Fatalf("tw.WriteHeader() error = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tw.Close() error = %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("gz.Close() error = %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("f.Close() error = %v", err)
+	}
+
+	dest := filepath.Join(dir, "dest")
+	if err := extractTarGz(archive, dest); err == nil {
+		t.Errorf("extractTarGz(%q, %q) error = nil, want an error", archive, dest)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped")); !os.IsNotExist(err) {
+		t.Errorf("os.Stat(escaped) error = %v, want it not to exist", err)
+	}
+}
@@ -3,10 +3,15 @@ package job
 import (
 	"context"
 	"fmt"
+	"io"
 
+	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/internal/experiments"
+	"github.com/buildkite/agent/v3/internal/job/shell"
 	"github.com/buildkite/agent/v3/internal/socket"
 	"github.com/buildkite/agent/v3/jobapi"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/version"
 )
 
 // startJobAPI starts the job API server, iff the job API experiment is enabled, and the OS of the box supports it
@@ -31,7 +36,32 @@ func (e *Executor) startJobAPI(ctx context.Context) (cleanup func(), err error)
 		return cleanup, fmt.Errorf("creating job API socket path: %v", err)
 	}
 
-	srv, token, err := jobapi.NewServer(e.shell.Logger, socketPath, e.shell.Env)
+	// Tap the job output so it can be streamed from the Job API. Redactors are
+	// set up later, wrapping these writers, so only redacted output is seen.
+	logs := jobapi.NewLogBroadcaster()
+	e.shell.Writer = io.MultiWriter(e.shell.Writer, logs)
+	if wl, ok := e.shell.Logger.(*shell.WriterLogger); ok {
+		e.shell.Logger = &shell.WriterLogger{
+			Writer: io.MultiWriter(wl.Writer, logs),
+			Ansi:   wl.Ansi,
+		}
+	}
+
+	// Values to redact can be added through the Job API at any time, so
+	// redactors need to be in place even if there's nothing to redact yet.
+	e.redactionsMu.Lock()
+	e.dynamicRedactions = true
+	e.redactionsMu.Unlock()
+
+	opts := []jobapi.ServerOpts{
+		jobapi.WithLogBroadcaster(logs),
+		jobapi.WithRedactors(e),
+	}
+	if client := e.apiClient(); client != nil {
+		opts = append(opts, jobapi.WithAPIClient(client, e.ExecutorConfig.JobID))
+	}
+
+	srv, token, err := jobapi.NewServer(e.shell.Logger, socketPath, e.shell.Env, opts...)
 	if err != nil {
 		return cleanup, fmt.Errorf("creating job API server: %v", err)
 	}
@@ -48,5 +78,23 @@ func (e *Executor) startJobAPI(ctx context.Context) (cleanup func(), err error)
 		if err != nil {
 			e.shell.Errorf("Error stopping Job API server: %v", err)
 		}
+		logs.Close()
 	}, nil
 }
+
+// apiClient returns a Buildkite Agent API client using the job's access token
+// and endpoint, so that the Job API can make requests on behalf of the job.
+// It returns nil if the job doesn't have an access token.
+func (e *Executor) apiClient() *api.Client {
+	token, _ := e.shell.Env.Get("BUILDKITE_AGENT_ACCESS_TOKEN")
+	if token == "" {
+		return nil
+	}
+	endpoint, _ := e.shell.Env.Get("BUILDKITE_AGENT_ENDPOINT")
+
+	return api.NewClient(logger.Discard, api.Config{
+		Endpoint:  endpoint,
+		Token:     token,
+		UserAgent: version.UserAgent(),
+	})
+}
@@ -6,14 +6,17 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/buildkite/agent/v3/internal/experiments"
+	"github.com/buildkite/agent/v3/internal/gitmirrors"
 	"github.com/buildkite/agent/v3/internal/job/shell"
 	"github.com/buildkite/agent/v3/internal/utils"
 	"github.com/buildkite/agent/v3/tracetools"
 	"github.com/buildkite/roko"
+	homedir "github.com/mitchellh/go-homedir"
 )
 
 func (e *Executor) removeCheckoutDir() error {
@@ -141,6 +144,17 @@ func (e *Executor) CheckoutPhase(ctx context.Context) error {
 				e.shell.Warningf("Checkout was cancelled due to context cancellation")
 				r.Break()
 
+			case errors.Is(err, errNativeGitUnsupported):
+				// Another attempt would need the same things from go-git
+				e.shell.Warningf("Checkout failed! %s", err)
+				r.Break()
+
+			case errors.Is(err, errCheckoutUnrecoverable):
+				// Recovering already cloned the repository again from scratch,
+				// so there's nothing left for another attempt to try
+				e.shell.Warningf("Checkout failed! %s", err)
+				r.Break()
+
 			default:
 				e.shell.Warningf("Checkout failed! %s (%s)", err, r)
 
@@ -237,7 +251,7 @@ func hasGitCommit(ctx context.Context, sh *shell.Shell, gitDir string, commit st
 
 func (e *Executor) updateGitMirror(ctx context.Context, repository string) (string, error) {
 	// Create a unique directory for the repository mirror
-	mirrorDir := filepath.Join(e.ExecutorConfig.GitMirrorsPath, dirForRepository(repository))
+	mirrorDir := filepath.Join(e.ExecutorConfig.GitMirrorsPath, gitmirrors.DirForRepository(repository))
 	isMainRepository := repository == e.Repository
 
 	// Create the mirrors path if it doesn't exist
@@ -253,6 +267,20 @@ func (e *Executor) updateGitMirror(ctx context.Context, repository string) (stri
 
 	lockTimeout := time.Second * time.Duration(e.GitMirrorsLockTimeout)
 
+	// Seed a missing mirror, so that only what's changed since the seed was
+	// made needs to be fetched. Seeding takes the clone lock itself.
+	if e.GitMirrorsSeedPath != "" && !utils.FileExists(mirrorDir) {
+		e.shell.Commentf("Seeding a mirror of the repository from %s", e.GitMirrorsSeedPath)
+		if err := e.shell.Run(ctx, "buildkite-agent", "git-mirrors", "seed",
+			"--git-mirrors-path", e.GitMirrorsPath,
+			"--git-mirrors-lock-timeout", strconv.Itoa(e.GitMirrorsLockTimeout),
+			"--seed-path", e.GitMirrorsSeedPath,
+			repository,
+		); err != nil {
+			e.shell.Commentf("Couldn't seed the mirror, so it will be cloned instead: %v", err)
+		}
+	}
+
 	if e.Debug {
 		e.shell.Commentf("Acquiring mirror repository clone lock")
 	}
@@ -266,6 +294,12 @@ func (e *Executor) updateGitMirror(ctx context.Context, repository string) (stri
 	}
 	defer mirrorCloneLock.Unlock()
 
+	// Record that the mirror is in use, so that mirror maintenance doesn't
+	// remove it for being unused
+	if err := gitmirrors.MarkUsed(mirrorDir); err != nil {
+		e.shell.Warningf("Couldn't record that the git mirror is in use: %v", err)
+	}
+
 	// If we don't have a mirror, we need to clone it
 	if !utils.FileExists(mirrorDir) {
 		e.shell.Commentf("Cloning a mirror of the repository to %q", mirrorDir)
@@ -373,13 +407,23 @@ func (e *Executor) updateRemoteURL(ctx context.Context, gitDir, repository strin
 	// Update the origin of the repository so we can gracefully handle
 	// repository renames.
 
+	// The checkout (but never a mirror) is updated with go-git when using the
+	// native-git experiment
+	native := gitDir == "" && e.useNativeGit(ctx)
+
 	// First check what the existing remote is, for both logging and debugging
 	// purposes.
-	args := []string{"remote", "get-url", "origin"}
-	if gitDir != "" {
-		args = append([]string{"--git-dir", gitDir}, args...)
+	var gotURL string
+	var err error
+	if native {
+		gotURL, err = nativeGitRemoteURL(e.shell.Getwd(), "origin")
+	} else {
+		args := []string{"remote", "get-url", "origin"}
+		if gitDir != "" {
+			args = append([]string{"--git-dir", gitDir}, args...)
+		}
+		gotURL, err = e.shell.RunAndCapture(ctx, "git", args...)
 	}
-	gotURL, err := e.shell.RunAndCapture(ctx, "git", args...)
 	if err != nil {
 		return false, err
 	}
@@ -398,7 +442,11 @@ func (e *Executor) updateRemoteURL(ctx context.Context, gitDir, repository strin
 	e.shell.Commentf("This is usually because the repository has been renamed.")
 	e.shell.Commentf("If this is unexpected, you may see failures.")
 
-	args = []string{"remote", "set-url", "origin", repository}
+	if native {
+		return true, nativeGitSetRemoteURL(e.shell.Getwd(), "origin", repository)
+	}
+
+	args := []string{"remote", "set-url", "origin", repository}
 	if gitDir != "" {
 		args = append([]string{"--git-dir", gitDir}, args...)
 	}
@@ -409,14 +457,17 @@ func (e *Executor) getOrUpdateMirrorDir(ctx context.Context, repository string)
 	var mirrorDir string
 	// Skip updating the Git mirror before using it?
 	if e.ExecutorConfig.GitMirrorsSkipUpdate {
-		mirrorDir = filepath.Join(e.ExecutorConfig.GitMirrorsPath, dirForRepository(repository))
+		mirrorDir = filepath.Join(e.ExecutorConfig.GitMirrorsPath, gitmirrors.DirForRepository(repository))
 		e.shell.Commentf("Skipping update and using existing mirror for repository %s at %s.", repository, mirrorDir)
 
 		// Check if specified mirrorDir exists, otherwise the clone will fail.
 		if !utils.FileExists(mirrorDir) {
 			// Fall back to a clean clone, rather than failing the clone and therefore the build
 			e.shell.Commentf("No existing mirror found for repository %s at %s.", repository, mirrorDir)
-			mirrorDir = ""
+			return "", nil
+		}
+		if err := gitmirrors.MarkUsed(mirrorDir); err != nil {
+			e.shell.Warningf("Couldn't record that the git mirror is in use: %v", err)
 		}
 		return mirrorDir, nil
 	}
@@ -424,10 +475,50 @@ func (e *Executor) getOrUpdateMirrorDir(ctx context.Context, repository string)
 	return e.updateGitMirror(ctx, repository)
 }
 
+// lockGitMirror takes the use lock on the mirror of a repository. It's shared
+// with other jobs, but mirror maintenance takes it exclusively, so holding it
+// keeps the mirror from being removed or garbage collected while the checkout
+// borrows objects from it. The returned func releases the lock.
+func (e *Executor) lockGitMirror(ctx context.Context, repository string) (func(), error) {
+	mirrorDir := filepath.Join(e.ExecutorConfig.GitMirrorsPath, gitmirrors.DirForRepository(repository))
+
+	// The lock file lives next to the mirror, so the mirrors path has to exist
+	if err := os.MkdirAll(e.ExecutorConfig.GitMirrorsPath, 0777); err != nil {
+		return nil, err
+	}
+
+	if e.Debug {
+		e.shell.Commentf("Acquiring mirror repository use lock")
+	}
+
+	lockCtx, canc := context.WithTimeout(ctx, time.Second*time.Duration(e.GitMirrorsLockTimeout))
+	defer canc()
+	lock, err := gitmirrors.LockUse(lockCtx, mirrorDir)
+	if err != nil {
+		return nil, err
+	}
+	return func() { lock.Unlock() }, nil
+}
+
+// isSparseCheckout reports whether the existing checkout in the working
+// directory is a sparse checkout.
+func (e *Executor) isSparseCheckout(ctx context.Context) bool {
+	// Only ask git if sparse checkout has ever been set up
+	if !utils.FileExists(filepath.Join(e.shell.Getwd(), ".git", "info", "sparse-checkout")) {
+		return false
+	}
+	if e.useNativeGit(ctx) {
+		sparse, err := nativeGitIsSparseCheckout(e.shell.Getwd())
+		return err == nil && sparse
+	}
+	sparse, err := e.shell.RunAndCapture(ctx, "git", "config", "--bool", "core.sparseCheckout")
+	return err == nil && sparse == "true"
+}
+
 // defaultCheckoutPhase is called by the CheckoutPhase if no global or plugin checkout
 // hook exists. It performs the default checkout on the Repository provided in the config
 func (e *Executor) defaultCheckoutPhase(ctx context.Context) error {
-	span, _ := tracetools.StartSpanFromContext(ctx, "repo-checkout", e.ExecutorConfig.TracingBackend)
+	span, ctx := tracetools.StartSpanFromContext(ctx, "repo-checkout", e.ExecutorConfig.TracingBackend)
 	span.AddAttributes(map[string]string{
 		"checkout.repo_name": e.Repository,
 		"checkout.refspec":   e.RefSpec,
@@ -436,6 +527,15 @@ func (e *Executor) defaultCheckoutPhase(ctx context.Context) error {
 	var err error
 	defer func() { span.FinishWithError(err) }()
 
+	if e.useNativeGit(ctx) {
+		// Rather than quietly running git for what go-git can't do
+		if err = e.checkNativeGitSupport(); err != nil {
+			return err
+		}
+		e.shell.Commentf("Using native-git experiment 🧪")
+		span.AddAttributes(map[string]string{"checkout.is_native_git": "true"})
+	}
+
 	if e.SSHKeyscan {
 		addRepositoryHostToSSHKnownHosts(ctx, e.shell, e.Repository)
 	}
@@ -445,6 +545,15 @@ func (e *Executor) defaultCheckoutPhase(ctx context.Context) error {
 	// If we can, get a mirror of the git repository to use for reference later
 	if e.ExecutorConfig.GitMirrorsPath != "" && e.ExecutorConfig.Repository != "" {
 		span.AddAttributes(map[string]string{"checkout.is_using_git_mirrors": "true"})
+
+		// Keep the mirror until the checkout is done cloning and fetching
+		var unlockMirror func()
+		unlockMirror, err = e.lockGitMirror(ctx, e.Repository)
+		if err != nil {
+			return fmt.Errorf("locking git mirror: %w", err)
+		}
+		defer unlockMirror()
+
 		mirrorDir, err = e.getOrUpdateMirrorDir(ctx, e.Repository)
 		if err != nil {
 			return fmt.Errorf("getting/updating git mirror: %w", err)
@@ -458,112 +567,34 @@ func (e *Executor) defaultCheckoutPhase(ctx context.Context) error {
 		return fmt.Errorf("creating checkout dir: %w", err)
 	}
 
-	gitCloneFlags := e.GitCloneFlags
-	if mirrorDir != "" {
-		gitCloneFlags += fmt.Sprintf(" --reference %q", mirrorDir)
-	}
-
-	// Does the git directory exist?
-	existingGitDir := filepath.Join(e.shell.Getwd(), ".git")
-	if utils.FileExists(existingGitDir) {
-		// Update the origin of the repository so we can gracefully handle
-		// repository renames
-		if _, err := e.updateRemoteURL(ctx, "", e.Repository); err != nil {
-			return fmt.Errorf("setting origin: %w", err)
-		}
-	} else {
-		if err := gitClone(ctx, e.shell, gitCloneFlags, e.Repository, "."); err != nil {
-			return fmt.Errorf("cloning git repository: %w", err)
-		}
-	}
-
-	// Git clean prior to checkout, we do this even if submodules have been
-	// disabled to ensure previous submodules are cleaned up
-	if hasGitSubmodules(e.shell) {
-		if err := gitCleanSubmodules(ctx, e.shell, e.GitCleanFlags); err != nil {
-			return fmt.Errorf("cleaning git submodules: %w", err)
-		}
+	if len(e.GitSparseCheckoutPaths) > 0 {
+		span.AddAttributes(map[string]string{"checkout.is_sparse": "true"})
 	}
 
-	if err := gitClean(ctx, e.shell, e.GitCleanFlags); err != nil {
-		return fmt.Errorf("cleaning git repository: %w", err)
+	if err := e.prepareCheckout(ctx, mirrorDir); err != nil {
+		return err
 	}
 
-	gitFetchFlags := e.GitFetchFlags
-
-	switch {
-	case e.RefSpec != "":
-		// If a refspec is provided then use it instead.
-		// For example, `refs/not/a/head`
-		e.shell.Commentf("Fetch and checkout custom refspec")
-		if err := gitFetch(ctx, e.shell, gitFetchFlags, "origin", e.RefSpec); err != nil {
-			return fmt.Errorf("fetching refspec %q: %w", e.RefSpec, err)
-		}
-
-	case e.PullRequest != "false" && strings.Contains(e.PipelineProvider, "github"):
-		// GitHub has a special ref which lets us fetch a pull request head, whether
-		// or not there is a current head in this repository or another which
-		// references the commit. We presume a commit sha is provided. See:
-		// https://help.github.com/articles/checking-out-pull-requests-locally/#modifying-an-inactive-pull-request-locally
-		e.shell.Commentf("Fetch and checkout pull request head from GitHub")
-		refspec := fmt.Sprintf("refs/pull/%s/head", e.PullRequest)
-
-		if err := gitFetch(ctx, e.shell, gitFetchFlags, "origin", refspec); err != nil {
-			return fmt.Errorf("fetching PR refspec %q: %w", refspec, err)
-		}
-
-		gitFetchHead, _ := e.shell.RunAndCapture(ctx, "git", "rev-parse", "FETCH_HEAD")
-		e.shell.Commentf("FETCH_HEAD is now `%s`", gitFetchHead)
-
-	case e.Commit == "HEAD":
-		// If the commit is "HEAD" then we can't do a commit-specific fetch and will
-		// need to fetch the remote head and checkout the fetched head explicitly.
-		e.shell.Commentf("Fetch and checkout remote branch HEAD commit")
-		if err := gitFetch(ctx, e.shell, gitFetchFlags, "origin", e.Branch); err != nil {
-			return fmt.Errorf("fetching branch %q: %w", e.Branch, err)
-		}
-
-	default:
-		// Otherwise fetch and checkout the commit directly.
-		if err := gitFetch(ctx, e.shell, gitFetchFlags, "origin", e.Commit); err == nil {
-			break // it worked, break out of the switch statement
-		} else if gerr := new(gitError); errors.As(err, &gerr) {
-			// if we fail in a way that means the repository is corrupt, we should bail
-			switch gerr.Type {
-			case gitErrorFetchRetryClean, gitErrorFetchBadObject:
-				return fmt.Errorf("fetching commit %q: %w", e.Commit, err)
-			case gitErrorFetchBadReference:
-				// fallback to fetching all heads and tags
-			}
+	if err := e.fetchSource(ctx, "origin"); err != nil {
+		if !isCorruptCheckoutError(err) {
+			return err
 		}
 
-		// Some repositories don't support fetching a specific commit so we fall
-		// back to fetching all heads and tags, hoping that the commit is included.
-		e.shell.Commentf("Commit fetch failed, trying to fetch all heads and tags")
-		// By default `git fetch origin` will only fetch tags which are
-		// reachable from a fetches branch. git 1.9.0+ changed `--tags` to
-		// fetch all tags in addition to the default refspec, but pre 1.9.0 it
-		// excludes the default refspec.
-		gitFetchRefspec, err := e.shell.RunAndCapture(ctx, "git", "config", "remote.origin.fetch")
+		// The checkout may be corrupt, so try to recover it, rather than
+		// leaving it to the checkout retries to remove the whole thing
+		step, err := e.recoverCheckout(ctx, mirrorDir, err)
 		if err != nil {
-			return fmt.Errorf("getting remote.origin.fetch: %w", err)
-		}
-
-		if err := gitFetch(ctx, e.shell,
-			gitFetchFlags, "origin", gitFetchRefspec, "+refs/tags/*:refs/tags/*",
-		); err != nil {
-			return fmt.Errorf("fetching commit %q: %w", e.Commit, err)
+			return err
 		}
+		span.AddAttributes(map[string]string{"checkout.recovery_step": step})
 	}
 
-	gitCheckoutFlags := e.GitCheckoutFlags
-
 	if e.Commit == "HEAD" {
-		if err := gitCheckout(ctx, e.shell, gitCheckoutFlags, "FETCH_HEAD"); err != nil {
+		if err := e.checkoutSource(ctx, "FETCH_HEAD"); err != nil {
 			return fmt.Errorf("checking out FETCH_HEAD: %w", err)
 		}
 	} else {
-		if err := gitCheckout(ctx, e.shell, gitCheckoutFlags, e.Commit); err != nil {
+		if err := e.checkoutSource(ctx, e.Commit); err != nil {
 			return fmt.Errorf("checking out commit %q: %w", e.Commit, err)
 		}
 	}
@@ -578,7 +609,11 @@ func (e *Executor) defaultCheckoutPhase(ctx context.Context) error {
 		}
 	}
 
-	if gitSubmodules {
+	if gitSubmodules && e.useNativeGit(ctx) {
+		if err := e.updateSubmodulesNatively(ctx); err != nil {
+			return fmt.Errorf("updating submodules: %w", err)
+		}
+	} else if gitSubmodules {
 		// `submodule sync` will ensure the .git/config
 		// matches the .gitmodules file.  The command
 		// is only available in git version 1.8.1, so
@@ -612,6 +647,12 @@ func (e *Executor) defaultCheckoutPhase(ctx context.Context) error {
 				}
 				// It's all mirrored submodules for the rest of the loop.
 
+				unlockMirror, err := e.lockGitMirror(ctx, repository)
+				if err != nil {
+					return fmt.Errorf("locking git mirror for submodules: %w", err)
+				}
+				defer unlockMirror()
+
 				mirrorDir, err := e.getOrUpdateMirrorDir(ctx, repository)
 				if err != nil {
 					return fmt.Errorf("getting/updating mirror dir for submodules: %w", err)
@@ -625,7 +666,7 @@ func (e *Executor) defaultCheckoutPhase(ctx context.Context) error {
 				// Tests use a local temp path for the repository, real repositories don't. Handle both.
 				var repositoryPath string
 				if !utils.FileExists(repository) {
-					repositoryPath = filepath.Join(e.ExecutorConfig.GitMirrorsPath, dirForRepository(repository))
+					repositoryPath = filepath.Join(e.ExecutorConfig.GitMirrorsPath, gitmirrors.DirForRepository(repository))
 				} else {
 					repositoryPath = repository
 				}
@@ -660,12 +701,12 @@ func (e *Executor) defaultCheckoutPhase(ctx context.Context) error {
 	// good solution to this problem that we've found
 	e.shell.Commentf("Cleaning again to catch any post-checkout changes")
 
-	if err := gitClean(ctx, e.shell, e.GitCleanFlags); err != nil {
+	if err := e.clean(ctx); err != nil {
 		return fmt.Errorf("cleaning repository post-checkout: %w", err)
 	}
 
 	if gitSubmodules {
-		if err := gitCleanSubmodules(ctx, e.shell, e.GitCleanFlags); err != nil {
+		if err := e.cleanSubmodules(ctx); err != nil {
 			return fmt.Errorf("cleaning submodules post-checkout: %w", err)
 		}
 	}
@@ -686,26 +727,7 @@ func (e *Executor) defaultCheckoutPhase(ctx context.Context) error {
 	e.shell.Commentf("Checking to see if Git data needs to be sent to Buildkite")
 	if err := e.shell.Run(ctx, "buildkite-agent", "meta-data", "exists", "buildkite:git:commit"); err != nil {
 		e.shell.Commentf("Sending Git commit information back to Buildkite")
-		// Format:
-		//
-		// commit 0123456789abcdef0123456789abcdef01234567
-		// abbrev-commit 0123456789
-		// Author: John Citizen <john@example.com>
-		//
-		//    Subject of the commit message
-		//
-		//    Body of the commit message, which
-		//    may span multiple lines.
-		gitArgs := []string{
-			"--no-pager",
-			"log",
-			"-1",
-			"HEAD",
-			"-s", // --no-patch was introduced in v1.8.4 in 2013, but e.g. CentOS 7 isn't there yet
-			"--no-color",
-			"--format=commit %H%nabbrev-commit %h%nAuthor: %an <%ae>%n%n%w(0,4,4)%B",
-		}
-		out, err := e.shell.RunAndCapture(ctx, "git", gitArgs...)
+		out, err := e.commitInfo(ctx)
 		if err != nil {
 			return fmt.Errorf("getting git commit information: %w", err)
 		}
@@ -718,13 +740,335 @@ func (e *Executor) defaultCheckoutPhase(ctx context.Context) error {
 	return nil
 }
 
+// commitInfo describes the checked out commit, to send to Buildkite.
+func (e *Executor) commitInfo(ctx context.Context) (string, error) {
+	if e.useNativeGit(ctx) {
+		return nativeGitCommitInfo(e.shell.Getwd())
+	}
+
+	// Format:
+	//
+	// commit 0123456789abcdef0123456789abcdef01234567
+	// abbrev-commit 0123456789
+	// Author: John Citizen <john@example.com>
+	//
+	//    Subject of the commit message
+	//
+	//    Body of the commit message, which
+	//    may span multiple lines.
+	gitArgs := []string{
+		"--no-pager",
+		"log",
+		"-1",
+		"HEAD",
+		"-s", // --no-patch was introduced in v1.8.4 in 2013, but e.g. CentOS 7 isn't there yet
+		"--no-color",
+		"--format=commit %H%nabbrev-commit %h%nAuthor: %an <%ae>%n%n%w(0,4,4)%B",
+	}
+	return e.shell.RunAndCapture(ctx, "git", gitArgs...)
+}
+
+// prepareCheckout clones the repository into the checkout directory, unless
+// it's already there, and cleans it ready to fetch the source into. Objects
+// are borrowed from the mirror, if there is one.
+func (e *Executor) prepareCheckout(ctx context.Context, mirrorDir string) error {
+	sparseCheckout := len(e.GitSparseCheckoutPaths) > 0
+
+	gitCloneFlags := e.GitCloneFlags
+	if mirrorDir != "" {
+		gitCloneFlags += fmt.Sprintf(" --reference %q", mirrorDir)
+		if e.GitCloneFilter != "" {
+			e.shell.Commentf("Skipping partial clone, as objects are borrowed from the git mirror")
+		}
+	} else if e.GitCloneFilter != "" {
+		gitCloneFlags += fmt.Sprintf(" --filter %q", e.GitCloneFilter)
+	}
+	if sparseCheckout {
+		// Don't check out the whole default branch, only to throw most of it
+		// away again
+		gitCloneFlags += " --no-checkout"
+	}
+
+	// Does the git directory exist?
+	existingGitDir := filepath.Join(e.shell.Getwd(), ".git")
+	if utils.FileExists(existingGitDir) {
+		// Update the origin of the repository so we can gracefully handle
+		// repository renames
+		if _, err := e.updateRemoteURL(ctx, "", e.Repository); err != nil {
+			return fmt.Errorf("setting origin: %w", err)
+		}
+	} else if e.useNativeGit(ctx) {
+		e.shell.Commentf("Cloning %s with go-git", e.Repository)
+		sshAuth := e.nativeGitSSH()
+		defer sshAuth.Close()
+		auth, err := sshAuth.auth(e.Repository)
+		if err != nil {
+			return fmt.Errorf("cloning git repository: %w", err)
+		}
+		if err := nativeGitClone(ctx, e.shell.Writer, auth, e.Repository, e.shell.Getwd()); err != nil {
+			return fmt.Errorf("cloning git repository: %w", err)
+		}
+	} else {
+		if err := gitClone(ctx, e.shell, gitCloneFlags, e.Repository, "."); err != nil {
+			return fmt.Errorf("cloning git repository: %w", err)
+		}
+	}
+
+	// Set up the sparse checkout before cleaning, so that git clean also removes
+	// untracked files left behind outside the sparse checkout
+	if sparseCheckout {
+		e.shell.Commentf("Limiting the checkout to %s", strings.Join(e.GitSparseCheckoutPaths, ", "))
+		if err := gitSparseCheckout(ctx, e.shell, e.GitSparseCheckoutPaths); err != nil {
+			return fmt.Errorf("setting up sparse checkout: %w", err)
+		}
+	} else if e.isSparseCheckout(ctx) {
+		// An earlier job used a sparse checkout, but this one needs everything
+		e.shell.Commentf("Restoring the full checkout")
+		if err := e.disableSparseCheckout(ctx); err != nil {
+			return fmt.Errorf("disabling sparse checkout: %w", err)
+		}
+	}
+
+	// Git clean prior to checkout, we do this even if submodules have been
+	// disabled to ensure previous submodules are cleaned up
+	if hasGitSubmodules(e.shell) {
+		if err := e.cleanSubmodules(ctx); err != nil {
+			return fmt.Errorf("cleaning git submodules: %w", err)
+		}
+	}
+
+	if err := e.clean(ctx); err != nil {
+		return fmt.Errorf("cleaning git repository: %w", err)
+	}
+
+	return nil
+}
+
+// fetchSource fetches the commit, pull request or refspec that the job builds
+// from a remote, which is usually origin.
+func (e *Executor) fetchSource(ctx context.Context, remote string) error {
+	switch {
+	case e.RefSpec != "":
+		// If a refspec is provided then use it instead.
+		// For example, `refs/not/a/head`
+		e.shell.Commentf("Fetch and checkout custom refspec")
+		if err := e.fetch(ctx, remote, e.RefSpec); err != nil {
+			return fmt.Errorf("fetching refspec %q: %w", e.RefSpec, err)
+		}
+
+	case e.PullRequest != "false" && strings.Contains(e.PipelineProvider, "github"):
+		// GitHub has a special ref which lets us fetch a pull request head, whether
+		// or not there is a current head in this repository or another which
+		// references the commit. We presume a commit sha is provided. See:
+		// https://help.github.com/articles/checking-out-pull-requests-locally/#modifying-an-inactive-pull-request-locally
+		e.shell.Commentf("Fetch and checkout pull request head from GitHub")
+		refspec := fmt.Sprintf("refs/pull/%s/head", e.PullRequest)
+
+		if err := e.fetch(ctx, remote, refspec); err != nil {
+			return fmt.Errorf("fetching PR refspec %q: %w", refspec, err)
+		}
+
+		gitFetchHead, _ := e.revParse(ctx, "FETCH_HEAD")
+		e.shell.Commentf("FETCH_HEAD is now `%s`", gitFetchHead)
+
+	case e.Commit == "HEAD":
+		// If the commit is "HEAD" then we can't do a commit-specific fetch and will
+		// need to fetch the remote head and checkout the fetched head explicitly.
+		e.shell.Commentf("Fetch and checkout remote branch HEAD commit")
+		if err := e.fetch(ctx, remote, e.Branch); err != nil {
+			return fmt.Errorf("fetching branch %q: %w", e.Branch, err)
+		}
+
+	default:
+		// Otherwise fetch and checkout the commit directly.
+		if err := e.fetch(ctx, remote, e.Commit); err == nil {
+			break // it worked, break out of the switch statement
+		} else if gerr := new(gitError); errors.As(err, &gerr) {
+			// if we fail in a way that means the repository is corrupt, we should bail,
+			// so that the checkout can be recovered
+			switch gerr.Type {
+			case gitErrorFetchRetryClean, gitErrorFetchBadObject:
+				return fmt.Errorf("fetching commit %q: %w", e.Commit, err)
+			case gitErrorFetchBadReference:
+				// fallback to fetching all heads and tags
+			}
+		}
+
+		// Some repositories don't support fetching a specific commit so we fall
+		// back to fetching all heads and tags, hoping that the commit is included.
+		e.shell.Commentf("Commit fetch failed, trying to fetch all heads and tags")
+		// By default `git fetch origin` will only fetch tags which are
+		// reachable from a fetches branch. git 1.9.0+ changed `--tags` to
+		// fetch all tags in addition to the default refspec, but pre 1.9.0 it
+		// excludes the default refspec.
+		gitFetchRefspec, err := e.remoteFetchRefSpec(ctx)
+		if err != nil {
+			return fmt.Errorf("getting remote.origin.fetch: %w", err)
+		}
+
+		if err := e.fetch(ctx, remote, gitFetchRefspec, "+refs/tags/*:refs/tags/*"); err != nil {
+			return fmt.Errorf("fetching commit %q: %w", e.Commit, err)
+		}
+	}
+
+	return nil
+}
+
+// useNativeGit returns whether to clone, fetch, check out and clean the
+// repository in-process with go-git, rather than with the git binary, which is
+// what the native-git experiment does.
+func (e *Executor) useNativeGit(ctx context.Context) bool {
+	return experiments.IsEnabled(ctx, experiments.NativeGit)
+}
+
+// errNativeGitUnsupported is returned when the checkout needs something that
+// go-git can't do, or can't do the way git would, rather than running git for
+// it.
+var errNativeGitUnsupported = errors.New("the native-git experiment doesn't support this checkout")
+
+// checkNativeGitSupport returns errNativeGitUnsupported if the checkout can't
+// be done with go-git.
+func (e *Executor) checkNativeGitSupport() error {
+	var unsupported []string
+	if e.ExecutorConfig.GitMirrorsPath != "" {
+		unsupported = append(unsupported, "git mirrors")
+	}
+	if e.GitCloneFilter != "" {
+		unsupported = append(unsupported, "partial clones")
+	}
+	if len(e.GitSparseCheckoutPaths) > 0 {
+		unsupported = append(unsupported, "sparse checkouts")
+	}
+	// go-git has its own SSH client, so it can't run a different one
+	for _, name := range []string{"GIT_SSH_COMMAND", "GIT_SSH"} {
+		if _, ok := e.shell.Env.Get(name); ok {
+			unsupported = append(unsupported, "$"+name)
+		}
+	}
+	if len(unsupported) > 0 {
+		return fmt.Errorf("%w: it uses %s", errNativeGitUnsupported, strings.Join(unsupported, ", "))
+	}
+
+	if _, err := parseNativeGitCleanFlags(e.GitCleanFlags); err != nil {
+		return fmt.Errorf("%w: %v", errNativeGitUnsupported, err)
+	}
+	return nil
+}
+
+// nativeGitSSH returns go-git's SSH authentication for the job, which uses the
+// job's SSH agent. It needs closing once go-git is done with it.
+func (e *Executor) nativeGitSSH() *nativeGitSSH {
+	authSock, _ := e.shell.Env.Get("SSH_AUTH_SOCK")
+	// The same home directory that ssh-keyscan adds hosts to known_hosts in
+	homeDir, _ := homedir.Dir()
+	return &nativeGitSSH{authSock: authSock, homeDir: homeDir}
+}
+
+// fetch fetches refspecs from a remote into the checkout. With go-git, the git
+// fetch flags are ignored.
+func (e *Executor) fetch(ctx context.Context, remote string, refSpec ...string) error {
+	if !e.useNativeGit(ctx) {
+		return gitFetch(ctx, e.shell, e.GitFetchFlags, remote, refSpec...)
+	}
+	e.shell.Commentf("Fetching %s from %s with go-git", strings.Join(refSpec, " "), remote)
+	sshAuth := e.nativeGitSSH()
+	defer sshAuth.Close()
+	auth, err := sshAuth.auth(e.Repository)
+	if err != nil {
+		return &gitError{error: err, Type: gitErrorFetch}
+	}
+	return nativeGitFetch(ctx, e.shell.Writer, auth, e.shell.Getwd(), remote, refSpec...)
+}
+
+// clean removes untracked files from the checkout, like git clean with the git
+// clean flags.
+func (e *Executor) clean(ctx context.Context) error {
+	if !e.useNativeGit(ctx) {
+		return gitClean(ctx, e.shell, e.GitCleanFlags)
+	}
+	flags, err := parseNativeGitCleanFlags(e.GitCleanFlags)
+	if err != nil {
+		return err
+	}
+	return nativeGitClean(e.shell.Getwd(), flags)
+}
+
+// cleanSubmodules removes untracked files from the checked out submodules.
+func (e *Executor) cleanSubmodules(ctx context.Context) error {
+	if !e.useNativeGit(ctx) {
+		return gitCleanSubmodules(ctx, e.shell, e.GitCleanFlags)
+	}
+	flags, err := parseNativeGitCleanFlags(e.GitCleanFlags)
+	if err != nil {
+		return err
+	}
+	return nativeGitCleanSubmodules(e.shell.Getwd(), flags)
+}
+
+// disableSparseCheckout turns a sparse checkout back into a full one.
+func (e *Executor) disableSparseCheckout(ctx context.Context) error {
+	if !e.useNativeGit(ctx) {
+		return e.shell.Run(ctx, "git", "sparse-checkout", "disable")
+	}
+	return nativeGitDisableSparseCheckout(e.shell.Getwd())
+}
+
+// updateSubmodulesNatively checks out the submodules with go-git, as the git
+// submodule sync, update and foreach commands do otherwise. The submodule
+// clone config is ignored.
+func (e *Executor) updateSubmodulesNatively(ctx context.Context) error {
+	if e.SSHKeyscan {
+		// submodules might need their fingerprints verified too
+		urls, err := nativeGitSubmoduleURLs(e.shell.Getwd())
+		if err != nil {
+			e.shell.Warningf("Failed to enumerate git submodules: %v", err)
+		}
+		for _, url := range urls {
+			addRepositoryHostToSSHKnownHosts(ctx, e.shell, url)
+		}
+	}
+
+	e.shell.Commentf("Updating submodules with go-git")
+	sshAuth := e.nativeGitSSH()
+	defer sshAuth.Close()
+	return nativeGitUpdateSubmodules(ctx, e.shell.Writer, sshAuth.auth, e.shell.Getwd())
+}
+
+// checkoutSource checks out the fetched source. With go-git, the git checkout
+// flags are ignored, and changes to the working tree are always discarded.
+func (e *Executor) checkoutSource(ctx context.Context, reference string) error {
+	if !e.useNativeGit(ctx) {
+		return gitCheckout(ctx, e.shell, e.GitCheckoutFlags, reference)
+	}
+	e.shell.Commentf("Checking out %s with go-git", reference)
+	return nativeGitCheckout(ctx, e.shell.Getwd(), reference)
+}
+
+// revParse returns the commit that a revision of the checkout refers to.
+func (e *Executor) revParse(ctx context.Context, rev string) (string, error) {
+	if !e.useNativeGit(ctx) {
+		return e.shell.RunAndCapture(ctx, "git", "rev-parse", rev)
+	}
+	return nativeGitRevParse(e.shell.Getwd(), rev)
+}
+
+// remoteFetchRefSpec returns the refspecs that origin is fetched with by
+// default.
+func (e *Executor) remoteFetchRefSpec(ctx context.Context) (string, error) {
+	if !e.useNativeGit(ctx) {
+		return e.shell.RunAndCapture(ctx, "git", "config", "remote.origin.fetch")
+	}
+	refSpecs, err := nativeGitRemoteFetchRefSpecs(e.shell.Getwd(), "origin")
+	return strings.Join(refSpecs, " "), err
+}
+
 func (e *Executor) resolveCommit(ctx context.Context) {
 	commitRef, _ := e.shell.Env.Get("BUILDKITE_COMMIT")
 	if commitRef == "" {
 		e.shell.Warningf("BUILDKITE_COMMIT was empty")
 		return
 	}
-	cmdOut, err := e.shell.RunAndCapture(ctx, "git", "rev-parse", commitRef)
+	cmdOut, err := e.revParse(ctx, commitRef)
 	if err != nil {
 		e.shell.Warningf("Error running git rev-parse %q: %v", commitRef, err)
 		return
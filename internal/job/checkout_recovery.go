@@ -0,0 +1,159 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/buildkite/agent/v3/metrics"
+	"github.com/buildkite/agent/v3/tracetools"
+)
+
+var errCheckoutUnrecoverable = errors.New("couldn't recover the checkout")
+
+// Lock files that a git process killed part way through (for example, when a
+// job is cancelled) leaves behind, which stop later git processes from running.
+var staleGitLockFiles = []string{"index.lock", "shallow.lock"}
+
+// isCorruptCheckoutError returns whether an error fetching into the checkout
+// could be caused by the checkout being corrupt.
+func isCorruptCheckoutError(err error) bool {
+	ge := new(gitError)
+	if !errors.As(err, &ge) {
+		return false
+	}
+	return ge.Type == gitErrorFetchRetryClean || ge.Type == gitErrorFetchBadObject
+}
+
+// checkoutRecoveryStep is a step towards recovering a checkout that can't be
+// fetched into. Each step is more drastic (and slower) than the last.
+type checkoutRecoveryStep struct {
+	// Name of the step, used in traces and metrics
+	name string
+
+	// Logged as the header of the step's section
+	description string
+
+	// Tries to recover the checkout, and fetches into it again
+	recover func(context.Context) error
+}
+
+// recoverCheckout tries to recover a checkout that fetching failed in, after
+// which the source has been fetched. It tries repairing the checkout, fetching
+// from the git mirror, cloning from the git mirror again and finally cloning
+// from the repository again, stopping at the first that works. It returns the
+// name of the step that recovered the checkout.
+func (e *Executor) recoverCheckout(ctx context.Context, mirrorDir string, fetchErr error) (string, error) {
+	steps := []checkoutRecoveryStep{{
+		name:        "repair",
+		description: "Repairing the checkout",
+		recover: func(ctx context.Context) error {
+			if err := e.repairCheckout(ctx); err != nil {
+				return err
+			}
+			return e.fetchSource(ctx, "origin")
+		},
+	}}
+	if mirrorDir != "" {
+		steps = append(steps, checkoutRecoveryStep{
+			name:        "fetch-from-mirror",
+			description: "Fetching from the git mirror",
+			recover: func(ctx context.Context) error {
+				return e.fetchSource(ctx, mirrorDir)
+			},
+		}, checkoutRecoveryStep{
+			name:        "clone-from-mirror",
+			description: "Cloning the repository again from the git mirror",
+			recover: func(ctx context.Context) error {
+				return e.recloneCheckout(ctx, mirrorDir)
+			},
+		})
+	}
+	steps = append(steps, checkoutRecoveryStep{
+		name:        "clone",
+		description: "Cloning the repository again",
+		recover: func(ctx context.Context) error {
+			// The mirror may be what's corrupt, so don't borrow from it
+			return e.recloneCheckout(ctx, "")
+		},
+	})
+
+	e.shell.Warningf("Fetching failed in a way that means the checkout may be corrupt: %v", fetchErr)
+
+	err := fetchErr
+	for _, step := range steps {
+		if ctx.Err() != nil {
+			break
+		}
+
+		e.shell.Headerf("%s", step.description)
+
+		span, stepCtx := tracetools.StartSpanFromContext(ctx, "checkout-recovery", e.ExecutorConfig.TracingBackend)
+		span.AddAttributes(map[string]string{"checkout.recovery.step": step.name})
+		err = step.recover(stepCtx)
+		span.FinishWithError(err)
+
+		result := "success"
+		if err != nil {
+			result = "failure"
+		}
+		e.metrics.Count("checkout.recovery", 1, metrics.Tags{"step": step.name, "result": result})
+
+		if err == nil {
+			e.shell.Commentf("Recovered the checkout")
+			return step.name, nil
+		}
+		e.shell.Warningf("%s didn't recover the checkout: %v", step.description, err)
+	}
+
+	return "", fmt.Errorf("%w: %w", errCheckoutUnrecoverable, err)
+}
+
+// repairCheckout removes lock files left behind by git processes that didn't
+// finish, and checks that the objects the checkout refers to all exist.
+func (e *Executor) repairCheckout(ctx context.Context) error {
+	// The job has the checkout to itself, and no git process is running in it
+	// between steps, so any lock files are stale.
+	gitDir := filepath.Join(e.shell.Getwd(), ".git")
+	for _, name := range staleGitLockFiles {
+		path := filepath.Join(gitDir, name)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		e.shell.Commentf("Removing stale lock file %s", path)
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("removing stale lock file: %w", err)
+		}
+	}
+
+	// go-git has nothing like git fsck, so fetching again finds out whether
+	// the checkout is still broken.
+	if e.useNativeGit(ctx) {
+		return nil
+	}
+
+	// Only checking that the objects exist is much quicker than checking their
+	// contents, which matters in large repositories, and missing objects are
+	// what usually breaks fetches.
+	if err := e.shell.Run(ctx, "git", "fsck", "--connectivity-only", "--no-dangling"); err != nil {
+		return fmt.Errorf("checking the repository: %w", err)
+	}
+	return nil
+}
+
+// recloneCheckout removes the checkout, clones the repository again, borrowing
+// objects from the mirror if there is one, and fetches into it.
+func (e *Executor) recloneCheckout(ctx context.Context, mirrorDir string) error {
+	if err := e.removeCheckoutDir(); err != nil {
+		return err
+	}
+	if err := e.createCheckoutDir(); err != nil {
+		return fmt.Errorf("creating checkout dir: %w", err)
+	}
+	if err := e.prepareCheckout(ctx, mirrorDir); err != nil {
+		return err
+	}
+	return e.fetchSource(ctx, "origin")
+}
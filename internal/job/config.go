@@ -3,10 +3,13 @@ package job
 import (
 	"log"
 	"reflect"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/buildkite/agent/v3/env"
+	"github.com/buildkite/agent/v3/internal/replacer"
 	"github.com/buildkite/agent/v3/process"
 )
 
@@ -89,6 +92,13 @@ type ExecutorConfig struct {
 	// Config key=value pairs to pass to "git" when submodule init commands are invoked
 	GitSubmoduleCloneConfig []string `env:"BUILDKITE_GIT_SUBMODULE_CLONE_CONFIG" normalize:"list"`
 
+	// Directories to check out with "git sparse-checkout" in cone mode, instead
+	// of the whole repository
+	GitSparseCheckoutPaths []string `env:"BUILDKITE_GIT_SPARSE_CHECKOUT_PATHS" normalize:"list"`
+
+	// Filter to pass to "git clone --filter" for a partial clone (e.g. blob:none)
+	GitCloneFilter string `env:"BUILDKITE_GIT_CLONE_FILTER"`
+
 	// Whether or not to run the hooks/commands in a PTY
 	RunInPty bool
 
@@ -125,6 +135,9 @@ type ExecutorConfig struct {
 	// Skip updating the Git mirror before using it
 	GitMirrorsSkipUpdate bool `env:"BUILDKITE_GIT_MIRRORS_SKIP_UPDATE"`
 
+	// Where to find seeds to create missing git mirrors from
+	GitMirrorsSeedPath string
+
 	// Path to the buildkite-agent binary
 	BinPath string
 
@@ -159,11 +172,20 @@ type ExecutorConfig struct {
 	// List of environment variable globs to redact from job output
 	RedactedVars []string
 
+	// Patterns matching secrets to redact from job output by their content
+	RedactedPatterns []replacer.Pattern
+
 	// Backend to use for tracing. If an empty string, no tracing will occur.
 	TracingBackend string
 
 	// Service name to use when reporting traces.
 	TracingServiceName string
+
+	// Whether to send metrics to DogStatsD, the DogStatsD host, and whether
+	// to send timings as distributions
+	MetricsDatadog              bool
+	MetricsDatadogHost          string
+	MetricsDatadogDistributions bool
 }
 
 // ReadFromEnvironment reads configuration from the Environment, returns a map
@@ -202,6 +224,23 @@ func (c *ExecutorConfig) ReadFromEnvironment(environ *env.Environment) map[strin
 				}
 				v.SetBool(newBool)
 				changed[tag] = newStr
+			case reflect.Slice:
+				if v.Type().Elem().Kind() != reflect.String || f.Tag.Get("normalize") != "list" {
+					log.Printf("warning: job.ExecutorConfig.ReadFromEnvironment does not support %v for %s", v.Type(), tag)
+					break
+				}
+				// Lists are comma separated, like they are for CLI flags
+				newList := []string{}
+				for _, item := range strings.Split(newStr, ",") {
+					if item = strings.TrimSpace(item); item != "" {
+						newList = append(newList, item)
+					}
+				}
+				if slices.Equal(newList, v.Interface().([]string)) {
+					break
+				}
+				v.Set(reflect.ValueOf(newList))
+				changed[tag] = newStr
 			default:
 				log.Printf("warning: job.ExecutorConfig.ReadFromEnvironment does not support %v for %s", v.Kind(), tag)
 			}
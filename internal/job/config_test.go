@@ -80,3 +80,23 @@ func TestReadFromEnvironmentIgnoresMalformedBooleans(t *testing.T) {
 		t.Errorf("config.PluginsAlwaysCloneFresh = %t, want %t", got, want)
 	}
 }
+
+func TestReadFromEnvironmentSplitsLists(t *testing.T) {
+	t.Parallel()
+	config := &ExecutorConfig{
+		GitSparseCheckoutPaths: []string{"docs"},
+	}
+	environ := env.FromSlice([]string{
+		"BUILDKITE_GIT_SPARSE_CHECKOUT_PATHS=src/app, docs,,",
+	})
+	changes := config.ReadFromEnvironment(environ)
+	wantChanges := map[string]string{
+		"BUILDKITE_GIT_SPARSE_CHECKOUT_PATHS": "src/app, docs,,",
+	}
+	if diff := cmp.Diff(changes, wantChanges); diff != "" {
+		t.Errorf("config.ReadFromEnvironment(environ) diff (-got +want):\n%s", diff)
+	}
+	if diff := cmp.Diff(config.GitSparseCheckoutPaths, []string{"src/app", "docs"}); diff != "" {
+		t.Errorf("config.GitSparseCheckoutPaths diff (-got +want):\n%s", diff)
+	}
+}
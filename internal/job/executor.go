@@ -15,6 +15,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/buildkite/agent/v3/agent/plugin"
@@ -29,6 +30,8 @@ import (
 	"github.com/buildkite/agent/v3/internal/tempfile"
 	"github.com/buildkite/agent/v3/internal/utils"
 	"github.com/buildkite/agent/v3/kubernetes"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/metrics"
 	"github.com/buildkite/agent/v3/process"
 	"github.com/buildkite/agent/v3/tracetools"
 	"github.com/buildkite/roko"
@@ -58,6 +61,24 @@ type Executor struct {
 
 	// A channel to track cancellation
 	cancelCh chan struct{}
+
+	// Metrics about the job, sent to DogStatsD if the agent is configured to
+	metrics *metrics.Scope
+
+	// redactionsMu guards the fields below, which can be changed by the Job
+	// API while hooks and commands are running.
+	redactionsMu sync.Mutex
+
+	// The redactors currently wrapping the shell output, if any
+	redactors replacer.Mux
+
+	// Values to redact that came from the environment, and values to redact
+	// that were added while the job was running (with the Job API)
+	envRedactions, addedRedactions []string
+
+	// If true, redactors are set up even when there is nothing to redact yet,
+	// because values to redact might be added while the job is running
+	dynamicRedactions bool
 }
 
 // New returns a new executor instance
@@ -65,6 +86,7 @@ func New(conf ExecutorConfig) *Executor {
 	return &Executor{
 		ExecutorConfig: conf,
 		cancelCh:       make(chan struct{}),
+		metrics:        metrics.NewCollector(logger.Discard, metrics.CollectorConfig{}).Scope(nil),
 	}
 }
 
@@ -120,6 +142,9 @@ func (e *Executor) Run(ctx context.Context) (exitCode int) {
 	// Create an empty env for us to keep track of our env changes in
 	e.shell.Env = env.FromSlice(os.Environ())
 
+	stopMetrics := e.startMetrics()
+	defer stopMetrics()
+
 	// Initialize the job API, iff the experiment is enabled. Noop otherwise
 	cleanup, err := e.startJobAPI(ctx)
 	if err != nil {
@@ -498,7 +523,7 @@ func (e *Executor) applyEnvironmentChanges(changes hook.EnvChanges, redactors re
 	e.shell.Env.Apply(changes.Diff)
 
 	// reset output redactors based on new environment variable values
-	redactors.Reset(redact.Values(e.shell, e.ExecutorConfig.RedactedVars, e.shell.Env.Dump()))
+	e.resetRedactors(redactors, redact.Values(e.shell, e.ExecutorConfig.RedactedVars, e.shell.Env.Dump()))
 
 	// First, let see any of the environment variables are supposed
 	// to change the job configuration at run time.
@@ -616,11 +641,6 @@ func dirForAgentName(agentName string) string {
 	return badCharsPattern.ReplaceAllString(agentName, "-")
 }
 
-func dirForRepository(repository string) string {
-	badCharsPattern := regexp.MustCompile("[[:^alnum:]]")
-	return badCharsPattern.ReplaceAllString(repository, "-")
-}
-
 // Given a repository, it will add the host to the set of SSH known_hosts on the machine
 func addRepositoryHostToSSHKnownHosts(ctx context.Context, sh *shell.Shell, repository string) {
 	if utils.FileExists(repository) {
@@ -1089,11 +1109,15 @@ func (e *Executor) ignoredEnv() []string {
 
 // setupRedactors wraps shell output and logging in Redactor if any redaction
 // is necessary based on RedactedVars configuration and the existence of
-// matching environment vars.
+// matching environment vars, or RedactedPatterns configuration.
 // redactor.Mux (possibly empty) is returned so the caller can `defer redactor.Flush()`
 func (e *Executor) setupRedactors() replacer.Mux {
-	valuesToRedact := redact.Values(e.shell, e.ExecutorConfig.RedactedVars, e.shell.Env.Dump())
-	if len(valuesToRedact) == 0 {
+	e.redactionsMu.Lock()
+	defer e.redactionsMu.Unlock()
+
+	e.envRedactions = redact.Values(e.shell, e.ExecutorConfig.RedactedVars, e.shell.Env.Dump())
+	valuesToRedact := e.allRedactions()
+	if len(valuesToRedact) == 0 && len(e.ExecutorConfig.RedactedPatterns) == 0 && !e.dynamicRedactions {
 		return nil
 	}
 
@@ -1108,7 +1132,7 @@ func (e *Executor) setupRedactors() replacer.Mux {
 		rdc.Reset(valuesToRedact)
 		mux = append(mux, rdc)
 	} else {
-		rdc := replacer.New(e.shell.Writer, valuesToRedact, redact.Redact)
+		rdc := replacer.NewWithPatterns(e.shell.Writer, valuesToRedact, e.ExecutorConfig.RedactedPatterns, redact.Redact)
 		e.shell.Writer = rdc
 		mux = append(mux, rdc)
 	}
@@ -1133,9 +1157,42 @@ func (e *Executor) setupRedactors() replacer.Mux {
 		mux = append(mux, rdc)
 	}
 
+	e.redactors = mux
 	return mux
 }
 
+// resetRedactors resets the redactors with new values to redact from the
+// environment, keeping any values that were added while the job was running.
+func (e *Executor) resetRedactors(redactors replacer.Mux, envValues []string) {
+	e.redactionsMu.Lock()
+	defer e.redactionsMu.Unlock()
+
+	e.envRedactions = envValues
+	redactors.Reset(e.allRedactions())
+}
+
+// AddRedactions adds values to redact from the remainder of the job log. It
+// is safe to call while hooks and commands are running.
+func (e *Executor) AddRedactions(values ...string) {
+	e.redactionsMu.Lock()
+	defer e.redactionsMu.Unlock()
+
+	e.addedRedactions = append(e.addedRedactions, values...)
+	if e.redactors == nil {
+		return
+	}
+	e.redactors.Reset(e.allRedactions())
+}
+
+// allRedactions returns all the values to redact, including their encoded
+// forms. e.redactionsMu must be held.
+func (e *Executor) allRedactions() []string {
+	values := make([]string, 0, len(e.envRedactions)+len(e.addedRedactions))
+	values = append(values, e.envRedactions...)
+	values = append(values, e.addedRedactions...)
+	return redact.WithEncodedForms(values)
+}
+
 func (e *Executor) startKubernetesClient(ctx context.Context, kubernetesClient *kubernetes.Client) error {
 	e.shell.Commentf("Using experimental Kubernetes support")
 	err := roko.NewRetrier(
@@ -1,9 +1,15 @@
 package job
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
 	"testing"
 
+	"github.com/buildkite/agent/v3/env"
 	"github.com/buildkite/agent/v3/internal/job/shell"
 	"github.com/buildkite/agent/v3/internal/redact"
 	"github.com/buildkite/agent/v3/tracetools"
@@ -30,22 +36,6 @@ func TestDirForAgentName(t *testing.T) {
 	}
 }
 
-var repositoryNameTests = []struct {
-	repositoryName string
-	expected       string
-}{
-	{"git@github.com:acme-inc/my-project.git", "git-github-com-acme-inc-my-project-git"},
-	{"https://github.com/acme-inc/my-project.git", "https---github-com-acme-inc-my-project-git"},
-}
-
-func TestDirForRepository(t *testing.T) {
-	t.Parallel()
-
-	for _, test := range repositoryNameTests {
-		assert.Equal(t, test.expected, dirForRepository(test.repositoryName))
-	}
-}
-
 func TestValuesToRedact(t *testing.T) {
 	t.Parallel()
 
@@ -82,6 +72,91 @@ func TestValuesToRedactEmpty(t *testing.T) {
 	}
 }
 
+func TestAddRedactions(t *testing.T) {
+	t.Parallel()
+
+	var out bytes.Buffer
+	sh := shell.NewTestShell(t)
+	sh.Env = env.FromMap(map[string]string{"DATABASE_PASSWORD": "hunter2hunter2"})
+	sh.Writer = &out
+	sh.Logger = &shell.WriterLogger{Writer: &out}
+
+	e := New(ExecutorConfig{RedactedVars: []string{"*_PASSWORD"}})
+	e.shell = sh
+	e.dynamicRedactions = true
+
+	redactors := e.setupRedactors()
+	fmt.Fprintln(e.shell.Writer, "password hunter2hunter2, token llamasecret")
+
+	e.AddRedactions("llamasecret")
+	fmt.Fprintln(e.shell.Writer, "password hunter2hunter2, token llamasecret")
+
+	if err := redactors.Flush(); err != nil {
+		t.Fatalf("redactors.Flush() = %v", err)
+	}
+
+	want := "password [REDACTED], token llamasecret\npassword [REDACTED], token [REDACTED]\n"
+	if got := out.String(); got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+
+	// Redactions added with the Job API outlive changes to the environment.
+	e.resetRedactors(redactors, nil)
+	fmt.Fprintln(e.shell.Writer, "password hunter2hunter2, token llamasecret")
+	if err := redactors.Flush(); err != nil {
+		t.Fatalf("redactors.Flush() = %v", err)
+	}
+
+	want += "password hunter2hunter2, token [REDACTED]\n"
+	if got := out.String(); got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+}
+
+func TestRedactorsRedactEncodedForms(t *testing.T) {
+	t.Parallel()
+
+	const secret = "s3cr3t/llama+alpaca's \"password\""
+
+	tests := []struct {
+		desc, output string
+	}{
+		{desc: "base64", output: base64.StdEncoding.EncodeToString([]byte(secret + "\n"))},
+		{desc: "base64, unaligned", output: base64.StdEncoding.EncodeToString([]byte("x=" + secret))},
+		{desc: "base64 URL", output: base64.URLEncoding.EncodeToString([]byte(secret))},
+		{desc: "query escaped", output: "https://example.com/?password=" + url.QueryEscape(secret)},
+		{desc: "path escaped", output: "https://example.com/" + url.PathEscape(secret)},
+		{desc: "JSON", output: `{"password":"s3cr3t/llama+alpaca's \"password\""}`},
+		{desc: "single quoted", output: `echo 's3cr3t/llama+alpaca'\''s "password"'`},
+		{desc: "backslash escaped", output: `echo s3cr3t/llama+alpaca\'s\ \"password\"`},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			var out bytes.Buffer
+			sh := shell.NewTestShell(t)
+			sh.Env = env.FromMap(map[string]string{"LLAMA_PASSWORD": secret})
+			sh.Writer = &out
+
+			e := New(ExecutorConfig{RedactedVars: []string{"*_PASSWORD"}})
+			e.shell = sh
+
+			redactors := e.setupRedactors()
+			fmt.Fprintln(e.shell.Writer, test.output)
+			if err := redactors.Flush(); err != nil {
+				t.Fatalf("redactors.Flush() = %v", err)
+			}
+
+			if !strings.Contains(out.String(), "[REDACTED]") {
+				t.Errorf("output = %q, want it to contain [REDACTED]", out.String())
+			}
+		})
+	}
+}
+
 func TestStartTracing_NoTracingBackend(t *testing.T) {
 	var err error
 
@@ -28,6 +28,7 @@ const (
 	gitErrorFetchBadReference
 	gitErrorClean
 	gitErrorCleanSubmodules
+	gitErrorSparseCheckout
 )
 
 var (
@@ -118,6 +119,25 @@ func gitClean(ctx context.Context, sh shellRunner, gitCleanFlags string) error {
 	return nil
 }
 
+// gitSparseCheckout limits the working tree to the directories (and files at
+// the root of the repository), using "git sparse-checkout" in cone mode.
+func gitSparseCheckout(ctx context.Context, sh shellRunner, dirs []string) error {
+	commandArgs := []string{"sparse-checkout", "set", "--cone"}
+	for _, dir := range dirs {
+		// Cone mode matches directories relative to the root of the
+		// repository, so "/src/" and "src" are the same
+		if dir = strings.Trim(filepath.ToSlash(dir), "/"); dir != "" {
+			commandArgs = append(commandArgs, dir)
+		}
+	}
+
+	if err := sh.Run(ctx, "git", commandArgs...); err != nil {
+		return &gitError{error: err, Type: gitErrorSparseCheckout}
+	}
+
+	return nil
+}
+
 func gitCleanSubmodules(ctx context.Context, sh shellRunner, gitCleanFlags string) error {
 	individualCleanFlags, err := shellwords.Split(gitCleanFlags)
 	if err != nil {
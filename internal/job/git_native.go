@@ -0,0 +1,804 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/shellwords"
+	"github.com/go-git/go-billy/v5/osfs"
+	gogit "github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	formatconfig "github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// With the native-git experiment, the repository is cloned, fetched, checked
+// out and cleaned in-process with go-git, instead of by running the git binary.
+// These functions are the native equivalents of gitClone, gitFetch,
+// gitCheckout and friends, and return the same gitError types, classified from
+// go-git's errors rather than from git's output.
+
+func init() {
+	// go-git runs git-upload-pack to fetch from repositories on disk, so
+	// serve them in-process instead, which leaves nothing needing git
+	client.InstallProtocol("file", server.NewClient(nativeLocalLoader{}))
+}
+
+// nativeLocalLoader opens repositories on disk for go-git's in-process server.
+// Unlike go-git's own loader, it opens repositories with a working tree, as
+// well as bare ones.
+type nativeLocalLoader struct{}
+
+func (nativeLocalLoader) Load(ep *transport.Endpoint) (storer.Storer, error) {
+	repo, err := gogit.PlainOpen(ep.Path)
+	if errors.Is(err, gogit.ErrRepositoryNotExists) {
+		return nil, transport.ErrRepositoryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return repo.Storer, nil
+}
+
+// nativeFetchHead is where a refspec without a destination is fetched to, as
+// git fetch does.
+const nativeFetchHead = plumbing.ReferenceName("FETCH_HEAD")
+
+// nativeGitClone clones the repository into dir, without checking out a
+// working tree, since the job's commit is fetched and checked out next.
+func nativeGitClone(ctx context.Context, progress io.Writer, auth transport.AuthMethod, repository, dir string) error {
+	_, err := gogit.PlainCloneContext(ctx, dir, false, &gogit.CloneOptions{
+		URL:        repository,
+		Auth:       auth,
+		NoCheckout: true,
+		Progress:   progress,
+	})
+	if err != nil {
+		return &gitError{error: err, Type: gitErrorClone}
+	}
+	return nil
+}
+
+// nativeGitFetch fetches the refspecs from a remote of the repository in dir.
+// Like git fetch, a refspec without a destination (such as a branch name or a
+// commit) is fetched to FETCH_HEAD.
+func nativeGitFetch(ctx context.Context, progress io.Writer, auth transport.AuthMethod, dir, remote string, refSpec ...string) error {
+	var refSpecs []gitconfig.RefSpec
+	for _, r := range refSpec {
+		individualRefSpecs, err := shellwords.Split(r)
+		if err != nil {
+			return err
+		}
+		for _, rs := range individualRefSpecs {
+			refSpecs = append(refSpecs, nativeRefSpec(rs))
+		}
+	}
+
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return &gitError{error: err, Type: gitErrorFetchRetryClean}
+	}
+
+	err = repo.FetchContext(ctx, &gogit.FetchOptions{
+		RemoteName: remote,
+		RefSpecs:   refSpecs,
+		Auth:       auth,
+		Progress:   progress,
+		Force:      true,
+	})
+	switch {
+	case err == nil, errors.Is(err, gogit.NoErrAlreadyUpToDate):
+		return nil
+
+	case errors.Is(err, gogit.NoMatchingRefSpecError{}),
+		errors.Is(err, gogit.ErrExactSHA1NotSupported):
+		// Fall back to fetching all heads and tags, as when git can't find
+		// a short commit hash.
+		return &gitError{error: err, Type: gitErrorFetchBadReference}
+
+	case errors.Is(err, plumbing.ErrObjectNotFound):
+		// The checkout refers to objects that it doesn't have.
+		return &gitError{error: err, Type: gitErrorFetchBadObject}
+
+	default:
+		return &gitError{error: err, Type: gitErrorFetch}
+	}
+}
+
+// nativeRefSpec turns a refspec given to git fetch into one go-git accepts.
+// go-git needs an explicit destination, and doesn't expand short ref names, so
+// a branch name is expanded to its full ref, as it almost always names a
+// branch.
+func nativeRefSpec(rs string) gitconfig.RefSpec {
+	if strings.Contains(rs, ":") {
+		return gitconfig.RefSpec(rs)
+	}
+
+	src := strings.TrimPrefix(rs, "+")
+	if !plumbing.IsHash(src) && src != "HEAD" && !strings.HasPrefix(src, "refs/") {
+		src = plumbing.NewBranchReferenceName(src).String()
+	}
+	return gitconfig.RefSpec(fmt.Sprintf("+%s:%s", src, nativeFetchHead))
+}
+
+// nativeGitRemoteFetchRefSpecs returns the refspecs that git fetch uses for a
+// remote by default, like "git config remote.origin.fetch".
+func nativeGitRemoteFetchRefSpecs(dir, remote string) ([]string, error) {
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return nil, err
+	}
+	r, err := repo.Remote(remote)
+	if err != nil {
+		return nil, err
+	}
+	var refSpecs []string
+	for _, rs := range r.Config().Fetch {
+		refSpecs = append(refSpecs, rs.String())
+	}
+	return refSpecs, nil
+}
+
+// nativeGitRevParse returns the commit that a revision of the repository in dir
+// refers to, like git rev-parse.
+func nativeGitRevParse(dir, rev string) (string, error) {
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return "", err
+	}
+	hash, err := repo.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return "", err
+	}
+	return hash.String(), nil
+}
+
+// nativeGitCheckout checks out a commit (or FETCH_HEAD, or any other revision)
+// in the repository in dir, discarding any changes to the working tree, like
+// git checkout -f.
+func nativeGitCheckout(ctx context.Context, dir, reference string) error {
+	if !gitCheckRefFormat(reference) {
+		return fmt.Errorf("%q %w", reference, errInvalidRef)
+	}
+
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return &gitError{error: err, Type: gitErrorCheckoutRetryClean}
+	}
+
+	hash, err := repo.ResolveRevision(plumbing.Revision(reference))
+	if err != nil {
+		return &gitError{error: err, Type: gitErrorCheckoutReferenceIsNotATree}
+	}
+	if _, err := repo.CommitObject(*hash); err != nil {
+		return &gitError{error: err, Type: gitErrorCheckoutReferenceIsNotATree}
+	}
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		return &gitError{error: err, Type: gitErrorCheckoutRetryClean}
+	}
+	if err := ctx.Err(); err != nil {
+		return &gitError{error: err, Type: gitErrorCheckout}
+	}
+	if err := wt.Checkout(&gogit.CheckoutOptions{Hash: *hash, Force: true}); err != nil {
+		// Like an exit status of 128 from git checkout, this is usually
+		// a corrupt index or object, so start again from a clean checkout.
+		return &gitError{error: err, Type: gitErrorCheckoutRetryClean}
+	}
+	return nil
+}
+
+// nativeGitRemoteURL returns the URL of a remote of the repository in dir, like
+// git remote get-url.
+func nativeGitRemoteURL(dir, remote string) (string, error) {
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return "", err
+	}
+	r, err := repo.Remote(remote)
+	if err != nil {
+		return "", err
+	}
+	return r.Config().URLs[0], nil
+}
+
+// nativeGitSetRemoteURL changes the URL of a remote of the repository in dir,
+// like git remote set-url.
+func nativeGitSetRemoteURL(dir, remote, url string) error {
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return err
+	}
+	return setNativeRemoteURL(repo, remote, url)
+}
+
+func setNativeRemoteURL(repo *gogit.Repository, remote, url string) error {
+	cfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+	r, ok := cfg.Remotes[remote]
+	if !ok {
+		return gogit.ErrRemoteNotFound
+	}
+	r.URLs = []string{url}
+	return repo.SetConfig(cfg)
+}
+
+// nativeGitSparseConfigFiles are where git keeps core.sparseCheckout. git
+// sparse-checkout writes it to the worktree's own config, and older versions
+// of git write it to the repository's config.
+var nativeGitSparseConfigFiles = []string{"config", "config.worktree"}
+
+// nativeGitIsSparseCheckout reports whether the repository in dir has a sparse
+// checkout, like git config --bool core.sparseCheckout.
+func nativeGitIsSparseCheckout(dir string) (bool, error) {
+	for _, name := range nativeGitSparseConfigFiles {
+		cfg, err := readNativeGitConfig(filepath.Join(dir, ".git", name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		switch strings.ToLower(cfg.Section("core").Option("sparseCheckout")) {
+		case "true", "yes", "on", "1":
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// nativeGitDisableSparseCheckout turns off the sparse checkout of the
+// repository in dir, like git sparse-checkout disable. The files that were left
+// out are restored by the next checkout, which resets the whole working tree.
+func nativeGitDisableSparseCheckout(dir string) error {
+	// git marks the files left out in the index, and go-git leaves them alone
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return err
+	}
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return err
+	}
+	for _, e := range idx.Entries {
+		e.SkipWorktree = false
+	}
+	if err := repo.Storer.SetIndex(idx); err != nil {
+		return err
+	}
+
+	for _, name := range nativeGitSparseConfigFiles {
+		path := filepath.Join(dir, ".git", name)
+		cfg, err := readNativeGitConfig(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !cfg.HasSection("core") {
+			continue
+		}
+		cfg.Section("core").
+			RemoveOption("sparseCheckout").
+			RemoveOption("sparseCheckoutCone")
+
+		var buf strings.Builder
+		if err := formatconfig.NewEncoder(&buf).Encode(cfg); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, []byte(buf.String()), 0o644); err != nil {
+			return err
+		}
+	}
+
+	err = os.Remove(filepath.Join(dir, ".git", "info", "sparse-checkout"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func readNativeGitConfig(path string) (*formatconfig.Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg := formatconfig.New()
+	if err := formatconfig.NewDecoder(f).Decode(cfg); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// nativeGitCleanFlags are the git clean flags that nativeGitClean supports.
+type nativeGitCleanFlags struct {
+	force       int  // -f, given twice to remove nested repositories too
+	directories bool // -d
+	ignored     bool // -x
+	onlyIgnored bool // -X
+}
+
+// parseNativeGitCleanFlags parses git clean flags, such as the default -ffxdq,
+// into the ones nativeGitClean supports, and returns an error for any others.
+func parseNativeGitCleanFlags(flags string) (nativeGitCleanFlags, error) {
+	var f nativeGitCleanFlags
+
+	args, err := shellwords.Split(flags)
+	if err != nil {
+		return f, err
+	}
+	for _, arg := range args {
+		switch arg {
+		case "--force":
+			f.force++
+			continue
+		case "--quiet":
+			continue
+		}
+		if !strings.HasPrefix(arg, "-") || strings.HasPrefix(arg, "--") {
+			return f, fmt.Errorf("git clean flag %q isn't supported", arg)
+		}
+		for _, c := range arg[1:] {
+			switch c {
+			case 'f':
+				f.force++
+			case 'd':
+				f.directories = true
+			case 'x':
+				f.ignored = true
+			case 'X':
+				f.onlyIgnored = true
+			case 'q':
+			default:
+				return f, fmt.Errorf("git clean flag %q isn't supported", "-"+string(c))
+			}
+		}
+	}
+
+	if f.force == 0 {
+		return f, fmt.Errorf("git clean flags %q don't include -f", flags)
+	}
+	return f, nil
+}
+
+// nativeGitClean removes the files in the working tree of the repository in dir
+// that aren't in its index, like git clean. Submodules are left alone, as
+// git clean leaves them.
+func nativeGitClean(dir string, flags nativeGitCleanFlags) error {
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return &gitError{error: err, Type: gitErrorClean}
+	}
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return &gitError{error: err, Type: gitErrorClean}
+	}
+
+	c := &nativeCleaner{
+		root:        dir,
+		flags:       flags,
+		tracked:     make(map[string]bool),
+		trackedDirs: make(map[string]bool),
+	}
+	for _, e := range idx.Entries {
+		c.tracked[e.Name] = true
+		for d := path.Dir(e.Name); d != "."; d = path.Dir(d) {
+			c.trackedDirs[d] = true
+		}
+	}
+	if !flags.ignored {
+		patterns, err := gitignore.ReadPatterns(osfs.New(dir), nil)
+		if err != nil {
+			return &gitError{error: err, Type: gitErrorClean}
+		}
+		c.ignore = gitignore.NewMatcher(patterns)
+	}
+
+	if err := c.clean(""); err != nil {
+		return &gitError{error: err, Type: gitErrorClean}
+	}
+	return nil
+}
+
+// nativeGitCleanSubmodules cleans the checked out submodules of the repository
+// in dir, and their submodules, like git submodule foreach --recursive git
+// clean.
+func nativeGitCleanSubmodules(dir string, flags nativeGitCleanFlags) error {
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return &gitError{error: err, Type: gitErrorCleanSubmodules}
+	}
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return &gitError{error: err, Type: gitErrorCleanSubmodules}
+	}
+
+	for _, e := range idx.Entries {
+		if e.Mode != filemode.Submodule {
+			continue
+		}
+		subDir := filepath.Join(dir, filepath.FromSlash(e.Name))
+		if _, err := os.Stat(filepath.Join(subDir, ".git")); err != nil {
+			continue // it isn't checked out
+		}
+		if err := nativeGitClean(subDir, flags); err != nil {
+			return &gitError{error: fmt.Errorf("cleaning submodule %s: %w", e.Name, err), Type: gitErrorCleanSubmodules}
+		}
+		if err := nativeGitCleanSubmodules(subDir, flags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nativeCleaner walks a working tree, removing what git clean would.
+type nativeCleaner struct {
+	root  string
+	flags nativeGitCleanFlags
+
+	// The files (and submodules) in the index, and the directories that
+	// contain them, as slash-separated paths relative to root
+	tracked, trackedDirs map[string]bool
+
+	// Matches ignored files, unless they're removed anyway (-x)
+	ignore gitignore.Matcher
+}
+
+// clean cleans a directory, given relative to the root of the working tree.
+func (c *nativeCleaner) clean(dir string) error {
+	entries, err := os.ReadDir(filepath.Join(c.root, filepath.FromSlash(dir)))
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := path.Join(dir, entry.Name())
+		if name == ".git" || c.tracked[name] {
+			continue
+		}
+		full := filepath.Join(c.root, filepath.FromSlash(name))
+		isDir := entry.IsDir()
+
+		if isDir && c.trackedDirs[name] {
+			if err := c.clean(name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		ignored := c.ignore != nil && c.ignore.Match(strings.Split(name, "/"), isDir)
+
+		if !isDir {
+			// Ignored files are removed with -x, and only they are with -X
+			if c.flags.ignored || ignored == c.flags.onlyIgnored {
+				if err := os.Remove(full); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		// Untracked directories are only removed with -d, and ones that
+		// are repositories of their own need -f twice
+		if !c.flags.directories {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(full, ".git")); err == nil && c.flags.force < 2 {
+			continue
+		}
+		if c.flags.ignored || (c.flags.onlyIgnored && ignored) {
+			if err := os.RemoveAll(full); err != nil {
+				return err
+			}
+			continue
+		}
+		if ignored {
+			continue
+		}
+
+		// Clean inside the directory, so that ignored files are kept (or
+		// removed, with -X), and remove it if nothing's left
+		if err := c.clean(name); err != nil {
+			return err
+		}
+		if !c.flags.onlyIgnored {
+			_ = os.Remove(full) // fails if it isn't empty
+		}
+	}
+	return nil
+}
+
+// nativeGitSubmoduleURLs returns the URLs of the submodules in .gitmodules in
+// the working tree of the repository in dir.
+func nativeGitSubmoduleURLs(dir string) ([]string, error) {
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return nil, err
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return nil, err
+	}
+	subs, err := wt.Submodules()
+	if err != nil {
+		return nil, err
+	}
+
+	urls := make([]string, 0, len(subs))
+	for _, sub := range subs {
+		urls = append(urls, sub.Config().URL)
+	}
+	return urls, nil
+}
+
+// nativeGitAuthFunc returns how go-git authenticates with a repository.
+type nativeGitAuthFunc func(repository string) (transport.AuthMethod, error)
+
+// nativeGitUpdateSubmodules checks out the submodules of the repository in dir
+// at the commits in its index, and their submodules, like git submodule sync
+// and git submodule update --init --recursive --force. Changes to the
+// submodules' working trees are discarded.
+func nativeGitUpdateSubmodules(ctx context.Context, progress io.Writer, auth nativeGitAuthFunc, dir string) error {
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return err
+	}
+	return updateNativeSubmodules(ctx, progress, auth, repo)
+}
+
+func updateNativeSubmodules(ctx context.Context, progress io.Writer, auth nativeGitAuthFunc, repo *gogit.Repository) error {
+	wt, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	subs, err := wt.Submodules()
+	if err != nil {
+		return err
+	}
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range subs {
+		cfg := sub.Config()
+		entry, err := idx.Entry(cfg.Path)
+		if err != nil {
+			// It's in .gitmodules, but not in the commit
+			continue
+		}
+
+		if err := sub.Init(); err != nil && !errors.Is(err, gogit.ErrSubmoduleAlreadyInitialized) {
+			return fmt.Errorf("initialising submodule %s: %w", cfg.Name, err)
+		}
+		subRepo, err := sub.Repository()
+		if err != nil {
+			return fmt.Errorf("opening submodule %s: %w", cfg.Name, err)
+		}
+
+		// Follow changes to the URL in .gitmodules, like git submodule sync
+		url, err := nativeSubmoduleURL(repo, cfg.URL)
+		if err != nil {
+			return fmt.Errorf("resolving the URL of submodule %s: %w", cfg.Name, err)
+		}
+		if err := setNativeRemoteURL(subRepo, gogit.DefaultRemoteName, url); err != nil {
+			return fmt.Errorf("setting the URL of submodule %s: %w", cfg.Name, err)
+		}
+
+		if _, err := subRepo.CommitObject(entry.Hash); err != nil {
+			subAuth, err := auth(url)
+			if err != nil {
+				return fmt.Errorf("fetching submodule %s: %w", cfg.Name, err)
+			}
+			if err := fetchNativeSubmoduleCommit(ctx, progress, subAuth, subRepo, entry.Hash); err != nil {
+				return fmt.Errorf("fetching submodule %s: %w", cfg.Name, err)
+			}
+		}
+
+		subWt, err := subRepo.Worktree()
+		if err != nil {
+			return fmt.Errorf("checking out submodule %s: %w", cfg.Name, err)
+		}
+		if err := subWt.Checkout(&gogit.CheckoutOptions{Hash: entry.Hash, Force: true}); err != nil {
+			return fmt.Errorf("checking out submodule %s: %w", cfg.Name, err)
+		}
+
+		if err := updateNativeSubmodules(ctx, progress, auth, subRepo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchNativeSubmoduleCommit fetches the branches and tags of a submodule's
+// remote, and then the commit itself if that didn't include it, which only
+// works if the remote allows fetching commits that aren't on a branch.
+func fetchNativeSubmoduleCommit(ctx context.Context, progress io.Writer, auth transport.AuthMethod, repo *gogit.Repository, commit plumbing.Hash) error {
+	err := repo.FetchContext(ctx, &gogit.FetchOptions{
+		Auth:     auth,
+		Progress: progress,
+		Force:    true,
+	})
+	if err != nil && !errors.Is(err, gogit.NoErrAlreadyUpToDate) {
+		return err
+	}
+	if _, err := repo.CommitObject(commit); err == nil {
+		return nil
+	}
+
+	err = repo.FetchContext(ctx, &gogit.FetchOptions{
+		Auth:     auth,
+		Progress: progress,
+		RefSpecs: []gitconfig.RefSpec{gitconfig.RefSpec(fmt.Sprintf("+%s:%s", commit, nativeFetchHead))},
+		Force:    true,
+	})
+	if err != nil && !errors.Is(err, gogit.NoErrAlreadyUpToDate) {
+		return err
+	}
+	return nil
+}
+
+// nativeSubmoduleURL resolves a submodule URL that's relative to the URL of
+// the superproject's origin, as git does for URLs starting with ./ or ../.
+func nativeSubmoduleURL(repo *gogit.Repository, url string) (string, error) {
+	if !strings.HasPrefix(url, "./") && !strings.HasPrefix(url, "../") {
+		return url, nil
+	}
+
+	origin, err := repo.Remote(gogit.DefaultRemoteName)
+	if err != nil {
+		return "", err
+	}
+	ep, err := transport.NewEndpoint(origin.Config().URLs[0])
+	if err != nil {
+		return "", err
+	}
+	ep.Path = path.Join(ep.Path, url)
+	if ep.Protocol == "file" {
+		return ep.Path, nil
+	}
+	return ep.String(), nil
+}
+
+// nativeGitCommitInfo describes the HEAD commit of the repository in dir, in
+// the same format as the git log command that sends it to Buildkite.
+func nativeGitCommitInfo(dir string) (string, error) {
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return "", err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return "", err
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "commit %s\n", commit.Hash)
+	// git abbreviates to at least 7 characters, and more only to tell
+	// commits apart in much larger repositories
+	fmt.Fprintf(&b, "abbrev-commit %s\n", commit.Hash.String()[:7])
+	fmt.Fprintf(&b, "Author: %s <%s>\n\n", commit.Author.Name, commit.Author.Email)
+	for _, line := range strings.Split(strings.TrimRight(commit.Message, "\n"), "\n") {
+		b.WriteString("    ")
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	return strings.TrimRight(b.String(), "\n"), nil
+}
+
+// nativeGitSSH authenticates go-git with SSH remotes the way ssh would for the
+// job: with the keys in the job's SSH agent, if it has one, or else the default
+// keys in ~/.ssh, and checking host keys against known_hosts. It needs closing
+// once go-git is done with it.
+type nativeGitSSH struct {
+	authSock string
+	homeDir  string
+
+	conn net.Conn
+}
+
+// auth returns how go-git authenticates with the repository. Repositories that
+// aren't SSH URLs need nothing, as go-git uses any credentials in the URL.
+func (s *nativeGitSSH) auth(repository string) (transport.AuthMethod, error) {
+	ep, err := transport.NewEndpoint(repository)
+	if err != nil {
+		return nil, err
+	}
+	if ep.Protocol != "ssh" {
+		return nil, nil
+	}
+
+	user := ep.User
+	if user == "" {
+		user = gitssh.DefaultUsername
+	}
+
+	var knownHosts []string
+	for _, path := range []string{
+		filepath.Join(s.homeDir, ".ssh", "known_hosts"),
+		"/etc/ssh/ssh_known_hosts",
+	} {
+		if _, err := os.Stat(path); err == nil {
+			knownHosts = append(knownHosts, path)
+		}
+	}
+	if len(knownHosts) == 0 {
+		return nil, fmt.Errorf("there's no known_hosts file to check the host key of %s against", ep.Host)
+	}
+	hostKeyCallback, err := gitssh.NewKnownHostsCallback(knownHosts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gitssh.PublicKeysCallback{
+		User:                  user,
+		Callback:              s.signers,
+		HostKeyCallbackHelper: gitssh.HostKeyCallbackHelper{HostKeyCallback: hostKeyCallback},
+	}, nil
+}
+
+func (s *nativeGitSSH) signers() ([]ssh.Signer, error) {
+	if s.authSock == "" {
+		return s.keyFileSigners(), nil
+	}
+	if s.conn == nil {
+		conn, err := net.Dial("unix", s.authSock)
+		if err != nil {
+			return nil, fmt.Errorf("connecting to the SSH agent: %w", err)
+		}
+		s.conn = conn
+	}
+	return agent.NewClient(s.conn).Signers()
+}
+
+// keyFileSigners returns the default keys in ~/.ssh that ssh would try. Keys
+// with a passphrase are skipped, as there's nobody to enter it.
+func (s *nativeGitSSH) keyFileSigners() []ssh.Signer {
+	var signers []ssh.Signer
+	for _, name := range []string{"id_rsa", "id_ecdsa", "id_ed25519"} {
+		pem, err := os.ReadFile(filepath.Join(s.homeDir, ".ssh", name))
+		if err != nil {
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	return signers
+}
+
+// Close closes the connection to the SSH agent, if there is one.
+func (s *nativeGitSSH) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
@@ -0,0 +1,504 @@
+package job
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	gogit "github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestNativeRefSpec(t *testing.T) {
+	t.Parallel()
+
+	const sha = "0123456789abcdef0123456789abcdef01234567"
+	tests := map[string]string{
+		"main":                           "+refs/heads/main:FETCH_HEAD",
+		"feature/llamas":                 "+refs/heads/feature/llamas:FETCH_HEAD",
+		"refs/pull/123/head":             "+refs/pull/123/head:FETCH_HEAD",
+		"HEAD":                           "+HEAD:FETCH_HEAD",
+		sha:                              "+" + sha + ":FETCH_HEAD",
+		"+refs/heads/*:refs/remotes/o/*": "+refs/heads/*:refs/remotes/o/*",
+		"refs/tags/v1:refs/tags/v1":      "refs/tags/v1:refs/tags/v1",
+	}
+	for in, want := range tests {
+		if got := nativeRefSpec(in).String(); got != want {
+			t.Errorf("nativeRefSpec(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestNativeGitCloneFetchAndCheckout(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	remote := createNativeGitTestRepo(t)
+	main := gitOutput(t, remote, "rev-parse", "main")
+	feature := gitOutput(t, remote, "rev-parse", "feature")
+
+	dir := t.TempDir()
+	require.NoError(t, nativeGitClone(ctx, io.Discard, nil, remote, dir))
+
+	// A branch is fetched to FETCH_HEAD, which can be checked out.
+	require.NoError(t, nativeGitFetch(ctx, io.Discard, nil, dir, "origin", "feature"))
+	head, err := nativeGitRevParse(dir, "FETCH_HEAD")
+	require.NoError(t, err)
+	assert.Equal(t, feature, head)
+	require.NoError(t, nativeGitCheckout(ctx, dir, "FETCH_HEAD"))
+	assertFileContent(t, filepath.Join(dir, "llamas.txt"), "feature")
+
+	// Changes to the working tree are discarded, like git checkout -f.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "llamas.txt"), []byte("changed"), 0o644))
+	require.NoError(t, nativeGitCheckout(ctx, dir, main))
+	assertFileContent(t, filepath.Join(dir, "llamas.txt"), "main")
+
+	// The refspecs that origin is fetched with by default can be fetched too.
+	refSpecs, err := nativeGitRemoteFetchRefSpecs(dir, "origin")
+	require.NoError(t, err)
+	if diff := cmp.Diff(refSpecs, []string{"+refs/heads/*:refs/remotes/origin/*"}); diff != "" {
+		t.Errorf("nativeGitRemoteFetchRefSpecs(dir, origin) diff (-got +want):\n%s", diff)
+	}
+	require.NoError(t, nativeGitFetch(ctx, io.Discard, nil, dir, "origin", strings.Join(refSpecs, " "), "+refs/tags/*:refs/tags/*"))
+	require.NoError(t, nativeGitCheckout(ctx, dir, "v1"))
+	assertFileContent(t, filepath.Join(dir, "llamas.txt"), "main")
+}
+
+func TestNativeGitErrors(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	remote := createNativeGitTestRepo(t)
+	feature := gitOutput(t, remote, "rev-parse", "feature")
+
+	dir := t.TempDir()
+	require.NoError(t, nativeGitClone(ctx, io.Discard, nil, remote, dir))
+
+	tests := []struct {
+		name     string
+		run      func() error
+		wantType int
+	}{
+		{
+			name:     "clone of a missing repository",
+			run:      func() error { return nativeGitClone(ctx, io.Discard, nil, filepath.Join(remote, "nope"), t.TempDir()) },
+			wantType: gitErrorClone,
+		},
+		{
+			name:     "fetch of a missing branch",
+			run:      func() error { return nativeGitFetch(ctx, io.Discard, nil, dir, "origin", "alpacas") },
+			wantType: gitErrorFetchBadReference,
+		},
+		{
+			// go-git's server for repositories on disk doesn't allow fetching
+			// commits that aren't at the tip of a ref, so the checkout falls
+			// back to fetching everything.
+			name:     "fetch of a commit the remote won't serve",
+			run:      func() error { return nativeGitFetch(ctx, io.Discard, nil, dir, "origin", feature) },
+			wantType: gitErrorFetchBadReference,
+		},
+		{
+			name:     "fetch into a directory that isn't a repository",
+			run:      func() error { return nativeGitFetch(ctx, io.Discard, nil, t.TempDir(), "origin", "main") },
+			wantType: gitErrorFetchRetryClean,
+		},
+		{
+			name:     "checkout of a missing commit",
+			run:      func() error { return nativeGitCheckout(ctx, dir, "0123456789abcdef0123456789abcdef01234567") },
+			wantType: gitErrorCheckoutReferenceIsNotATree,
+		},
+		{
+			name:     "checkout in a directory that isn't a repository",
+			run:      func() error { return nativeGitCheckout(ctx, t.TempDir(), "main") },
+			wantType: gitErrorCheckoutRetryClean,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			err := test.run()
+			ge := new(gitError)
+			if !errors.As(err, &ge) {
+				t.Fatalf("error = %v, want a gitError", err)
+			}
+			if ge.Type != test.wantType {
+				t.Errorf("gitError.Type = %d, want %d (error = %v)", ge.Type, test.wantType, err)
+			}
+		})
+	}
+}
+
+func TestNativeGitCheckoutValidatesRef(t *testing.T) {
+	t.Parallel()
+	err := nativeGitCheckout(context.Background(), t.TempDir(), "--nope")
+	assert.EqualError(t, err, `"--nope" is not a valid git ref format`)
+}
+
+func TestNativeGitRemoteURL(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	remote := createNativeGitTestRepo(t)
+	dir := t.TempDir()
+	require.NoError(t, nativeGitClone(ctx, io.Discard, nil, remote, dir))
+
+	got, err := nativeGitRemoteURL(dir, "origin")
+	require.NoError(t, err)
+	assert.Equal(t, remote, got)
+
+	require.NoError(t, nativeGitSetRemoteURL(dir, "origin", "git@github.com:buildkite/llamas.git"))
+	assert.Equal(t, "git@github.com:buildkite/llamas.git", gitOutput(t, dir, "remote", "get-url", "origin"))
+
+	assert.ErrorIs(t, nativeGitSetRemoteURL(dir, "upstream", remote), gogit.ErrRemoteNotFound)
+}
+
+func TestNativeGitDisableSparseCheckout(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	remote := createNativeGitTestRepo(t)
+	require.NoError(t, os.Mkdir(filepath.Join(remote, "alpacas"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(remote, "alpacas", "alpacas.txt"), []byte("alpacas"), 0o644))
+	gitOutput(t, remote, "add", "alpacas")
+	gitOutput(t, remote, "commit", "-m", "alpacas")
+
+	// git makes the sparse checkout, as an earlier job without native-git would
+	dir := t.TempDir()
+	gitOutput(t, dir, "clone", remote, ".")
+	gitOutput(t, dir, "sparse-checkout", "set", "--cone", "nothing")
+	assert.NoFileExists(t, filepath.Join(dir, "alpacas", "alpacas.txt"))
+
+	sparse, err := nativeGitIsSparseCheckout(dir)
+	require.NoError(t, err)
+	assert.True(t, sparse, "nativeGitIsSparseCheckout(dir) after git sparse-checkout set")
+
+	require.NoError(t, nativeGitDisableSparseCheckout(dir))
+	sparse, err = nativeGitIsSparseCheckout(dir)
+	require.NoError(t, err)
+	assert.False(t, sparse, "nativeGitIsSparseCheckout(dir) after nativeGitDisableSparseCheckout(dir)")
+
+	// Checking out restores the files that were left out
+	require.NoError(t, nativeGitCheckout(ctx, dir, "main"))
+	assertFileContent(t, filepath.Join(dir, "alpacas", "alpacas.txt"), "alpacas")
+	assert.Empty(t, gitOutput(t, dir, "status", "--porcelain"))
+}
+
+func TestParseNativeGitCleanFlags(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		flags   string
+		want    nativeGitCleanFlags
+		wantErr bool
+	}{
+		{flags: "-ffxdq", want: nativeGitCleanFlags{force: 2, directories: true, ignored: true}},
+		{flags: "-fdq", want: nativeGitCleanFlags{force: 1, directories: true}},
+		{flags: "--force --quiet -X", want: nativeGitCleanFlags{force: 1, onlyIgnored: true}},
+		{flags: "-dx", wantErr: true},
+		{flags: "-fdq -e vendor", wantErr: true},
+		{flags: "-f --dry-run", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := parseNativeGitCleanFlags(test.flags)
+		if test.wantErr {
+			assert.Error(t, err, "parseNativeGitCleanFlags(%q)", test.flags)
+			continue
+		}
+		require.NoError(t, err, "parseNativeGitCleanFlags(%q)", test.flags)
+		assert.Equal(t, test.want, got, "parseNativeGitCleanFlags(%q)", test.flags)
+	}
+}
+
+func TestNativeGitClean(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		flags string
+		kept  []string
+	}{
+		{
+			flags: "-ffxdq",
+			kept:  []string{"llamas.txt", ".gitignore", "tracked/llamas.txt"},
+		},
+		{
+			// Ignored files are kept, and so are untracked directories
+			// that are repositories of their own
+			flags: "-fdq",
+			kept:  []string{"llamas.txt", ".gitignore", "tracked/llamas.txt", "ignored.log", "untracked/ignored.log", "nested/.git/HEAD"},
+		},
+		{
+			// Untracked directories are left alone
+			flags: "-fxq",
+			kept:  []string{"llamas.txt", ".gitignore", "tracked/llamas.txt", "untracked/untracked.txt", "untracked/ignored.log", "nested/.git/HEAD"},
+		},
+		{
+			// Only ignored files are removed
+			flags: "-fdX",
+			kept:  []string{"llamas.txt", ".gitignore", "tracked/llamas.txt", "untracked.txt", "tracked/untracked.txt", "untracked/untracked.txt", "nested/.git/HEAD"},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.flags, func(t *testing.T) {
+			t.Parallel()
+
+			dir := createNativeGitTestRepo(t)
+			files := map[string]string{
+				".gitignore":              "*.log\n",
+				"tracked/llamas.txt":      "llamas",
+				"untracked.txt":           "untracked",
+				"ignored.log":             "ignored",
+				"tracked/untracked.txt":   "untracked",
+				"untracked/untracked.txt": "untracked",
+				"untracked/ignored.log":   "ignored",
+				"nested/.git/HEAD":        "ref: refs/heads/main\n",
+			}
+			for name, content := range files {
+				path := filepath.Join(dir, filepath.FromSlash(name))
+				require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+				require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+			}
+			gitOutput(t, dir, "add", ".gitignore", "tracked/llamas.txt")
+			gitOutput(t, dir, "commit", "-m", "tracked")
+
+			flags, err := parseNativeGitCleanFlags(test.flags)
+			require.NoError(t, err)
+			require.NoError(t, nativeGitClean(dir, flags))
+
+			var got []string
+			err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+				if err != nil || d.IsDir() {
+					return err
+				}
+				rel, err := filepath.Rel(dir, path)
+				if err != nil {
+					return err
+				}
+				rel = filepath.ToSlash(rel)
+				if strings.HasPrefix(rel, ".git/") {
+					return nil
+				}
+				got = append(got, rel)
+				return nil
+			})
+			require.NoError(t, err)
+			assert.ElementsMatch(t, test.kept, got)
+		})
+	}
+}
+
+func TestNativeGitUpdateAndCleanSubmodules(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	sub := createNativeGitTestRepo(t)
+	remote := createNativeGitTestRepo(t)
+	gitOutput(t, remote, "-c", "protocol.file.allow=always", "submodule", "add", sub, "sub")
+	gitOutput(t, remote, "commit", "-m", "Add submodule")
+
+	dir := t.TempDir()
+	require.NoError(t, nativeGitClone(ctx, io.Discard, nil, remote, dir))
+	require.NoError(t, nativeGitFetch(ctx, io.Discard, nil, dir, "origin", "main"))
+	require.NoError(t, nativeGitCheckout(ctx, dir, "FETCH_HEAD"))
+
+	urls, err := nativeGitSubmoduleURLs(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{sub}, urls)
+
+	var authURLs []string
+	auth := func(url string) (transport.AuthMethod, error) {
+		authURLs = append(authURLs, url)
+		return nil, nil
+	}
+	require.NoError(t, nativeGitUpdateSubmodules(ctx, io.Discard, auth, dir))
+	assertFileContent(t, filepath.Join(dir, "sub", "llamas.txt"), "main")
+	assert.Equal(t, []string{sub}, authURLs)
+	assert.Equal(t, gitOutput(t, sub, "rev-parse", "main"), gitOutput(t, filepath.Join(dir, "sub"), "rev-parse", "HEAD"))
+
+	// Changes to the submodule are cleaned and discarded
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "llamas.txt"), []byte("changed"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "untracked.txt"), []byte("untracked"), 0o644))
+	flags, err := parseNativeGitCleanFlags("-ffxdq")
+	require.NoError(t, err)
+	require.NoError(t, nativeGitCleanSubmodules(dir, flags))
+	assert.NoFileExists(t, filepath.Join(dir, "sub", "untracked.txt"))
+	require.NoError(t, nativeGitUpdateSubmodules(ctx, io.Discard, auth, dir))
+	assertFileContent(t, filepath.Join(dir, "sub", "llamas.txt"), "main")
+
+	// Cleaning the superproject leaves the submodule alone
+	require.NoError(t, nativeGitClean(dir, flags))
+	assertFileContent(t, filepath.Join(dir, "sub", "llamas.txt"), "main")
+}
+
+func TestNativeSubmoduleURL(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		origin, url, want string
+	}{
+		{"git@github.com:buildkite/agent.git", "git@github.com:buildkite/llamas.git", "git@github.com:buildkite/llamas.git"},
+		{"git@github.com:buildkite/agent.git", "../llamas.git", "ssh://git@github.com/buildkite/llamas.git"},
+		{"https://github.com/buildkite/agent.git", "../llamas.git", "https://github.com/buildkite/llamas.git"},
+		{"/src/agent", "../llamas", "/src/llamas"},
+	}
+	for _, test := range tests {
+		repo, err := gogit.Init(memory.NewStorage(), nil)
+		require.NoError(t, err)
+		_, err = repo.CreateRemote(&gitconfig.RemoteConfig{Name: "origin", URLs: []string{test.origin}})
+		require.NoError(t, err)
+
+		got, err := nativeSubmoduleURL(repo, test.url)
+		require.NoError(t, err)
+		assert.Equal(t, test.want, got, "nativeSubmoduleURL(%q, %q)", test.origin, test.url)
+	}
+}
+
+func TestNativeGitCommitInfo(t *testing.T) {
+	t.Parallel()
+
+	dir := createNativeGitTestRepo(t)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "llamas.txt"), []byte("body"), 0o644))
+	gitOutput(t, dir, "commit", "-am", "Subject of the commit\n\nBody of the commit, which\nspans lines.")
+
+	got, err := nativeGitCommitInfo(dir)
+	require.NoError(t, err)
+	want := gitOutput(t, dir, "--no-pager", "log", "-1", "HEAD", "-s", "--no-color", "--abbrev=7",
+		"--format=commit %H%nabbrev-commit %h%nAuthor: %an <%ae>%n%n%w(0,4,4)%B")
+	assert.Equal(t, want, got)
+}
+
+func TestNativeGitSSHAuth(t *testing.T) {
+	t.Parallel()
+
+	homeDir := t.TempDir()
+	s := &nativeGitSSH{homeDir: homeDir}
+
+	// Other URLs use credentials in the URL
+	auth, err := s.auth("https://github.com/buildkite/agent.git")
+	require.NoError(t, err)
+	assert.Nil(t, auth)
+
+	// Host keys are checked against known_hosts, so there has to be one
+	if _, err := os.Stat("/etc/ssh/ssh_known_hosts"); err != nil {
+		_, err = s.auth("git@github.com:buildkite/agent.git")
+		assert.Error(t, err)
+	}
+	require.NoError(t, os.Mkdir(filepath.Join(homeDir, ".ssh"), 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(homeDir, ".ssh", "known_hosts"), nil, 0o600))
+
+	auth, err = s.auth("llamas@github.com:buildkite/agent.git")
+	require.NoError(t, err)
+	keys, ok := auth.(*gitssh.PublicKeysCallback)
+	require.True(t, ok, "auth = %T, want *ssh.PublicKeysCallback", auth)
+	assert.Equal(t, "llamas", keys.User)
+
+	auth, err = s.auth("ssh://github.com/buildkite/agent.git")
+	require.NoError(t, err)
+	assert.Equal(t, "git", auth.(*gitssh.PublicKeysCallback).User)
+}
+
+func TestNativeGitSSHSigners(t *testing.T) {
+	t.Parallel()
+
+	_, key, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	// Without an SSH agent, the default keys in ~/.ssh are used
+	homeDir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(homeDir, ".ssh"), 0o700))
+	pemBlock, err := ssh.MarshalPrivateKey(key, "")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(homeDir, ".ssh", "id_ed25519"), pem.EncodeToMemory(pemBlock), 0o600))
+
+	s := &nativeGitSSH{homeDir: homeDir}
+	signers, err := s.signers()
+	require.NoError(t, err)
+	require.Len(t, signers, 1)
+	wantKey := signers[0].PublicKey().Marshal()
+
+	// With one, the keys in the agent are used instead
+	keyring := agent.NewKeyring()
+	require.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: key}))
+	authSock := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", authSock)
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+
+	s = &nativeGitSSH{authSock: authSock, homeDir: t.TempDir()}
+	t.Cleanup(func() { s.Close() })
+	signers, err = s.signers()
+	require.NoError(t, err)
+	require.Len(t, signers, 1)
+	assert.Equal(t, wantKey, signers[0].PublicKey().Marshal())
+}
+
+// createNativeGitTestRepo creates a repository with a main branch, tagged v1,
+// and a feature branch, which each change llamas.txt.
+func createNativeGitTestRepo(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is needed to create the test repository")
+	}
+
+	dir := t.TempDir()
+	commit := func(content string) {
+		t.Helper()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "llamas.txt"), []byte(content), 0o644))
+		gitOutput(t, dir, "add", "llamas.txt")
+		gitOutput(t, dir, "commit", "-m", content)
+	}
+
+	gitOutput(t, dir, "init", "--initial-branch=main")
+	commit("main")
+	gitOutput(t, dir, "tag", "v1")
+	gitOutput(t, dir, "checkout", "-b", "feature")
+	commit("feature")
+	gitOutput(t, dir, "checkout", "main")
+	return dir
+}
+
+// gitOutput runs git in dir, and returns its trimmed output.
+func gitOutput(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", append([]string{"-C", dir, "-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s error = %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func assertFileContent(t *testing.T, path, want string) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, want, string(got))
+}
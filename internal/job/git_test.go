@@ -223,6 +223,14 @@ func TestGitClean(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestGitSparseCheckout(t *testing.T) {
+	t.Parallel()
+	sh := new(mockShellRunner).Expect("git", "sparse-checkout", "set", "--cone", "src/app", "docs")
+	defer sh.Check(t)
+	err := gitSparseCheckout(context.Background(), sh, []string{"/src/app/", "", "docs"})
+	require.NoError(t, err)
+}
+
 func TestGitCleanSubmodules(t *testing.T) {
 	t.Parallel()
 	sh := new(mockShellRunner).
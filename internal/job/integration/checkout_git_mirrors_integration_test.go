@@ -11,6 +11,7 @@ import (
 	"testing"
 
 	"github.com/buildkite/agent/v3/internal/experiments"
+	"github.com/buildkite/agent/v3/internal/gitmirrors"
 	"github.com/buildkite/bintest/v3"
 )
 
@@ -723,3 +724,172 @@ func TestGitMirrorEnv(t *testing.T) {
 		t.Errorf("gitMirrorPath = %q, want prefix %q", gitMirrorPath, tester.GitMirrorsDir)
 	}
 }
+
+func TestCheckingOutSeedsMissingGitMirror(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester(mainCtx)
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	if err := tester.EnableGitMirrors(); err != nil {
+		t.Fatalf("EnableGitMirrors() error = %v", err)
+	}
+
+	seedPath := t.TempDir()
+	seed := filepath.Join(seedPath, gitmirrors.SeedName(tester.Repo.Path, gitmirrors.SeedFormatBundle))
+	if out, err := tester.Repo.Execute("bundle", "create", seed, "--all"); err != nil {
+		t.Fatalf("tester.Repo.Execute(bundle, create, %q, --all) error = %v\nout = %s", seed, err, out)
+	}
+
+	env := []string{
+		"BUILDKITE_GIT_CLONE_FLAGS=-v",
+		"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
+		"BUILDKITE_GIT_FETCH_FLAGS=-v",
+		"BUILDKITE_GIT_MIRRORS_SEED_PATH=" + seedPath,
+	}
+
+	// Actually execute git commands, but with expectations
+	git := tester.
+		MustMock(t, "git").
+		PassthroughToLocalCommand()
+
+	// The mirror is seeded rather than cloned, then updated
+	git.ExpectAll([][]any{
+		{"--git-dir", matchSubDir(tester.GitMirrorsDir), "rev-parse", "HEAD^{commit}"},
+		{"--git-dir", matchSubDir(tester.GitMirrorsDir), "rev-parse", "HEAD^{commit}"},
+		{"--git-dir", matchSubDir(tester.GitMirrorsDir), "remote", "get-url", "origin"},
+		{"--git-dir", matchSubDir(tester.GitMirrorsDir), "fetch", "origin", "main"},
+		{"clone", "-v", "--reference", matchSubDir(tester.GitMirrorsDir), "--", tester.Repo.Path, "."},
+		{"clean", "-fdq"},
+		{"fetch", "-v", "--", "origin", "main"},
+		{"checkout", "-f", "FETCH_HEAD"},
+		{"clean", "-fdq"},
+		{"--no-pager", "log", "-1", "HEAD", "-s", "--no-color", gitShowFormatArg},
+	})
+
+	mirrorDir := filepath.Join(tester.GitMirrorsDir, gitmirrors.DirForRepository(tester.Repo.Path))
+
+	agent := tester.MockAgent(t)
+	agent.Expect("git-mirrors", "seed",
+		"--git-mirrors-path", tester.GitMirrorsDir,
+		"--git-mirrors-lock-timeout", bintest.MatchAny(),
+		"--seed-path", seedPath,
+		tester.Repo.Path,
+	).AndCallFunc(func(c *bintest.Call) {
+		if err := gitmirrors.Seed(mainCtx, tester.Repo.Path, mirrorDir, seed); err != nil {
+			fmt.Fprintf(c.Stderr, "gitmirrors.Seed() error = %v\n", err)
+			c.Exit(1)
+			return
+		}
+		c.Exit(0)
+	})
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(1)
+	agent.Expect("meta-data", "set", "buildkite:git:commit").WithStdin(commitPattern)
+
+	tester.RunAndCheck(t, env...)
+}
+
+func TestCheckingOutClonesGitMirrorWhenSeedingFails(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester(mainCtx)
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	if err := tester.EnableGitMirrors(); err != nil {
+		t.Fatalf("EnableGitMirrors() error = %v", err)
+	}
+
+	seedPath := t.TempDir()
+
+	env := []string{
+		"BUILDKITE_GIT_CLONE_FLAGS=-v",
+		"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
+		"BUILDKITE_GIT_FETCH_FLAGS=-v",
+		"BUILDKITE_GIT_MIRRORS_SEED_PATH=" + seedPath,
+	}
+
+	// Actually execute git commands, but with expectations
+	git := tester.
+		MustMock(t, "git").
+		PassthroughToLocalCommand()
+
+	// There's no seed, so the mirror is cloned as usual
+	git.ExpectAll([][]any{
+		{"clone", "--mirror", "-v", "--", tester.Repo.Path, matchSubDir(tester.GitMirrorsDir)},
+		{"clone", "-v", "--reference", matchSubDir(tester.GitMirrorsDir), "--", tester.Repo.Path, "."},
+		{"clean", "-fdq"},
+		{"fetch", "-v", "--", "origin", "main"},
+		{"checkout", "-f", "FETCH_HEAD"},
+		{"clean", "-fdq"},
+		{"--no-pager", "log", "-1", "HEAD", "-s", "--no-color", gitShowFormatArg},
+	})
+
+	agent := tester.MockAgent(t)
+	agent.Expect("git-mirrors", "seed",
+		"--git-mirrors-path", tester.GitMirrorsDir,
+		"--git-mirrors-lock-timeout", bintest.MatchAny(),
+		"--seed-path", seedPath,
+		tester.Repo.Path,
+	).AndExitWith(1)
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(1)
+	agent.Expect("meta-data", "set", "buildkite:git:commit").WithStdin(commitPattern)
+
+	tester.RunAndCheck(t, env...)
+}
+
+func TestCheckingOutRecoversCorruptCheckout_WithGitMirrors(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester(mainCtx)
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	if err := tester.EnableGitMirrors(); err != nil {
+		t.Fatalf("EnableGitMirrors() error = %v", err)
+	}
+
+	corruptCheckout(t, tester)
+
+	env := []string{
+		"BUILDKITE_GIT_CLONE_FLAGS=-v",
+		"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
+		"BUILDKITE_GIT_FETCH_FLAGS=-v",
+	}
+
+	// Actually execute git commands, but with expectations
+	git := tester.
+		MustMock(t, "git").
+		PassthroughToLocalCommand()
+
+	// Neither repairing nor fetching from the mirror can recover the checkout,
+	// so it's cloned again from the mirror
+	git.ExpectAll([][]any{
+		{"clone", "--mirror", "-v", "--", tester.Repo.Path, matchSubDir(tester.GitMirrorsDir)},
+		{"remote", "get-url", "origin"},
+		{"clean", "-fdq"},
+		{"fetch", "-v", "--", "origin", "main"},
+		{"fsck", "--connectivity-only", "--no-dangling"},
+		{"fetch", "-v", "--", matchSubDir(tester.GitMirrorsDir), "main"},
+		{"clone", "-v", "--reference", matchSubDir(tester.GitMirrorsDir), "--", tester.Repo.Path, "."},
+		{"clean", "-fdq"},
+		{"fetch", "-v", "--", "origin", "main"},
+		{"checkout", "-f", "FETCH_HEAD"},
+		{"clean", "-fdq"},
+		{"--no-pager", "log", "-1", "HEAD", "-s", "--no-color", gitShowFormatArg},
+	})
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MockAgent(t)
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(1)
+	agent.Expect("meta-data", "set", "buildkite:git:commit").WithStdin(commitPattern)
+
+	tester.RunAndCheck(t, env...)
+}
@@ -3,14 +3,17 @@ package integration
 import (
 	"errors"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strings"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/buildkite/agent/v3/internal/experiments"
 	"github.com/buildkite/bintest/v3"
@@ -70,6 +73,74 @@ func TestWithResolvingCommitExperiment(t *testing.T) {
 	tester.RunAndCheck(t, env...)
 }
 
+func TestCheckingOutWithNativeGitExperiment(t *testing.T) {
+	t.Parallel()
+
+	// The shell is found on the PATH on Windows, alongside git
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	ctx, _ := experiments.Enable(mainCtx, experiments.NativeGit)
+	tester, err := NewBootstrapTester(ctx)
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	// go-git clones, fetches, checks out and cleans the repository, and reads
+	// the commit, so the checkout works without git on the PATH at all
+	path := []string{tester.PathDir}
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		if _, err := os.Stat(filepath.Join(dir, "git")); err == nil {
+			continue
+		}
+		path = append(path, dir)
+	}
+
+	env := []string{
+		"PATH=" + strings.Join(path, string(os.PathListSeparator)),
+		"BUILDKITE_GIT_CLONE_FLAGS=-v",
+		"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
+		"BUILDKITE_GIT_FETCH_FLAGS=-v",
+	}
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MockAgent(t)
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(1)
+	agent.Expect("meta-data", "set", "buildkite:git:commit").WithStdin(commitPattern)
+
+	tester.RunAndCheck(t, env...)
+}
+
+func TestCheckingOutWithNativeGitExperimentFailsWithGitMirrors(t *testing.T) {
+	t.Parallel()
+
+	ctx, _ := experiments.Enable(mainCtx, experiments.NativeGit)
+	tester, err := NewBootstrapTester(ctx)
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	if err := tester.EnableGitMirrors(); err != nil {
+		t.Fatalf("EnableGitMirrors() error = %v", err)
+	}
+
+	// git isn't run to set up the mirror, or to check out without it
+	git := tester.MustMock(t, "git")
+	git.Expect().NotCalled()
+
+	err = tester.Run(t)
+	if err == nil {
+		t.Fatalf("tester.Run() error = nil, want the checkout to fail\noutput:\n%s", tester.Output)
+	}
+	if want := "native-git experiment doesn't support this checkout: it uses git mirrors"; !strings.Contains(tester.Output, want) {
+		t.Errorf("tester.Output doesn't contain %q\noutput:\n%s", want, tester.Output)
+	}
+	tester.CheckMocks(t)
+}
+
 func TestCheckingOutLocalGitProject(t *testing.T) {
 	t.Parallel()
 
@@ -275,6 +346,114 @@ func TestCheckingOutShallowCloneOfLocalGitProject(t *testing.T) {
 	tester.RunAndCheck(t, env...)
 }
 
+// addSparseCheckoutDirs commits files in a couple of directories to the test
+// repository, for testing sparse checkouts.
+func addSparseCheckoutDirs(t *testing.T, repo *gitRepository) {
+	t.Helper()
+
+	for _, name := range []string{"docs/index.md", "src/main.go"} {
+		path := filepath.Join(repo.Path, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatalf("os.MkdirAll(%q) error = %v", filepath.Dir(path), err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0o600); err != nil {
+			t.Fatalf("os.WriteFile(%q) error = %v", path, err)
+		}
+		if err := repo.Add(name); err != nil {
+			t.Fatalf("repo.Add(%q) error = %v", name, err)
+		}
+	}
+	if err := repo.Commit("Add docs and src"); err != nil {
+		t.Fatalf("repo.Commit(...) error = %v", err)
+	}
+}
+
+func TestCheckingOutSparseCheckoutOfLocalGitProject(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester(mainCtx)
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	addSparseCheckoutDirs(t, tester.Repo)
+
+	env := []string{
+		"BUILDKITE_GIT_CLONE_FLAGS=-v",
+		"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
+		"BUILDKITE_GIT_FETCH_FLAGS=-v",
+		"BUILDKITE_GIT_SPARSE_CHECKOUT_PATHS=docs",
+		"BUILDKITE_GIT_CLONE_FILTER=blob:none",
+	}
+
+	// Actually execute git commands, but with expectations
+	git := tester.
+		MustMock(t, "git").
+		PassthroughToLocalCommand()
+
+	// But assert which ones are called
+	git.ExpectAll([][]any{
+		{"clone", "-v", "--filter", "blob:none", "--no-checkout", "--", tester.Repo.Path, "."},
+		{"sparse-checkout", "set", "--cone", "docs"},
+		{"clean", "-fdq"},
+		{"fetch", "-v", "--", "origin", "main"},
+		{"checkout", "-f", "FETCH_HEAD"},
+		{"clean", "-fdq"},
+		{"--no-pager", "log", "-1", "HEAD", "-s", "--no-color", gitShowFormatArg},
+	})
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MockAgent(t)
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(1)
+	agent.Expect("meta-data", "set", "buildkite:git:commit").WithStdin(commitPattern)
+
+	tester.RunAndCheck(t, env...)
+
+	for _, name := range []string{"test.txt", "docs/index.md"} {
+		if _, err := os.Stat(filepath.Join(tester.CheckoutDir(), filepath.FromSlash(name))); err != nil {
+			t.Errorf("os.Stat(%s) error = %v, want it to be checked out", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tester.CheckoutDir(), "src")); !os.IsNotExist(err) {
+		t.Errorf("os.Stat(src) error = %v, want it not to be checked out", err)
+	}
+}
+
+func TestCheckingOutRestoresFullCheckoutAfterSparseCheckout(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester(mainCtx)
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	addSparseCheckoutDirs(t, tester.Repo)
+
+	// Create an existing sparse checkout
+	if out, err := tester.Repo.Execute("clone", "--no-checkout", "--", tester.Repo.Path, tester.CheckoutDir()); err != nil {
+		t.Fatalf("tester.Repo.Execute(clone, ...) error = %v\nout = %s", err, out)
+	}
+	checkout := &gitRepository{Path: tester.CheckoutDir()}
+	if out, err := checkout.Execute("sparse-checkout", "set", "--cone", "docs"); err != nil {
+		t.Fatalf("checkout.Execute(sparse-checkout, set, ...) error = %v\nout = %s", err, out)
+	}
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MockAgent(t)
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(0)
+
+	tester.RunAndCheck(t)
+
+	if !strings.Contains(tester.Output, "Restoring the full checkout") {
+		t.Errorf(`tester.Output does not contain "Restoring the full checkout"`)
+	}
+	if _, err := os.Stat(filepath.Join(tester.CheckoutDir(), "src", "main.go")); err != nil {
+		t.Errorf("os.Stat(src/main.go) error = %v, want it to be checked out", err)
+	}
+}
+
 func TestCheckingOutLocalGitProjectWithShortCommitHash(t *testing.T) {
 	t.Parallel()
 
@@ -434,13 +613,13 @@ func TestFetchErrorIsRetried(t *testing.T) {
 		MustMock(t, "git").
 		PassthroughToLocalCommand()
 
-	// But assert which ones are called
+	// But assert which ones are called. Removing the stale lock file is
+	// enough to recover the checkout, so it isn't cloned again.
 	git.ExpectAll([][]any{
 		{"remote", "get-url", "origin"},
 		{"clean", "-ffxdq"},
 		{"fetch", "-v", "--prune", "--depth=1", "--", "origin", "main"},
-		{"clone", "-v", "--depth=1", "--", tester.Repo.Path, "."},
-		{"clean", "-ffxdq"},
+		{"fsck", "--connectivity-only", "--no-dangling"},
 		{"fetch", "-v", "--prune", "--depth=1", "--", "origin", "main"},
 		{"checkout", "-f", "FETCH_HEAD"},
 		{"clean", "-ffxdq"},
@@ -453,6 +632,111 @@ func TestFetchErrorIsRetried(t *testing.T) {
 	agent.Expect("meta-data", "set", "buildkite:git:commit").WithStdin(commitPattern)
 
 	tester.RunAndCheck(t, env...)
+
+	if _, err := os.Stat(lockFilePath); !os.IsNotExist(err) {
+		t.Errorf("os.Stat(%q) error = %v, want the stale lock file to be removed", lockFilePath, err)
+	}
+}
+
+// corruptCheckout clones the repository into the checkout dir, then points
+// the remote's refs at an object that doesn't exist, so that fetching into
+// the checkout fails with "bad object".
+func corruptCheckout(t *testing.T, tester *ExecutorTester) {
+	t.Helper()
+
+	if err := os.MkdirAll(tester.CheckoutDir(), 0o755); err != nil {
+		t.Fatalf("os.MkdirAll(%q) error = %v", tester.CheckoutDir(), err)
+	}
+	cmd := exec.Command("git", "clone", "-v", "--", tester.Repo.Path, ".")
+	cmd.Dir = tester.CheckoutDir()
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git clone error = %v\nout = %s", err, out)
+	}
+
+	// git update-ref checks that the object exists, so write the ref directly.
+	// Loose refs take precedence over packed ones.
+	ref := filepath.Join(tester.CheckoutDir(), ".git", "refs", "remotes", "origin", "main")
+	if err := os.MkdirAll(filepath.Dir(ref), 0o755); err != nil {
+		t.Fatalf("os.MkdirAll(%q) error = %v", filepath.Dir(ref), err)
+	}
+	if err := os.WriteFile(ref, []byte("0000000000000000000000000000000000000001\n"), 0o644); err != nil {
+		t.Fatalf("os.WriteFile(%q) error = %v", ref, err)
+	}
+}
+
+func TestCheckingOutRecoversCorruptCheckout(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester(mainCtx)
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	corruptCheckout(t, tester)
+
+	statsd, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.ListenPacket(udp, 127.0.0.1:0) error = %v", err)
+	}
+	defer statsd.Close()
+
+	env := []string{
+		"BUILDKITE_GIT_CLONE_FLAGS=-v",
+		"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
+		"BUILDKITE_GIT_FETCH_FLAGS=-v",
+		"BUILDKITE_METRICS_DATADOG=true",
+		"BUILDKITE_METRICS_DATADOG_HOST=" + statsd.LocalAddr().String(),
+	}
+
+	// Actually execute git commands, but with expectations
+	git := tester.
+		MustMock(t, "git").
+		PassthroughToLocalCommand()
+
+	// Repairing can't recover the checkout, so it's cloned again
+	git.ExpectAll([][]any{
+		{"remote", "get-url", "origin"},
+		{"clean", "-fdq"},
+		{"fetch", "-v", "--", "origin", "main"},
+		{"fsck", "--connectivity-only", "--no-dangling"},
+		{"clone", "-v", "--", tester.Repo.Path, "."},
+		{"clean", "-fdq"},
+		{"fetch", "-v", "--", "origin", "main"},
+		{"checkout", "-f", "FETCH_HEAD"},
+		{"clean", "-fdq"},
+		{"--no-pager", "log", "-1", "HEAD", "-s", "--no-color", gitShowFormatArg},
+	})
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MockAgent(t)
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(1)
+	agent.Expect("meta-data", "set", "buildkite:git:commit").WithStdin(commitPattern)
+
+	tester.RunAndCheck(t, env...)
+
+	// Each recovery step is counted by its result
+	var sent strings.Builder
+	buf := make([]byte, 64*1024)
+	for {
+		if err := statsd.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Fatalf("statsd.SetReadDeadline() error = %v", err)
+		}
+		n, _, err := statsd.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		sent.Write(buf[:n])
+		sent.WriteByte('\n')
+	}
+	for _, want := range []string{
+		`buildkite\.checkout\.recovery:1\|c\|#.*(result:failure,.*step:repair|step:repair,.*result:failure)`,
+		`buildkite\.checkout\.recovery:1\|c\|#.*(result:success,.*step:clone|step:clone,.*result:success)`,
+	} {
+		if !regexp.MustCompile(want).MatchString(sent.String()) {
+			t.Errorf("metrics sent to DogStatsD = %q, want a line matching %q", sent.String(), want)
+		}
+	}
 }
 
 func TestCheckingOutSetsCorrectGitMetadataAndSendsItToBuildkite(t *testing.T) {
@@ -0,0 +1,45 @@
+package job
+
+import (
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/metrics"
+)
+
+// startMetrics starts sending metrics to DogStatsD, if the agent that started
+// the job is configured to. The metrics are tagged the same way as the agent's
+// own job metrics. It returns a function that stops sending metrics.
+func (e *Executor) startMetrics() func() {
+	if !e.ExecutorConfig.MetricsDatadog {
+		return func() {}
+	}
+
+	// The collector's own logging would only clutter the job log.
+	mc := metrics.NewCollector(logger.Discard, metrics.CollectorConfig{
+		Datadog:              e.ExecutorConfig.MetricsDatadog,
+		DatadogHost:          e.ExecutorConfig.MetricsDatadogHost,
+		DatadogDistributions: e.ExecutorConfig.MetricsDatadogDistributions,
+	})
+	if err := mc.Start(); err != nil {
+		e.shell.Warningf("Couldn't start sending metrics: %v", err)
+		return func() {}
+	}
+
+	tags := metrics.Tags{}
+	for tag, name := range map[string]string{
+		"agent_name": "BUILDKITE_AGENT_NAME",
+		"pipeline":   "BUILDKITE_PIPELINE_SLUG",
+		"org":        "BUILDKITE_ORGANIZATION_SLUG",
+		"branch":     "BUILDKITE_BRANCH",
+		"source":     "BUILDKITE_SOURCE",
+		"queue":      "BUILDKITE_AGENT_META_DATA_QUEUE",
+	} {
+		tags[tag], _ = e.shell.Env.Get(name)
+	}
+	e.metrics = mc.Scope(tags)
+
+	return func() {
+		if err := mc.Stop(); err != nil {
+			e.shell.Warningf("Couldn't stop sending metrics: %v", err)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package redact
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"strings"
+)
+
+// shellSpecial are the bytes that are backslash-escaped by printf %q style
+// shell quoting.
+const shellSpecial = " \t!\"#$&'()*,;<=>?[\\]^`{|}~"
+
+// EncodedForms returns the common encodings of value that might appear in
+// output instead of value itself: base64 (standard and URL alphabets),
+// percent-encoding, JSON string escaping, and shell quoting. Forms identical
+// to value, or shorter than LengthMin, are omitted.
+//
+// A base64 encoding of value depends on the bytes around it when it is part
+// of a larger input, so there is a base64 form for each of the 3 possible
+// alignments of value within the input's 3-byte groups. Each covers only the
+// base64 characters that depend on value alone, so a character or two at
+// each end of value may remain visible (in encoded form).
+func EncodedForms(value string) []string {
+	forms := make(map[string]struct{})
+	add := func(form string) {
+		if form != value && len(form) >= LengthMin {
+			forms[form] = struct{}{}
+		}
+	}
+
+	for offset := 0; offset < 3; offset++ {
+		add(alignedBase64(base64.StdEncoding, value, offset))
+		add(alignedBase64(base64.URLEncoding, value, offset))
+	}
+
+	add(url.QueryEscape(value))
+	add(url.PathEscape(value))
+
+	if b, err := json.Marshal(value); err == nil {
+		add(strings.TrimSuffix(strings.TrimPrefix(string(b), `"`), `"`))
+	}
+
+	// Within single quotes, a single quote is written as '\''.
+	add(strings.ReplaceAll(value, `'`, `'\''`))
+
+	// Outside quotes, special characters are escaped with a backslash.
+	var escaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		if strings.IndexByte(shellSpecial, value[i]) >= 0 {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteByte(value[i])
+	}
+	add(escaped.String())
+
+	out := make([]string, 0, len(forms))
+	for form := range forms {
+		out = append(out, form)
+	}
+	return out
+}
+
+// alignedBase64 returns the part of the base64 encoding of value that doesn't
+// depend on the bytes around it, when value starts offset bytes into a 3-byte
+// group of a larger input.
+func alignedBase64(enc *base64.Encoding, value string, offset int) string {
+	// Stand in zeroes for the bytes around value, then drop the characters
+	// that they affect.
+	n := offset + len(value)
+	padded := make([]byte, (n+2)/3*3)
+	copy(padded[offset:], value)
+	encoded := enc.EncodeToString(padded)
+
+	// Each group of 3 bytes is encoded as 4 characters of 6 bits each, so 1
+	// leading byte affects 2 characters, and 2 leading bytes affect 3.
+	// Similarly, 1 trailing byte affects 2 characters, and 2 affect 3.
+	start := []int{0, 2, 3}[offset]
+	end := len(encoded) - []int{0, 3, 2}[n%3]
+	if start >= end {
+		return ""
+	}
+	return encoded[start:end]
+}
+
+// WithEncodedForms returns values along with the encoded forms of each value.
+func WithEncodedForms(values []string) []string {
+	out := make([]string, 0, len(values))
+	for _, v := range values {
+		out = append(out, v)
+		out = append(out, EncodedForms(v)...)
+	}
+	return out
+}
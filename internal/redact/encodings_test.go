@@ -0,0 +1,122 @@
+package redact
+
+import (
+	"encoding/base64"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestEncodedForms(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc    string
+		value   string
+		want    []string
+		notWant []string
+	}{
+		{
+			desc:  "base64 standard and URL alphabets",
+			value: "\xfb\xff\xbf\xfb\xff\xbf",
+			want:  []string{"+/+/+/+/", "-_-_-_-_", "v/v/v/v", "7_7_7_7"},
+		},
+		{
+			desc:  "base64 at each alignment",
+			value: "hunter22",
+			want: []string{
+				"aHVudGVyMj", // hunter22
+				"h1bnRlcjIy", // ?hunter22
+				"odW50ZXIyM", // ??hunter22
+			},
+		},
+		{
+			desc:  "percent-encoding",
+			value: "pa ss&word=1",
+			want:  []string{"pa+ss%26word%3D1", "pa%20ss&word=1"},
+		},
+		{
+			desc:  "JSON escaping",
+			value: "pa\"ss\\wo\nrd",
+			want:  []string{`pa\"ss\\wo\nrd`},
+		},
+		{
+			desc:  "shell quoting",
+			value: "it's a secret",
+			want:  []string{`it'\''s a secret`, `it\'s\ a\ secret`},
+		},
+		{
+			desc:    "forms identical to the value are omitted",
+			value:   "hunter2hunter2",
+			notWant: []string{"hunter2hunter2"},
+		},
+		{
+			desc:    "forms that are too short are omitted",
+			value:   "abcd",
+			notWant: []string{"YWJj", "YmNk"},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			forms := EncodedForms(test.value)
+			for _, want := range test.want {
+				if !slices.Contains(forms, want) {
+					t.Errorf("EncodedForms(%q) = %q, want it to contain %q", test.value, forms, want)
+				}
+			}
+			for _, notWant := range test.notWant {
+				if slices.Contains(forms, notWant) {
+					t.Errorf("EncodedForms(%q) = %q, want it not to contain %q", test.value, forms, notWant)
+				}
+			}
+			for _, form := range forms {
+				if len(form) < LengthMin {
+					t.Errorf("EncodedForms(%q) contains %q, shorter than LengthMin (%d)", test.value, form, LengthMin)
+				}
+			}
+		})
+	}
+}
+
+// A secret embedded in a larger input is only found in the input's base64
+// encoding at whatever alignment it happens to have, so some form must match
+// at every alignment.
+func TestEncodedFormsFindsUnalignedBase64(t *testing.T) {
+	t.Parallel()
+
+	encodings := map[string]*base64.Encoding{
+		"std": base64.StdEncoding,
+		"url": base64.URLEncoding,
+	}
+
+	for _, secret := range []string{"hunter2", "s3cr3t!", "\xfb\xff\xbf\xfb\xff\xbf\xfb"} {
+		forms := EncodedForms(secret)
+		for name, enc := range encodings {
+			for _, prefix := range []string{"", "a", "ab"} {
+				encoded := enc.EncodeToString([]byte(prefix + secret + " trailing"))
+
+				found := slices.ContainsFunc(forms, func(form string) bool {
+					return strings.Contains(encoded, form)
+				})
+				if !found {
+					t.Errorf("%s base64 of %q = %q, which contains none of EncodedForms(%q) = %q", name, prefix+secret+" trailing", encoded, secret, forms)
+				}
+			}
+		}
+	}
+}
+
+func TestWithEncodedForms(t *testing.T) {
+	t.Parallel()
+
+	got := WithEncodedForms([]string{"hunter2", "it's a secret"})
+	for _, want := range []string{"hunter2", "it's a secret", "aHVudGVyM", `it\'s\ a\ secret`} {
+		if !slices.Contains(got, want) {
+			t.Errorf("WithEncodedForms(...) = %q, want it to contain %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package redact
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/buildkite/agent/v3/internal/replacer"
+	"golang.org/x/exp/maps"
+)
+
+// Detectors are built-in patterns for well-known kinds of secret, which can
+// be found in the job output without them having passed through the
+// environment.
+var Detectors = map[string]replacer.Pattern{
+	"aws-access-key-id": {
+		Match: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`),
+	},
+	"buildkite-api-token": {
+		Match: regexp.MustCompile(`\bbkua_[0-9a-f]{40}\b`),
+	},
+	"github-token": {
+		Match: regexp.MustCompile(`\b(?:gh[opsur]_[A-Za-z0-9]{36,255}|github_pat_[A-Za-z0-9_]{22,255})\b`),
+	},
+	"jwt": {
+		Match: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{5,}\.eyJ[A-Za-z0-9_-]{5,}\.[A-Za-z0-9_-]{10,}`),
+	},
+	"pem-private-key": {
+		Match:    regexp.MustCompile(`-----BEGIN [A-Z0-9 ]*PRIVATE KEY-----`),
+		BlockEnd: regexp.MustCompile(`-----END [A-Z0-9 ]*PRIVATE KEY-----`),
+	},
+	"slack-token": {
+		Match: regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}`),
+	},
+}
+
+// Patterns returns the patterns to redact, given the names of built-in
+// detectors (or "all" for every detector) and custom regular expressions.
+func Patterns(detectors, expressions []string) ([]replacer.Pattern, error) {
+	var patterns []replacer.Pattern
+
+	for _, name := range detectors {
+		if name == "all" {
+			names := maps.Keys(Detectors)
+			sort.Strings(names)
+			for _, n := range names {
+				patterns = append(patterns, Detectors[n])
+			}
+			continue
+		}
+
+		p, ok := Detectors[name]
+		if !ok {
+			names := maps.Keys(Detectors)
+			sort.Strings(names)
+			return nil, fmt.Errorf("unknown redaction detector %q (available detectors: all, %s)", name, strings.Join(names, ", "))
+		}
+		patterns = append(patterns, p)
+	}
+
+	for _, expr := range expressions {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redacted pattern %q: %w", expr, err)
+		}
+		patterns = append(patterns, replacer.Pattern{Match: re})
+	}
+
+	return patterns, nil
+}
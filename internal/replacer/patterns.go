@@ -0,0 +1,217 @@
+package replacer
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// maxPatternLine is the longest line that patterns are matched against.
+// Longer lines are matched in pieces of this size, so a secret straddling
+// the boundary between two pieces won't be found.
+const maxPatternLine = 64 * 1024
+
+// A partial line that hasn't been added to for this long is written out
+// without waiting for the rest of the line, so that prompts (such as
+// "Password: ") appear. A secret split by such a pause won't be found.
+const partialLineTimeout = 200 * time.Millisecond
+
+// A multi-line secret that hasn't ended after this many lines or bytes
+// probably never will (for example, a truncated key, or a tool that only
+// printed the header), so output resumes rather than being suppressed until
+// the end of the job.
+const (
+	maxBlockLines = 100
+	maxBlockBytes = 64 * 1024
+)
+
+// Pattern describes secrets to search for by their content, rather than by
+// their exact value.
+type Pattern struct {
+	// Match finds secrets within a single line.
+	Match *regexp.Regexp
+
+	// BlockEnd, if set, makes Match the start of a multi-line secret (such as
+	// a PEM block), which continues up to and including the next match of
+	// BlockEnd. The whole block is replaced at once.
+	BlockEnd *regexp.Regexp
+}
+
+// patternWriter is a streaming writer that replaces content matching patterns.
+// Because regular expressions can't be evaluated incrementally, it buffers
+// output a line at a time (treating both \n and \r as ending a line, so that
+// progress bars still flow), and matches patterns against whole lines. If
+// output pauses partway through a line, the partial line is written out.
+type patternWriter struct {
+	mu sync.Mutex
+
+	dst         io.Writer
+	patterns    []Pattern
+	replacement func([]byte) []byte
+
+	// Partial line waiting for a line ending, and the timer that writes it
+	// out if the line ending is slow to arrive.
+	buf   []byte
+	timer *time.Timer
+
+	// The end of the multi-line secret currently being suppressed, if any,
+	// and how much of it has been suppressed so far.
+	blockEnd   *regexp.Regexp
+	blockLines int
+	blockBytes int
+}
+
+func newPatternWriter(dst io.Writer, patterns []Pattern, replacement func([]byte) []byte) *patternWriter {
+	return &patternWriter{
+		dst:         dst,
+		patterns:    patterns,
+		replacement: replacement,
+	}
+}
+
+// Write buffers b, and writes out every complete line with any secrets
+// replaced.
+func (w *patternWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, b...)
+	for {
+		i := bytes.IndexAny(w.buf, "\r\n")
+		if i < 0 {
+			if len(w.buf) < maxPatternLine {
+				break
+			}
+			i = maxPatternLine - 1
+		}
+		if err := w.writeLine(w.buf[:i+1]); err != nil {
+			return len(b), err
+		}
+		w.buf = w.buf[i+1:]
+	}
+
+	// Don't hold on to a large underlying array once it's been written out.
+	if len(w.buf) == 0 {
+		w.buf = nil
+		w.stopTimer()
+		return len(b), nil
+	}
+
+	if w.timer == nil {
+		w.timer = time.AfterFunc(partialLineTimeout, w.flushPartialLine)
+	} else {
+		w.timer.Reset(partialLineTimeout)
+	}
+	return len(b), nil
+}
+
+// flushPartialLine writes out a partial line that has been waiting for its
+// line ending for too long.
+func (w *patternWriter) flushPartialLine() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Within a multi-line secret, the partial line is only suppressed, and the
+	// block's end might be split across it, so wait for the rest.
+	if len(w.buf) == 0 || w.blockEnd != nil {
+		return
+	}
+	// There's nowhere to report an error, but the next Write will likely
+	// return the same one.
+	_ = w.writeLine(w.buf)
+	w.buf = nil
+}
+
+// stopTimer stops the partial line timer, if it's running. w.mu must be held.
+func (w *patternWriter) stopTimer() {
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
+
+// Flush writes out any partial line. It assumes there is no more data in the
+// stream.
+func (w *patternWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Nothing more is coming, so any multi-line secret has ended.
+	defer func() { w.blockEnd = nil }()
+	w.stopTimer()
+
+	if len(w.buf) == 0 {
+		return nil
+	}
+	err := w.writeLine(w.buf)
+	w.buf = nil
+	return err
+}
+
+// writeLine replaces secrets in line and writes it to dst. w.mu must be held.
+func (w *patternWriter) writeLine(line []byte) error {
+	var out []byte
+
+	// Continue suppressing a multi-line secret, until the end of the block.
+	if w.blockEnd != nil {
+		if loc := w.blockEnd.FindIndex(line); loc != nil {
+			w.blockEnd = nil
+			line = line[loc[1]:]
+		} else {
+			w.blockLines++
+			w.blockBytes += len(line)
+			if w.blockLines <= maxBlockLines && w.blockBytes <= maxBlockBytes {
+				return nil
+			}
+			// Give up on the block ending, and resume output from this line.
+			// The start of the block has already been replaced.
+			w.blockEnd = nil
+			out = append(out, '\n')
+		}
+	}
+
+	for len(line) > 0 {
+		// Find the earliest match of any of the patterns.
+		var (
+			first []int
+			match Pattern
+		)
+		for _, p := range w.patterns {
+			loc := p.Match.FindIndex(line)
+			if loc == nil || loc[0] == loc[1] {
+				continue
+			}
+			if first == nil || loc[0] < first[0] {
+				first, match = loc, p
+			}
+		}
+		if first == nil {
+			out = append(out, line...)
+			break
+		}
+
+		out = append(out, line[:first[0]]...)
+		out = append(out, w.replacement(line[first[0]:first[1]])...)
+		line = line[first[1]:]
+
+		if match.BlockEnd == nil {
+			continue
+		}
+
+		// The block might also end on this line.
+		loc := match.BlockEnd.FindIndex(line)
+		if loc == nil {
+			w.blockEnd = match.BlockEnd
+			w.blockLines, w.blockBytes = 0, 0
+			break
+		}
+		line = line[loc[1]:]
+	}
+
+	if len(out) == 0 {
+		return nil
+	}
+	_, err := w.dst.Write(out)
+	return err
+}
@@ -31,6 +31,10 @@ type Replacer struct {
 	// Output re-streamed to this writer.
 	dst io.Writer
 
+	// If there are patterns to search for, dst is a patternWriter that
+	// forwards to the original destination, and must also be flushed.
+	patterns *patternWriter
+
 	// Intermediate buffer to account for partially-written data.
 	buf []byte
 
@@ -79,6 +83,21 @@ func New(dst io.Writer, needles []string, replacement func([]byte) []byte) *Repl
 	return r
 }
 
+// NewWithPatterns returns a new Replacer that, in addition to searching for
+// needles, searches each line of output for content matching any of the
+// patterns, and calls replacement for each match. Unlike needles, patterns
+// can only be matched once a whole line has been written, so output is
+// forwarded to dst a line at a time (or a partial line, once output pauses).
+func NewWithPatterns(dst io.Writer, needles []string, patterns []Pattern, replacement func([]byte) []byte) *Replacer {
+	if len(patterns) == 0 {
+		return New(dst, needles, replacement)
+	}
+	pw := newPatternWriter(dst, patterns, replacement)
+	r := New(pw, needles, replacement)
+	r.patterns = pw
+	return r
+}
+
 // Write searches the stream for needles (strings, secrets, ...), calls the
 // replacement callback to obtain any replacements, and forwards the output to
 // the destination writer.
@@ -196,7 +215,13 @@ func (r *Replacer) Flush() error {
 	// Since there is no more incoming data, any remaining partial matches
 	// cannot complete.
 	r.partialMatches = r.partialMatches[:0]
-	return r.flushUpTo(len(r.buf))
+	if err := r.flushUpTo(len(r.buf)); err != nil {
+		return err
+	}
+	if r.patterns != nil {
+		return r.patterns.Flush()
+	}
+	return nil
 }
 
 // flush writes out the buffer up to an index. limit is an upper limit.
@@ -72,6 +72,16 @@ func NewClient(ctx context.Context, path, token string) (*Client, error) {
 	}, nil
 }
 
+// NewHTTPClient creates a new Client that makes requests with an ordinary HTTP
+// client instead of dialling a socket. This allows the same JSON APIs to be
+// used across the network. If cli is nil, http.DefaultClient is used.
+func NewHTTPClient(cli *http.Client, token string) *Client {
+	if cli == nil {
+		cli = http.DefaultClient
+	}
+	return &Client{cli: cli, token: token}
+}
+
 // Do implements the common bits of an API call. req is serialised to JSON and
 // passed as the request body if not nil. The method is called, with the token
 // added in the Authorization header. The response is deserialised, either into
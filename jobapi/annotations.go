@@ -0,0 +1,54 @@
+package jobapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/go-chi/chi/v5"
+)
+
+// maxAnnotationBodySize is the largest annotation body the Agent API accepts.
+const maxAnnotationBodySize = 1024 * 1024
+
+func (s *Server) createAnnotation(w http.ResponseWriter, r *http.Request) {
+	var req AnnotationRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	defer r.Body.Close()
+	if err != nil {
+		s.writeError(w, fmt.Errorf("failed to decode request body: %w", err), http.StatusBadRequest)
+		return
+	}
+
+	if bodySize := len(req.Body); bodySize > maxAnnotationBodySize {
+		s.writeError(w, fmt.Sprintf("annotation body size (%dB) exceeds maximum (%dB)", bodySize, maxAnnotationBodySize), http.StatusUnprocessableEntity)
+		return
+	}
+
+	annotation := &api.Annotation{
+		Body:    req.Body,
+		Context: req.Context,
+		Style:   req.Style,
+		Append:  req.Append,
+	}
+	resp, err := s.apiClient.Annotate(r.Context(), s.jobID, annotation)
+	if err != nil {
+		s.writeAPIError(w, "creating annotation", resp, err)
+		return
+	}
+
+	s.writeResponse(w, AnnotationResponse{Context: req.Context})
+}
+
+func (s *Server) removeAnnotation(w http.ResponseWriter, r *http.Request) {
+	annotationContext := chi.URLParam(r, "context")
+
+	resp, err := s.apiClient.AnnotationRemove(r.Context(), s.jobID, annotationContext)
+	if err != nil {
+		s.writeAPIError(w, fmt.Sprintf("removing annotation with context %q", annotationContext), resp, err)
+		return
+	}
+
+	s.writeResponse(w, AnnotationResponse{Context: annotationContext})
+}
@@ -0,0 +1,67 @@
+package jobapi_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/jobapi"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestAnnotations(t *testing.T) {
+	t.Parallel()
+
+	fake := newFakeAPIClient()
+	srv, token := testServerWithAPIClient(t, fake)
+	client := testSocketClient(srv.SocketPath)
+
+	testAPI(t, nil, newAPIRequest(t, token, http.MethodPost, "/annotations", jobapi.AnnotationRequest{
+		Body:    "Reached base camp",
+		Context: "climb",
+		Style:   "info",
+	}), client, apiTestCase[any, jobapi.AnnotationResponse]{
+		expectedStatus:       http.StatusOK,
+		expectedResponseBody: &jobapi.AnnotationResponse{Context: "climb"},
+	})
+
+	testAPI(t, nil, newAPIRequest(t, token, http.MethodPost, "/annotations", jobapi.AnnotationRequest{
+		Body:    ", then the summit",
+		Context: "climb",
+		Append:  true,
+	}), client, apiTestCase[any, jobapi.AnnotationResponse]{
+		expectedStatus:       http.StatusOK,
+		expectedResponseBody: &jobapi.AnnotationResponse{Context: "climb"},
+	})
+
+	want := map[string]*api.Annotation{
+		"climb": {Body: "Reached base camp, then the summit", Context: "climb", Style: "info"},
+	}
+	if diff := cmp.Diff(fake.annotations, want); diff != "" {
+		t.Errorf("annotations diff (-got +want):\n%s", diff)
+	}
+
+	testAPI(t, nil, newAPIRequest(t, token, http.MethodDelete, "/annotations/climb", nil), client, apiTestCase[any, jobapi.AnnotationResponse]{
+		expectedStatus:       http.StatusOK,
+		expectedResponseBody: &jobapi.AnnotationResponse{Context: "climb"},
+	})
+
+	testAPI(t, nil, newAPIRequest(t, token, http.MethodDelete, "/annotations/climb", nil), client, apiTestCase[any, any]{
+		expectedStatus: http.StatusNotFound,
+		expectedError:  &jobapi.ErrorResponse{Error: `removing annotation with context "climb": not found`},
+	})
+}
+
+func TestAnnotations_BodyTooLarge(t *testing.T) {
+	t.Parallel()
+
+	srv, token := testServerWithAPIClient(t, newFakeAPIClient())
+
+	body := make([]byte, 1024*1024+1)
+	testAPI(t, nil, newAPIRequest(t, token, http.MethodPost, "/annotations", jobapi.AnnotationRequest{
+		Body: string(body),
+	}), testSocketClient(srv.SocketPath), apiTestCase[any, any]{
+		expectedStatus: http.StatusUnprocessableEntity,
+		expectedError:  &jobapi.ErrorResponse{Error: "annotation body size (1048577B) exceeds maximum (1048576B)"},
+	})
+}
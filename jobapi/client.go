@@ -3,12 +3,20 @@ package jobapi
 import (
 	"context"
 	"errors"
+	"net/url"
 	"os"
 
 	"github.com/buildkite/agent/v3/internal/socket"
 )
 
-const envURL = "http://job/api/current-job/v0/env"
+const (
+	envURL         = "http://job/api/current-job/v0/env"
+	metaDataURL    = "http://job/api/current-job/v0/meta-data"
+	annotationsURL = "http://job/api/current-job/v0/annotations"
+	stepURL        = "http://job/api/current-job/v0/step"
+	logURL         = "http://job/api/current-job/v0/log"
+	redactionsURL  = "http://job/api/current-job/v0/redactions"
+)
 
 // Client connects to the Job API.
 type Client struct {
@@ -79,3 +87,79 @@ func (c *Client) EnvDelete(ctx context.Context, del []string) (deleted []string,
 	resp.Normalize()
 	return resp.Deleted, nil
 }
+
+// MetaDataKeys lists the meta-data keys set on the current build.
+func (c *Client) MetaDataKeys(ctx context.Context) ([]string, error) {
+	var resp MetaDataKeysResponse
+	if err := c.client.Do(ctx, "GET", metaDataURL, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Keys, nil
+}
+
+// MetaDataGet gets the value of a meta-data key on the current build.
+func (c *Client) MetaDataGet(ctx context.Context, key string) (string, error) {
+	var resp MetaDataResponse
+	if err := c.client.Do(ctx, "GET", metaDataURL+"/"+url.PathEscape(key), nil, &resp); err != nil {
+		return "", err
+	}
+	return resp.Value, nil
+}
+
+// MetaDataSet sets the value of a meta-data key on the current build.
+func (c *Client) MetaDataSet(ctx context.Context, key, value string) error {
+	req := MetaDataSetRequest{Value: value}
+	return c.client.Do(ctx, "PUT", metaDataURL+"/"+url.PathEscape(key), &req, nil)
+}
+
+// Annotate creates an annotation on the current build, or appends to an
+// existing one if req.Append is set.
+func (c *Client) Annotate(ctx context.Context, req *AnnotationRequest) error {
+	return c.client.Do(ctx, "POST", annotationsURL, req, nil)
+}
+
+// AnnotationRemove removes the annotation with the given context from the
+// current build.
+func (c *Client) AnnotationRemove(ctx context.Context, annotationContext string) error {
+	return c.client.Do(ctx, "DELETE", annotationsURL+"/"+url.PathEscape(annotationContext), nil, nil)
+}
+
+// StepGet gets an attribute of a step, which can be identified by ID or key.
+// An empty format returns the attribute as a string, or "json" returns it
+// JSON-encoded.
+func (c *Client) StepGet(ctx context.Context, key, attribute, format string) (string, error) {
+	query := url.Values{}
+	if attribute != "" {
+		query.Set("attribute", attribute)
+	}
+	if format != "" {
+		query.Set("format", format)
+	}
+	u := stepURL + "/" + url.PathEscape(key)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var resp StepGetResponse
+	if err := c.client.Do(ctx, "GET", u, nil, &resp); err != nil {
+		return "", err
+	}
+	return resp.Output, nil
+}
+
+// StepUpdate changes an attribute of a step, which can be identified by ID or
+// key.
+func (c *Client) StepUpdate(ctx context.Context, key string, req *StepUpdateRequest) error {
+	return c.client.Do(ctx, "PUT", stepURL+"/"+url.PathEscape(key), req, nil)
+}
+
+// LogAppend writes a group header, comment or body into the job log.
+func (c *Client) LogAppend(ctx context.Context, req *LogAppendRequest) error {
+	return c.client.Do(ctx, "POST", logURL, req, nil)
+}
+
+// RedactionCreate adds values to redact from the remainder of the job log.
+func (c *Client) RedactionCreate(ctx context.Context, values []string) error {
+	req := RedactionCreateRequest{Values: values}
+	return c.client.Do(ctx, "POST", redactionsURL, &req, nil)
+}
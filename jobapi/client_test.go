@@ -9,6 +9,8 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -18,6 +20,7 @@ import (
 
 type fakeServer struct {
 	env         map[string]string
+	metaData    map[string]string
 	sock, token string
 	svr         *http.Server
 }
@@ -30,6 +33,9 @@ func runFakeServer() (svr *fakeServer, err error) {
 			"YZMA":     "Villain",
 			"READONLY": "Should never change",
 		},
+		metaData: map[string]string{
+			"PALACE": "Yzma's lab",
+		},
 		sock:  filepath.Join(os.TempDir(), fmt.Sprintf("testsocket-%d-%x", os.Getpid(), rand.Int())),
 		token: "to_the_secret_lab",
 	}
@@ -51,6 +57,10 @@ func (f *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		socket.WriteError(w, "invalid Authorization header", http.StatusForbidden)
 		return
 	}
+	if strings.HasPrefix(r.URL.Path, "/api/current-job/v0/meta-data") {
+		f.serveMetaData(w, r)
+		return
+	}
 	if r.URL.Path != "/api/current-job/v0/env" {
 		socket.WriteError(w, fmt.Sprintf("not found: %q", r.URL.Path), http.StatusNotFound)
 		return
@@ -122,6 +132,46 @@ func (f *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (f *fakeServer) serveMetaData(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/current-job/v0/meta-data"), "/")
+
+	switch {
+	case r.Method == "GET" && key == "":
+		resp := MetaDataKeysResponse{Keys: make([]string, 0, len(f.metaData))}
+		for k := range f.metaData {
+			resp.Keys = append(resp.Keys, k)
+		}
+		sort.Strings(resp.Keys)
+		if err := json.NewEncoder(w).Encode(&resp); err != nil {
+			socket.WriteError(w, fmt.Sprintf("encoding response: %v", err), http.StatusInternalServerError)
+		}
+
+	case r.Method == "GET":
+		v, ok := f.metaData[key]
+		if !ok {
+			socket.WriteError(w, fmt.Sprintf("no such key %q", key), http.StatusNotFound)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(&MetaDataResponse{Key: key, Value: v}); err != nil {
+			socket.WriteError(w, fmt.Sprintf("encoding response: %v", err), http.StatusInternalServerError)
+		}
+
+	case r.Method == "PUT":
+		var req MetaDataSetRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			socket.WriteError(w, fmt.Sprintf("decoding request: %v", err), http.StatusBadRequest)
+			return
+		}
+		f.metaData[key] = req.Value
+		if err := json.NewEncoder(w).Encode(&MetaDataResponse{Key: key, Value: req.Value}); err != nil {
+			socket.WriteError(w, fmt.Sprintf("encoding response: %v", err), http.StatusInternalServerError)
+		}
+
+	default:
+		socket.WriteError(w, fmt.Sprintf("unsupported method %q", r.Method), http.StatusBadRequest)
+	}
+}
+
 func TestClient_NoSocket(t *testing.T) {
 	ctx, canc := context.WithTimeout(context.Background(), 10*time.Second)
 	t.Cleanup(canc)
@@ -230,3 +280,45 @@ func TestClientEnvDelete(t *testing.T) {
 		t.Errorf("cli.EnvDelete diff (-got +want):\n%s", diff)
 	}
 }
+
+func TestClientMetaData(t *testing.T) {
+	t.Parallel()
+
+	svr, err := runFakeServer()
+	if err != nil {
+		t.Fatalf("runFakeServer() = %v", err)
+	}
+	defer svr.Close()
+
+	ctx, canc := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(canc)
+
+	cli, err := NewClient(ctx, svr.sock, svr.token)
+	if err != nil {
+		t.Fatalf("NewClient(%q, %q) error = %v", svr.sock, svr.token, err)
+	}
+
+	if err := cli.MetaDataSet(ctx, "GROOVE", "Emperor's New"); err != nil {
+		t.Fatalf("cli.MetaDataSet(GROOVE) error = %v", err)
+	}
+
+	got, err := cli.MetaDataGet(ctx, "GROOVE")
+	if err != nil {
+		t.Fatalf("cli.MetaDataGet(GROOVE) error = %v", err)
+	}
+	if want := "Emperor's New"; got != want {
+		t.Errorf("cli.MetaDataGet(GROOVE) = %q, want %q", got, want)
+	}
+
+	if _, err := cli.MetaDataGet(ctx, "LLAMA"); err == nil {
+		t.Errorf("cli.MetaDataGet(LLAMA) error = nil, want non-nil error")
+	}
+
+	keys, err := cli.MetaDataKeys(ctx)
+	if err != nil {
+		t.Fatalf("cli.MetaDataKeys() error = %v", err)
+	}
+	if diff := cmp.Diff(keys, []string{"GROOVE", "PALACE"}); diff != "" {
+		t.Errorf("cli.MetaDataKeys diff (-got +want):\n%s", diff)
+	}
+}
@@ -0,0 +1,189 @@
+package jobapi_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/internal/job/shell"
+	"github.com/buildkite/agent/v3/jobapi"
+)
+
+const testJobID = "b8a2a4b3-2b5e-4b8f-9c1a-3c4d5e6f7a8b"
+
+// fakeAPIClient implements jobapi.APIClient, storing everything in memory.
+type fakeAPIClient struct {
+	mu          sync.Mutex
+	metaData    map[string]string
+	annotations map[string]*api.Annotation
+	steps       map[string]map[string]string
+}
+
+func newFakeAPIClient() *fakeAPIClient {
+	return &fakeAPIClient{
+		metaData: map[string]string{
+			"volcano": "cotopaxi",
+		},
+		annotations: map[string]*api.Annotation{},
+		steps: map[string]map[string]string{
+			"summit": {"label": ":mountain: Summit"},
+		},
+	}
+}
+
+func notFound() (*api.Response, error) {
+	resp := &api.Response{Response: &http.Response{StatusCode: http.StatusNotFound}}
+	return resp, errors.New("not found")
+}
+
+func (f *fakeAPIClient) GetMetaData(_ context.Context, scope, id, key string) (*api.MetaData, *api.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if scope != "job" || id != testJobID {
+		resp, err := notFound()
+		return nil, resp, err
+	}
+	v, ok := f.metaData[key]
+	if !ok {
+		resp, err := notFound()
+		return nil, resp, err
+	}
+	return &api.MetaData{Key: key, Value: v}, nil, nil
+}
+
+func (f *fakeAPIClient) MetaDataKeys(_ context.Context, scope, id string) ([]string, *api.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if scope != "job" || id != testJobID {
+		resp, err := notFound()
+		return nil, resp, err
+	}
+	keys := make([]string, 0, len(f.metaData))
+	for k := range f.metaData {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil, nil
+}
+
+func (f *fakeAPIClient) SetMetaData(_ context.Context, jobID string, md *api.MetaData) (*api.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if jobID != testJobID {
+		return notFound()
+	}
+	f.metaData[md.Key] = md.Value
+	return nil, nil
+}
+
+func testServerWithAPIClient(t *testing.T, client jobapi.APIClient) (*jobapi.Server, string) {
+	t.Helper()
+
+	sockName, err := jobapi.NewSocketPath(os.TempDir())
+	if err != nil {
+		t.Fatalf("creating socket path: %v", err)
+	}
+
+	srv, token, err := jobapi.NewServer(shell.TestingLogger{T: t}, sockName, testEnviron(), jobapi.WithAPIClient(client, testJobID))
+	if err != nil {
+		t.Fatalf("creating server: %v", err)
+	}
+
+	if err := srv.Start(); err != nil {
+		t.Fatalf("starting server: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := srv.Stop(); err != nil {
+			t.Errorf("stopping server: %v", err)
+		}
+	})
+
+	return srv, token
+}
+
+func (f *fakeAPIClient) Annotate(_ context.Context, jobID string, annotation *api.Annotation) (*api.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if jobID != testJobID {
+		return notFound()
+	}
+	ctx := annotation.Context
+	if ctx == "" {
+		ctx = "default"
+	}
+	if existing, ok := f.annotations[ctx]; ok && annotation.Append {
+		existing.Body += annotation.Body
+		return nil, nil
+	}
+	a := *annotation
+	f.annotations[ctx] = &a
+	return nil, nil
+}
+
+func (f *fakeAPIClient) AnnotationRemove(_ context.Context, jobID, context string) (*api.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.annotations[context]; jobID != testJobID || !ok {
+		return notFound()
+	}
+	delete(f.annotations, context)
+	return nil, nil
+}
+
+func (f *fakeAPIClient) StepExport(_ context.Context, key string, req *api.StepExportRequest) (*api.StepExportResponse, *api.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	step, ok := f.steps[key]
+	if !ok {
+		resp, err := notFound()
+		return nil, resp, err
+	}
+	return &api.StepExportResponse{Output: step[req.Attribute]}, nil, nil
+}
+
+func (f *fakeAPIClient) StepUpdate(_ context.Context, key string, update *api.StepUpdate) (*api.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	step, ok := f.steps[key]
+	if !ok {
+		return notFound()
+	}
+	if update.Append {
+		step[update.Attribute] += update.Value
+	} else {
+		step[update.Attribute] = update.Value
+	}
+	return nil, nil
+}
+
+func newAPIRequest(t *testing.T, token, method, path string, body any) *http.Request {
+	t.Helper()
+
+	buf := bytes.NewBuffer(nil)
+	if body != nil {
+		if err := json.NewEncoder(buf).Encode(body); err != nil {
+			t.Fatalf("JSON-encoding body into buf: %v", err)
+		}
+	}
+	req, err := http.NewRequest(method, "http://job/api/current-job/v0"+path, buf)
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	return req
+}
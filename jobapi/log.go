@@ -0,0 +1,90 @@
+package jobapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+func (s *Server) streamLog(w http.ResponseWriter, r *http.Request) {
+	if s.logs == nil {
+		s.writeError(w, "the job log is not available to this Job API server", http.StatusServiceUnavailable)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.writeError(w, "streaming is not supported by this connection", http.StatusInternalServerError)
+		return
+	}
+
+	lines, unsubscribe := s.logs.Subscribe()
+	defer unsubscribe()
+
+	// The log is streamed as server-sent events, one event per line of output.
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-s.done:
+			return
+
+		case line, open := <-lines:
+			if !open {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", line); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func (s *Server) appendLog(w http.ResponseWriter, r *http.Request) {
+	var req LogAppendRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	defer r.Body.Close()
+	if err != nil {
+		s.writeError(w, fmt.Errorf("failed to decode request body: %w", err), http.StatusBadRequest)
+		return
+	}
+
+	if req.Header == "" && req.Comment == "" && req.Body == "" {
+		s.writeError(w, "at least one of header, comment or body must be provided", http.StatusUnprocessableEntity)
+		return
+	}
+
+	// A newline in a header or comment would let the request inject arbitrary
+	// group markers into the log.
+	if strings.ContainsAny(req.Header, "\r\n") || strings.ContainsAny(req.Comment, "\r\n") {
+		s.writeError(w, "header and comment must be a single line", http.StatusUnprocessableEntity)
+		return
+	}
+
+	if req.Header != "" {
+		// "---" starts a collapsed group and "+++" an expanded one, in the
+		// same way as output from commands.
+		marker := "---"
+		if req.Expanded {
+			marker = "+++"
+		}
+		s.Logger.Printf("%s %s", marker, req.Header)
+	}
+	if req.Comment != "" {
+		s.Logger.Commentf("%s", req.Comment)
+	}
+	if req.Body != "" {
+		s.Logger.Printf("%s", strings.TrimSuffix(req.Body, "\n"))
+	}
+
+	s.writeResponse(w, LogAppendResponse{})
+}
@@ -0,0 +1,114 @@
+package jobapi
+
+import (
+	"bytes"
+	"sync"
+)
+
+// logSubscriberBuffer is the number of lines buffered for each subscriber
+// before it is considered too slow and disconnected.
+const logSubscriberBuffer = 1024
+
+// LogBroadcaster is an io.Writer that splits the job log into lines and fans
+// them out to any number of subscribers, such as clients streaming GET /log.
+// Writes never block on subscribers: a subscriber that falls too far behind is
+// disconnected, so that a slow client can't hold up the job.
+type LogBroadcaster struct {
+	mu      sync.Mutex
+	partial []byte
+	subs    map[chan string]struct{}
+	closed  bool
+}
+
+// NewLogBroadcaster returns a new LogBroadcaster with no subscribers.
+func NewLogBroadcaster() *LogBroadcaster {
+	return &LogBroadcaster{
+		subs: make(map[chan string]struct{}),
+	}
+}
+
+// Write sends every complete line in p to the subscribers. Any trailing
+// partial line is held until it is completed by a later write (or Close).
+func (b *LogBroadcaster) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return len(p), nil
+	}
+
+	b.partial = append(b.partial, p...)
+	for {
+		i := bytes.IndexByte(b.partial, '\n')
+		if i < 0 {
+			break
+		}
+		b.send(string(bytes.TrimSuffix(b.partial[:i], []byte{'\r'})))
+		b.partial = b.partial[i+1:]
+	}
+
+	// Don't hold on to the underlying array forever if lines are long.
+	if len(b.partial) == 0 {
+		b.partial = nil
+	}
+
+	return len(p), nil
+}
+
+// send delivers a line to each subscriber, dropping any that can't keep up.
+// b.mu must be held.
+func (b *LogBroadcaster) send(line string) {
+	for ch := range b.subs {
+		select {
+		case ch <- line:
+		default:
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe returns a channel that receives each line written after the call.
+// The channel is closed when the broadcaster is closed, when the subscriber
+// falls too far behind, or after unsubscribe is called.
+func (b *LogBroadcaster) Subscribe() (lines <-chan string, unsubscribe func()) {
+	ch := make(chan string, logSubscriberBuffer)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	b.subs[ch] = struct{}{}
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Close flushes any partial line and closes all subscriber channels.
+func (b *LogBroadcaster) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil
+	}
+	if len(b.partial) > 0 {
+		b.send(string(b.partial))
+		b.partial = nil
+	}
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+	b.closed = true
+	return nil
+}
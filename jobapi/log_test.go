@@ -0,0 +1,178 @@
+package jobapi_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/internal/job/shell"
+	"github.com/buildkite/agent/v3/jobapi"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLogBroadcaster(t *testing.T) {
+	t.Parallel()
+
+	b := jobapi.NewLogBroadcaster()
+	lines, unsubscribe := b.Subscribe()
+	defer unsubscribe()
+
+	fmt.Fprint(b, "climbing ")
+	fmt.Fprint(b, "chimborazo\r\nstill ")
+	fmt.Fprint(b, "climbing\n")
+	fmt.Fprint(b, "summit")
+	b.Close()
+
+	var got []string
+	for line := range lines {
+		got = append(got, line)
+	}
+
+	want := []string{"climbing chimborazo", "still climbing", "summit"}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("lines diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestLogBroadcaster_DropsSlowSubscribers(t *testing.T) {
+	t.Parallel()
+
+	b := jobapi.NewLogBroadcaster()
+	lines, _ := b.Subscribe()
+
+	// Nothing is reading from lines, so eventually the subscriber is dropped
+	// instead of blocking the writer.
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(b, "line %d\n", i)
+	}
+
+	count := 0
+	for range lines {
+		count++
+	}
+	if count == 0 || count >= 2000 {
+		t.Errorf("subscriber received %d lines, want some but not all", count)
+	}
+}
+
+func TestStreamLog(t *testing.T) {
+	t.Parallel()
+
+	logs := jobapi.NewLogBroadcaster()
+	sockName, err := jobapi.NewSocketPath(os.TempDir())
+	if err != nil {
+		t.Fatalf("creating socket path: %v", err)
+	}
+	srv, token, err := jobapi.NewServer(shell.TestingLogger{T: t}, sockName, testEnviron(), jobapi.WithLogBroadcaster(logs))
+	if err != nil {
+		t.Fatalf("creating server: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("starting server: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req := newAPIRequest(t, token, http.MethodGet, "/log", nil).WithContext(ctx)
+	resp, err := testSocketClient(srv.SocketPath).Do(req)
+	if err != nil {
+		t.Fatalf("client.Do(req) error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	if got, want := resp.Header.Get("Content-Type"), "text/event-stream"; got != want {
+		t.Errorf("Content-Type = %q, want %q", got, want)
+	}
+
+	fmt.Fprintln(logs, "--- :mountain: Ascending")
+	fmt.Fprintln(logs, "Reached the summit")
+
+	scanner := bufio.NewScanner(resp.Body)
+	var got []string
+	for len(got) < 2 && scanner.Scan() {
+		if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			got = append(got, data)
+		}
+	}
+
+	want := []string{"--- :mountain: Ascending", "Reached the summit"}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("streamed log diff (-got +want):\n%s", diff)
+	}
+
+	// Stopping the server should end the stream rather than waiting for it.
+	if err := srv.Stop(); err != nil {
+		t.Fatalf("stopping server: %v", err)
+	}
+}
+
+func TestAppendLog(t *testing.T) {
+	t.Parallel()
+
+	buf := &lockedBuffer{}
+	logger := &shell.WriterLogger{Writer: buf}
+	sockName, err := jobapi.NewSocketPath(os.TempDir())
+	if err != nil {
+		t.Fatalf("creating socket path: %v", err)
+	}
+	srv, token, err := jobapi.NewServer(logger, sockName, testEnviron())
+	if err != nil {
+		t.Fatalf("creating server: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("starting server: %v", err)
+	}
+	defer srv.Stop()
+
+	client := testSocketClient(srv.SocketPath)
+
+	testAPI(t, nil, newAPIRequest(t, token, http.MethodPost, "/log", jobapi.LogAppendRequest{
+		Header:   "Test results",
+		Expanded: true,
+		Body:     "42 passed\n",
+	}), client, apiTestCase[any, jobapi.LogAppendResponse]{
+		expectedStatus:       http.StatusOK,
+		expectedResponseBody: &jobapi.LogAppendResponse{},
+	})
+
+	testAPI(t, nil, newAPIRequest(t, token, http.MethodPost, "/log", jobapi.LogAppendRequest{
+		Header: "Sneaky\n+++ Header",
+	}), client, apiTestCase[any, any]{
+		expectedStatus: http.StatusUnprocessableEntity,
+		expectedError:  &jobapi.ErrorResponse{Error: "header and comment must be a single line"},
+	})
+
+	testAPI(t, nil, newAPIRequest(t, token, http.MethodPost, "/log", jobapi.LogAppendRequest{}), client, apiTestCase[any, any]{
+		expectedStatus: http.StatusUnprocessableEntity,
+		expectedError:  &jobapi.ErrorResponse{Error: "at least one of header, comment or body must be provided"},
+	})
+
+	got := buf.String()
+	if want := "+++ Test results\n42 passed\n"; !strings.Contains(got, want) {
+		t.Errorf("logged output = %q, want it to contain %q", got, want)
+	}
+}
+
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
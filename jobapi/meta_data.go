@@ -0,0 +1,70 @@
+package jobapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/go-chi/chi/v5"
+)
+
+// metaDataScope returns the scope and ID to use for a meta-data request. By
+// default meta-data is read from the build of the current job, but another
+// build can be chosen with the build query parameter (in the same way as
+// `buildkite-agent meta-data get --build`).
+func (s *Server) metaDataScope(r *http.Request) (scope, id string) {
+	if build := r.URL.Query().Get("build"); build != "" {
+		return "build", build
+	}
+	return "job", s.jobID
+}
+
+func (s *Server) listMetaData(w http.ResponseWriter, r *http.Request) {
+	scope, id := s.metaDataScope(r)
+	keys, resp, err := s.apiClient.MetaDataKeys(r.Context(), scope, id)
+	if err != nil {
+		s.writeAPIError(w, "listing meta-data keys", resp, err)
+		return
+	}
+
+	s.writeResponse(w, MetaDataKeysResponse{Keys: keys})
+}
+
+func (s *Server) getMetaData(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	scope, id := s.metaDataScope(r)
+	md, resp, err := s.apiClient.GetMetaData(r.Context(), scope, id, key)
+	if err != nil {
+		s.writeAPIError(w, fmt.Sprintf("getting meta-data key %q", key), resp, err)
+		return
+	}
+
+	s.writeResponse(w, MetaDataResponse{Key: key, Value: md.Value})
+}
+
+func (s *Server) setMetaData(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+
+	var req MetaDataSetRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	defer r.Body.Close()
+	if err != nil {
+		s.writeError(w, fmt.Errorf("failed to decode request body: %w", err), http.StatusBadRequest)
+		return
+	}
+
+	// The Agent API rejects blank values, so we do too, but with a nicer error.
+	if req.Value == "" {
+		s.writeError(w, fmt.Sprintf("meta-data value for key %q must not be empty", key), http.StatusUnprocessableEntity)
+		return
+	}
+
+	resp, err := s.apiClient.SetMetaData(r.Context(), s.jobID, &api.MetaData{Key: key, Value: req.Value})
+	if err != nil {
+		s.writeAPIError(w, fmt.Sprintf("setting meta-data key %q", key), resp, err)
+		return
+	}
+
+	s.writeResponse(w, MetaDataResponse{Key: key, Value: req.Value})
+}
@@ -0,0 +1,76 @@
+package jobapi_test
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/buildkite/agent/v3/jobapi"
+)
+
+func TestMetaData(t *testing.T) {
+	t.Parallel()
+
+	srv, token := testServerWithAPIClient(t, newFakeAPIClient())
+	client := testSocketClient(srv.SocketPath)
+
+	newRequest := func(method, path string, body any) *http.Request {
+		return newAPIRequest(t, token, method, "/meta-data"+path, body)
+	}
+
+	testAPI(t, nil, newRequest(http.MethodGet, "/volcano", nil), client, apiTestCase[any, jobapi.MetaDataResponse]{
+		expectedStatus:       http.StatusOK,
+		expectedResponseBody: &jobapi.MetaDataResponse{Key: "volcano", Value: "cotopaxi"},
+	})
+
+	testAPI(t, nil, newRequest(http.MethodGet, "/lake", nil), client, apiTestCase[any, any]{
+		expectedStatus: http.StatusNotFound,
+		expectedError:  &jobapi.ErrorResponse{Error: `getting meta-data key "lake": not found`},
+	})
+
+	testAPI(t, nil, newRequest(http.MethodPut, "/lake", jobapi.MetaDataSetRequest{Value: "quilotoa"}), client, apiTestCase[any, jobapi.MetaDataResponse]{
+		expectedStatus:       http.StatusOK,
+		expectedResponseBody: &jobapi.MetaDataResponse{Key: "lake", Value: "quilotoa"},
+	})
+
+	testAPI(t, nil, newRequest(http.MethodPut, "/lake", jobapi.MetaDataSetRequest{}), client, apiTestCase[any, any]{
+		expectedStatus: http.StatusUnprocessableEntity,
+		expectedError:  &jobapi.ErrorResponse{Error: `meta-data value for key "lake" must not be empty`},
+	})
+
+	testAPI(t, nil, newRequest(http.MethodGet, "", nil), client, apiTestCase[any, jobapi.MetaDataKeysResponse]{
+		expectedStatus:       http.StatusOK,
+		expectedResponseBody: &jobapi.MetaDataKeysResponse{Keys: []string{"lake", "volcano"}},
+	})
+
+	testAPI(t, nil, newRequest(http.MethodGet, "?build=another-build", nil), client, apiTestCase[any, any]{
+		expectedStatus: http.StatusNotFound,
+		expectedError:  &jobapi.ErrorResponse{Error: "listing meta-data keys: not found"},
+	})
+}
+
+func TestMetaData_WithoutAPIClient(t *testing.T) {
+	t.Parallel()
+
+	srv, token, err := testServer(t, testEnviron())
+	if err != nil {
+		t.Fatalf("creating server: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("starting server: %v", err)
+	}
+	defer srv.Stop()
+
+	req, err := http.NewRequest(http.MethodGet, "http://job/api/current-job/v0/meta-data/volcano", nil)
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+	testAPI(t, nil, req, testSocketClient(srv.SocketPath), apiTestCase[any, any]{
+		expectedStatus: http.StatusServiceUnavailable,
+		expectedError: &jobapi.ErrorResponse{
+			Error: "this endpoint requires access to the Buildkite Agent API, which is not available to this Job API server",
+		},
+	})
+}
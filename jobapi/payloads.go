@@ -48,3 +48,76 @@ type EnvDeleteResponse struct {
 func (e EnvDeleteResponse) Normalize() {
 	sort.Strings(e.Deleted)
 }
+
+// MetaDataKeysResponse is the response body for the GET /meta-data endpoint
+type MetaDataKeysResponse struct {
+	Keys []string `json:"keys"`
+}
+
+// MetaDataResponse is the response body for the GET and PUT /meta-data/{key} endpoints
+type MetaDataResponse struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// MetaDataSetRequest is the request body for the PUT /meta-data/{key} endpoint
+type MetaDataSetRequest struct {
+	Value string `json:"value"`
+}
+
+// AnnotationRequest is the request body for the POST /annotations endpoint
+type AnnotationRequest struct {
+	Body    string `json:"body"`
+	Context string `json:"context,omitempty"`
+	Style   string `json:"style,omitempty"`
+	Append  bool   `json:"append,omitempty"`
+}
+
+// AnnotationResponse is the response body for the POST /annotations and
+// DELETE /annotations/{context} endpoints
+type AnnotationResponse struct {
+	Context string `json:"context"`
+}
+
+// StepGetResponse is the response body for the GET /step/{key} endpoint
+type StepGetResponse struct {
+	Output string `json:"output"`
+}
+
+// StepUpdateRequest is the request body for the PUT /step/{key} endpoint
+type StepUpdateRequest struct {
+	Attribute string `json:"attribute"`
+	Value     string `json:"value"`
+	Append    bool   `json:"append,omitempty"`
+	Build     string `json:"build,omitempty"`
+}
+
+// StepUpdateResponse is the response body for the PUT /step/{key} endpoint
+type StepUpdateResponse struct {
+	Attribute string `json:"attribute"`
+}
+
+// LogAppendRequest is the request body for the POST /log endpoint
+type LogAppendRequest struct {
+	// Header, if set, starts a new group in the job log with this title.
+	Header string `json:"header,omitempty"`
+	// Expanded causes the new group to be expanded by default.
+	Expanded bool `json:"expanded,omitempty"`
+	// Comment, if set, is printed as a comment line.
+	Comment string `json:"comment,omitempty"`
+	// Body, if set, is printed as-is.
+	Body string `json:"body,omitempty"`
+}
+
+// LogAppendResponse is the response body for the POST /log endpoint
+type LogAppendResponse struct{}
+
+// RedactionCreateRequest is the request body for the POST /redactions endpoint
+type RedactionCreateRequest struct {
+	Values []string `json:"values"`
+}
+
+// RedactionCreateResponse is the response body for the POST /redactions endpoint
+type RedactionCreateResponse struct {
+	Added int `json:"added"`
+}
@@ -0,0 +1,47 @@
+package jobapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/buildkite/agent/v3/internal/redact"
+)
+
+func (s *Server) createRedactions(w http.ResponseWriter, r *http.Request) {
+	if s.redactors == nil {
+		s.writeError(w, "adding redactions is not supported by this Job API server", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req RedactionCreateRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	defer r.Body.Close()
+	if err != nil {
+		s.writeError(w, fmt.Errorf("failed to decode request body: %w", err), http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Values) == 0 {
+		s.writeError(w, "no values to redact were provided", http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Short values would redact too much useful output, so they're rejected
+	// in the same way as short environment variable values. The values
+	// themselves are secret, so the error only says which ones by index.
+	var short []int
+	for i, v := range req.Values {
+		if len(v) < redact.LengthMin {
+			short = append(short, i)
+		}
+	}
+	if len(short) > 0 {
+		s.writeError(w, fmt.Sprintf("values to redact must be at least %d bytes long, but the values at these indexes are too short: %v", redact.LengthMin, short), http.StatusUnprocessableEntity)
+		return
+	}
+
+	s.redactors.AddRedactions(req.Values...)
+
+	s.writeResponse(w, RedactionCreateResponse{Added: len(req.Values)})
+}
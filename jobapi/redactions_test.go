@@ -0,0 +1,70 @@
+package jobapi_test
+
+import (
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/buildkite/agent/v3/internal/job/shell"
+	"github.com/buildkite/agent/v3/jobapi"
+	"github.com/google/go-cmp/cmp"
+)
+
+type fakeRedactors struct {
+	mu     sync.Mutex
+	values []string
+}
+
+func (f *fakeRedactors) AddRedactions(values ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.values = append(f.values, values...)
+}
+
+func TestCreateRedactions(t *testing.T) {
+	t.Parallel()
+
+	redactors := &fakeRedactors{}
+	sockName, err := jobapi.NewSocketPath(os.TempDir())
+	if err != nil {
+		t.Fatalf("creating socket path: %v", err)
+	}
+	srv, token, err := jobapi.NewServer(shell.TestingLogger{T: t}, sockName, testEnviron(), jobapi.WithRedactors(redactors))
+	if err != nil {
+		t.Fatalf("creating server: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("starting server: %v", err)
+	}
+	defer srv.Stop()
+
+	client := testSocketClient(srv.SocketPath)
+
+	testAPI(t, nil, newAPIRequest(t, token, http.MethodPost, "/redactions", jobapi.RedactionCreateRequest{
+		Values: []string{"hunter2hunter2", "llamasecret"},
+	}), client, apiTestCase[any, jobapi.RedactionCreateResponse]{
+		expectedStatus:       http.StatusOK,
+		expectedResponseBody: &jobapi.RedactionCreateResponse{Added: 2},
+	})
+
+	testAPI(t, nil, newAPIRequest(t, token, http.MethodPost, "/redactions", jobapi.RedactionCreateRequest{
+		Values: []string{"longenough", "short"},
+	}), client, apiTestCase[any, any]{
+		expectedStatus: http.StatusUnprocessableEntity,
+		expectedError: &jobapi.ErrorResponse{
+			Error: "values to redact must be at least 6 bytes long, but the values at these indexes are too short: [1]",
+		},
+	})
+
+	testAPI(t, nil, newAPIRequest(t, token, http.MethodPost, "/redactions", jobapi.RedactionCreateRequest{}), client, apiTestCase[any, any]{
+		expectedStatus: http.StatusUnprocessableEntity,
+		expectedError:  &jobapi.ErrorResponse{Error: "no values to redact were provided"},
+	})
+
+	redactors.mu.Lock()
+	defer redactors.mu.Unlock()
+	if diff := cmp.Diff(redactors.values, []string{"hunter2hunter2", "llamasecret"}); diff != "" {
+		t.Errorf("redacted values diff (-got +want):\n%s", diff)
+	}
+}
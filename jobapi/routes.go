@@ -2,10 +2,12 @@ package jobapi
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 
 	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/internal/socket"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -27,6 +29,30 @@ func (s *Server) router() chi.Router {
 		r.Get("/env", s.getEnv)
 		r.Patch("/env", s.patchEnv)
 		r.Delete("/env", s.deleteEnv)
+
+		r.Get("/log", s.streamLog)
+		r.Post("/log", s.appendLog)
+
+		r.Post("/redactions", s.createRedactions)
+
+		r.Route("/meta-data", func(r chi.Router) {
+			r.Use(s.requireAPIClient)
+			r.Get("/", s.listMetaData)
+			r.Get("/{key}", s.getMetaData)
+			r.Put("/{key}", s.setMetaData)
+		})
+
+		r.Route("/annotations", func(r chi.Router) {
+			r.Use(s.requireAPIClient)
+			r.Post("/", s.createAnnotation)
+			r.Delete("/{context}", s.removeAnnotation)
+		})
+
+		r.Route("/step/{key}", func(r chi.Router) {
+			r.Use(s.requireAPIClient)
+			r.Get("/", s.getStep)
+			r.Put("/", s.updateStep)
+		})
 	})
 
 	return r
@@ -159,6 +185,47 @@ func (s *Server) deleteEnv(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// requireAPIClient is a middleware that rejects requests to endpoints that
+// proxy through to the Agent API when the server wasn't given an API client.
+func (s *Server) requireAPIClient(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.apiClient == nil {
+			s.writeError(w, "this endpoint requires access to the Buildkite Agent API, which is not available to this Job API server", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeAPIError writes an error that came from the Agent API. If the Agent
+// API responded with a client error status (e.g. 404 for a missing meta-data
+// key), that status is passed through, otherwise it is reported as a bad
+// gateway.
+func (s *Server) writeAPIError(w http.ResponseWriter, action string, resp *api.Response, err error) {
+	status := http.StatusBadGateway
+	if resp != nil && resp.Response != nil && resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		status = resp.StatusCode
+	}
+	var apiErr *api.ErrorResponse
+	if errors.As(err, &apiErr) && apiErr.Message != "" {
+		err = errors.New(apiErr.Message)
+	}
+	s.writeError(w, fmt.Errorf("%s: %w", action, err), status)
+}
+
+func (s *Server) writeError(w http.ResponseWriter, err any, code int) {
+	if err := socket.WriteError(w, err, code); err != nil {
+		s.Logger.Errorf("Job API: couldn't write error: %v", err)
+	}
+}
+
+func (s *Server) writeResponse(w http.ResponseWriter, resp any) {
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		s.Logger.Errorf("Job API: couldn't encode or write response: %v", err)
+	}
+}
+
 func checkProtected(candidates []string) []string {
 	protected := make([]string, 0, len(candidates))
 	for _, c := range candidates {
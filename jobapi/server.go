@@ -7,6 +7,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/env"
 	"github.com/buildkite/agent/v3/internal/job/shell"
 	"github.com/buildkite/agent/v3/internal/socket"
@@ -22,14 +23,74 @@ type Server struct {
 	mtx     sync.RWMutex
 	environ *env.Environment
 
+	// apiClient and jobID are used to proxy requests through to the Buildkite
+	// Agent API on behalf of the job. If apiClient is nil, those endpoints
+	// respond with an error.
+	apiClient APIClient
+	jobID     string
+
+	// logs is the source of job log output for streaming GET /log requests.
+	logs *LogBroadcaster
+
+	// redactors receives values to redact from POST /redactions requests.
+	redactors Redactors
+
 	token   string
 	sockSvr *socket.Server
+
+	// done is closed when the server is stopping, to end long-lived requests.
+	done chan struct{}
+}
+
+// APIClient is the subset of the Agent API client that the Job API server
+// uses to proxy requests on behalf of the job.
+type APIClient interface {
+	Annotate(ctx context.Context, jobId string, annotation *api.Annotation) (*api.Response, error)
+	AnnotationRemove(ctx context.Context, jobId string, context string) (*api.Response, error)
+	GetMetaData(ctx context.Context, scope, id, key string) (*api.MetaData, *api.Response, error)
+	MetaDataKeys(ctx context.Context, scope, id string) ([]string, *api.Response, error)
+	SetMetaData(ctx context.Context, jobId string, metaData *api.MetaData) (*api.Response, error)
+	StepExport(ctx context.Context, stepIdOrKey string, stepGetRequest *api.StepExportRequest) (*api.StepExportResponse, *api.Response, error)
+	StepUpdate(ctx context.Context, stepIdOrKey string, stepUpdate *api.StepUpdate) (*api.Response, error)
+}
+
+// Redactors adds values to redact from the job log while the job is running.
+type Redactors interface {
+	AddRedactions(values ...string)
+}
+
+// ServerOpts configures optional parts of a Job API server.
+type ServerOpts func(*Server)
+
+// WithAPIClient enables the endpoints that are proxied through to the
+// Buildkite Agent API, using client to make requests on behalf of jobID.
+func WithAPIClient(client APIClient, jobID string) ServerOpts {
+	return func(s *Server) {
+		s.apiClient = client
+		s.jobID = jobID
+	}
+}
+
+// WithLogBroadcaster enables streaming the job log from GET /log. The
+// broadcaster should be written to with the job's (redacted) output.
+func WithLogBroadcaster(logs *LogBroadcaster) ServerOpts {
+	return func(s *Server) {
+		s.logs = logs
+	}
+}
+
+// WithRedactors enables adding values to redact from the job log with
+// POST /redactions.
+func WithRedactors(redactors Redactors) ServerOpts {
+	return func(s *Server) {
+		s.redactors = redactors
+	}
 }
 
 // NewServer creates a new Job API server
 // socketPath is the path to the socket on which the server will listen
 // environ is the environment which the server will mutate and inspect as part of its operation
-func NewServer(logger shell.Logger, socketPath string, environ *env.Environment) (server *Server, token string, err error) {
+func NewServer(logger shell.Logger, socketPath string, environ *env.Environment, opts ...ServerOpts) (server *Server, token string, err error) {
 	token, err = socket.GenerateToken(32)
 	if err != nil {
 		return nil, "", fmt.Errorf("generating token: %w", err)
@@ -40,6 +101,11 @@ func NewServer(logger shell.Logger, socketPath string, environ *env.Environment)
 		Logger:     logger,
 		environ:    environ,
 		token:      token,
+		done:       make(chan struct{}),
+	}
+
+	for _, o := range opts {
+		o(s)
 	}
 
 	svr, err := socket.NewServer(socketPath, s.router())
@@ -66,6 +132,13 @@ func (s *Server) Start() error {
 // Stop gracefully shuts the server down, blocking until all requests have been served or the grace period has expired
 // It returns an error if the server has not been started
 func (s *Server) Stop() error {
+	// End any streaming requests, which would otherwise hold up shutdown.
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+
 	// Shutdown signal with grace period of 10 seconds
 	shutdownCtx, serverStopCtx := context.WithTimeout(context.Background(), 10*time.Second)
 	defer serverStopCtx()
@@ -0,0 +1,73 @@
+package jobapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/go-chi/chi/v5"
+)
+
+// stepBuild returns the build to look for a step in. Steps can be targeted
+// by ID or by key, and targeting one by key requires a build, so like
+// `buildkite-agent step get`, this defaults to the build of the current job.
+func (s *Server) stepBuild(build string) string {
+	if build != "" {
+		return build
+	}
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	build, _ = s.environ.Get("BUILDKITE_BUILD_ID")
+	return build
+}
+
+func (s *Server) getStep(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	query := r.URL.Query()
+
+	req := &api.StepExportRequest{
+		Attribute: query.Get("attribute"),
+		Build:     s.stepBuild(query.Get("build")),
+		Format:    query.Get("format"),
+	}
+	export, resp, err := s.apiClient.StepExport(r.Context(), key, req)
+	if err != nil {
+		s.writeAPIError(w, fmt.Sprintf("getting step %q", key), resp, err)
+		return
+	}
+
+	s.writeResponse(w, StepGetResponse{Output: export.Output})
+}
+
+func (s *Server) updateStep(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+
+	var req StepUpdateRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	defer r.Body.Close()
+	if err != nil {
+		s.writeError(w, fmt.Errorf("failed to decode request body: %w", err), http.StatusBadRequest)
+		return
+	}
+
+	if req.Attribute == "" {
+		s.writeError(w, "attribute must not be empty", http.StatusUnprocessableEntity)
+		return
+	}
+
+	update := &api.StepUpdate{
+		IdempotencyUUID: api.NewUUID(),
+		Build:           s.stepBuild(req.Build),
+		Attribute:       req.Attribute,
+		Value:           req.Value,
+		Append:          req.Append,
+	}
+	resp, err := s.apiClient.StepUpdate(r.Context(), key, update)
+	if err != nil {
+		s.writeAPIError(w, fmt.Sprintf("updating step %q", key), resp, err)
+		return
+	}
+
+	s.writeResponse(w, StepUpdateResponse{Attribute: req.Attribute})
+}
@@ -0,0 +1,44 @@
+package jobapi_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/buildkite/agent/v3/jobapi"
+)
+
+func TestSteps(t *testing.T) {
+	t.Parallel()
+
+	srv, token := testServerWithAPIClient(t, newFakeAPIClient())
+	client := testSocketClient(srv.SocketPath)
+
+	testAPI(t, nil, newAPIRequest(t, token, http.MethodGet, "/step/summit?attribute=label", nil), client, apiTestCase[any, jobapi.StepGetResponse]{
+		expectedStatus:       http.StatusOK,
+		expectedResponseBody: &jobapi.StepGetResponse{Output: ":mountain: Summit"},
+	})
+
+	testAPI(t, nil, newAPIRequest(t, token, http.MethodPut, "/step/summit", jobapi.StepUpdateRequest{
+		Attribute: "label",
+		Value:     " (5897m)",
+		Append:    true,
+	}), client, apiTestCase[any, jobapi.StepUpdateResponse]{
+		expectedStatus:       http.StatusOK,
+		expectedResponseBody: &jobapi.StepUpdateResponse{Attribute: "label"},
+	})
+
+	testAPI(t, nil, newAPIRequest(t, token, http.MethodGet, "/step/summit?attribute=label", nil), client, apiTestCase[any, jobapi.StepGetResponse]{
+		expectedStatus:       http.StatusOK,
+		expectedResponseBody: &jobapi.StepGetResponse{Output: ":mountain: Summit (5897m)"},
+	})
+
+	testAPI(t, nil, newAPIRequest(t, token, http.MethodPut, "/step/summit", jobapi.StepUpdateRequest{Value: "nope"}), client, apiTestCase[any, any]{
+		expectedStatus: http.StatusUnprocessableEntity,
+		expectedError:  &jobapi.ErrorResponse{Error: "attribute must not be empty"},
+	})
+
+	testAPI(t, nil, newAPIRequest(t, token, http.MethodGet, "/step/crater?attribute=label", nil), client, apiTestCase[any, any]{
+		expectedStatus: http.StatusNotFound,
+		expectedError:  &jobapi.ErrorResponse{Error: `getting step "crater": not found`},
+	})
+}
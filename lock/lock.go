@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,21 +18,84 @@ import (
 
 // For local sockets, we can afford to be fairly chatty. 100ms is an arbitrary
 // choice which is simultaneously "a long time" (for a computer) and
-// "the blink of an eye" (for a human).
+// "the blink of an eye" (for a human). This is only used when long-polling
+// isn't available (e.g. the leader agent is an older version).
 const localSocketSleepDuration = 100 * time.Millisecond
 
+// longPollTimeout is how long each long-poll request waits for a lock to
+// change. Waiting is repeated as needed, so this mostly bounds how long an
+// individual request to the API takes.
+const longPollTimeout = 10 * time.Second
+
+// MinLeaseTTL is the shortest lease TTL that the agent running a job renews
+// reliably on the job's behalf.
+const MinLeaseTTL = 30 * time.Second
+
+// Lock describes a lock key that is currently in use.
+type Lock = agentapi.Lock
+
 // Client implements a client library for the Agent API locking service.
 type Client struct {
 	client *agentapi.Client
+
+	owner    agentapi.LockOwner
+	leaseTTL time.Duration
+
+	renewMu  sync.Mutex
+	renewals map[string]context.CancelFunc // keyed by key and value
+}
+
+// ClientOpts configure a Client.
+type ClientOpts func(*Client)
+
+// WithLeaseTTL causes locks written by the client to expire unless they are
+// renewed within the TTL. While a lock (or a do-once section) is held, the
+// client renews the lease in the background, and the agent running the job
+// (given by BUILDKITE_JOB_ID) renews it until the job finishes, so the lock
+// only expires if both stop running. A zero TTL (the default) means locks never
+// expire.
+func WithLeaseTTL(ttl time.Duration) ClientOpts {
+	return func(c *Client) {
+		c.leaseTTL = ttl
+	}
 }
 
 // NewClient creates a new machine-scope lock service client.
-func NewClient(ctx context.Context, socketsDir string) (*Client, error) {
+func NewClient(ctx context.Context, socketsDir string, opts ...ClientOpts) (*Client, error) {
 	cli, err := agentapi.NewClient(ctx, agentapi.LeaderPath(socketsDir))
 	if err != nil {
 		return nil, err
 	}
-	return &Client{client: cli}, nil
+	return newClient(cli, opts...), nil
+}
+
+func newClient(cli *agentapi.Client, opts ...ClientOpts) *Client {
+	hostname, _ := os.Hostname()
+	c := &Client{
+		client: cli,
+		owner: agentapi.LockOwner{
+			JobID:    os.Getenv("BUILDKITE_JOB_ID"),
+			Hostname: hostname,
+		},
+		renewals: make(map[string]context.CancelFunc),
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+// lease returns the lease to attach to values written by the client.
+func (c *Client) lease() agentapi.LockLease {
+	return agentapi.LockLease{
+		Owner: c.owner,
+		TTL:   c.leaseTTL,
+	}
+}
+
+// cas is a shorthand for compare-and-swap with the client's lease.
+func (c *Client) cas(ctx context.Context, key, old, new string) (string, bool, error) {
+	return c.client.LockCompareAndSwap(ctx, key, old, new, c.lease())
 }
 
 // Get retrieves the current state of a lock.
@@ -39,6 +103,123 @@ func (c *Client) Get(ctx context.Context, key string) (string, error) {
 	return c.client.LockGet(ctx, key)
 }
 
+// List retrieves all the locks currently in use.
+func (c *Client) List(ctx context.Context) ([]Lock, error) {
+	return c.client.LockList(ctx)
+}
+
+// ForceRelease unlocks the lock for the given key, whatever its current value
+// and whoever holds it. It returns the value that was released ("" if the lock
+// was not held). This is intended for operators recovering from a stuck lock;
+// ordinary processes should use Unlock or DoOnceEnd.
+func (c *Client) ForceRelease(ctx context.Context, key string) (string, error) {
+	val, err := c.client.LockGet(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	for val != "" {
+		st, done, err := c.cas(ctx, key, val, "")
+		if err != nil {
+			return "", fmt.Errorf("cas: %w", err)
+		}
+		if done {
+			return val, nil
+		}
+		// Changed concurrently - try again with the new value.
+		val = st
+	}
+	return "", nil
+}
+
+// RenewJobLeases renews the leases on the locks (and semaphore slots) held by
+// the job with the given ID, so that they last as long as the job rather than
+// only as long as the process that acquired them. Locks without a lease are
+// left alone.
+func (c *Client) RenewJobLeases(ctx context.Context, jobID string) error {
+	leases, err := c.jobLeases(ctx, jobID)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, l := range leases {
+		// If the lock has been released in the meantime, this does nothing.
+		var err error
+		if l.max > 0 {
+			_, _, err = c.client.SemaphoreAcquire(ctx, l.key, l.token, l.max, l.lease, 0)
+		} else {
+			_, _, err = c.client.LockCompareAndSwap(ctx, l.key, l.token, l.token, l.lease)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("renewing lock %q: %w", l.key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ReleaseJobLeases releases the locks (and semaphore slots) with leases held
+// by the job with the given ID, for when the job has finished. It returns the
+// keys it released. Locks without a lease (such as completed do-once sections)
+// are left alone.
+func (c *Client) ReleaseJobLeases(ctx context.Context, jobID string) ([]string, error) {
+	leases, err := c.jobLeases(ctx, jobID)
+	if err != nil {
+		return nil, err
+	}
+	var released []string
+	var errs []error
+	for _, l := range leases {
+		var done bool
+		var err error
+		if l.max > 0 {
+			done, err = c.client.SemaphoreRelease(ctx, l.key, l.token)
+		} else {
+			_, done, err = c.client.LockCompareAndSwap(ctx, l.key, l.token, "", l.lease)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("releasing lock %q: %w", l.key, err))
+			continue
+		}
+		if done {
+			released = append(released, l.key)
+		}
+	}
+	return released, errors.Join(errs...)
+}
+
+// jobLease is a lock value, or a semaphore slot, held under a lease.
+type jobLease struct {
+	key, token string
+	max        int // 0 for ordinary locks
+	lease      agentapi.LockLease
+}
+
+// jobLeases lists the leases held by the job with the given ID.
+func (c *Client) jobLeases(ctx context.Context, jobID string) ([]jobLease, error) {
+	if jobID == "" {
+		return nil, nil
+	}
+	locks, err := c.client.LockList(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing locks: %w", err)
+	}
+	var out []jobLease
+	for _, l := range locks {
+		if holders := agentapi.SemaphoreHolders(l.Value); holders != nil {
+			for _, h := range holders {
+				if h.Lease.Owner.JobID == jobID && h.Lease.TTL > 0 {
+					out = append(out, jobLease{key: l.Key, token: h.Token, max: h.Max, lease: h.Lease})
+				}
+			}
+			continue
+		}
+		if l.Owner.JobID == jobID && l.TTL > 0 {
+			lease := agentapi.LockLease{Owner: l.Owner, TTL: l.TTL}
+			out = append(out, jobLease{key: l.Key, token: l.Value, lease: lease})
+		}
+	}
+	return out, nil
+}
+
 // Locker returns a sync.Mutex-like object that uses the client to perform
 // locking. Any errors encountered by the client while locking or unlocking
 // (for example, the agent running the API stops running) will cause a panic
@@ -55,37 +236,104 @@ func (c *Client) Locker(key string) sync.Locker {
 // token or an error. The token must be passed to Unlock in order to unlock the
 // lock later on.
 func (c *Client) Lock(ctx context.Context, key string) (string, error) {
-	// The token generation only has to avoid making the same token twice to
-	// prevent separate processes unlocking each other.
-	// Using crypto/rand to generate 16 bytes is possibly overkill - it's not a
-	// goal to be cryptographically secure - but ensures the result.
-	otp := make([]byte, 16)
-	if _, err := rand.Read(otp); err != nil {
+	token, err := newToken("acquired")
+	if err != nil {
 		return "", err
 	}
-	token := fmt.Sprintf("acquired(pid=%d,otp=%x)", os.Getpid(), otp)
 
 	for {
-		_, done, err := c.client.LockCompareAndSwap(ctx, key, "", token)
+		val, done, err := c.cas(ctx, key, "", token)
 		if err != nil {
 			return "", fmt.Errorf("cas: %w", err)
 		}
 
 		if done {
+			c.startRenewing(key, token, func(ctx context.Context) (bool, error) {
+				_, done, err := c.cas(ctx, key, token, token)
+				return done, err
+			})
+			return token, nil
+		}
+
+		// Not done. Wait for whoever holds the lock to release it.
+		if _, err := c.waitChange(ctx, key, val); err != nil {
+			return "", err
+		}
+	}
+}
+
+// Acquire blocks until one of max slots in the counting semaphore for the
+// given key is acquired, so that at most max processes hold the semaphore at
+// once. Waiters are given slots in the order they started waiting. It returns a
+// token or an error. The token must be passed to Unlock in order to release the
+// slot later on. All processes using the same key must use the same max.
+func (c *Client) Acquire(ctx context.Context, key string, max int) (string, error) {
+	if max < 1 {
+		return "", fmt.Errorf("invalid semaphore max %d: must be at least 1", max)
+	}
+
+	token, err := newToken(semaphoreTokenKind)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		start := time.Now()
+		acquired, _, err := c.client.SemaphoreAcquire(ctx, key, token, max, c.lease(), longPollTimeout/2)
+		if err != nil {
+			c.abandon(key, token)
+			return "", fmt.Errorf("semaphore: %w", err)
+		}
+
+		if acquired {
+			c.startRenewing(key, token, func(ctx context.Context) (bool, error) {
+				acquired, _, err := c.client.SemaphoreAcquire(ctx, key, token, max, c.lease(), 0)
+				if err == nil && !acquired {
+					// The slot expired, and renewing joined the queue instead.
+					c.abandon(key, token)
+				}
+				return acquired, err
+			})
 			return token, nil
 		}
 
-		// Not done.
-		if err := sleep(ctx, localSocketSleepDuration); err != nil {
+		// Still waiting. Asking again also keeps our place in the queue.
+		// The server waits before responding, but older servers don't, so
+		// avoid asking again too quickly.
+		if err := sleep(ctx, localSocketSleepDuration-time.Since(start)); err != nil {
+			c.abandon(key, token)
 			return "", err
 		}
 	}
 }
 
+// abandon gives up the token's place in a semaphore queue, so that a waiter
+// that stops waiting doesn't hold up the waiters behind it. It's best-effort:
+// if it fails, the place expires on its own.
+func (c *Client) abandon(key, token string) {
+	ctx, canc := context.WithTimeout(context.Background(), time.Second)
+	defer canc()
+	c.client.SemaphoreRelease(ctx, key, token)
+}
+
 // Unlock unlocks the lock for the given key. To prevent different processes
-// accidentally unlocking the same lock, token must match the current lock value.
+// accidentally unlocking the same lock, token must match the current lock value
+// (or, for a semaphore, be one of the current holders).
 func (c *Client) Unlock(ctx context.Context, key, token string) error {
-	val, done, err := c.client.LockCompareAndSwap(ctx, key, token, "")
+	c.stopRenewing(key, token)
+
+	if strings.HasPrefix(token, semaphoreTokenKind+"(") {
+		released, err := c.client.SemaphoreRelease(ctx, key, token)
+		if err != nil {
+			return fmt.Errorf("semaphore: %w", err)
+		}
+		if !released {
+			return errors.New("already unlocked")
+		}
+		return nil
+	}
+
+	val, done, err := c.cas(ctx, key, token, "")
 	if err != nil {
 		return fmt.Errorf("cas: %w", err)
 	}
@@ -137,7 +385,7 @@ func (c *Client) DoOnceStart(ctx context.Context, key string) (bool, error) {
 		switch state {
 		case "":
 			// Try to acquire the lock by transitioning to state "doing"
-			st, done, err := c.client.LockCompareAndSwap(ctx, key, "", "doing")
+			st, done, err := c.cas(ctx, key, "", "doing")
 			if err != nil {
 				return false, fmt.Errorf("cas: %w", err)
 			}
@@ -147,14 +395,15 @@ func (c *Client) DoOnceStart(ctx context.Context, key string) (bool, error) {
 				continue
 			}
 
+			c.startRenewing(key, "doing", func(ctx context.Context) (bool, error) {
+				_, done, err := c.cas(ctx, key, "doing", "doing")
+				return done, err
+			})
 			return true, nil
 
 		case "doing":
 			// Work in progress - wait until state "done".
-			if err := sleep(ctx, localSocketSleepDuration); err != nil {
-				return false, err
-			}
-			st, err := c.client.LockGet(ctx, key)
+			st, err := c.waitChange(ctx, key, "doing")
 			if err != nil {
 				return false, err
 			}
@@ -173,7 +422,11 @@ func (c *Client) DoOnceStart(ctx context.Context, key string) (bool, error) {
 
 // DoOnceEnd marks a do-once section as completed.
 func (c *Client) DoOnceEnd(ctx context.Context, key string) error {
-	st, done, err := c.client.LockCompareAndSwap(ctx, key, "doing", "done")
+	c.stopRenewing(key, "doing")
+	// The work is done, so the "done" state should never expire.
+	lease := c.lease()
+	lease.TTL = 0
+	st, done, err := c.client.LockCompareAndSwap(ctx, key, "doing", "done", lease)
 	if err != nil {
 		return fmt.Errorf("cas: %w", err)
 	}
@@ -183,6 +436,67 @@ func (c *Client) DoOnceEnd(ctx context.Context, key string) error {
 	return nil
 }
 
+// startRenewing renews the lease on the lock value in the background using
+// renew, until stopRenewing is called or renew reports the value was lost.
+func (c *Client) startRenewing(key, value string, renew func(context.Context) (bool, error)) {
+	if c.leaseTTL <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.renewMu.Lock()
+	c.renewals[key+"\x00"+value] = cancel
+	c.renewMu.Unlock()
+
+	go func() {
+		defer cancel()
+		for {
+			// Renew well before the lease expires, to allow for retries.
+			if err := sleep(ctx, c.leaseTTL/3); err != nil {
+				return
+			}
+			done, err := renew(ctx)
+			if err != nil {
+				// Perhaps the API is briefly unavailable. Keep trying until
+				// the lease expires, at which point the value is gone anyway.
+				continue
+			}
+			if !done {
+				// The value changed (it was force-released or expired).
+				return
+			}
+		}
+	}()
+}
+
+// stopRenewing stops renewing the lease on the lock value.
+func (c *Client) stopRenewing(key, value string) {
+	c.renewMu.Lock()
+	defer c.renewMu.Unlock()
+	k := key + "\x00" + value
+	if cancel, ok := c.renewals[k]; ok {
+		cancel()
+		delete(c.renewals, k)
+	}
+}
+
+// semaphoreTokenKind prefixes tokens for semaphores, so that Unlock can tell
+// them apart from ordinary lock tokens.
+const semaphoreTokenKind = "semaphore"
+
+// newToken generates a new token for a lock value.
+func newToken(kind string) (string, error) {
+	// The token generation only has to avoid making the same token twice to
+	// prevent separate processes unlocking each other.
+	// Using crypto/rand to generate 16 bytes is possibly overkill - it's not a
+	// goal to be cryptographically secure - but ensures the result.
+	otp := make([]byte, 16)
+	if _, err := rand.Read(otp); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s(pid=%d,otp=%x)", kind, os.Getpid(), otp), nil
+}
+
 type locker struct {
 	client     *Client
 	mu         sync.Mutex
@@ -208,6 +522,24 @@ func (l *locker) Unlock() {
 	l.mu.Unlock()
 }
 
+// waitChange waits until the value of the lock key is no longer old, and returns
+// the new value. If long-polling fails (perhaps the leader is an older agent
+// that doesn't support it), it falls back to sleeping briefly and getting the
+// value. The value returned might still be old if the long-poll timed out.
+func (c *Client) waitChange(ctx context.Context, key, old string) (string, error) {
+	v, err := c.client.LockWait(ctx, key, old, longPollTimeout)
+	if err == nil {
+		return v, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if err := sleep(ctx, localSocketSleepDuration); err != nil {
+		return "", err
+	}
+	return c.client.LockGet(ctx, key)
+}
+
 // sleep sleeps in a context-aware way. The only non-nil errors returned are
 // from ctx.Err.
 func sleep(ctx context.Context, d time.Duration) error {
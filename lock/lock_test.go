@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -12,6 +13,7 @@ import (
 
 	"github.com/buildkite/agent/v3/internal/agentapi"
 	"github.com/buildkite/agent/v3/logger"
+	"github.com/google/go-cmp/cmp"
 )
 
 var testSocketCounter uint32
@@ -48,7 +50,7 @@ func testServerAndClient(t *testing.T, ctx context.Context) (*agentapi.Server, *
 
 	// lock.NewClient takes the socket *directory*. Rather than temporarily
 	// symlink the socket created above, I've manually created a client.
-	return svr, &Client{client: cli}
+	return svr, newClient(cli)
 }
 
 func TestLockUnlock(t *testing.T) {
@@ -142,3 +144,187 @@ func TestDoOnce(t *testing.T) {
 		t.Errorf("calls.Load() = %d, want %d", got, want)
 	}
 }
+
+func TestLeaseExpiryAndRenewal(t *testing.T) {
+	t.Parallel()
+	ctx, canc := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(canc)
+
+	svr, cli := testServerAndClient(t, ctx)
+	t.Cleanup(func() { svr.Close() })
+
+	const ttl = 300 * time.Millisecond
+
+	// A lock written by a process that then stops running (and so never
+	// renews the lease) should expire.
+	crashed := agentapi.LockLease{TTL: ttl}
+	if _, ok, err := cli.client.LockCompareAndSwap(ctx, "crashed", "", "acquired(crashed)", crashed); err != nil || !ok {
+		t.Fatalf("LockCompareAndSwap(ctx, crashed, %q, %q, %v) = (_, %t, %v), want (_, true, nil)", "", "acquired(crashed)", crashed, ok, err)
+	}
+
+	// A lock held by a live client with a lease should be renewed.
+	leased := newClient(cli.client, WithLeaseTTL(ttl))
+	token, err := leased.Lock(ctx, "live")
+	if err != nil {
+		t.Fatalf("leased.Lock(ctx, live) error = %v", err)
+	}
+
+	time.Sleep(3 * ttl)
+
+	if got, err := cli.Get(ctx, "crashed"); err != nil || got != "" {
+		t.Errorf("cli.Get(ctx, crashed) = (%q, %v), want (%q, nil)", got, err, "")
+	}
+	if got, err := cli.Get(ctx, "live"); err != nil || got != token {
+		t.Errorf("cli.Get(ctx, live) = (%q, %v), want (%q, nil)", got, err, token)
+	}
+
+	if err := leased.Unlock(ctx, "live", token); err != nil {
+		t.Errorf("leased.Unlock(ctx, live, %q) = %v", token, err)
+	}
+}
+
+func TestJobLeases(t *testing.T) {
+	t.Parallel()
+	ctx, canc := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(canc)
+
+	svr, cli := testServerAndClient(t, ctx)
+	t.Cleanup(func() { svr.Close() })
+
+	const ttl = 300 * time.Millisecond
+
+	// The processes that wrote these have exited, so only the agent running
+	// the job renews their leases.
+	job := agentapi.LockLease{Owner: agentapi.LockOwner{JobID: "job-1"}, TTL: ttl}
+	other := agentapi.LockLease{Owner: agentapi.LockOwner{JobID: "job-2"}, TTL: ttl}
+	done := agentapi.LockLease{Owner: agentapi.LockOwner{JobID: "job-1"}}
+	for _, w := range []struct {
+		key   string
+		lease agentapi.LockLease
+	}{
+		{"llama", job},
+		{"alpaca", other},
+		{"guanaco", done},
+	} {
+		if _, ok, err := cli.client.LockCompareAndSwap(ctx, w.key, "", "acquired", w.lease); err != nil || !ok {
+			t.Fatalf("LockCompareAndSwap(ctx, %q, %q, acquired, %v) = (_, %t, %v), want (_, true, nil)", w.key, "", w.lease, ok, err)
+		}
+	}
+	if ok, _, err := cli.client.SemaphoreAcquire(ctx, "emulator", "semaphore(job-1)", 2, job, 0); err != nil || !ok {
+		t.Fatalf("SemaphoreAcquire(ctx, emulator, semaphore(job-1), 2, %v, 0) = (%t, _, %v), want (true, _, nil)", job, ok, err)
+	}
+
+	for i := 0; i < 9; i++ {
+		if err := cli.RenewJobLeases(ctx, "job-1"); err != nil {
+			t.Fatalf("cli.RenewJobLeases(ctx, job-1) = %v", err)
+		}
+		time.Sleep(ttl / 3)
+	}
+
+	for key, want := range map[string]string{"llama": "acquired", "alpaca": "", "guanaco": "acquired"} {
+		if got, err := cli.Get(ctx, key); err != nil || got != want {
+			t.Errorf("cli.Get(ctx, %q) = (%q, %v), want (%q, nil)", key, got, err, want)
+		}
+	}
+	if got, err := cli.Get(ctx, "emulator"); err != nil || !strings.Contains(got, "semaphore(job-1)") {
+		t.Errorf("cli.Get(ctx, emulator) = (%q, %v), want a semaphore held by semaphore(job-1)", got, err)
+	}
+
+	released, err := cli.ReleaseJobLeases(ctx, "job-1")
+	if err != nil {
+		t.Fatalf("cli.ReleaseJobLeases(ctx, job-1) error = %v", err)
+	}
+	if diff := cmp.Diff(released, []string{"emulator", "llama"}); diff != "" {
+		t.Errorf("cli.ReleaseJobLeases(ctx, job-1) diff (-got +want):\n%s", diff)
+	}
+	for key, want := range map[string]string{"llama": "", "emulator": "", "guanaco": "acquired"} {
+		if got, err := cli.Get(ctx, key); err != nil || got != want {
+			t.Errorf("cli.Get(ctx, %q) = (%q, %v), want (%q, nil)", key, got, err, want)
+		}
+	}
+}
+
+func TestListAndForceRelease(t *testing.T) {
+	t.Parallel()
+	ctx, canc := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(canc)
+
+	svr, cli := testServerAndClient(t, ctx)
+	t.Cleanup(func() { svr.Close() })
+
+	token, err := cli.Lock(ctx, "llama")
+	if err != nil {
+		t.Fatalf("cli.Lock(ctx, llama) error = %v", err)
+	}
+
+	locks, err := cli.List(ctx)
+	if err != nil {
+		t.Fatalf("cli.List(ctx) error = %v", err)
+	}
+	hostname, _ := os.Hostname()
+	if len(locks) != 1 || locks[0].Key != "llama" || locks[0].Value != token || locks[0].Owner.Hostname != hostname {
+		t.Errorf("cli.List(ctx) = %+v, want one lock with key llama, value %q, owner hostname %q", locks, token, hostname)
+	}
+
+	got, err := cli.ForceRelease(ctx, "llama")
+	if err != nil {
+		t.Fatalf("cli.ForceRelease(ctx, llama) error = %v", err)
+	}
+	if got != token {
+		t.Errorf("cli.ForceRelease(ctx, llama) = %q, want %q", got, token)
+	}
+
+	if got, err := cli.Get(ctx, "llama"); err != nil || got != "" {
+		t.Errorf("cli.Get(ctx, llama) = (%q, %v), want (%q, nil)", got, err, "")
+	}
+
+	// Force-releasing a lock that isn't held is fine.
+	if got, err := cli.ForceRelease(ctx, "llama"); err != nil || got != "" {
+		t.Errorf("cli.ForceRelease(ctx, llama) = (%q, %v), want (%q, nil)", got, err, "")
+	}
+}
+
+func TestSemaphore(t *testing.T) {
+	t.Parallel()
+	ctx, canc := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(canc)
+
+	svr, cli := testServerAndClient(t, ctx)
+	t.Cleanup(func() { svr.Close() })
+
+	const max = 3
+	var wg sync.WaitGroup
+	var holding, maxHolding, acquires atomic.Int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := cli.Acquire(ctx, "emulator", max)
+			if err != nil {
+				t.Errorf("Client.Acquire(ctx, emulator, %d) error = %v", max, err)
+				return
+			}
+			acquires.Add(1)
+			h := holding.Add(1)
+			for {
+				m := maxHolding.Load()
+				if h <= m || maxHolding.CompareAndSwap(m, h) {
+					break
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+			holding.Add(-1)
+			if err := cli.Unlock(ctx, "emulator", token); err != nil {
+				t.Errorf("Client.Unlock(ctx, emulator, %q) = %v", token, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got, want := acquires.Load(), int32(10); got != want {
+		t.Errorf("acquires.Load() = %d, want %d", got, want)
+	}
+	if got := maxHolding.Load(); got > max {
+		t.Errorf("maxHolding.Load() = %d, want at most %d", got, max)
+	}
+}